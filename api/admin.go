@@ -0,0 +1,243 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package api
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"net/url"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/topfreegames/arkadiko/mqttclient"
+)
+
+// redacted replaces the values of secret configuration keys
+const redacted = "[REDACTED]"
+
+// configureAdmin creates the admin API, served on its own listener so it
+// can be kept off the network the API is exposed on. Scheduled messages and
+// dead letters are only served here, as they hold payloads before they are
+// encrypted
+func (app *App) configureAdmin() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureAdmin",
+	})
+
+	app.Admin = nil
+	if !app.Config.GetBool("admin.enabled") {
+		l.Info("Admin API is not enabled.")
+		return nil
+	}
+
+	username := app.Config.GetString("admin.username")
+	password := app.Config.GetString("admin.password")
+	if username == "" || password == "" {
+		err := fmt.Errorf("admin API needs admin.username and admin.password")
+		l.WithError(err).Error("Failed to configure admin API.")
+		return err
+	}
+
+	a := echo.New()
+	a.HideBanner = true
+	a.HidePort = true
+	a.Use(middleware.BasicAuth(func(u, p string, c echo.Context) (bool, error) {
+		validUser := subtle.ConstantTimeCompare([]byte(u), []byte(username)) == 1
+		validPass := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+		return validUser && validPass, nil
+	}))
+	a.Use(NewRecoveryMiddleware(app.OnErrorHandler).Serve)
+
+	a.GET("/loglevel", GetLogLevelHandler(app))
+	a.PUT("/loglevel", SetLogLevelHandler(app))
+	a.GET("/connections", ConnectionsHandler(app))
+	a.GET("/config", ConfigHandler(app))
+	a.POST("/drain", DrainHandler(app))
+
+	// Scheduled messages
+	a.GET("/schedules", ListSchedulesHandler(app))
+	a.DELETE("/schedules/:id", CancelScheduleHandler(app))
+
+	// Dead letters
+	a.GET("/deadletters", ListDeadLettersHandler(app))
+	a.POST("/deadletters/replay", ReplayDeadLettersHandler(app))
+	a.DELETE("/deadletters/:id", DeleteDeadLetterHandler(app))
+
+	a.GET("/debug/pprof/", echo.WrapHandler(http.HandlerFunc(pprof.Index)))
+	a.GET("/debug/pprof/cmdline", echo.WrapHandler(http.HandlerFunc(pprof.Cmdline)))
+	a.GET("/debug/pprof/profile", echo.WrapHandler(http.HandlerFunc(pprof.Profile)))
+	a.GET("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	a.POST("/debug/pprof/symbol", echo.WrapHandler(http.HandlerFunc(pprof.Symbol)))
+	a.GET("/debug/pprof/trace", echo.WrapHandler(http.HandlerFunc(pprof.Trace)))
+	a.GET("/debug/pprof/:profile", func(c echo.Context) error {
+		pprof.Handler(c.Param("profile")).ServeHTTP(c.Response(), c.Request())
+		return nil
+	})
+
+	app.Admin = a
+	l.Info("Configured admin API successfully.")
+	return nil
+}
+
+// logger returns the logrus logger the app logs to, whose level is changed
+// by the admin API
+func (app *App) logger() *log.Logger {
+	switch l := app.Logger.(type) {
+	case *log.Logger:
+		return l
+	case *log.Entry:
+		return l.Logger
+	}
+	return nil
+}
+
+// GetLogLevelHandler is the handler responsible for reporting the level
+// the app logs at
+func GetLogLevelHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		logger := app.logger()
+		if logger == nil {
+			return FailWith(http.StatusNotImplemented, "Logger has no level", c)
+		}
+		return SucceedWith(map[string]interface{}{
+			"level": logger.GetLevel().String(),
+		}, c)
+	}
+}
+
+// SetLogLevelHandler is the handler responsible for changing the level the
+// app logs at
+func SetLogLevelHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		logger := app.logger()
+		if logger == nil {
+			return FailWith(http.StatusNotImplemented, "Logger has no level", c)
+		}
+
+		var body struct {
+			Level string `json:"level"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return FailWith(http.StatusBadRequest, "Invalid body", c)
+		}
+		level, err := log.ParseLevel(body.Level)
+		if err != nil {
+			return FailWithPayload(http.StatusBadRequest, "Invalid level", map[string]interface{}{
+				"level": body.Level,
+			}, c)
+		}
+
+		previous := logger.GetLevel()
+		logger.SetLevel(level)
+		app.Logger.WithFields(log.Fields{
+			"source":   "admin",
+			"previous": previous.String(),
+			"level":    level.String(),
+		}).Warn("Changed log level.")
+
+		return SucceedWith(map[string]interface{}{
+			"level": level.String(),
+		}, c)
+	}
+}
+
+// BrokerState is the state of a broker as seen by the admin API
+type BrokerState struct {
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	mqttclient.BrokerHealth
+}
+
+// ConnectionsHandler is the handler responsible for reporting the state of
+// the connections to every broker
+func ConnectionsHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		health := app.Brokers.Health()
+		brokers := map[string]BrokerState{}
+		for name, mc := range app.Brokers.Brokers {
+			brokers[name] = BrokerState{
+				Host:         mc.MqttServerHost,
+				Port:         mc.MqttServerPort,
+				BrokerHealth: health[name],
+			}
+		}
+
+		return SucceedWith(map[string]interface{}{
+			"default":  app.Brokers.Default,
+			"brokers":  brokers,
+			"draining": app.IsDraining(),
+		}, c)
+	}
+}
+
+// ConfigHandler is the handler responsible for showing the effective
+// configuration, with secrets redacted
+func ConfigHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		secrets := app.Config.GetStringSlice("admin.redactedKeys")
+		return SucceedWith(map[string]interface{}{
+			"config": redact(app.Config.AllSettings(), "", secrets),
+		}, c)
+	}
+}
+
+// DrainHandler is the handler responsible for reporting the app as not
+// ready, so load balancers stop sending it requests
+func DrainHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		if !app.draining.Swap(true) {
+			app.Logger.WithField("source", "admin").Warn("Draining.")
+		}
+		return SucceedWith(map[string]interface{}{
+			"draining": true,
+		}, c)
+	}
+}
+
+// redact copies settings replacing the values of keys whose path contains
+// one of secrets, and the passwords of URLs
+func redact(settings map[string]interface{}, prefix string, secrets []string) map[string]interface{} {
+	redactedSettings := make(map[string]interface{}, len(settings))
+	for key, value := range settings {
+		redactedSettings[key] = redactValue(value, strings.ToLower(prefix+key), secrets)
+	}
+	return redactedSettings
+}
+
+func redactValue(value interface{}, path string, secrets []string) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return redact(v, path+".", secrets)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = redactValue(item, path, secrets)
+		}
+		return values
+	}
+
+	for _, secret := range secrets {
+		if strings.Contains(path, strings.ToLower(secret)) {
+			return redacted
+		}
+	}
+	if s, ok := value.(string); ok {
+		if u, err := url.Parse(s); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				return u.Redacted()
+			}
+		}
+	}
+	return value
+}
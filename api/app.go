@@ -15,6 +15,7 @@ import (
 	"os"
 	"os/signal"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -29,9 +30,23 @@ import (
 	"github.com/spf13/viper"
 	"go.opentelemetry.io/contrib/instrumentation/github.com/labstack/echo/otelecho"
 
+	"github.com/topfreegames/arkadiko/async"
+	"github.com/topfreegames/arkadiko/compression"
+	"github.com/topfreegames/arkadiko/deadletter"
+	"github.com/topfreegames/arkadiko/encryption"
+	"github.com/topfreegames/arkadiko/enrichment"
+	"github.com/topfreegames/arkadiko/envelope"
 	"github.com/topfreegames/arkadiko/httpclient"
+	"github.com/topfreegames/arkadiko/idempotency"
+	"github.com/topfreegames/arkadiko/limits"
+	arkmetrics "github.com/topfreegames/arkadiko/metrics"
 	"github.com/topfreegames/arkadiko/mqttclient"
 	"github.com/topfreegames/arkadiko/otel"
+	"github.com/topfreegames/arkadiko/publisher"
+	"github.com/topfreegames/arkadiko/scheduler"
+	"github.com/topfreegames/arkadiko/schema"
+	"github.com/topfreegames/arkadiko/signing"
+	"github.com/topfreegames/arkadiko/tracing"
 )
 
 // JSON type
@@ -39,21 +54,39 @@ type JSON map[string]interface{}
 
 // App is a struct that represents a arkadiko API Application
 type App struct {
-	Debug      bool
-	Port       int
-	Host       string
-	ConfigPath string
-	Errors     metrics.EWMA
-	App        *echo.Echo
-	Config     *viper.Viper
-	Logger     log.FieldLogger
-	MqttClient *mqttclient.MqttClient
-	HttpClient *httpclient.HttpClient
-	NewRelic   newrelic.Application
-	DDStatsD   *DogStatsD
-	Metrics    *Metrics
-	OtelCloser otel.Closer
-	ctx        context.Context
+	Debug       bool
+	Port        int
+	Host        string
+	ConfigPath  string
+	Errors      metrics.EWMA
+	App         *echo.Echo
+	Admin       *echo.Echo
+	Config      *viper.Viper
+	Logger      log.FieldLogger
+	Brokers     *mqttclient.Router
+	MqttClient  *mqttclient.MqttClient
+	HttpClient  *httpclient.HttpClient
+	Schemas     *schema.Registry
+	Enrichment  *enrichment.Pipeline
+	Limits      *limits.Limits
+	Compression *compression.Compressor
+	Encryption  *encryption.Encryptor
+	Signing     *signing.Signer
+	Envelope    *envelope.Wrapper
+	Tracing     *tracing.Propagator
+	Idempotency *idempotency.Deduplicator
+	Scheduler   *scheduler.Scheduler
+	Async       *async.Queue
+	DeadLetters *deadletter.Recorder
+	Publisher   *publisher.Publisher
+	NewRelic    newrelic.Application
+	Metrics     *Metrics
+	OtelCloser  otel.Closer
+	// MetricsCloser flushes and stops the metrics exporters
+	MetricsCloser otel.Closer
+	ctx           context.Context
+	draining      atomic.Bool
+	onShutdown    []func()
 }
 
 // GetApp returns a new arkadiko API Application
@@ -90,7 +123,47 @@ func (app *App) Configure() error {
 		return err
 	}
 
-	err = app.configureStatsD()
+	err = app.configureMetrics()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureSchemas()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureEnrichment()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureLimits()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureCompression()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureEncryption()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureSigning()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureEnvelope()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureIdempotency()
 	if err != nil {
 		return err
 	}
@@ -100,6 +173,25 @@ func (app *App) Configure() error {
 		return err
 	}
 
+	err = app.configureAdmin()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureDeadLetters()
+	if err != nil {
+		return err
+	}
+
+	err = app.configureScheduler()
+	if err != nil {
+		return err
+	}
+
+	app.configureAsync()
+
+	app.configurePublisher()
+
 	app.configureOtel()
 
 	return nil
@@ -115,19 +207,18 @@ func (app *App) configureSentry() {
 	l.Info("Configured sentry successfully.")
 }
 
-func (app *App) configureStatsD() error {
+func (app *App) configureMetrics() error {
 	l := app.Logger.WithFields(log.Fields{
 		"source":    "app",
-		"operation": "configureStatsD",
+		"operation": "configureMetrics",
 	})
 
-	ddstatsd, err := NewDogStatsD(app.Config)
+	closer, err := arkmetrics.Configure(app.ctx, app.Config, app.Logger)
 	if err != nil {
-		l.WithError(err).Error("Failed to initialize DogStatsD.")
+		l.WithError(err).Error("Failed to configure metrics.")
 		return err
 	}
-	app.DDStatsD = ddstatsd
-	l.Info("Initialized DogStatsD successfully.")
+	app.MetricsCloser = closer
 
 	return nil
 }
@@ -157,26 +248,255 @@ func (app *App) configureNewRelic() error {
 	return nil
 }
 
+func (app *App) configureSchemas() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureSchemas",
+	})
+
+	registry, err := schema.NewRegistry(app.Config, app.Logger)
+	if err != nil {
+		l.WithError(err).Error("Failed to load payload schemas.")
+		return err
+	}
+	app.Schemas = registry
+	l.Info("Loaded payload schemas successfully.")
+
+	return nil
+}
+
+func (app *App) configureLimits() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureLimits",
+	})
+
+	limits, err := limits.NewLimits(app.Config, app.Logger)
+	if err != nil {
+		l.WithError(err).Error("Failed to load size limits.")
+		return err
+	}
+	app.Limits = limits
+	l.Info("Loaded size limits successfully.")
+
+	return nil
+}
+
+func (app *App) configureCompression() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureCompression",
+	})
+
+	compressor, err := compression.NewCompressor(app.Config, app.Logger)
+	if err != nil {
+		l.WithError(err).Error("Failed to load compression rules.")
+		return err
+	}
+	app.Compression = compressor
+	l.Info("Loaded compression rules successfully.")
+
+	return nil
+}
+
+func (app *App) configureEncryption() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureEncryption",
+	})
+
+	encryptor, err := encryption.NewEncryptor(app.Config, app.Logger)
+	if err != nil {
+		l.WithError(err).Error("Failed to configure encryption.")
+		return err
+	}
+	app.Encryption = encryptor
+	l.Info("Configured encryption successfully.")
+
+	return nil
+}
+
+func (app *App) configureSigning() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureSigning",
+	})
+
+	signer, err := signing.NewSigner(app.Config, app.Logger)
+	if err != nil {
+		l.WithError(err).Error("Failed to configure signing.")
+		return err
+	}
+	app.Signing = signer
+	l.Info("Configured signing successfully.")
+
+	return nil
+}
+
+func (app *App) configureEnvelope() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureEnvelope",
+	})
+
+	wrapper, err := envelope.NewWrapper(app.Config)
+	if err != nil {
+		l.WithError(err).Error("Failed to load envelope rules.")
+		return err
+	}
+	app.Envelope = wrapper
+	l.Info("Loaded envelope rules successfully.")
+
+	return nil
+}
+
+func (app *App) configureEnrichment() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureEnrichment",
+	})
+
+	pipeline, err := enrichment.NewPipeline(app.Config)
+	if err != nil {
+		l.WithError(err).Error("Failed to configure payload enrichment.")
+		return err
+	}
+	app.Enrichment = pipeline
+	l.Info("Configured payload enrichment successfully.")
+
+	return nil
+}
+
+func (app *App) configureIdempotency() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureIdempotency",
+	})
+
+	deduplicator, err := idempotency.NewDeduplicator(app.Config, "http")
+	if err != nil {
+		l.WithError(err).Error("Failed to configure idempotency.")
+		return err
+	}
+	app.Idempotency = deduplicator
+	l.Info("Configured idempotency successfully.")
+
+	return nil
+}
+
+func (app *App) configureDeadLetters() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureDeadLetters",
+	})
+
+	if app.DeadLetters != nil {
+		app.DeadLetters.Close()
+		app.DeadLetters = nil
+	}
+
+	recorder, err := deadletter.NewRecorder(app.Config, app.Brokers.PublishMessage, app.Logger)
+	if err != nil {
+		l.WithError(err).Error("Failed to configure dead letters.")
+		return err
+	}
+	if recorder == nil {
+		l.Info("Dead letters are not enabled.")
+		return nil
+	}
+	app.DeadLetters = recorder
+	l.Info("Configured dead letters successfully.")
+
+	return nil
+}
+
+func (app *App) configureScheduler() error {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureScheduler",
+	})
+
+	if app.Scheduler != nil {
+		app.Scheduler.Stop()
+		app.Scheduler = nil
+	}
+
+	if !app.Config.GetBool("scheduler.enabled") {
+		l.Info("Scheduler is not enabled.")
+		return nil
+	}
+
+	s, err := scheduler.NewScheduler(app.Config, app.PublishMessage, app.Logger)
+	if err != nil {
+		l.WithError(err).Error("Failed to configure scheduler.")
+		return err
+	}
+	s.DeadLetters = app.DeadLetters
+	app.Scheduler = s
+	l.Info("Configured scheduler successfully.")
+
+	return nil
+}
+
+func (app *App) configureAsync() {
+	l := app.Logger.WithFields(log.Fields{
+		"source":    "app",
+		"operation": "configureAsync",
+	})
+
+	if app.Async != nil {
+		app.Async.Stop()
+		app.Async = nil
+	}
+
+	if !app.Config.GetBool("async.enabled") {
+		l.Info("Async publishing is not enabled.")
+		return
+	}
+
+	app.Async = async.NewQueue(app.Config, app.PublishMessage, app.Logger)
+	app.Async.DeadLetters = app.DeadLetters
+	l.Info("Configured async publishing successfully.")
+}
+
+// configurePublisher shares the publishing components with the publisher of
+// every message received by the app
+func (app *App) configurePublisher() {
+	app.Publisher = &publisher.Publisher{
+		Brokers:     app.Brokers,
+		Limits:      app.Limits,
+		Compression: app.Compression,
+		Encryption:  app.Encryption,
+		Signing:     app.Signing,
+		Envelope:    app.Envelope,
+		Scheduler:   app.Scheduler,
+		Async:       app.Async,
+		DeadLetters: app.DeadLetters,
+		Metrics:     app.Metrics.Frontend,
+	}
+}
+
 func (app *App) configureOtel() {
 	l := app.Logger.WithFields(log.Fields{
 		"source":    "app",
 		"operation": "configureOtel",
 	})
 
+	app.Tracing = tracing.NewPropagator(app.Config)
+
+	app.OtelCloser = otel.NoopCloser
 	if app.Config.GetBool("jaeger.disabled") {
-		app.OtelCloser = func(context.Context) error { return nil }
 		return
 	}
 
-	closer, err := otel.NewTracer(app.ctx)
+	closer, err := otel.NewTracer(app.ctx, app.Config, app.Logger)
 	if err != nil {
-		l.Error("Failed to initialize Open Telemetry.")
+		l.WithError(err).Error("Failed to initialize Open Telemetry, requests will not be traced.")
 		return
 	}
 
-	app.Config.SetDefault("jaeger.serviceName", "arkadiko")
 	app.App.Use(otelecho.Middleware(app.Config.GetString("jaeger.serviceName"), otelecho.WithSkipper(func(c echo.Context) bool {
-		return strings.Contains(c.Path(), "/healthcheck") 
+		return strings.Contains(c.Path(), "/healthcheck") || strings.HasPrefix(c.Path(), "/healthz")
 	})))
 
 	app.OtelCloser = closer
@@ -185,6 +505,33 @@ func (app *App) configureOtel() {
 func (app *App) setConfigurationDefaults() {
 	app.Config.SetDefault("healthcheck.workingText", "WORKING")
 	app.Config.SetDefault("httpserver.metricsServer", 9090)
+	app.Config.SetDefault("sendmqtt.allowNonObjectJSON", false)
+	app.Config.SetDefault("sendmqtt.rawContentTypes", []string{
+		echo.MIMEOctetStream,
+		echo.MIMETextPlain,
+		"application/x-protobuf",
+	})
+	app.Config.SetDefault("scheduler.enabled", false)
+	app.Config.SetDefault("async.enabled", false)
+	app.Config.SetDefault("schemas.path", "./config/schemas")
+	app.Config.SetDefault("schemas.dryRun", false)
+	app.Config.SetDefault("healthz.maxSaturation", 0.9)
+	app.Config.SetDefault("healthz.drainPeriod", "0s")
+	app.Config.SetDefault("healthz.probe.enabled", false)
+	app.Config.SetDefault("healthz.probe.topic", "arkadiko/healthz")
+	app.Config.SetDefault("healthz.probe.timeout", "1s")
+	app.Config.SetDefault("admin.enabled", false)
+	app.Config.SetDefault("admin.host", "127.0.0.1")
+	app.Config.SetDefault("admin.port", 9091)
+	app.Config.SetDefault("admin.redactedKeys", []string{
+		"pass",
+		"secret",
+		"token",
+		"key",
+		"credential",
+		"auth",
+		"sentry.url",
+	})
 }
 
 func (app *App) loadConfiguration() error {
@@ -222,15 +569,17 @@ func (app *App) configureApplication() error {
 
 	app.App = echo.New()
 
-
 	a := app.App
 
 	_, w, _ := os.Pipe()
 	a.Logger.SetOutput(w)
 
+	app.Metrics = NewMetrics()
+
 	basicAuthUser := app.Config.GetString("basicauth.username")
 	if basicAuthUser != "" {
 		basicAuthPass := app.Config.GetString("basicauth.password")
+		a.Use(NewUnauthorizedMetricsMiddleware(app.Metrics.Rejections).Serve)
 		a.Use(middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
 			if username == basicAuthUser && password == basicAuthPass {
 				return true, nil
@@ -240,12 +589,11 @@ func (app *App) configureApplication() error {
 
 	}
 
-	app.Metrics = NewMetrics()
-
 	a.Pre(middleware.RemoveTrailingSlash())
+	a.Pre(NewRequestIDMiddleware().Serve)
 	a.Use(NewLoggerMiddleware(app.Logger).Serve)
 	a.Use(NewRecoveryMiddleware(app.OnErrorHandler).Serve)
-	a.Use(NewResponseTimeMetricsMiddleware(app.DDStatsD, app.Metrics.APILatency).Serve)
+	a.Use(NewResponseTimeMetricsMiddleware(app.Metrics.APILatency).Serve)
 	a.Use(NewVersionMiddleware().Serve)
 	a.Use(NewSentryMiddleware(app).Serve)
 	a.Use(NewNewRelicMiddleware(app, app.Logger).Serve)
@@ -253,21 +601,52 @@ func (app *App) configureApplication() error {
 	// Routes
 	// Healthcheck
 	a.GET("/healthcheck", HealthCheckHandler(app))
+	a.GET("/healthz/live", LivenessHandler(app))
+	a.GET("/healthz/ready", ReadinessHandler(app))
 
 	// MQTT Route
-	a.POST("/sendmqtt/*", SendMqttHandler(app))
+	a.POST("/sendmqtt/*", SendMqttHandler(app), NewDecompressMiddleware().Serve, NewBodyLimitMiddleware(app).Serve, NewIdempotencyMiddleware(app).Serve)
+
+	// Keys consumers verify signed payloads with
+	a.GET("/signing/keys", SigningKeysHandler(app))
+
+	// callers are given the ids of the messages they schedule, so they can
+	// cancel them, while listing every schedule is left to the admin API
+	a.DELETE("/schedules/:id", CancelScheduleHandler(app))
 
 	app.Errors = metrics.NewEWMA15()
 
 	l.Debug("Connecting to mqtt...")
 	onConnectionLost := func(client mqtt.Client, err error) {
 		l.WithError(err).Error("Connection to MQTT server lost")
-		app.Metrics.DisconnectionCounter.WithLabelValues(err.Error()).Inc()
 	}
-	app.MqttClient = mqttclient.GetMqttClient(app.ConfigPath, nil, onConnectionLost, nil, l)
+	if app.Brokers != nil {
+		app.Brokers.Close()
+	}
+	brokers, err := mqttclient.NewRouter(mqttclient.Options{
+		Config:           app.Config,
+		OnConnectionLost: onConnectionLost,
+		Logger:           l,
+	})
+	if err != nil {
+		l.WithError(err).Error("Failed to connect to mqtt.")
+		return err
+	}
+	app.Brokers = brokers
+	app.MqttClient = brokers.Brokers[brokers.Default]
 	l.Info("Connected to mqtt successfully.")
 
-	app.HttpClient = httpclient.GetHttpClient(app.ConfigPath, l)
+	if app.HttpClient != nil {
+		app.HttpClient.Close()
+	}
+	app.HttpClient, err = httpclient.NewHttpClient(httpclient.Options{
+		Config: app.Config,
+		Logger: l,
+	})
+	if err != nil {
+		l.WithError(err).Error("Failed to configure http client.")
+		return err
+	}
 
 	go func() {
 		app.Errors.Tick()
@@ -289,7 +668,8 @@ func (app *App) Start() error {
 
 	// start metrics server
 	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{}))
+	gatherers := prometheus.Gatherers{prometheus.DefaultGatherer, arkmetrics.Gatherer()}
+	mux.Handle("/metrics", promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}))
 	metricsServer := &http.Server{
 		Addr:    fmt.Sprintf(":%d", app.Config.GetInt("httpserver.metricsServer")),
 		Handler: mux,
@@ -302,6 +682,17 @@ func (app *App) Start() error {
 		}
 	}()
 
+	if app.Admin != nil {
+		adminAddress := fmt.Sprintf("%s:%d", app.Config.GetString("admin.host"), app.Config.GetInt("admin.port"))
+		go func() {
+			err := app.Admin.Start(adminAddress)
+			if err != nil && err != http.ErrServerClosed {
+				l.WithError(err).Error("Failed to start admin server.")
+			}
+		}()
+		l.WithField("address", adminAddress).Info("Admin API starting.")
+	}
+
 	l.WithFields(log.Fields{
 		"host": app.Host,
 		"port": app.Port,
@@ -311,6 +702,13 @@ func (app *App) Start() error {
 		return app.ctx
 	}
 
+	if app.Scheduler != nil {
+		app.Scheduler.Start()
+	}
+	if app.Async != nil {
+		app.Async.Start()
+	}
+
 	shutdown, cancel := signal.NotifyContext(app.ctx, os.Interrupt)
 	defer cancel()
 
@@ -323,10 +721,72 @@ func (app *App) Start() error {
 
 	<-shutdown.Done()
 
+	// report not ready and give load balancers some time to notice before
+	// refusing connections
+	app.draining.Store(true)
+	time.Sleep(app.Config.GetDuration("healthz.drainPeriod"))
+
 	err := app.App.Shutdown(app.ctx)
 	if err != nil {
 		l.WithError(err).Error("App failed to stop.")
 	}
+	if app.Admin != nil {
+		if err := app.Admin.Shutdown(app.ctx); err != nil {
+			l.WithError(err).Error("Admin server failed to stop.")
+		}
+	}
 
+	// servers sharing the app's components stop before them
+	for _, f := range app.onShutdown {
+		f()
+	}
+
+	app.Close()
+
+	if err := app.MetricsCloser(app.ctx); err != nil {
+		l.WithError(err).Error("Failed to flush metrics.")
+	}
 	return app.OtelCloser(app.ctx)
 }
+
+// PublishMessage publishes a message to the named broker, compressing,
+// encrypting, signing and splitting payloads that are too large into chunks
+// where enabled
+func (app *App) PublishMessage(ctx context.Context, broker, topic, payload string, retained bool) error {
+	return app.Publisher.PublishMessage(ctx, broker, topic, payload, retained)
+}
+
+// RegisterOnShutdown registers a function to call once the app stops
+// serving, before it stops publishing scheduled and queued messages, so
+// servers sharing its components can stop first
+func (app *App) RegisterOnShutdown(f func()) {
+	app.onShutdown = append(app.onShutdown, f)
+}
+
+// IsDraining returns whether the app is shutting down
+func (app *App) IsDraining() bool {
+	return app.draining.Load()
+}
+
+// Close stops publishing scheduled and queued messages and disconnects from
+// the brokers
+func (app *App) Close() {
+	app.draining.Store(true)
+
+	// queued messages are published before disconnecting
+	if app.Async != nil {
+		app.Async.Stop()
+	}
+	if app.Scheduler != nil {
+		app.Scheduler.Stop()
+	}
+	if app.DeadLetters != nil {
+		app.DeadLetters.Close()
+	}
+	if app.Brokers != nil {
+		app.Brokers.Close()
+	}
+	if app.HttpClient != nil {
+		app.HttpClient.Close()
+	}
+}
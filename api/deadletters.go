@@ -0,0 +1,94 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/topfreegames/arkadiko/deadletter"
+)
+
+// ListDeadLettersHandler is the handler responsible for listing messages that could not be delivered
+func ListDeadLettersHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		if app.DeadLetters == nil {
+			return FailWith(http.StatusNotFound, "Dead letters are not enabled", c)
+		}
+
+		letters, err := app.DeadLetters.List()
+		if err == deadletter.ErrNotInspectable {
+			return FailWith(http.StatusNotImplemented, err.Error(), c)
+		}
+		if err != nil {
+			return FailWith(http.StatusInternalServerError, err.Error(), c)
+		}
+
+		return SucceedWith(map[string]interface{}{
+			"deadLetters": letters,
+		}, c)
+	}
+}
+
+// ReplayDeadLettersHandler is the handler responsible for publishing dead
+// letters again, either the ones given in the ids body field or every one
+func ReplayDeadLettersHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		if app.DeadLetters == nil {
+			return FailWith(http.StatusNotFound, "Dead letters are not enabled", c)
+		}
+
+		var body struct {
+			IDs []string `json:"ids"`
+		}
+		b, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return FailWith(http.StatusBadRequest, err.Error(), c)
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &body); err != nil {
+				return FailWith(http.StatusBadRequest, err.Error(), c)
+			}
+		}
+
+		result, err := app.DeadLetters.Replay(c.Request().Context(), app.PublishMessage, body.IDs...)
+		if err == deadletter.ErrNotInspectable {
+			return FailWith(http.StatusNotImplemented, err.Error(), c)
+		}
+		if err != nil {
+			return FailWith(http.StatusInternalServerError, err.Error(), c)
+		}
+
+		return SucceedWith(map[string]interface{}{
+			"replayed": result.Replayed,
+			"failed":   result.Failed,
+		}, c)
+	}
+}
+
+// DeleteDeadLetterHandler is the handler responsible for discarding a dead letter
+func DeleteDeadLetterHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		if app.DeadLetters == nil {
+			return FailWith(http.StatusNotFound, "Dead letters are not enabled", c)
+		}
+
+		err := app.DeadLetters.Remove(c.Param("id"))
+		if err == deadletter.ErrNotInspectable {
+			return FailWith(http.StatusNotImplemented, err.Error(), c)
+		}
+		if err != nil {
+			return FailWith(http.StatusInternalServerError, err.Error(), c)
+		}
+
+		return SucceedWith(map[string]interface{}{}, c)
+	}
+}
@@ -0,0 +1,124 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/topfreegames/arkadiko/api"
+	"github.com/topfreegames/arkadiko/deadletter"
+	. "github.com/topfreegames/arkadiko/testing"
+)
+
+var _ = Describe("Dead Letters Handlers", func() {
+	var dir string
+
+	getTestApp := func() *api.App {
+		a := GetDefaultTestApp()
+		a.DeadLetters.Close()
+		a.Config.Set("deadletter.file.path", filepath.Join(dir, "deadletters.jsonl"))
+		recorder, err := deadletter.NewRecorder(a.Config, a.Brokers.PublishMessage, a.Logger)
+		Expect(err).NotTo(HaveOccurred())
+		a.DeadLetters = recorder
+		a.Publisher.DeadLetters = recorder
+		return a
+	}
+
+	listDeadLetters := func(a *api.App) []*deadletter.Letter {
+		status, body := AdminRequest(a, "GET", "/deadletters", "")
+		Expect(status).To(Equal(http.StatusOK), body)
+
+		var result struct {
+			DeadLetters []*deadletter.Letter `json:"deadLetters"`
+		}
+		Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+		return result.DeadLetters
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "arkadiko-deadletters")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("Should record messages that could not be published", func() {
+		a := getTestApp()
+		a.Brokers.Close()
+
+		status, body := PostBody(a, "/sendmqtt/test/topic?source=tests", `{"message": "hello"}`)
+		Expect(status).To(Equal(http.StatusInternalServerError), body)
+
+		letters := listDeadLetters(a)
+		Expect(letters).To(HaveLen(1))
+		Expect(letters[0].Broker).To(Equal("default"))
+		Expect(letters[0].Topic).To(Equal("test/topic"))
+		Expect(letters[0].Payload).To(ContainSubstring("hello"))
+		Expect(letters[0].Error).NotTo(BeEmpty())
+		Expect(letters[0].Attempts).To(Equal(3))
+		Expect(letters[0].Requestor).To(Equal("tests"))
+	})
+
+	It("Should replay dead letters", func() {
+		a := getTestApp()
+		a.DeadLetters.Record(&deadletter.Letter{Broker: "default", Topic: "test/topic", Payload: "first"})
+		a.DeadLetters.Record(&deadletter.Letter{Broker: "default", Topic: "test/topic", Payload: "second"})
+		letters := listDeadLetters(a)
+		Expect(letters).To(HaveLen(2))
+
+		status, body := AdminRequest(a, "POST", "/deadletters/replay", fmt.Sprintf(`{"ids": [%q]}`, letters[0].ID))
+		Expect(status).To(Equal(http.StatusOK), body)
+		var result map[string]interface{}
+		Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+		Expect(result["replayed"]).To(Equal([]interface{}{letters[0].ID}))
+
+		left := listDeadLetters(a)
+		Expect(left).To(HaveLen(1))
+		Expect(left[0].ID).To(Equal(letters[1].ID))
+
+		status, body = AdminRequest(a, "POST", "/deadletters/replay", `{}`)
+		Expect(status).To(Equal(http.StatusOK), body)
+		Expect(listDeadLetters(a)).To(BeEmpty())
+	})
+
+	It("Should delete dead letters", func() {
+		a := getTestApp()
+		a.DeadLetters.Record(&deadletter.Letter{Broker: "default", Topic: "test/topic", Payload: "first"})
+		letters := listDeadLetters(a)
+
+		status, body := AdminRequest(a, "DELETE", fmt.Sprintf("/deadletters/%s", letters[0].ID), "")
+		Expect(status).To(Equal(http.StatusOK), body)
+		Expect(listDeadLetters(a)).To(BeEmpty())
+	})
+
+	It("Should not be served by the API listener", func() {
+		a := getTestApp()
+		status, _ := Get(a, "/deadletters")
+		Expect(status).To(Equal(http.StatusNotFound))
+		status, _ = Get(a, "/schedules")
+		Expect(status).To(Equal(http.StatusNotFound))
+	})
+
+	It("Should fail if dead letters are not enabled", func() {
+		a := getTestApp()
+		a.DeadLetters = nil
+
+		status, _ := AdminRequest(a, "GET", "/deadletters", "")
+		Expect(status).To(Equal(http.StatusNotFound))
+	})
+})
@@ -20,6 +20,14 @@ func HealthCheckHandler(app *App) func(c echo.Context) error {
 		c.Set("route", "Healthcheck")
 		workingString := app.Config.GetString("healthcheck.workingText")
 		workingString = strings.TrimSpace(workingString)
+
+		if c.QueryParam("details") == "true" {
+			return c.JSON(http.StatusOK, map[string]interface{}{
+				"status":  workingString,
+				"brokers": app.Brokers.Health(),
+			})
+		}
+
 		return c.String(http.StatusOK, workingString)
 	}
 }
@@ -36,6 +36,19 @@ var _ = Describe("Healthcheck Handler", func() {
 			Expect(status).To(Equal(http.StatusOK))
 			Expect(body).To(Equal("OTHERWORKING"))
 		})
+
+		It("Should respond with the state of the brokers if asked for details", func() {
+			a := GetDefaultTestApp()
+			status, body := Get(a, "/healthcheck?details=true")
+
+			Expect(status).To(Equal(http.StatusOK))
+			var result map[string]interface{}
+			Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+			Expect(result["status"]).To(Equal("WORKING"))
+			broker := result["brokers"].(map[string]interface{})["default"].(map[string]interface{})
+			Expect(broker["breaker"]).To(Equal("closed"))
+			Expect(broker["connections"]).To(HaveLen(2))
+		})
 	})
 
 	Describe("Perf", func() {
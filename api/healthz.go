@@ -0,0 +1,130 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Check is the state of one of the dependencies of the app
+type Check struct {
+	Ready  bool        `json:"ready"`
+	Detail interface{} `json:"detail,omitempty"`
+	Error  string      `json:"error,omitempty"`
+}
+
+// LivenessHandler is the handler responsible for reporting that the process is up
+func LivenessHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		c.Set("route", "Liveness")
+		return c.JSON(http.StatusOK, map[string]interface{}{
+			"status": "ok",
+		})
+	}
+}
+
+// ReadinessHandler is the handler responsible for reporting whether the app
+// can take traffic, with the state of every dependency
+func ReadinessHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		c.Set("route", "Readiness")
+
+		// only the config enables probes, so callers can't make every
+		// readiness check publish to the brokers
+		checks := app.readinessChecks(c.Request().Context(), app.Config.GetBool("healthz.probe.enabled"))
+
+		ready := true
+		for _, check := range checks {
+			ready = ready && check.Ready
+		}
+
+		status := http.StatusOK
+		if !ready {
+			status = http.StatusServiceUnavailable
+		}
+		return c.JSON(status, map[string]interface{}{
+			"ready":  ready,
+			"checks": checks,
+		})
+	}
+}
+
+func (app *App) readinessChecks(ctx context.Context, probe bool) map[string]*Check {
+	checks := map[string]*Check{}
+
+	// the gRPC server shares the brokers of the app, so their checks cover
+	// the connections both publish through
+	checks["shutdown"] = &Check{Ready: !app.IsDraining()}
+
+	names := []string{}
+	for name := range app.Brokers.Brokers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	health := app.Brokers.Health()
+	for _, name := range names {
+		broker := health[name]
+		check := &Check{Ready: broker.Breaker != "open", Detail: broker}
+		for _, connection := range broker.Connections {
+			check.Ready = check.Ready && connection.Connected
+		}
+
+		if check.Ready && probe {
+			probeCtx, cancel := context.WithTimeout(ctx, app.Config.GetDuration("healthz.probe.timeout"))
+			err := app.Brokers.Brokers[name].Probe(probeCtx, app.Config.GetString("healthz.probe.topic"))
+			cancel()
+			if err != nil {
+				check.Ready = false
+				check.Error = fmt.Sprintf("probe failed: %s", err.Error())
+			}
+		}
+		checks[fmt.Sprintf("broker:%s", name)] = check
+	}
+
+	maxSaturation := app.Config.GetFloat64("healthz.maxSaturation")
+	if app.Async != nil {
+		saturation := saturation(app.Async.Len(), app.Async.Size)
+		checks["async"] = &Check{
+			Ready: saturation < maxSaturation,
+			Detail: map[string]interface{}{
+				"queued":     app.Async.Len(),
+				"size":       app.Async.Size,
+				"saturation": saturation,
+			},
+		}
+	}
+	if app.Scheduler != nil {
+		pending := app.Scheduler.Pending()
+		saturation := saturation(pending, app.Scheduler.MaxPending)
+		checks["scheduler"] = &Check{
+			Ready: saturation < maxSaturation,
+			Detail: map[string]interface{}{
+				"pending":    pending,
+				"maxPending": app.Scheduler.MaxPending,
+				"saturation": saturation,
+			},
+		}
+	}
+
+	return checks
+}
+
+// saturation returns how full something holding up to size items is. Sizes
+// of zero can't hold anything, so they are always full
+func saturation(used, size int) float64 {
+	if size <= 0 {
+		return 1
+	}
+	return float64(used) / float64(size)
+}
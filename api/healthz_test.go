@@ -0,0 +1,139 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package api_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/async"
+	. "github.com/topfreegames/arkadiko/testing"
+)
+
+var _ = Describe("Healthz Handlers", func() {
+	getChecks := func(body string) (bool, map[string]map[string]interface{}) {
+		var result struct {
+			Ready  bool                              `json:"ready"`
+			Checks map[string]map[string]interface{} `json:"checks"`
+		}
+		Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+		return result.Ready, result.Checks
+	}
+
+	Describe("Liveness", func() {
+		It("Should respond ok", func() {
+			a := GetDefaultTestApp()
+			status, body := Get(a, "/healthz/live")
+
+			Expect(status).To(Equal(http.StatusOK))
+			Expect(body).To(MatchJSON(`{"status": "ok"}`))
+		})
+	})
+
+	Describe("Readiness", func() {
+		It("Should be ready when every dependency is", func() {
+			a := GetDefaultTestApp()
+			status, body := Get(a, "/healthz/ready")
+
+			Expect(status).To(Equal(http.StatusOK), body)
+			ready, checks := getChecks(body)
+			Expect(ready).To(BeTrue())
+			Expect(checks).To(HaveKey("broker:default"))
+			Expect(checks).To(HaveKey("async"))
+			Expect(checks).To(HaveKey("scheduler"))
+			Expect(checks["shutdown"]["ready"]).To(BeTrue())
+
+			broker := checks["broker:default"]["detail"].(map[string]interface{})
+			Expect(broker["connections"]).To(HaveLen(2))
+		})
+
+		It("Should not be ready when the async queue is saturated", func() {
+			a := GetDefaultTestApp()
+			config := viper.New()
+			config.Set("async.queueSize", 1)
+			a.Async = async.NewQueue(config, func(ctx context.Context, broker, topic, payload string, retained bool) error {
+				return nil
+			}, a.Logger)
+			Expect(a.Async.Enqueue(context.Background(), "default", "some/topic", "{}", false, "")).To(Succeed())
+
+			status, body := Get(a, "/healthz/ready")
+
+			Expect(status).To(Equal(http.StatusServiceUnavailable), body)
+			ready, checks := getChecks(body)
+			Expect(ready).To(BeFalse())
+			Expect(checks["async"]["ready"]).To(BeFalse())
+			Expect(checks["broker:default"]["ready"]).To(BeTrue())
+		})
+
+		It("Should report components that can't hold anything as saturated", func() {
+			a := GetDefaultTestApp()
+			config := viper.New()
+			config.Set("async.queueSize", 0)
+			a.Async = async.NewQueue(config, func(ctx context.Context, broker, topic, payload string, retained bool) error {
+				return nil
+			}, a.Logger)
+			a.Scheduler.MaxPending = 0
+
+			status, body := Get(a, "/healthz/ready")
+
+			Expect(status).To(Equal(http.StatusServiceUnavailable), body)
+			ready, checks := getChecks(body)
+			Expect(ready).To(BeFalse())
+			Expect(checks["async"]["ready"]).To(BeFalse())
+			Expect(checks["async"]["detail"].(map[string]interface{})["saturation"]).To(Equal(1.0))
+			Expect(checks["scheduler"]["ready"]).To(BeFalse())
+			Expect(checks["scheduler"]["detail"].(map[string]interface{})["saturation"]).To(Equal(1.0))
+		})
+
+		It("Should not be ready when shutting down", func() {
+			a := GetDefaultTestApp()
+			a.Close()
+
+			status, body := Get(a, "/healthz/ready")
+
+			Expect(status).To(Equal(http.StatusServiceUnavailable), body)
+			_, checks := getChecks(body)
+			Expect(checks["shutdown"]["ready"]).To(BeFalse())
+		})
+
+		It("Should do a round-trip through the brokers if probing is enabled", func() {
+			a := GetDefaultTestApp()
+			a.Config.Set("healthz.probe.enabled", true)
+			status, body := Get(a, "/healthz/ready")
+
+			Expect(status).To(Equal(http.StatusOK), body)
+			_, checks := getChecks(body)
+			Expect(checks["broker:default"]).NotTo(HaveKey("error"))
+		})
+
+		It("Should not let callers ask for probes", func() {
+			a := GetDefaultTestApp()
+			a.Config.Set("healthz.probe.topic", fmt.Sprintf("healthz/%s", uuid.NewV4().String()))
+			var probes int32
+			a.MqttClient.MqttClient.Subscribe(a.Config.GetString("healthz.probe.topic")+"/#", 1, func(client mqtt.Client, message mqtt.Message) {
+				atomic.AddInt32(&probes, 1)
+			}).Wait()
+
+			status, _ := Get(a, "/healthz/ready?probe=true")
+			Expect(status).To(Equal(http.StatusOK))
+			Consistently(func() int32 {
+				return atomic.LoadInt32(&probes)
+			}, 100*time.Millisecond).Should(BeZero())
+		})
+	})
+})
@@ -20,6 +20,13 @@ func FailWith(status int, message string, c echo.Context) error {
 	return c.String(status, fmt.Sprintf(`{"success":false,"reason":"%s"}`, message))
 }
 
+// FailWithPayload fails with the specified message and extra payload fields
+func FailWithPayload(status int, message string, payload map[string]interface{}, c echo.Context) error {
+	payload["success"] = false
+	payload["reason"] = message
+	return c.JSON(status, payload)
+}
+
 // SucceedWith sends payload to user with status 200
 func SucceedWith(payload map[string]interface{}, c echo.Context) error {
 	if len(payload) == 0 {
@@ -8,19 +8,25 @@
 package api
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"runtime/debug"
+	"strings"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-
 	raven "github.com/getsentry/raven-go"
 	"github.com/labstack/echo/v4"
 	log "github.com/sirupsen/logrus"
-)
 
-const responseTimeMillisecondsMetricName = "response_time_milliseconds"
+	"github.com/topfreegames/arkadiko/compression"
+	"github.com/topfreegames/arkadiko/idempotency"
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/requestid"
+)
 
 // NewVersionMiddleware with API version
 func NewVersionMiddleware() *VersionMiddleware {
@@ -43,6 +49,26 @@ func (v *VersionMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
+// NewRequestIDMiddleware returns a new request id middleware
+func NewRequestIDMiddleware() *RequestIDMiddleware {
+	return &RequestIDMiddleware{}
+}
+
+// RequestIDMiddleware gives each request the id in its X-Request-ID header,
+// or a new one, and sends it back in the response
+type RequestIDMiddleware struct{}
+
+// Serve serves the middleware
+func (r *RequestIDMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := requestid.Ensure(c.Request().Header.Get(requestid.Header))
+		c.Response().Header().Set(requestid.Header, id)
+		c.SetRequest(c.Request().WithContext(requestid.NewContext(c.Request().Context(), id)))
+		c.Set("requestId", id)
+		return next(c)
+	}
+}
+
 // NewSentryMiddleware returns a new sentry middleware
 func NewSentryMiddleware(app *App) *SentryMiddleware {
 	return &SentryMiddleware{
@@ -78,25 +104,45 @@ func (s *SentryMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
 	}
 }
 
-// ResponseTimeMetricsMiddleware struct encapsulating DDStatsD
+// NewUnauthorizedMetricsMiddleware returns a middleware counting requests
+// refused by the authentication middlewares that run after it
+func NewUnauthorizedMetricsMiddleware(rejections *metrics.CounterVec) *UnauthorizedMetricsMiddleware {
+	return &UnauthorizedMetricsMiddleware{rejections: rejections}
+}
+
+// UnauthorizedMetricsMiddleware counts unauthorized requests as rejected
+type UnauthorizedMetricsMiddleware struct {
+	rejections *metrics.CounterVec
+}
+
+// Serve serves the middleware
+func (u *UnauthorizedMetricsMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := next(c)
+		var httpErr *echo.HTTPError
+		if errors.As(err, &httpErr) && httpErr.Code == http.StatusUnauthorized {
+			u.rejections.WithLabelValues(metrics.FrontendHTTP, metrics.RejectedUnauthorized).Inc()
+		}
+		return err
+	}
+}
+
+// ResponseTimeMetricsMiddleware struct encapsulating the latency metric
 type ResponseTimeMetricsMiddleware struct {
-	DDStatsD      MetricsReporter
-	latencyMetric *prometheus.HistogramVec
+	latencyMetric *metrics.HistogramVec
 }
 
 // ResponseTimeMetricsMiddleware returns a new ResponseTimeMetricsMiddleware
 func NewResponseTimeMetricsMiddleware(
-	ddStatsD MetricsReporter,
-	latencyMetric *prometheus.HistogramVec,
+	latencyMetric *metrics.HistogramVec,
 ) *ResponseTimeMetricsMiddleware {
 	return &ResponseTimeMetricsMiddleware{
-		DDStatsD:      ddStatsD,
 		latencyMetric: latencyMetric,
 	}
 }
 
 // ResponseTimeMetricsMiddleware is a middleware to measure the response time
-// of a route and send it do StatsD
+// of a route and report it to the metrics exporters
 func (responseTimeMiddleware ResponseTimeMetricsMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		startTime := time.Now()
@@ -107,14 +153,6 @@ func (responseTimeMiddleware ResponseTimeMetricsMiddleware) Serve(next echo.Hand
 
 		timeUsed := time.Since(startTime)
 
-		tags := []string{
-			fmt.Sprintf("route:%s", route),
-			fmt.Sprintf("method:%s", method),
-			fmt.Sprintf("status:%d", status),
-		}
-
-		// Keeping both for retro compatibility in the short term
-		responseTimeMiddleware.DDStatsD.Timing(responseTimeMillisecondsMetricName, timeUsed, tags...)
 		responseTimeMiddleware.latencyMetric.WithLabelValues(route, method, fmt.Sprintf("%d", status)).Observe(timeUsed.Seconds())
 
 		return result
@@ -196,7 +234,7 @@ type LoggerMiddleware struct {
 // Serve serves the middleware
 func (l *LoggerMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
-		l := l.Logger.WithFields(log.Fields{
+		l := requestid.Logger(c.Request().Context(), l.Logger).WithFields(log.Fields{
 			"source": "request",
 		})
 
@@ -243,6 +281,14 @@ func (l *LoggerMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
 			reqLog = reqLog.WithField("requestor", requestor)
 		}
 
+		if broker, ok := c.Get("broker").(string); ok {
+			reqLog = reqLog.WithField("broker", broker)
+		}
+
+		if deduplicated, ok := c.Get("deduplicated").(bool); ok {
+			reqLog = reqLog.WithField("deduplicated", deduplicated)
+		}
+
 		retainedInterface := c.Get("retained")
 		if retainedInterface != nil {
 			retained := retainedInterface.(bool)
@@ -299,3 +345,175 @@ func (nr *NewRelicMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
 		return nil
 	}
 }
+
+// errNotStored signals the idempotency middleware a response must not be remembered
+var errNotStored = errors.New("response not stored")
+
+// NewDecompressMiddleware returns a new decompress middleware
+func NewDecompressMiddleware() *DecompressMiddleware {
+	return &DecompressMiddleware{}
+}
+
+// DecompressMiddleware decompresses gzip and zstd request bodies, as given
+// by their Content-Encoding
+type DecompressMiddleware struct{}
+
+type countingReader struct {
+	io.ReadCloser
+	count int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += n
+	return n, err
+}
+
+// Serve serves the middleware
+func (d *DecompressMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		encoding := strings.ToLower(strings.TrimSpace(c.Request().Header.Get(echo.HeaderContentEncoding)))
+		if encoding == "" || encoding == compression.Identity {
+			return next(c)
+		}
+
+		compressed := &countingReader{ReadCloser: c.Request().Body}
+		r, err := compression.NewReader(encoding, compressed)
+		if err == compression.ErrUnsupportedEncoding {
+			return FailWith(http.StatusUnsupportedMediaType, fmt.Sprintf("Unsupported content encoding %s", encoding), c)
+		}
+		if err != nil {
+			return FailWith(400, fmt.Sprintf("Invalid %s body", encoding), c)
+		}
+		defer r.Close()
+
+		decompressed := &countingReader{ReadCloser: r}
+		c.Request().Body = decompressed
+		c.Request().Header.Del(echo.HeaderContentEncoding)
+
+		err = next(c)
+		compression.ObserveRatio(encoding, compressed.count, decompressed.count)
+		return err
+	}
+}
+
+// NewBodyLimitMiddleware returns a new body limit middleware
+func NewBodyLimitMiddleware(app *App) *BodyLimitMiddleware {
+	return &BodyLimitMiddleware{
+		App: app,
+	}
+}
+
+// BodyLimitMiddleware refuses request bodies larger than allowed for the
+// topic they are sent to, without reading more than that into memory
+type BodyLimitMiddleware struct {
+	App *App
+}
+
+// Serve serves the middleware
+func (b *BodyLimitMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		topic := c.ParamValues()[0]
+		limit := b.App.Limits.For(topic).MaxBodySize
+		if limit <= 0 {
+			return next(c)
+		}
+
+		body, err := io.ReadAll(io.LimitReader(c.Request().Body, int64(limit)+1))
+		if err != nil {
+			return FailWith(400, err.Error(), c)
+		}
+		if err := b.App.Limits.CheckBody(topic, len(body)); err != nil {
+			b.App.Metrics.Rejections.WithLabelValues(metrics.FrontendHTTP, metrics.RejectedTooLarge).Inc()
+			return FailWithPayload(http.StatusRequestEntityTooLarge, err.Error(), map[string]interface{}{
+				"maxBodySize": limit,
+			}, c)
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		return next(c)
+	}
+}
+
+// NewIdempotencyMiddleware returns a new idempotency middleware
+func NewIdempotencyMiddleware(app *App) *IdempotencyMiddleware {
+	return &IdempotencyMiddleware{
+		App: app,
+	}
+}
+
+// IdempotencyMiddleware answers requests repeating an Idempotency-Key with
+// the response given to the first one, without running the handler again
+type IdempotencyMiddleware struct {
+	App *App
+}
+
+type bodyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *bodyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Serve serves the middleware
+func (i *IdempotencyMiddleware) Serve(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(idempotency.HeaderName)
+		if key == "" {
+			return next(c)
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return FailWith(400, err.Error(), c)
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := idempotency.Fingerprint(
+			c.Request().URL.RequestURI(),
+			c.Request().Header.Get(echo.HeaderContentType),
+			string(body),
+		)
+
+		var handlerErr error
+		result, deduplicated, err := i.App.Idempotency.Do(key, fingerprint, func() (*idempotency.Result, error) {
+			recorder := &bodyRecorder{ResponseWriter: c.Response().Writer}
+			c.Response().Writer = recorder
+			handlerErr = next(c)
+			c.Response().Writer = recorder.ResponseWriter
+
+			status := c.Response().Status
+			if handlerErr != nil || status < 200 || status > 299 {
+				return nil, errNotStored
+			}
+			return &idempotency.Result{
+				Status:      status,
+				ContentType: c.Response().Header().Get(echo.HeaderContentType),
+				Body:        recorder.body.String(),
+			}, nil
+		})
+
+		switch {
+		case err == errNotStored:
+			return handlerErr
+		case err == idempotency.ErrKeyReused:
+			return FailWith(http.StatusUnprocessableEntity, err.Error(), c)
+		case err == idempotency.ErrInFlight:
+			return FailWith(http.StatusConflict, err.Error(), c)
+		case err != nil:
+			return err
+		case !deduplicated:
+			return nil
+		}
+
+		c.Set("deduplicated", true)
+		c.Response().Header().Set("Idempotent-Replayed", "true")
+		if result.ContentType != "" {
+			c.Response().Header().Set(echo.HeaderContentType, result.ContentType)
+		}
+		return c.String(result.Status, result.Body)
+	}
+}
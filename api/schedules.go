@@ -0,0 +1,81 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/topfreegames/arkadiko/scheduler"
+)
+
+// ListSchedulesHandler is the handler responsible for listing pending scheduled messages
+func ListSchedulesHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		if app.Scheduler == nil {
+			return FailWith(http.StatusNotFound, "Scheduler is not enabled", c)
+		}
+
+		return SucceedWith(map[string]interface{}{
+			"schedules": app.Scheduler.List(),
+		}, c)
+	}
+}
+
+// CancelScheduleHandler is the handler responsible for cancelling a scheduled message
+func CancelScheduleHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		if app.Scheduler == nil {
+			return FailWith(http.StatusNotFound, "Scheduler is not enabled", c)
+		}
+
+		err := app.Scheduler.Cancel(c.Param("id"))
+		if err == scheduler.ErrNotFound {
+			return FailWith(http.StatusNotFound, err.Error(), c)
+		}
+		if err != nil {
+			return FailWith(http.StatusInternalServerError, err.Error(), c)
+		}
+
+		return SucceedWith(map[string]interface{}{}, c)
+	}
+}
+
+// getDeliverAt returns when the message should be published according to
+// the deliver_at and delay query parameters, or the zero time if it should
+// be published right away
+func getDeliverAt(c echo.Context) (time.Time, error) {
+	deliverAtValue := c.QueryParam("deliver_at")
+	delayValue := c.QueryParam("delay")
+
+	switch {
+	case deliverAtValue != "" && delayValue != "":
+		return time.Time{}, fmt.Errorf("Only one of deliver_at and delay may be given")
+	case deliverAtValue != "":
+		if unix, err := strconv.ParseInt(deliverAtValue, 10, 64); err == nil {
+			return time.Unix(unix, 0), nil
+		}
+		deliverAt, err := time.Parse(time.RFC3339, deliverAtValue)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("deliver_at must be a unix timestamp or an RFC 3339 date")
+		}
+		return deliverAt, nil
+	case delayValue != "":
+		delay, err := time.ParseDuration(delayValue)
+		if err != nil || delay < 0 {
+			return time.Time{}, fmt.Errorf("delay must be a positive duration such as 10m")
+		}
+		return time.Now().Add(delay), nil
+	}
+
+	return time.Time{}, nil
+}
@@ -0,0 +1,138 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/topfreegames/arkadiko/api"
+	"github.com/topfreegames/arkadiko/scheduler"
+	. "github.com/topfreegames/arkadiko/testing"
+)
+
+var _ = Describe("Schedules Handlers", func() {
+	var dir string
+
+	getTestApp := func() *api.App {
+		a := GetDefaultTestApp()
+		a.Scheduler.Stop()
+		a.Config.Set("scheduler.path", filepath.Join(dir, "schedules.json"))
+		s, err := scheduler.NewScheduler(a.Config, a.Brokers.PublishMessage, a.Logger)
+		Expect(err).NotTo(HaveOccurred())
+		a.Scheduler = s
+		a.Publisher.Scheduler = s
+		return a
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "arkadiko-schedules")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("Scheduling", func() {
+		It("Should accept delayed messages", func() {
+			a := getTestApp()
+			status, body := PostBody(a, "/sendmqtt/test/topic?delay=1h&retained=true", `{"message": "hello"}`)
+			Expect(status).To(Equal(http.StatusAccepted), body)
+
+			var result map[string]interface{}
+			Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+			Expect(result["topic"]).To(Equal("test/topic"))
+			Expect(result["retained"]).To(BeTrue())
+			Expect(result["scheduleId"]).NotTo(BeEmpty())
+
+			schedules := a.Scheduler.List()
+			Expect(schedules).To(HaveLen(1))
+			Expect(schedules[0].ID).To(Equal(result["scheduleId"]))
+			Expect(schedules[0].Payload).To(Equal(`{"message":"hello","should_moderate":false}`))
+		})
+
+		It("Should accept messages with a delivery date", func() {
+			a := getTestApp()
+			deliverAt := time.Now().Add(time.Hour).Unix()
+			status, body := PostBody(a, fmt.Sprintf("/sendmqtt/test/topic?deliver_at=%d", deliverAt), `{"message": "hello"}`)
+			Expect(status).To(Equal(http.StatusAccepted), body)
+			Expect(a.Scheduler.List()[0].DeliverAt.Unix()).To(Equal(deliverAt))
+		})
+
+		It("Should respond with 400 if both deliver_at and delay are given", func() {
+			a := getTestApp()
+			status, _ := PostBody(a, "/sendmqtt/test/topic?delay=1h&deliver_at=1700000000", `{"message": "hello"}`)
+			Expect(status).To(Equal(http.StatusBadRequest))
+		})
+
+		It("Should respond with 400 if delay is invalid", func() {
+			a := getTestApp()
+			status, _ := PostBody(a, "/sendmqtt/test/topic?delay=-1h", `{"message": "hello"}`)
+			Expect(status).To(Equal(http.StatusBadRequest))
+		})
+	})
+
+	Describe("List", func() {
+		It("Should return pending schedules", func() {
+			a := getTestApp()
+			schedule, err := a.Scheduler.Schedule("default", "test/topic", "{}", false, "", time.Now().Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+
+			status, body := AdminRequest(a, "GET", "/schedules", "")
+			Expect(status).To(Equal(http.StatusOK), body)
+
+			var result struct {
+				Schedules []*scheduler.Schedule `json:"schedules"`
+			}
+			Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+			Expect(result.Schedules).To(HaveLen(1))
+			Expect(result.Schedules[0].ID).To(Equal(schedule.ID))
+		})
+	})
+
+	Describe("Cancel", func() {
+		It("Should cancel pending schedules", func() {
+			a := getTestApp()
+			schedule, err := a.Scheduler.Schedule("default", "test/topic", "{}", false, "", time.Now().Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+
+			status, body := AdminRequest(a, "DELETE", fmt.Sprintf("/schedules/%s", schedule.ID), "")
+			Expect(status).To(Equal(http.StatusOK), body)
+			Expect(a.Scheduler.List()).To(BeEmpty())
+		})
+
+		It("Should let callers cancel the messages they scheduled on the API listener", func() {
+			a := getTestApp()
+			status, body := PostBody(a, "/sendmqtt/test/topic?delay=1h", `{"message": "hello"}`)
+			Expect(status).To(Equal(http.StatusAccepted), body)
+			var result map[string]interface{}
+			Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+
+			status, body = Delete(a, fmt.Sprintf("/schedules/%s", result["scheduleId"]))
+			Expect(status).To(Equal(http.StatusOK), body)
+			Expect(a.Scheduler.List()).To(BeEmpty())
+		})
+
+		It("Should respond with 404 for unknown schedules", func() {
+			a := getTestApp()
+			status, _ := AdminRequest(a, "DELETE", "/schedules/unknown", "")
+			Expect(status).To(Equal(http.StatusNotFound))
+			status, _ = Delete(a, "/schedules/unknown")
+			Expect(status).To(Equal(http.StatusNotFound))
+		})
+	})
+})
@@ -9,20 +9,30 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"net/http"
-	"strings"
-	"time"
 
 	"github.com/labstack/echo/v4"
 	log "github.com/sirupsen/logrus"
+
+	"github.com/topfreegames/arkadiko/async"
+	"github.com/topfreegames/arkadiko/enrichment"
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/mqttclient"
+	"github.com/topfreegames/arkadiko/publisher"
+	"github.com/topfreegames/arkadiko/requestid"
+	"github.com/topfreegames/arkadiko/scheduler"
+	mqtttopic "github.com/topfreegames/arkadiko/topic"
+	"github.com/topfreegames/arkadiko/tracing"
 )
 
 // SendMqttHandler is the handler responsible for sending messages to mqtt
 func SendMqttHandler(app *App) func(c echo.Context) error {
 	return func(c echo.Context) error {
-		lg := app.Logger.WithFields(log.Fields{
+		lg := requestid.Logger(c.Request().Context(), app.Logger).WithFields(log.Fields{
 			"handler": "SendMqttHandler",
 		})
 
@@ -33,96 +43,222 @@ func SendMqttHandler(app *App) func(c echo.Context) error {
 		}
 
 		source := c.QueryParam("source")
+		isAsync := c.QueryParam("async") == "true"
+		if isAsync && app.Async == nil {
+			return FailWith(400, "Async publishing is not enabled", c)
+		}
 
-		body := c.Request().Body
-		b, err := io.ReadAll(body)
+		deliverAt, err := getDeliverAt(c)
 		if err != nil {
 			return FailWith(400, err.Error(), c)
 		}
-
-		if string(b) == "null" {
-			return FailWith(400, "Invalid JSON", c)
+		if !deliverAt.IsZero() && app.Scheduler == nil {
+			return FailWith(400, "Scheduler is not enabled", c)
 		}
 
-		var msgPayload map[string]interface{}
-		err = WithSegment("payload", c, func() error {
-			return json.Unmarshal(b, &msgPayload)
-		})
+		contentType := requestContentType(app, c)
+
+		body := c.Request().Body
+		b, err := io.ReadAll(body)
 		if err != nil {
 			return FailWith(400, err.Error(), c)
 		}
 
-		// Default should_moderate to false so messages sent from the server side are not moderated
-		if _, exists := msgPayload["should_moderate"]; !exists {
-			msgPayload["should_moderate"] = false
+		topic := c.ParamValues()[0]
+
+		ctx, span := tracing.StartCreate(c.Request().Context(), topic, retained)
+		defer span.End()
+
+		var msgPayload map[string]interface{}
+		switch {
+		case contentType == echo.MIMEApplicationJSON:
+			if string(b) == "null" {
+				return FailWith(400, "Invalid JSON", c)
+			}
+
+			var value interface{}
+			err = WithSegment("payload", c, func() error {
+				return json.Unmarshal(b, &value)
+			})
+			if err != nil {
+				return FailWith(400, err.Error(), c)
+			}
+
+			var isObject bool
+			msgPayload, isObject = value.(map[string]interface{})
+			if !isObject && !app.Config.GetBool("sendmqtt.allowNonObjectJSON") {
+				return FailWith(400, "JSON payload must be an object", c)
+			}
+
+			result, err := app.Schemas.Validate(topic, value)
+			if err != nil {
+				return FailWith(500, err.Error(), c)
+			}
+			if result != nil && !result.Valid() {
+				app.Metrics.SchemaViolations.WithLabelValues(result.Pattern, fmt.Sprintf("%t", result.DryRun)).Inc()
+				lg.WithFields(log.Fields{
+					"topic":      topic,
+					"pattern":    result.Pattern,
+					"violations": result.Violations,
+					"dryRun":     result.DryRun,
+				}).Warn("payload does not match topic schema")
+
+				if !result.DryRun {
+					return FailWithPayload(http.StatusUnprocessableEntity, "Payload does not match topic schema", map[string]interface{}{
+						"errors": result.Violations,
+					}, c)
+				}
+			}
+
+			// Arrays and scalars are forwarded as they were received
+			if isObject {
+				app.Enrichment.Apply(topic, msgPayload, enrichment.Metadata{
+					Frontend:  metrics.FrontendHTTP,
+					Requestor: source,
+					RequestID: requestid.FromContext(c.Request().Context()),
+				})
+				app.Tracing.Inject(ctx, msgPayload)
+
+				b, err = json.Marshal(msgPayload)
+				if err != nil {
+					return FailWith(400, err.Error(), c)
+				}
+			}
+		case isRawContentType(app, contentType):
+			// Raw payloads are forwarded byte for byte
 		}
 
-		topic := c.ParamValues()[0]
-		gameID := getGameID(topic, msgPayload)
+		gameID := mqtttopic.GameID(topic, msgPayload)
 
-		b, err = json.Marshal(msgPayload)
-		if err != nil {
+		c.Set("requestor", source)
+		c.Set("topic", topic)
+		c.Set("game_id", gameID)
+		c.Set("retained", retained)
+
+		var result *publisher.Result
+		err = WithSegment("mqtt", c, func() error {
+			result, err = app.Publisher.Send(ctx, &publisher.Message{
+				Frontend:    metrics.FrontendHTTP,
+				Broker:      c.QueryParam("broker"),
+				Topic:       topic,
+				Payload:     b,
+				ContentType: contentType,
+				Retained:    retained,
+				GameID:      gameID,
+				Requestor:   source,
+				DeliverAt:   deliverAt,
+				Async:       isAsync,
+			})
+			return err
+		})
+
+		var envelopeErr *publisher.EnvelopeError
+		var tooLargeErr *publisher.TooLargeError
+		switch {
+		case errors.As(err, &envelopeErr):
 			return FailWith(400, err.Error(), c)
+		case errors.As(err, &tooLargeErr):
+			return FailWithPayload(http.StatusRequestEntityTooLarge, err.Error(), map[string]interface{}{
+				"size":           tooLargeErr.Size,
+				"maxPayloadSize": tooLargeErr.MaxPayloadSize,
+			}, c)
+		case err == mqttclient.ErrUnknownBroker:
+			return FailWith(400, fmt.Sprintf("Unknown broker %s", c.QueryParam("broker")), c)
 		}
-		workingString := fmt.Sprintf(`{"topic": "%s", "retained": %t, "payload": %v}`, topic, retained, string(b))
 
+		b = result.Payload
 		lg = lg.WithFields(log.Fields{
-			"topic":    topic,
-			"retained": retained,
-			"payload":  string(b),
-			"source":   source,
+			"topic":       topic,
+			"broker":      result.Broker,
+			"retained":    retained,
+			"payload":     string(b),
+			"contentType": contentType,
+			"source":      source,
 		})
+		c.Set("broker", result.Broker)
 
-		var mqttLatency time.Duration
-		var beforeMqttTime time.Time
+		if !deliverAt.IsZero() {
+			switch {
+			case err == scheduler.ErrFull:
+				return FailWith(http.StatusServiceUnavailable, err.Error(), c)
+			case err == scheduler.ErrTooFar:
+				return FailWith(400, err.Error(), c)
+			case err != nil:
+				lg.WithError(err).Error("failed to schedule mqtt message")
+				return FailWith(500, err.Error(), c)
+			}
 
-		err = WithSegment("mqtt", c, func() error {
-			beforeMqttTime = time.Now()
-			sendMqttErr := app.MqttClient.PublishMessage(c.Request().Context(), topic, string(b), retained)
-			mqttLatency = time.Now().Sub(beforeMqttTime)
+			lg.WithFields(log.Fields{
+				"scheduleId": result.Schedule.ID,
+				"deliverAt":  result.Schedule.DeliverAt,
+			}).Debug("scheduled mqtt message")
+			return c.JSON(http.StatusAccepted, map[string]interface{}{
+				"topic":      topic,
+				"retained":   retained,
+				"scheduleId": result.Schedule.ID,
+				"deliverAt":  result.Schedule.DeliverAt,
+			})
+		}
 
-			return sendMqttErr
-		})
+		if isAsync {
+			switch {
+			case err == async.ErrFull:
+				lg.Warn("async queue is full, dropping mqtt message")
+				return FailWith(http.StatusServiceUnavailable, err.Error(), c)
+			case err == async.ErrStopped:
+				return FailWith(http.StatusServiceUnavailable, err.Error(), c)
+			case err != nil:
+				return FailWith(500, err.Error(), c)
+			}
 
-		tags := []string{
-			fmt.Sprintf("error:%t", err != nil),
-			fmt.Sprintf("retained:%t", retained),
-			fmt.Sprintf("game_id:%s", gameID),
-		}
-		if source != "" {
-			tags = append(tags, fmt.Sprintf("requestor:%s", source))
+			lg.Debug("enqueued mqtt message")
+			return c.JSON(http.StatusAccepted, map[string]interface{}{
+				"topic":    topic,
+				"retained": retained,
+				"queued":   true,
+			})
 		}
 
-		app.DDStatsD.Timing("mqtt_latency", mqttLatency, tags...)
-		app.Metrics.MQTTLatency.WithLabelValues(fmt.Sprintf("%t", err != nil), fmt.Sprintf("%t", retained), gameID).Observe(mqttLatency.Seconds())
-		lg = lg.WithField("mqttLatency", mqttLatency.Nanoseconds())
+		lg = lg.WithField("mqttLatency", result.Latency.Nanoseconds())
 		lg.Debug("sent mqtt message")
-		c.Set("mqttLatency", mqttLatency)
-		c.Set("requestor", source)
-		c.Set("topic", topic)
-		c.Set("game_id", gameID)
-		c.Set("retained", retained)
+		c.Set("mqttLatency", result.Latency)
 
+		if errors.Is(err, mqttclient.ErrBrokerUnavailable) {
+			lg.WithError(err).Warn("broker is unavailable")
+			return FailWith(http.StatusServiceUnavailable, err.Error(), c)
+		}
 		if err != nil {
 			lg.WithError(err).Error("failed to send mqtt message")
 			return FailWith(500, err.Error(), c)
 		}
+
+		var workingString string
+		if contentType == echo.MIMEApplicationJSON {
+			workingString = fmt.Sprintf(`{"topic": "%s", "retained": %t, "payload": %v}`, topic, retained, string(b))
+		} else {
+			workingString = fmt.Sprintf(`{"topic": "%s", "retained": %t, "contentType": "%s", "size": %d}`, topic, retained, contentType, len(b))
+		}
 		return c.String(http.StatusOK, workingString)
 	}
 }
 
-func getGameID(topic string, msgPayload map[string]interface{}) string {
-	for _, k := range []string{"game_id", "gameID"} {
-		if v, ok := msgPayload[k]; ok && v != nil {
-			return fmt.Sprint(v)
-		}
-	}
-	gameID := ""
-	if strings.Contains(topic, "/") {
-		gameID = strings.Split(topic, "/")[1]
-	} else {
-		gameID = topic
+// requestContentType returns the media type of request bodies forwarded as
+// they are, or JSON for any other body. Clients that send no content type,
+// or the form content type curl sends by default, have always had their
+// bodies parsed as JSON
+func requestContentType(app *App, c echo.Context) string {
+	mediaType, _, err := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	if err == nil && isRawContentType(app, mediaType) {
+		return mediaType
 	}
+	return echo.MIMEApplicationJSON
+}
 
-	return gameID
+func isRawContentType(app *App, contentType string) bool {
+	for _, raw := range app.Config.GetStringSlice("sendmqtt.rawContentTypes") {
+		if contentType == raw {
+			return true
+		}
+	}
+	return false
 }
@@ -13,14 +13,28 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
 	uuid "github.com/satori/go.uuid"
 	"github.com/topfreegames/arkadiko/api"
+	"github.com/topfreegames/arkadiko/async"
+	"github.com/topfreegames/arkadiko/chunking"
+	"github.com/topfreegames/arkadiko/compression"
+	"github.com/topfreegames/arkadiko/encryption"
+	"github.com/topfreegames/arkadiko/envelope"
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/requestid"
 	. "github.com/topfreegames/arkadiko/testing"
+	"github.com/topfreegames/arkadiko/tracing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
 )
 
 var _ = Describe("Send to MQTT Handler", func() {
@@ -72,6 +86,585 @@ var _ = Describe("Send to MQTT Handler", func() {
 				Expect(status).To(Equal(400))
 			})
 		})
+		Describe("Enrichment", func() {
+			It("Should apply the transforms of every matching rule", func() {
+				a := GetDefaultTestApp()
+				testJSON := map[string]interface{}{
+					"msg":       "hello",
+					"internal":  "secret",
+					"server_id": "spoofed",
+				}
+				status, body := PostJSON(a, "/sendmqtt/enriched/topic?source=game-server", testJSON)
+				Expect(status).To(Equal(http.StatusOK))
+
+				var result map[string]interface{}
+				Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+				payload := result["payload"].(map[string]interface{})
+				Expect(payload).To(HaveKeyWithValue("message", "hello"))
+				Expect(payload).To(HaveKeyWithValue("should_moderate", false))
+				Expect(payload).To(HaveKeyWithValue("server_id", "arkadiko-test"))
+				Expect(payload).To(HaveKeyWithValue("requestor", "game-server"))
+				Expect(payload).To(HaveKey("sent_at"))
+				Expect(payload).To(HaveKey("message_id"))
+				Expect(payload).To(HaveKey("request_id"))
+				Expect(payload).NotTo(HaveKey("msg"))
+				Expect(payload).NotTo(HaveKey("internal"))
+			})
+		})
+
+		Describe("Request ID", func() {
+			send := func(a *api.App, id string) *httptest.ResponseRecorder {
+				req := httptest.NewRequest("POST", "/sendmqtt/test", strings.NewReader(`{"message": "hello"}`))
+				if id != "" {
+					req.Header.Set(requestid.Header, id)
+				}
+				rec := httptest.NewRecorder()
+				a.App.ServeHTTP(rec, req)
+				return rec
+			}
+
+			It("Should echo the request id given by the caller", func() {
+				a := GetDefaultTestApp()
+				rec := send(a, "caller-request-1")
+				Expect(rec.Code).To(Equal(http.StatusOK))
+				Expect(rec.Header().Get(requestid.Header)).To(Equal("caller-request-1"))
+			})
+
+			It("Should generate request ids for requests without valid ones", func() {
+				a := GetDefaultTestApp()
+				generated := send(a, "").Header().Get(requestid.Header)
+				Expect(requestid.Valid(generated)).To(BeTrue())
+
+				replaced := send(a, "forged id").Header().Get(requestid.Header)
+				Expect(replaced).NotTo(Equal("forged id"))
+				Expect(requestid.Valid(replaced)).To(BeTrue())
+			})
+		})
+
+		Describe("Idempotency", func() {
+			It("Should publish only once for repeated idempotency keys", func() {
+				a := GetDefaultTestApp()
+				topic := uuid.NewV4().String()
+
+				received := 0
+				a.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					received++
+				})
+				time.Sleep(50 * time.Millisecond)
+
+				key := uuid.NewV4().String()
+				headers := map[string]string{"Idempotency-Key": key}
+				url := fmt.Sprintf("/sendmqtt/%s", topic)
+				status, body := PostBodyWithHeaders(a, url, `{"message": "hello"}`, headers)
+				Expect(status).To(Equal(http.StatusOK))
+
+				repeatedStatus, repeatedBody := PostBodyWithHeaders(a, url, `{"message": "hello"}`, headers)
+				Expect(repeatedStatus).To(Equal(http.StatusOK))
+				Expect(repeatedBody).To(Equal(body))
+
+				time.Sleep(50 * time.Millisecond)
+				Expect(received).To(Equal(1))
+			})
+
+			It("Should respond with 422 if key is reused for a different request", func() {
+				a := GetDefaultTestApp()
+				headers := map[string]string{"Idempotency-Key": uuid.NewV4().String()}
+				status, _ := PostBodyWithHeaders(a, "/sendmqtt/test", `{"message": "hello"}`, headers)
+				Expect(status).To(Equal(http.StatusOK))
+
+				status, _ = PostBodyWithHeaders(a, "/sendmqtt/test", `{"message": "bye"}`, headers)
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+			})
+
+			It("Should not remember failed requests", func() {
+				a := GetDefaultTestApp()
+				headers := map[string]string{"Idempotency-Key": uuid.NewV4().String()}
+				status, _ := PostBodyWithHeaders(a, "/sendmqtt/test", `{"message": "hello"}}`, headers)
+				Expect(status).To(Equal(http.StatusBadRequest))
+
+				status, _ = PostBodyWithHeaders(a, "/sendmqtt/test", `{"message": "hello"}`, headers)
+				Expect(status).To(Equal(http.StatusOK))
+			})
+		})
+
+		Describe("Content Types", func() {
+			It("Should forward raw payloads byte for byte", func() {
+				a := GetDefaultTestApp()
+				client := a.MqttClient
+				topic := uuid.NewV4().String()
+				payload := "\x00\x01binary\xff"
+
+				url := fmt.Sprintf("/sendmqtt/%s?retained=true", topic)
+				status, body := PostBodyWithHeaders(a, url, payload, map[string]string{
+					"Content-Type": "application/octet-stream",
+				})
+
+				Expect(status).To(Equal(http.StatusOK))
+				Expect(body).To(Equal(fmt.Sprintf(
+					`{"topic": "%s", "retained": true, "contentType": "application/octet-stream", "size": %d}`,
+					topic, len(payload),
+				)))
+
+				var msg mqtt.Message
+				onMessageHandler := func(client mqtt.Client, message mqtt.Message) {
+					msg = message
+				}
+				client.MqttClient.Subscribe(topic, 2, onMessageHandler)
+
+				// Have to wait so the goroutine can call our handler
+				time.Sleep(50 * time.Millisecond)
+
+				Expect(msg).NotTo(BeNil())
+				Expect(string(msg.Payload())).To(Equal(payload))
+			})
+
+			It("Should not parse text payloads", func() {
+				a := GetDefaultTestApp()
+				status, _ := PostBodyWithHeaders(a, "/sendmqtt/test", `{"message": "hello"}}`, map[string]string{
+					"Content-Type": "text/plain; charset=utf-8",
+				})
+
+				Expect(status).To(Equal(http.StatusOK))
+			})
+
+			It("Should parse form encoded bodies as JSON", func() {
+				a := GetDefaultTestApp()
+				status, body := PostBodyWithHeaders(a, "/sendmqtt/test", `{"message": "hello"}`, map[string]string{
+					"Content-Type": "application/x-www-form-urlencoded",
+				})
+
+				Expect(status).To(Equal(http.StatusOK))
+				Expect(body).To(Equal(`{"topic": "test", "retained": false, "payload": {"message":"hello","should_moderate":false}}`))
+			})
+
+			It("Should parse bodies of unknown content types as JSON", func() {
+				a := GetDefaultTestApp()
+				status, _ := PostBodyWithHeaders(a, "/sendmqtt/test", `{"message": "hello"}`, map[string]string{
+					"Content-Type": "application/xml",
+				})
+				Expect(status).To(Equal(http.StatusOK))
+
+				status, _ = PostBodyWithHeaders(a, "/sendmqtt/test", "<message/>", map[string]string{
+					"Content-Type": "application/xml",
+				})
+				Expect(status).To(Equal(http.StatusBadRequest))
+			})
+
+			It("Should respond with 400 for JSON arrays unless allowed", func() {
+				a := GetDefaultTestApp()
+				status, _ := PostBody(a, "/sendmqtt/test", `[1, 2]`)
+				Expect(status).To(Equal(http.StatusBadRequest))
+
+				a.Config.Set("sendmqtt.allowNonObjectJSON", true)
+				defer a.Config.Set("sendmqtt.allowNonObjectJSON", false)
+				status, body := PostBodyWithHeaders(a, "/sendmqtt/test", `[1,  2]`, map[string]string{
+					"Content-Type": "application/json",
+				})
+				Expect(status).To(Equal(http.StatusOK))
+				Expect(body).To(Equal(`{"topic": "test", "retained": false, "payload": [1,  2]}`))
+			})
+		})
+
+		Describe("Schema Validation", func() {
+			It("Should respond with 422 and the violations if payload does not match schema", func() {
+				a := GetDefaultTestApp()
+				testJSON := map[string]interface{}{
+					"message": 1,
+				}
+				status, body := PostJSON(a, "/sendmqtt/schema/game/chat", testJSON)
+
+				Expect(status).To(Equal(http.StatusUnprocessableEntity))
+				var result map[string]interface{}
+				Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+				Expect(result["success"]).To(BeFalse())
+				Expect(result["errors"]).To(ConsistOf(HaveKeyWithValue("pointer", "/message")))
+			})
+
+			It("Should respond with 200 if payload matches schema", func() {
+				a := GetDefaultTestApp()
+				testJSON := map[string]interface{}{
+					"message": "hello",
+				}
+				status, _ := PostJSON(a, "/sendmqtt/schema/game/chat", testJSON)
+
+				Expect(status).To(Equal(http.StatusOK))
+			})
+
+			It("Should respond with 200 if schema is in dry run mode", func() {
+				a := GetDefaultTestApp()
+				testJSON := map[string]interface{}{
+					"message": 1,
+				}
+				status, _ := PostJSON(a, "/sendmqtt/schema/game/dryrun", testJSON)
+
+				Expect(status).To(Equal(http.StatusOK))
+			})
+		})
+		Describe("Brokers", func() {
+			It("Should respond with 200 when publishing to a known broker", func() {
+				a := GetDefaultTestApp()
+				status, body := PostBody(a, "/sendmqtt/test/topic?broker=default", `{"message": "hello"}`)
+				Expect(status).To(Equal(http.StatusOK), body)
+			})
+
+			It("Should respond with 400 for unknown brokers", func() {
+				a := GetDefaultTestApp()
+				status, body := PostBody(a, "/sendmqtt/test/topic?broker=unknown", `{"message": "hello"}`)
+				Expect(status).To(Equal(http.StatusBadRequest))
+				Expect(body).To(ContainSubstring("Unknown broker unknown"))
+			})
+		})
+
+		Describe("Size Limits", func() {
+			It("Should respond with 413 for bodies larger than allowed", func() {
+				a := GetDefaultTestApp()
+				status, body := PostBody(a, "/sendmqtt/limited/topic", fmt.Sprintf(`{"message": "%s"}`, strings.Repeat("a", 64)))
+				Expect(status).To(Equal(http.StatusRequestEntityTooLarge), body)
+				Expect(body).To(ContainSubstring("request body is too large"))
+			})
+
+			It("Should respond with 413 for payloads larger than allowed", func() {
+				a := GetDefaultTestApp()
+				// enrichment adds should_moderate, making the payload larger than the body
+				status, body := PostBody(a, "/sendmqtt/limited/topic", fmt.Sprintf(`{"message": "%s"}`, strings.Repeat("a", 20)))
+				Expect(status).To(Equal(http.StatusRequestEntityTooLarge), body)
+
+				var result map[string]interface{}
+				Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+				Expect(result["reason"]).To(Equal("payload is too large"))
+				Expect(result["maxPayloadSize"]).To(BeEquivalentTo(48))
+			})
+
+			It("Should publish large payloads in chunks where enabled", func() {
+				a := GetDefaultTestApp()
+				topic := fmt.Sprintf("chunked/%s", uuid.NewV4().String())
+				limit := a.Limits.For(topic)
+				reassembler := chunking.NewReassembler(time.Minute, limit.MaxBodySize, limit.ChunkSize())
+				var lock sync.Mutex
+				var payload string
+				a.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					result, complete, err := reassembler.Add(message.Payload())
+					if err == nil && complete {
+						payload = string(result)
+					}
+				}).Wait()
+
+				message := strings.Repeat("a", 1000)
+				status, body := PostBody(a, fmt.Sprintf("/sendmqtt/%s", topic), fmt.Sprintf(`{"message": "%s"}`, message))
+				Expect(status).To(Equal(http.StatusOK), body)
+
+				Eventually(func() string {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).Should(Equal(fmt.Sprintf(`{"message":"%s","should_moderate":false}`, message)))
+			})
+
+			It("Should respond with 413 for retained payloads that would need chunking", func() {
+				a := GetDefaultTestApp()
+				status, body := PostBody(a, "/sendmqtt/chunked/topic?retained=true", fmt.Sprintf(`{"message": "%s"}`, strings.Repeat("a", 1000)))
+				Expect(status).To(Equal(http.StatusRequestEntityTooLarge), body)
+			})
+		})
+
+		Describe("Compression", func() {
+			compress := func(encoding, body string) string {
+				compressed, err := compression.Compress(encoding, []byte(body))
+				Expect(err).NotTo(HaveOccurred())
+				return string(compressed)
+			}
+
+			for _, encoding := range []string{"gzip", "zstd"} {
+				encoding := encoding
+
+				It("Should accept "+encoding+" request bodies", func() {
+					a := GetDefaultTestApp()
+					status, body := PostBodyWithHeaders(a, "/sendmqtt/test/topic", compress(encoding, `{"message": "hello"}`), map[string]string{
+						"Content-Encoding": encoding,
+					})
+					Expect(status).To(Equal(http.StatusOK), body)
+					Expect(body).To(ContainSubstring(`"message":"hello"`))
+				})
+			}
+
+			It("Should respond with 415 for unsupported encodings", func() {
+				a := GetDefaultTestApp()
+				status, body := PostBodyWithHeaders(a, "/sendmqtt/test/topic", `{"message": "hello"}`, map[string]string{
+					"Content-Encoding": "br",
+				})
+				Expect(status).To(Equal(http.StatusUnsupportedMediaType), body)
+			})
+
+			It("Should limit the size of decompressed bodies", func() {
+				a := GetDefaultTestApp()
+				message := fmt.Sprintf(`{"message": "%s"}`, strings.Repeat("a", 1000))
+				status, body := PostBodyWithHeaders(a, "/sendmqtt/limited/topic", compress("gzip", message), map[string]string{
+					"Content-Encoding": "gzip",
+				})
+				Expect(status).To(Equal(http.StatusRequestEntityTooLarge), body)
+			})
+
+			It("Should compress payloads of topics with compression", func() {
+				a := GetDefaultTestApp()
+				topic := fmt.Sprintf("compressed/%s", uuid.NewV4().String())
+				var lock sync.Mutex
+				var payload []byte
+				a.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = message.Payload()
+				}).Wait()
+
+				message := strings.Repeat("a", 1000)
+				status, body := PostBody(a, fmt.Sprintf("/sendmqtt/%s", topic), fmt.Sprintf(`{"message": "%s"}`, message))
+				Expect(status).To(Equal(http.StatusOK), body)
+
+				Eventually(func() []byte {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).ShouldNot(BeNil())
+				lock.Lock()
+				defer lock.Unlock()
+				Expect(len(payload)).To(BeNumerically("<", len(message)))
+				decoded, err := a.Compression.Decode(payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(decoded)).To(Equal(fmt.Sprintf(`{"message":"%s","should_moderate":false}`, message)))
+			})
+
+			It("Should inject the trace context into payloads", func() {
+				a := GetDefaultTestApp()
+				recorder := tracetest.NewSpanRecorder()
+				otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+				defer otel.SetTracerProvider(noop.NewTracerProvider())
+				a.Config.Set("tracing.payloadField", "traceparent")
+				a.Tracing = tracing.NewPropagator(a.Config)
+				topic := uuid.NewV4().String()
+				var lock sync.Mutex
+				var payload []byte
+				a.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = message.Payload()
+				}).Wait()
+
+				traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+				status, body := PostBodyWithHeaders(a, fmt.Sprintf("/sendmqtt/%s", topic), `{"message": "hello"}`, map[string]string{
+					"traceparent": fmt.Sprintf("00-%s-00f067aa0ba902b7-01", traceID),
+				})
+				Expect(status).To(Equal(http.StatusOK), body)
+
+				Eventually(func() []byte {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).ShouldNot(BeNil())
+				lock.Lock()
+				defer lock.Unlock()
+				var received map[string]interface{}
+				Expect(json.Unmarshal(payload, &received)).To(Succeed())
+				Expect(received["traceparent"]).To(MatchRegexp("^00-%s-[0-9a-f]{16}-01$", traceID))
+				Expect(received["traceparent"]).NotTo(ContainSubstring("00f067aa0ba902b7"))
+
+				// consumers continue the trace from the publish, not the request
+				spans := map[string]sdktrace.ReadOnlySpan{}
+				for _, span := range recorder.Ended() {
+					spans[span.Name()] = span
+				}
+				Expect(spans).To(HaveKey(topic + " create"))
+				Expect(spans).To(HaveKey(topic + " publish"))
+				create := spans[topic+" create"].SpanContext()
+				Expect(received["traceparent"]).To(Equal(fmt.Sprintf("00-%s-%s-01", traceID, create.SpanID())))
+				Expect(spans[topic+" publish"].Parent().SpanID()).To(Equal(create.SpanID()))
+			})
+
+			It("Should wrap payloads of topics with envelopes", func() {
+				a := GetDefaultTestApp()
+				topic := fmt.Sprintf("enveloped/%s", uuid.NewV4().String())
+				var lock sync.Mutex
+				var payload []byte
+				a.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = message.Payload()
+				}).Wait()
+
+				traceID := "4bf92f3577b34da6a3ce929d0e0e4736"
+				status, body := PostBodyWithHeaders(a, fmt.Sprintf("/sendmqtt/%s?source=chat-service", topic), `{"message": "hello", "game_id": "my-game"}`, map[string]string{
+					"traceparent":  fmt.Sprintf("00-%s-00f067aa0ba902b7-01", traceID),
+					"X-Request-ID": "chat-request-1",
+				})
+				Expect(status).To(Equal(http.StatusOK), body)
+
+				Eventually(func() []byte {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).ShouldNot(BeNil())
+				lock.Lock()
+				defer lock.Unlock()
+				e, err := envelope.Decode(payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(e.ID).NotTo(BeEmpty())
+				Expect(e.Timestamp).To(BeTemporally("~", time.Now(), time.Minute))
+				Expect(e.Source).To(Equal("chat-service"))
+				Expect(e.GameID).To(Equal("my-game"))
+				Expect(e.TraceID).To(Equal(traceID))
+				Expect(e.RequestID).To(Equal("chat-request-1"))
+				Expect(e.ContentType).To(Equal("application/json"))
+				Expect(string(e.Data)).To(Equal(`{"game_id":"my-game","message":"hello","should_moderate":false}`))
+			})
+
+			It("Should encrypt payloads of topics with encryption", func() {
+				a := GetDefaultTestApp()
+				keyring, err := encryption.LoadKeyring("../config/test-keyring.json", time.Minute, a.Logger)
+				Expect(err).NotTo(HaveOccurred())
+				topic := fmt.Sprintf("encrypted/%s", uuid.NewV4().String())
+				var lock sync.Mutex
+				var payload []byte
+				a.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = message.Payload()
+				}).Wait()
+
+				status, body := PostBody(a, fmt.Sprintf("/sendmqtt/%s", topic), `{"message": "secret"}`)
+				Expect(status).To(Equal(http.StatusOK), body)
+
+				Eventually(func() []byte {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).ShouldNot(BeNil())
+				lock.Lock()
+				defer lock.Unlock()
+				Expect(string(payload)).To(HavePrefix("arkadiko-encryption/1 test-1\n"))
+				Expect(string(payload)).NotTo(ContainSubstring("secret"))
+				decrypted, err := encryption.Decrypt(keyring, topic, payload)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(decrypted)).To(Equal(`{"message":"secret","should_moderate":false}`))
+			})
+		})
+
+		Describe("Async", func() {
+			It("Should respond with 202 and publish in the background", func() {
+				a := GetDefaultTestApp()
+				a.Async.Start()
+				defer a.Async.Stop()
+
+				topic := uuid.NewV4().String()
+				var lock sync.Mutex
+				var payload string
+				a.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = string(message.Payload())
+				}).Wait()
+
+				status, body := PostBody(a, fmt.Sprintf("/sendmqtt/%s?async=true", topic), `{"message": "hello"}`)
+				Expect(status).To(Equal(http.StatusAccepted), body)
+
+				var result map[string]interface{}
+				Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+				Expect(result["topic"]).To(Equal(topic))
+				Expect(result["queued"]).To(BeTrue())
+
+				Eventually(func() string {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).Should(Equal(`{"message":"hello","should_moderate":false}`))
+			})
+
+			It("Should respond with 503 when the queue is full", func() {
+				a := GetDefaultTestApp()
+				a.Config.Set("async.queueSize", 1)
+				a.Async = async.NewQueue(a.Config, a.Brokers.PublishMessage, a.Logger)
+				a.Publisher.Async = a.Async
+
+				status, _ := PostBody(a, "/sendmqtt/test/topic?async=true", `{"message": "hello"}`)
+				Expect(status).To(Equal(http.StatusAccepted))
+
+				status, _ = PostBody(a, "/sendmqtt/test/topic?async=true", `{"message": "hello"}`)
+				Expect(status).To(Equal(http.StatusServiceUnavailable))
+			})
+
+			It("Should respond with 503 once stopped", func() {
+				a := GetDefaultTestApp()
+				a.Async.Stop()
+
+				status, _ := PostBody(a, "/sendmqtt/test/topic?async=true", `{"message": "hello"}`)
+				Expect(status).To(Equal(http.StatusServiceUnavailable))
+			})
+		})
+
+		Describe("Metrics", func() {
+			find := func(name string, labels map[string]string) *dto.Metric {
+				families, err := metrics.Gatherer().Gather()
+				Expect(err).NotTo(HaveOccurred())
+				for _, family := range families {
+					if family.GetName() != name {
+						continue
+					}
+				metric:
+					for _, m := range family.GetMetric() {
+						values := map[string]string{}
+						for _, pair := range m.GetLabel() {
+							values[pair.GetName()] = pair.GetValue()
+						}
+						for k, v := range labels {
+							if values[k] != v {
+								continue metric
+							}
+						}
+						return m
+					}
+				}
+				return nil
+			}
+
+			It("Should report the size and latency of published messages", func() {
+				a := GetDefaultTestApp()
+				status, _ := PostBody(a, "/sendmqtt/test/topic", `{"message": "hello"}`)
+				Expect(status).To(Equal(http.StatusOK))
+
+				size := find("arkadiko_payload_size_bytes", map[string]string{"frontend": "http", "broker": "default"})
+				Expect(size).NotTo(BeNil())
+				Expect(size.GetHistogram().GetSampleCount()).To(Equal(uint64(1)))
+				Expect(size.GetHistogram().GetSampleSum()).To(Equal(float64(len(`{"message":"hello","should_moderate":false}`))))
+
+				latency := find("arkadiko_mqtt_latency", map[string]string{"frontend": "http", "broker": "default", "error": "false"})
+				Expect(latency).NotTo(BeNil())
+				Expect(latency.GetHistogram().GetSampleCount()).To(Equal(uint64(1)))
+			})
+
+			It("Should count rejected requests by reason", func() {
+				a := GetDefaultTestApp()
+				status, _ := PostBody(a, "/sendmqtt/limited/topic", fmt.Sprintf(`{"message": "%s"}`, strings.Repeat("a", 64)))
+				Expect(status).To(Equal(http.StatusRequestEntityTooLarge))
+
+				rejected := find("arkadiko_rejected_requests", map[string]string{"frontend": "http", "reason": "too_large"})
+				Expect(rejected).NotTo(BeNil())
+				Expect(rejected.GetCounter().GetValue()).To(Equal(1.0))
+			})
+
+			It("Should count unauthorized requests", func() {
+				a := GetDefaultTestApp()
+				a.Config.Set("basicauth.username", "user")
+				a.Config.Set("basicauth.password", "pass")
+				Expect(a.Configure()).To(Succeed())
+
+				status, _ := PostBody(a, "/sendmqtt/test/topic", `{"message": "hello"}`)
+				Expect(status).To(Equal(http.StatusUnauthorized))
+
+				rejected := find("arkadiko_rejected_requests", map[string]string{"frontend": "http", "reason": "unauthorized"})
+				Expect(rejected).NotTo(BeNil())
+				Expect(rejected.GetCounter().GetValue()).To(Equal(1.0))
+			})
+		})
+
 		Describe("Retained Message", func() {
 			It("Should respond with 200 for a valid message", func() {
 				a := GetDefaultTestApp()
@@ -0,0 +1,23 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package api
+
+import (
+	"github.com/labstack/echo/v4"
+)
+
+// SigningKeysHandler is the handler responsible for listing the public keys
+// consumers verify signed payloads with
+func SigningKeysHandler(app *App) func(c echo.Context) error {
+	return func(c echo.Context) error {
+		c.Set("route", "SigningKeys")
+		return SucceedWith(map[string]interface{}{
+			"keys": app.Signing.PublicKeys(),
+		}, c)
+	}
+}
@@ -0,0 +1,73 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package api_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/topfreegames/arkadiko/signing"
+	. "github.com/topfreegames/arkadiko/testing"
+)
+
+var _ = Describe("Signing Handlers", func() {
+	getVerifier := func() *signing.Verifier {
+		a := GetDefaultTestApp()
+		status, body := Get(a, "/signing/keys")
+		Expect(status).To(Equal(http.StatusOK), body)
+
+		var result struct {
+			Keys []signing.PublicKey `json:"keys"`
+		}
+		Expect(json.Unmarshal([]byte(body), &result)).To(Succeed())
+		Expect(result.Keys).To(HaveLen(2))
+		Expect(result.Keys[0].ID).To(Equal("test-2"))
+		Expect(result.Keys[1].ID).To(Equal("test-1"))
+
+		verifier, err := signing.NewVerifier(result.Keys...)
+		Expect(err).NotTo(HaveOccurred())
+		return verifier
+	}
+
+	for _, prefix := range []string{"signed", "system"} {
+		prefix := prefix
+		It(fmt.Sprintf("Should sign payloads published to %s topics", prefix), func() {
+			verifier := getVerifier()
+			a := GetDefaultTestApp()
+			topic := fmt.Sprintf("%s/%s", prefix, uuid.NewV4().String())
+			var lock sync.Mutex
+			var payload []byte
+			a.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+				lock.Lock()
+				defer lock.Unlock()
+				payload = message.Payload()
+			}).Wait()
+
+			status, body := PostBody(a, fmt.Sprintf("/sendmqtt/%s", topic), `{"message": "maintenance at noon"}`)
+			Expect(status).To(Equal(http.StatusOK), body)
+
+			Eventually(func() []byte {
+				lock.Lock()
+				defer lock.Unlock()
+				return payload
+			}).ShouldNot(BeNil())
+			lock.Lock()
+			defer lock.Unlock()
+			verified, _, err := verifier.Verify(topic, payload)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(verified)).To(Equal(`{"message":"maintenance at noon","should_moderate":false}`))
+		})
+	}
+})
@@ -0,0 +1,215 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package async
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/deadletter"
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/requestid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	// ErrFull is returned when async.queueSize messages are already waiting
+	ErrFull = errors.New("async queue is full")
+	// ErrStopped is returned when enqueueing after the queue has been stopped
+	ErrStopped = errors.New("async queue is stopped")
+)
+
+// PublishFunc publishes a message taken from the queue to the named broker
+type PublishFunc func(ctx context.Context, broker, topic, payload string, retained bool) error
+
+type message struct {
+	broker    string
+	topic     string
+	payload   string
+	retained  bool
+	requestor string
+	// the span and request id of the request the message was sent by,
+	// restored when publishing it
+	spanContext trace.SpanContext
+	requestID   string
+}
+
+var (
+	metricsOnce     sync.Once
+	depthGauge      metrics.Gauge
+	messagesCounter *metrics.CounterVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		depthGauge = metrics.NewGauge(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "async_queue_depth",
+			Help:      "Messages waiting in the async queue",
+		})
+		messagesCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace:  "arkadiko",
+			Name:       "async_messages",
+			Help:       "Async messages by what happened to them",
+			StatsDName: "async_queue_messages",
+		}, []string{"status"})
+	})
+}
+
+// Queue publishes messages in the background, so callers that do not care
+// about the broker acknowledgement don't have to wait for it
+type Queue struct {
+	Size        int
+	Workers     int
+	DeadLetters *deadletter.Recorder
+	Logger      log.FieldLogger
+	publish     PublishFunc
+	messages    chan *message
+	lock        sync.RWMutex
+	started     bool
+	stopped     bool
+	wg          sync.WaitGroup
+}
+
+// NewQueue returns a Queue configured under the async key
+func NewQueue(config *viper.Viper, publish PublishFunc, logger log.FieldLogger) *Queue {
+	config.SetDefault("async.queueSize", 1000)
+	config.SetDefault("async.workers", 10)
+
+	initMetrics()
+
+	size := config.GetInt("async.queueSize")
+	return &Queue{
+		Size:     size,
+		Workers:  config.GetInt("async.workers"),
+		Logger:   logger.WithField("source", "AsyncQueue"),
+		publish:  publish,
+		messages: make(chan *message, size),
+	}
+}
+
+// Enqueue adds a message to the queue without waiting for it to be published
+// to broker. The message is published with the span and the request id of
+// ctx, but not its deadline, as the request is answered before
+func (q *Queue) Enqueue(ctx context.Context, broker, topic, payload string, retained bool, requestor string) error {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+
+	if q.stopped {
+		return ErrStopped
+	}
+
+	select {
+	case q.messages <- &message{
+		broker:      broker,
+		topic:       topic,
+		payload:     payload,
+		retained:    retained,
+		requestor:   requestor,
+		spanContext: trace.SpanContextFromContext(ctx),
+		requestID:   requestid.FromContext(ctx),
+	}:
+		depthGauge.Inc()
+		messagesCounter.WithLabelValues("enqueued").Inc()
+		return nil
+	default:
+		messagesCounter.WithLabelValues("dropped").Inc()
+		return ErrFull
+	}
+}
+
+// Len returns how many messages are waiting to be published
+func (q *Queue) Len() int {
+	return len(q.messages)
+}
+
+// Start starts the workers that publish queued messages
+func (q *Queue) Start() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.started || q.stopped {
+		return
+	}
+	q.started = true
+
+	for i := 0; i < q.Workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+	q.Logger.WithField("workers", q.Workers).Info("Started async workers.")
+}
+
+// Stop refuses new messages and waits for the queued ones to be published
+func (q *Queue) Stop() {
+	q.lock.Lock()
+	if q.stopped {
+		q.lock.Unlock()
+		return
+	}
+	q.stopped = true
+	close(q.messages)
+	started := q.started
+	q.lock.Unlock()
+
+	if !started {
+		if pending := q.Len(); pending > 0 {
+			q.Logger.WithField("pending", pending).Warn("Discarding async messages queued before the workers started.")
+			for m := range q.messages {
+				depthGauge.Dec()
+				q.deadLetter(m, ErrStopped, 0)
+			}
+		}
+		return
+	}
+
+	q.Logger.WithField("pending", q.Len()).Info("Draining async queue.")
+	q.wg.Wait()
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+
+	for m := range q.messages {
+		depthGauge.Dec()
+
+		ctx := trace.ContextWithSpanContext(context.Background(), m.spanContext)
+		ctx = requestid.NewContext(ctx, m.requestID)
+
+		err := q.publish(ctx, m.broker, m.topic, m.payload, m.retained)
+		if err != nil {
+			requestid.Logger(ctx, q.Logger).WithError(err).WithFields(log.Fields{
+				"operation": "publish",
+				"broker":    m.broker,
+				"topic":     m.topic,
+				"payload":   m.payload,
+				"retained":  m.retained,
+			}).Error("Failed to publish async message.")
+			messagesCounter.WithLabelValues("failed").Inc()
+			q.deadLetter(m, err, deadletter.Attempts(err))
+			continue
+		}
+		messagesCounter.WithLabelValues("published").Inc()
+	}
+}
+
+func (q *Queue) deadLetter(m *message, err error, attempts int) {
+	q.DeadLetters.Record(&deadletter.Letter{
+		Broker:    m.broker,
+		Topic:     m.topic,
+		Payload:   m.payload,
+		Retained:  m.retained,
+		Error:     err.Error(),
+		Attempts:  attempts,
+		Requestor: m.requestor,
+	})
+}
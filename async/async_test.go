@@ -0,0 +1,161 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package async_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/async"
+	"github.com/topfreegames/arkadiko/deadletter"
+	"github.com/topfreegames/arkadiko/requestid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var _ = Describe("Queue", func() {
+	l, _ := test.NewNullLogger()
+
+	var config *viper.Viper
+	var lock sync.Mutex
+	var published []string
+	var release chan struct{}
+
+	publish := func(ctx context.Context, broker, topic, payload string, retained bool) error {
+		if release != nil {
+			<-release
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		if topic == "fail" {
+			return errors.New("broker unavailable")
+		}
+		published = append(published, payload)
+		return nil
+	}
+
+	getPublished := func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return published
+	}
+
+	BeforeEach(func() {
+		config = viper.New()
+		published = nil
+		release = nil
+	})
+
+	It("Should publish queued messages", func() {
+		q := async.NewQueue(config, publish, l)
+		q.Start()
+		defer q.Stop()
+
+		Expect(q.Enqueue(context.Background(), "default", "topic", "first", false, "")).To(Succeed())
+		Expect(q.Enqueue(context.Background(), "default", "fail", "failed", false, "")).To(Succeed())
+		Expect(q.Enqueue(context.Background(), "default", "topic", "second", true, "")).To(Succeed())
+
+		Eventually(getPublished).Should(ConsistOf("first", "second"))
+	})
+
+	It("Should refuse messages once the queue is full", func() {
+		config.Set("async.queueSize", 2)
+		q := async.NewQueue(config, publish, l)
+
+		Expect(q.Enqueue(context.Background(), "default", "topic", "first", false, "")).To(Succeed())
+		Expect(q.Enqueue(context.Background(), "default", "topic", "second", false, "")).To(Succeed())
+		Expect(q.Enqueue(context.Background(), "default", "topic", "third", false, "")).To(Equal(async.ErrFull))
+		Expect(q.Len()).To(Equal(2))
+	})
+
+	It("Should drain queued messages when stopped", func() {
+		config.Set("async.workers", 1)
+		release = make(chan struct{})
+		q := async.NewQueue(config, publish, l)
+		q.Start()
+
+		for _, payload := range []string{"first", "second", "third"} {
+			Expect(q.Enqueue(context.Background(), "default", "topic", payload, false, "")).To(Succeed())
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			q.Stop()
+			close(stopped)
+		}()
+
+		Consistently(stopped).ShouldNot(BeClosed())
+		Expect(q.Enqueue(context.Background(), "default", "topic", "late", false, "")).To(Equal(async.ErrStopped))
+
+		close(release)
+		Eventually(stopped).Should(BeClosed())
+		Expect(getPublished()).To(Equal([]string{"first", "second", "third"}))
+	})
+
+	It("Should publish messages with the span and request id they were enqueued with", func() {
+		var lock sync.Mutex
+		var published context.Context
+		q := async.NewQueue(config, func(ctx context.Context, broker, topic, payload string, retained bool) error {
+			lock.Lock()
+			defer lock.Unlock()
+			published = ctx
+			return nil
+		}, l)
+		q.Start()
+
+		spanContext := trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    trace.TraceID{1},
+			SpanID:     trace.SpanID{2},
+			TraceFlags: trace.FlagsSampled,
+		})
+		ctx, cancel := context.WithCancel(trace.ContextWithSpanContext(context.Background(), spanContext))
+		ctx = requestid.NewContext(ctx, "request-1")
+		Expect(q.Enqueue(ctx, "default", "topic", "payload", false, "")).To(Succeed())
+		// the request is answered before the message is published
+		cancel()
+		q.Stop()
+
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(published.Err()).NotTo(HaveOccurred())
+		Expect(trace.SpanContextFromContext(published)).To(Equal(spanContext))
+		Expect(requestid.FromContext(published)).To(Equal("request-1"))
+	})
+
+	It("Should record messages that could not be published as dead letters", func() {
+		dir, err := os.MkdirTemp("", "arkadiko-async")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		config.Set("deadletter.sink", "file")
+		config.Set("deadletter.file.path", filepath.Join(dir, "deadletters.jsonl"))
+		recorder, err := deadletter.NewRecorder(config, nil, l)
+		Expect(err).NotTo(HaveOccurred())
+		defer recorder.Close()
+
+		q := async.NewQueue(config, publish, l)
+		q.DeadLetters = recorder
+		q.Start()
+		Expect(q.Enqueue(context.Background(), "default", "fail", "failed", true, "tests")).To(Succeed())
+		q.Stop()
+
+		letters, err := recorder.List()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(letters).To(HaveLen(1))
+		Expect(letters[0].Topic).To(Equal("fail"))
+		Expect(letters[0].Payload).To(Equal("failed"))
+		Expect(letters[0].Retained).To(BeTrue())
+		Expect(letters[0].Error).To(Equal("broker unavailable"))
+		Expect(letters[0].Requestor).To(Equal("tests"))
+	})
+})
@@ -0,0 +1,226 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+// Package chunking splits payloads too large for the broker into sequenced
+// messages and reassembles them on the consumer side.
+//
+// Every chunk is published to the topic of the original message with a one
+// line header followed by its part of the payload:
+//
+//	arkadiko-chunk/1 <id> <index> <total> <sha256>\n<data>
+//
+// where id identifies the original message, index goes from 0 to total-1
+// and sha256 is the hex digest of the whole payload.
+package chunking
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Prefix starts the header of every chunk
+const Prefix = "arkadiko-chunk/1 "
+
+// MaxHeaderSize is the largest a chunk header can be, so that chunks of
+// size bytes of data fit in size+MaxHeaderSize byte messages
+const MaxHeaderSize = 256
+
+// DefaultMaxPending is how many payloads a Reassembler waits for chunks of
+// at a time by default
+const DefaultMaxPending = 1000
+
+var (
+	// ErrNotChunk is returned when parsing a message that is not a chunk
+	ErrNotChunk = errors.New("message is not a chunk")
+	// ErrInvalidChunk is returned when parsing a chunk with a malformed header
+	ErrInvalidChunk = errors.New("invalid chunk header")
+	// ErrChecksum is returned when a reassembled payload does not match the
+	// digest of the original one
+	ErrChecksum = errors.New("reassembled payload does not match its checksum")
+	// ErrTooLarge is returned when a chunk says its payload is larger than
+	// the reassembler accepts
+	ErrTooLarge = errors.New("chunked payload is too large")
+	// ErrTooManyPending is returned when a chunk of a new payload arrives
+	// while the reassembler is waiting for as many payloads as it can
+	ErrTooManyPending = errors.New("too many chunked payloads are pending")
+)
+
+// Chunk is a part of a payload
+type Chunk struct {
+	ID    string
+	Index int
+	Total int
+	Sum   string
+	Data  []byte
+}
+
+// Split splits payload into messages of at most size bytes of data each,
+// identified by id
+func Split(id string, payload []byte, size int) [][]byte {
+	if size < 1 {
+		size = 1
+	}
+
+	digest := sha256.Sum256(payload)
+	sum := hex.EncodeToString(digest[:])
+	total := (len(payload) + size - 1) / size
+	if total == 0 {
+		total = 1
+	}
+
+	messages := make([][]byte, 0, total)
+	for i := 0; i < total; i++ {
+		end := (i + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+
+		header := fmt.Sprintf("%s%s %d %d %s\n", Prefix, id, i, total, sum)
+		message := make([]byte, 0, len(header)+end-i*size)
+		message = append(message, header...)
+		message = append(message, payload[i*size:end]...)
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// Parse returns the chunk in message, or ErrNotChunk if it is a regular
+// message
+func Parse(message []byte) (*Chunk, error) {
+	if !bytes.HasPrefix(message, []byte(Prefix)) {
+		return nil, ErrNotChunk
+	}
+
+	end := bytes.IndexByte(message, '\n')
+	if end < 0 {
+		return nil, ErrInvalidChunk
+	}
+
+	chunk := &Chunk{}
+	_, err := fmt.Sscanf(string(message[len(Prefix):end]), "%s %d %d %s", &chunk.ID, &chunk.Index, &chunk.Total, &chunk.Sum)
+	if err != nil || chunk.Total < 1 || chunk.Index < 0 || chunk.Index >= chunk.Total {
+		return nil, ErrInvalidChunk
+	}
+	chunk.Data = message[end+1:]
+
+	return chunk, nil
+}
+
+type pending struct {
+	chunks   [][]byte
+	received int
+	sum      string
+	started  time.Time
+}
+
+// Reassembler puts chunks back together. Incomplete payloads are discarded
+// once they are older than TTL. Chunks are headed by whoever published
+// them, so payloads of more than MaxChunks chunks, chunks of more than
+// ChunkSize bytes and chunks of new payloads while MaxPending are waiting
+// are refused rather than held in memory. Zero values are not limited
+type Reassembler struct {
+	TTL        time.Duration
+	ChunkSize  int
+	MaxChunks  int
+	MaxPending int
+	lock       sync.Mutex
+	pending    map[string]*pending
+}
+
+// NewReassembler returns a Reassembler that waits up to ttl for the chunks
+// of payloads of up to maxSize bytes, split into chunks of chunkSize bytes:
+// the maxPayloadSize of their topic less MaxHeaderSize
+func NewReassembler(ttl time.Duration, maxSize, chunkSize int) *Reassembler {
+	return &Reassembler{
+		TTL:        ttl,
+		ChunkSize:  chunkSize,
+		MaxChunks:  (maxSize + chunkSize - 1) / chunkSize,
+		MaxPending: DefaultMaxPending,
+		pending:    map[string]*pending{},
+	}
+}
+
+// Add takes a received message. Regular messages are returned as they are,
+// while chunks are kept until the last one of a payload arrives, when the
+// whole payload is returned. complete is false while chunks are missing
+func (r *Reassembler) Add(message []byte) (payload []byte, complete bool, err error) {
+	chunk, err := Parse(message)
+	if err == ErrNotChunk {
+		return message, true, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if r.MaxChunks > 0 && chunk.Total > r.MaxChunks {
+		return nil, false, ErrTooLarge
+	}
+	if r.ChunkSize > 0 && len(chunk.Data) > r.ChunkSize {
+		return nil, false, ErrInvalidChunk
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.expire()
+
+	p, ok := r.pending[chunk.ID]
+	if !ok {
+		if r.MaxPending > 0 && len(r.pending) >= r.MaxPending {
+			return nil, false, ErrTooManyPending
+		}
+		p = &pending{
+			chunks:  make([][]byte, chunk.Total),
+			sum:     chunk.Sum,
+			started: time.Now(),
+		}
+		r.pending[chunk.ID] = p
+	}
+	if len(p.chunks) != chunk.Total || p.sum != chunk.Sum {
+		return nil, false, ErrInvalidChunk
+	}
+	if p.chunks[chunk.Index] == nil {
+		p.chunks[chunk.Index] = append([]byte{}, chunk.Data...)
+		p.received++
+	}
+	if p.received < chunk.Total {
+		return nil, false, nil
+	}
+
+	delete(r.pending, chunk.ID)
+	payload = bytes.Join(p.chunks, nil)
+	digest := sha256.Sum256(payload)
+	if hex.EncodeToString(digest[:]) != p.sum {
+		return nil, false, ErrChecksum
+	}
+	return payload, true, nil
+}
+
+// Pending returns how many payloads are waiting for chunks
+func (r *Reassembler) Pending() int {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	r.expire()
+	return len(r.pending)
+}
+
+// expire must be called holding the lock
+func (r *Reassembler) expire() {
+	if r.TTL <= 0 {
+		return
+	}
+	for id, p := range r.pending {
+		if time.Since(p.started) > r.TTL {
+			delete(r.pending, id)
+		}
+	}
+}
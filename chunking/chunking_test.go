@@ -0,0 +1,144 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package chunking_test
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/arkadiko/chunking"
+)
+
+var _ = Describe("Chunking", func() {
+	payload := []byte(strings.Repeat("0123456789", 25))
+
+	Describe("Split", func() {
+		It("Should split payloads into sequenced chunks", func() {
+			messages := chunking.Split("some-id", payload, 100)
+			Expect(messages).To(HaveLen(3))
+
+			for i, message := range messages {
+				Expect(len(message)).To(BeNumerically("<=", 100+chunking.MaxHeaderSize))
+
+				chunk, err := chunking.Parse(message)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(chunk.ID).To(Equal("some-id"))
+				Expect(chunk.Index).To(Equal(i))
+				Expect(chunk.Total).To(Equal(3))
+			}
+		})
+
+		It("Should keep binary data", func() {
+			binary := []byte{0, '\n', 255, 10, 13, 0}
+			messages := chunking.Split("some-id", binary, 4)
+
+			chunk, err := chunking.Parse(messages[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(chunk.Data).To(Equal(binary[:4]))
+		})
+	})
+
+	Describe("Parse", func() {
+		It("Should fail for regular messages", func() {
+			_, err := chunking.Parse([]byte(`{"message": "hello"}`))
+			Expect(err).To(Equal(chunking.ErrNotChunk))
+		})
+
+		It("Should fail for malformed headers", func() {
+			_, err := chunking.Parse([]byte(chunking.Prefix + "some-id 3 3 abc\ndata"))
+			Expect(err).To(Equal(chunking.ErrInvalidChunk))
+
+			_, err = chunking.Parse([]byte(chunking.Prefix + "some-id"))
+			Expect(err).To(Equal(chunking.ErrInvalidChunk))
+		})
+	})
+
+	Describe("Reassembler", func() {
+		It("Should reassemble chunks received in any order", func() {
+			r := chunking.NewReassembler(time.Minute, len(payload), 100)
+			messages := chunking.Split("some-id", payload, 100)
+
+			for _, i := range []int{2, 0} {
+				result, complete, err := r.Add(messages[i])
+				Expect(err).NotTo(HaveOccurred())
+				Expect(complete).To(BeFalse())
+				Expect(result).To(BeNil())
+			}
+			Expect(r.Pending()).To(Equal(1))
+
+			result, complete, err := r.Add(messages[1])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(complete).To(BeTrue())
+			Expect(result).To(Equal(payload))
+			Expect(r.Pending()).To(Equal(0))
+		})
+
+		It("Should pass regular messages through", func() {
+			r := chunking.NewReassembler(time.Minute, len(payload), 100)
+			result, complete, err := r.Add([]byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(complete).To(BeTrue())
+			Expect(result).To(Equal([]byte("hello")))
+		})
+
+		It("Should fail when the reassembled payload does not match its checksum", func() {
+			r := chunking.NewReassembler(time.Minute, len(payload), 200)
+			messages := chunking.Split("some-id", payload, 200)
+			messages[1][len(messages[1])-1] = 'x'
+
+			_, _, err := r.Add(messages[0])
+			Expect(err).NotTo(HaveOccurred())
+			_, _, err = r.Add(messages[1])
+			Expect(err).To(Equal(chunking.ErrChecksum))
+		})
+
+		It("Should refuse payloads larger than allowed", func() {
+			r := chunking.NewReassembler(time.Minute, 200, 100)
+			_, _, err := r.Add(chunking.Split("some-id", payload, 100)[0])
+			Expect(err).To(Equal(chunking.ErrTooLarge))
+
+			// chunks of more data than the chunk size
+			_, _, err = r.Add(chunking.Split("other-id", payload[:200], 150)[0])
+			Expect(err).To(Equal(chunking.ErrInvalidChunk))
+			Expect(r.Pending()).To(Equal(0))
+		})
+
+		It("Should refuse new payloads while too many are pending", func() {
+			r := chunking.NewReassembler(time.Minute, len(payload), 100)
+			r.MaxPending = 1
+			first := chunking.Split("first", payload, 100)
+			second := chunking.Split("second", payload, 100)
+
+			_, _, err := r.Add(first[0])
+			Expect(err).NotTo(HaveOccurred())
+			_, _, err = r.Add(second[0])
+			Expect(err).To(Equal(chunking.ErrTooManyPending))
+
+			// chunks of the pending payload are still taken
+			_, _, err = r.Add(first[1])
+			Expect(err).NotTo(HaveOccurred())
+			_, complete, err := r.Add(first[2])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(complete).To(BeTrue())
+			_, _, err = r.Add(second[0])
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should discard incomplete payloads after the ttl", func() {
+			r := chunking.NewReassembler(10*time.Millisecond, len(payload), 100)
+			messages := chunking.Split("some-id", payload, 100)
+
+			_, _, err := r.Add(messages[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r.Pending()).To(Equal(1))
+			Eventually(r.Pending).Should(Equal(0))
+		})
+	})
+})
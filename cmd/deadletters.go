@@ -0,0 +1,125 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/api"
+	"github.com/topfreegames/arkadiko/deadletter"
+)
+
+var replayAll bool
+
+// deadLettersCmd groups the commands that handle messages that could not be delivered
+var deadLettersCmd = &cobra.Command{
+	Use:   "deadletters",
+	Short: "inspects and replays messages that could not be delivered",
+	Long: `Inspects and replays messages that could not be delivered, as recorded
+	by the file dead letter sink.`,
+}
+
+// listDeadLettersCmd prints every dead letter as a JSON line
+var listDeadLettersCmd = &cobra.Command{
+	Use:   "list",
+	Short: "lists dead letters",
+	Long:  `Prints every dead letter as a JSON line, oldest first.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := deadLettersLogger()
+		recorder := getDeadLetters(logger)
+
+		letters, err := recorder.List()
+		if err != nil {
+			logger.WithError(err).Fatal("Could not list dead letters.")
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		for _, letter := range letters {
+			encoder.Encode(letter)
+		}
+	},
+}
+
+// replayDeadLettersCmd publishes dead letters again
+var replayDeadLettersCmd = &cobra.Command{
+	Use:   "replay [ids...]",
+	Short: "replays dead letters",
+	Long: `Publishes the dead letters with the given ids, or every one with --all,
+	again. Letters that are published are removed.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		logger := deadLettersLogger()
+		if len(args) == 0 && !replayAll {
+			logger.Fatal("Give the ids of the dead letters to replay, or --all to replay every one.")
+		}
+
+		// letters are published the same way the API publishes messages,
+		// so the ones of encrypted or signed topics are encrypted and signed
+		app, err := api.GetApp("", 0, ConfigFile, false, logger)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not get arkadiko application.")
+		}
+		defer app.Close()
+		if app.DeadLetters == nil {
+			logger.Fatal("Dead letters are not enabled.")
+		}
+
+		result, err := app.DeadLetters.Replay(context.Background(), app.PublishMessage, args...)
+		if err != nil {
+			logger.WithError(err).Fatal("Could not replay dead letters.")
+		}
+
+		fmt.Printf("replayed %d dead letters\n", len(result.Replayed))
+		for id, reason := range result.Failed {
+			fmt.Printf("failed to replay %s: %s\n", id, reason)
+		}
+	},
+}
+
+func deadLettersLogger() log.FieldLogger {
+	log.SetLevel(log.WarnLevel)
+	if Verbose >= 2 {
+		log.SetLevel(log.InfoLevel)
+	}
+	log.SetOutput(os.Stderr)
+	return log.WithField("source", "deadletters")
+}
+
+func getDeadLetters(logger log.FieldLogger) *deadletter.Recorder {
+	config := viper.New()
+	config.SetConfigFile(ConfigFile)
+	config.SetEnvPrefix("arkadiko")
+	config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	config.AutomaticEnv()
+	if err := config.ReadInConfig(); err != nil {
+		logger.WithError(err).Fatal("Could not load configuration file.")
+	}
+
+	recorder, err := deadletter.NewRecorder(config, nil, logger)
+	if err != nil {
+		logger.WithError(err).Fatal("Could not open dead letters.")
+	}
+	if recorder == nil {
+		logger.Fatal("Dead letters are not enabled.")
+	}
+	return recorder
+}
+
+func init() {
+	RootCmd.AddCommand(deadLettersCmd)
+	deadLettersCmd.AddCommand(listDeadLettersCmd)
+	deadLettersCmd.AddCommand(replayDeadLettersCmd)
+
+	replayDeadLettersCmd.Flags().BoolVar(&replayAll, "all", false, "Replay every dead letter")
+}
@@ -61,17 +61,27 @@ var startCmd = &cobra.Command{
 			logger.WithError(err).Fatal("Could not get arkadiko application.")
 		}
 		logger = log.WithField("source", "rpc")
+		var rpcServer *remote.Server
 		if rpc {
-			rpcServer, err := remote.NewServer(
+			rpcServer, err = remote.NewServerWithComponents(
 				rpcHost,
 				rpcPort,
 				ConfigFile,
 				debug,
 				logger,
+				remote.Components{
+					Brokers:     app.Brokers,
+					Scheduler:   app.Scheduler,
+					Async:       app.Async,
+					DeadLetters: app.DeadLetters,
+				},
 			)
 			if err != nil {
 				logger.WithError(err).Fatal("Could not get arkadiko RPC server.")
 			}
+			// in-flight calls may still use the shared components, so the
+			// server stops before the app stops them
+			app.RegisterOnShutdown(rpcServer.Close)
 
 			go func(rpcs *remote.Server) {
 				err := rpcs.Start()
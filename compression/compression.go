@@ -0,0 +1,138 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+// Package compression compresses payloads published to the broker and
+// decompresses request bodies.
+//
+// Compressed payloads are wrapped in an envelope made of a one line header
+// naming the encoding, followed by the compressed bytes:
+//
+//	arkadiko-encoding/1 <encoding>\n<data>
+//
+// The encoding travels in the payload because MQTT 3.1.1, which the brokers
+// are connected with, has no user properties, and the JSON envelope is only
+// used for the topics configured to have one, while any payload, raw bytes
+// included, may be compressed. Consumers can use Decode to get the original
+// payload back.
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Prefix starts the header of every compressed payload
+const Prefix = "arkadiko-encoding/1 "
+
+const (
+	// Gzip is the gzip encoding
+	Gzip = "gzip"
+	// Zstd is the zstandard encoding
+	Zstd = "zstd"
+	// Identity means no encoding
+	Identity = "identity"
+)
+
+var (
+	// ErrUnsupportedEncoding is returned for encodings other than gzip and
+	// zstd
+	ErrUnsupportedEncoding = errors.New("unsupported encoding")
+	// ErrTooLarge is returned for payloads that decompress to more bytes
+	// than allowed
+	ErrTooLarge = errors.New("decompressed payload is too large")
+)
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+
+// Compress compresses data with encoding
+func Compress(encoding string, data []byte) ([]byte, error) {
+	switch encoding {
+	case Gzip:
+		var b bytes.Buffer
+		w := gzip.NewWriter(&b)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case Zstd:
+		return zstdEncoder.EncodeAll(data, nil), nil
+	}
+	return nil, ErrUnsupportedEncoding
+}
+
+// Decompress decompresses data compressed with encoding, failing with
+// ErrTooLarge once it gets larger than maxSize bytes, so small payloads can't
+// expand to any size
+func Decompress(encoding string, data []byte, maxSize int) ([]byte, error) {
+	r, err := NewReader(encoding, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	decompressed, err := io.ReadAll(io.LimitReader(r, int64(maxSize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(decompressed) > maxSize {
+		return nil, ErrTooLarge
+	}
+	return decompressed, nil
+}
+
+// NewReader returns a reader decompressing r, encoded with encoding
+func NewReader(encoding string, r io.Reader) (io.ReadCloser, error) {
+	switch encoding {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	}
+	return nil, ErrUnsupportedEncoding
+}
+
+// Wrap compresses data with encoding and wraps it in an envelope
+func Wrap(encoding string, data []byte) ([]byte, error) {
+	compressed, err := Compress(encoding, data)
+	if err != nil {
+		return nil, err
+	}
+
+	header := fmt.Sprintf("%s%s\n", Prefix, encoding)
+	message := make([]byte, 0, len(header)+len(compressed))
+	message = append(message, header...)
+	return append(message, compressed...), nil
+}
+
+// Decode returns the original payload of a compressed message, or message
+// itself if it was not compressed. Payloads decompressing to more than
+// maxSize bytes fail with ErrTooLarge
+func Decode(message []byte, maxSize int) ([]byte, error) {
+	if !bytes.HasPrefix(message, []byte(Prefix)) {
+		return message, nil
+	}
+
+	end := bytes.IndexByte(message, '\n')
+	if end < 0 {
+		return nil, fmt.Errorf("invalid compressed message header")
+	}
+	encoding := string(message[len(Prefix):end])
+
+	return Decompress(encoding, message[end+1:], maxSize)
+}
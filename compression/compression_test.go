@@ -0,0 +1,145 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package compression_test
+
+import (
+	"bytes"
+	"io"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/compression"
+)
+
+var _ = Describe("Compression", func() {
+	l, _ := test.NewNullLogger()
+	payload := strings.Repeat(`{"player": "someone", "score": 100}`, 100)
+
+	Describe("Codecs", func() {
+		for _, encoding := range []string{compression.Gzip, compression.Zstd} {
+			encoding := encoding
+
+			It("Should compress and decompress with "+encoding, func() {
+				compressed, err := compression.Compress(encoding, []byte(payload))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(compressed)).To(BeNumerically("<", len(payload)))
+
+				decompressed, err := compression.Decompress(encoding, compressed, len(payload))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(decompressed)).To(Equal(payload))
+
+				r, err := compression.NewReader(encoding, bytes.NewReader(compressed))
+				Expect(err).NotTo(HaveOccurred())
+				defer r.Close()
+				streamed, err := io.ReadAll(r)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(streamed)).To(Equal(payload))
+			})
+		}
+
+		It("Should refuse payloads decompressing to more than allowed", func() {
+			bomb, err := compression.Wrap(compression.Gzip, make([]byte, 10*1024*1024))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(bomb)).To(BeNumerically("<", 64*1024))
+
+			_, err = compression.Decode(bomb, 1024*1024)
+			Expect(err).To(Equal(compression.ErrTooLarge))
+
+			c, err := compression.NewCompressor(viper.New(), l)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = c.Decode(bomb)
+			Expect(err).To(Equal(compression.ErrTooLarge))
+		})
+
+		It("Should fail for unsupported encodings", func() {
+			_, err := compression.Compress("br", []byte(payload))
+			Expect(err).To(Equal(compression.ErrUnsupportedEncoding))
+			_, err = compression.NewReader("br", strings.NewReader(payload))
+			Expect(err).To(Equal(compression.ErrUnsupportedEncoding))
+		})
+	})
+
+	Describe("Envelope", func() {
+		It("Should decode wrapped payloads", func() {
+			wrapped, err := compression.Wrap(compression.Zstd, []byte(payload))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(wrapped)).To(HavePrefix("arkadiko-encoding/1 zstd\n"))
+
+			decoded, err := compression.Decode(wrapped, len(payload))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(decoded)).To(Equal(payload))
+		})
+
+		It("Should return payloads that are not compressed as they are", func() {
+			decoded, err := compression.Decode([]byte(`{"message": "hello"}`), 1)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(decoded)).To(Equal(`{"message": "hello"}`))
+		})
+	})
+
+	Describe("Compressor", func() {
+		var config *viper.Viper
+
+		newCompressor := func() *compression.Compressor {
+			c, err := compression.NewCompressor(config, l)
+			Expect(err).NotTo(HaveOccurred())
+			return c
+		}
+
+		BeforeEach(func() {
+			config = viper.New()
+			config.Set("compression.minSize", 100)
+			config.Set("compression.topics", []map[string]interface{}{
+				{"pattern": "leaderboards/#", "encoding": "gzip"},
+				{"pattern": "inventory/+", "encoding": "zstd", "minSize": 10000},
+				{"pattern": "raw/#", "encoding": "identity"},
+			})
+		})
+
+		It("Should compress payloads of matching topics", func() {
+			c := newCompressor()
+
+			encoded := c.Encode("leaderboards/global", payload)
+			Expect(encoded).To(HavePrefix("arkadiko-encoding/1 gzip\n"))
+			Expect(c.EncodedSize("leaderboards/global", payload)).To(Equal(len(encoded)))
+
+			decoded, err := c.Decode([]byte(encoded))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(decoded)).To(Equal(payload))
+		})
+
+		It("Should skip payloads smaller than the minimum size", func() {
+			c := newCompressor()
+			Expect(c.Encode("leaderboards/global", "small")).To(Equal("small"))
+			Expect(c.Encode("inventory/player", payload)).To(Equal(payload))
+		})
+
+		It("Should skip payloads that would not get smaller", func() {
+			c := newCompressor()
+			random := "q8Z!x2@Lm#9vR$w7^Tp&3*Ks(6)Jd_1+Hf=4-Yb[0]Nc{5}Ga;8:Ue'2,Ix.7/Oz<9>Wr?1|Ql~3`Mv"
+			Expect(c.Encode("leaderboards/global", random+random[:30])).To(Equal(random + random[:30]))
+		})
+
+		It("Should not compress other topics", func() {
+			c := newCompressor()
+			Expect(c.Encode("raw/topic", payload)).To(Equal(payload))
+			Expect(c.Encode("other/topic", payload)).To(Equal(payload))
+		})
+
+		It("Should fail for unsupported encodings", func() {
+			config.Set("compression.topics", []map[string]interface{}{
+				{"pattern": "#", "encoding": "br"},
+			})
+			_, err := compression.NewCompressor(config, l)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
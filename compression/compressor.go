@@ -0,0 +1,184 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package compression
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/topic"
+)
+
+type ruleConfig struct {
+	Pattern  string `mapstructure:"pattern"`
+	Encoding string `mapstructure:"encoding"`
+	MinSize  *int   `mapstructure:"minSize"`
+}
+
+type rule struct {
+	pattern  string
+	encoding string
+	minSize  int
+}
+
+var (
+	metricsOnce     sync.Once
+	ratioHistogram  *metrics.HistogramVec
+	messagesCounter *metrics.CounterVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		ratioHistogram = metrics.NewHistogramVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "compression_ratio",
+			Help:      "Compressed size over original size of compressed payloads and request bodies",
+			Buckets:   []float64{0.05, 0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1},
+		}, []string{"direction", "encoding"})
+		messagesCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "compressed_messages",
+			Help:      "Payloads of topics with compression by whether they were compressed",
+		}, []string{"encoding", "status"})
+	})
+}
+
+// ObserveRatio records the compression ratio of a request body
+func ObserveRatio(encoding string, compressed, original int) {
+	initMetrics()
+	if original > 0 {
+		ratioHistogram.WithLabelValues("ingress", encoding).Observe(float64(compressed) / float64(original))
+	}
+}
+
+// Compressor compresses the payloads of the topics matching its rules
+type Compressor struct {
+	MinSize int
+	// MaxDecodedSize is the largest payload Decode decompresses
+	MaxDecodedSize int
+	Logger         log.FieldLogger
+	rules          []*rule
+}
+
+// NewCompressor returns a Compressor with the rules configured under the
+// compression key
+func NewCompressor(config *viper.Viper, logger log.FieldLogger) (*Compressor, error) {
+	config.SetDefault("compression.minSize", 1024)
+	config.SetDefault("compression.maxDecodedSize", 2*1024*1024)
+
+	initMetrics()
+
+	c := &Compressor{
+		MinSize:        config.GetInt("compression.minSize"),
+		MaxDecodedSize: config.GetInt("compression.maxDecodedSize"),
+		Logger:         logger.WithField("source", "Compressor"),
+	}
+	if c.MaxDecodedSize <= 0 {
+		return nil, fmt.Errorf("compression.maxDecodedSize must be positive")
+	}
+
+	var rules []ruleConfig
+	err := config.UnmarshalKey("compression.topics", &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid compression.topics configuration: %w", err)
+	}
+
+	for _, rc := range rules {
+		if rc.Pattern == "" {
+			return nil, fmt.Errorf("compression rules need a pattern")
+		}
+		if rc.Encoding != Gzip && rc.Encoding != Zstd && rc.Encoding != Identity {
+			return nil, fmt.Errorf("unsupported encoding %s for %s", rc.Encoding, rc.Pattern)
+		}
+
+		minSize := c.MinSize
+		if rc.MinSize != nil {
+			minSize = *rc.MinSize
+		}
+
+		c.rules = append(c.rules, &rule{
+			pattern:  rc.Pattern,
+			encoding: rc.Encoding,
+			minSize:  minSize,
+		})
+		c.Logger.WithFields(log.Fields{
+			"pattern":  rc.Pattern,
+			"encoding": rc.Encoding,
+			"minSize":  minSize,
+		}).Info("Loaded compression rule.")
+	}
+
+	return c, nil
+}
+
+// Encode compresses payload with the encoding of the first rule matching t.
+// Payloads smaller than the minimum size of the rule, or that would not get
+// any smaller, are returned as they are
+func (c *Compressor) Encode(t, payload string) string {
+	result, encoding, status := c.encode(t, payload)
+	if encoding == "" {
+		return result
+	}
+
+	messagesCounter.WithLabelValues(encoding, status).Inc()
+	if status == "compressed" || status == "not_smaller" {
+		ratioHistogram.WithLabelValues("egress", encoding).Observe(float64(len(result)) / float64(len(payload)))
+	}
+	if status != "compressed" {
+		return payload
+	}
+	return result
+}
+
+// EncodedSize returns how large payload will be once published to t
+func (c *Compressor) EncodedSize(t, payload string) int {
+	result, _, status := c.encode(t, payload)
+	if status != "compressed" {
+		return len(payload)
+	}
+	return len(result)
+}
+
+// Decode returns the original payload of a compressed message, or message
+// itself if it was not compressed, refusing payloads that decompress to more
+// than MaxDecodedSize bytes
+func (c *Compressor) Decode(message []byte) ([]byte, error) {
+	return Decode(message, c.MaxDecodedSize)
+}
+
+// encode returns the compressed payload, the encoding used and what
+// happened, or an empty encoding if payloads of t are not compressed
+func (c *Compressor) encode(t, payload string) (string, string, string) {
+	for _, rl := range c.rules {
+		if !topic.Match(rl.pattern, t) {
+			continue
+		}
+		if rl.encoding == Identity {
+			return payload, "", ""
+		}
+		if len(payload) < rl.minSize {
+			return payload, rl.encoding, "too_small"
+		}
+
+		wrapped, err := Wrap(rl.encoding, []byte(payload))
+		if err != nil {
+			c.Logger.WithError(err).WithField("topic", t).Error("Failed to compress payload.")
+			return payload, rl.encoding, "failed"
+		}
+		if len(wrapped) >= len(payload) {
+			return string(wrapped), rl.encoding, "not_smaller"
+		}
+		return string(wrapped), rl.encoding, "compressed"
+	}
+
+	return payload, "", ""
+}
@@ -0,0 +1,231 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package deadletter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/metrics"
+)
+
+// ErrNotInspectable is returned when reading letters back from a sink that
+// only writes them, like the mqtt one
+var ErrNotInspectable = errors.New("dead letters can not be inspected with this sink")
+
+// PublishFunc publishes a message to topic on the named broker
+type PublishFunc func(ctx context.Context, broker, topic, payload string, retained bool) error
+
+// Letter is a message that could not be delivered
+type Letter struct {
+	ID        string    `json:"id"`
+	Broker    string    `json:"broker"`
+	Topic     string    `json:"topic"`
+	Payload   string    `json:"payload"`
+	Retained  bool      `json:"retained"`
+	Error     string    `json:"error"`
+	Attempts  int       `json:"attempts"`
+	Requestor string    `json:"requestor,omitempty"`
+	FailedAt  time.Time `json:"failedAt"`
+}
+
+// Sink keeps dead letters somewhere they can be looked at later
+type Sink interface {
+	Write(letter *Letter) error
+	Close() error
+}
+
+// Store is a Sink whose letters can be read back and removed
+type Store interface {
+	Sink
+	List() ([]*Letter, error)
+	Remove(ids ...string) error
+}
+
+// Attempts returns how many times publishing was tried before failing with
+// err, or zero for errors that don't tell it, like the one returned while
+// the circuit breaker of a broker is open
+func Attempts(err error) int {
+	var attempted interface{ Attempts() int }
+	if errors.As(err, &attempted) {
+		return attempted.Attempts()
+	}
+	return 0
+}
+
+// ReplayResult tells which letters were published again and why the others
+// failed
+type ReplayResult struct {
+	Replayed []string          `json:"replayed"`
+	Failed   map[string]string `json:"failed"`
+}
+
+var (
+	metricsOnce    sync.Once
+	lettersCounter *metrics.CounterVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		lettersCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "dead_letters",
+			Help:      "Dead letters by what happened to them",
+		}, []string{"status"})
+	})
+}
+
+// Recorder records messages that could not be delivered to a Sink
+type Recorder struct {
+	Sink   Sink
+	Logger log.FieldLogger
+}
+
+// NewRecorder returns a Recorder writing to the sink configured under the
+// deadletter key, or nil if dead letters are disabled. publish is used by
+// the mqtt sink
+func NewRecorder(config *viper.Viper, publish PublishFunc, logger log.FieldLogger) (*Recorder, error) {
+	config.SetDefault("deadletter.sink", "none")
+
+	initMetrics()
+
+	var sink Sink
+	var err error
+	switch kind := config.GetString("deadletter.sink"); kind {
+	case "", "none":
+		return nil, nil
+	case "file":
+		sink, err = NewFileSink(config)
+	case "mqtt":
+		sink = NewMqttSink(config, publish)
+	default:
+		err = fmt.Errorf("unknown dead letter sink %s", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{
+		Sink:   sink,
+		Logger: logger.WithField("source", "DeadLetters"),
+	}, nil
+}
+
+// Record writes a message that could not be delivered to the sink. It is
+// safe to call on a nil Recorder, so callers don't have to check whether
+// dead letters are enabled
+func (r *Recorder) Record(letter *Letter) {
+	if r == nil {
+		return
+	}
+
+	if letter.ID == "" {
+		letter.ID = uuid.NewV4().String()
+	}
+	if letter.FailedAt.IsZero() {
+		letter.FailedAt = time.Now().UTC()
+	}
+
+	l := r.Logger.WithFields(log.Fields{
+		"operation":    "Record",
+		"deadLetterId": letter.ID,
+		"broker":       letter.Broker,
+		"topic":        letter.Topic,
+		"attempts":     letter.Attempts,
+		"requestor":    letter.Requestor,
+	})
+
+	err := r.Sink.Write(letter)
+	if err != nil {
+		l.WithError(err).WithField("payload", letter.Payload).Error("Failed to record dead letter.")
+		lettersCounter.WithLabelValues("lost").Inc()
+		return
+	}
+
+	l.Info("Recorded dead letter.")
+	lettersCounter.WithLabelValues("recorded").Inc()
+}
+
+// List returns the recorded letters, oldest first
+func (r *Recorder) List() ([]*Letter, error) {
+	store, ok := r.Sink.(Store)
+	if !ok {
+		return nil, ErrNotInspectable
+	}
+	return store.List()
+}
+
+// Remove discards recorded letters
+func (r *Recorder) Remove(ids ...string) error {
+	store, ok := r.Sink.(Store)
+	if !ok {
+		return ErrNotInspectable
+	}
+	return store.Remove(ids...)
+}
+
+// Replay publishes the letters with the given ids, or every letter if none
+// is given, again. Letters that are published are removed, the others are
+// kept to be replayed later
+func (r *Recorder) Replay(ctx context.Context, publish PublishFunc, ids ...string) (*ReplayResult, error) {
+	store, ok := r.Sink.(Store)
+	if !ok {
+		return nil, ErrNotInspectable
+	}
+
+	letters, err := store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	wanted := map[string]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	result := &ReplayResult{Replayed: []string{}, Failed: map[string]string{}}
+	for _, letter := range letters {
+		if len(wanted) > 0 && !wanted[letter.ID] {
+			continue
+		}
+
+		err := publish(ctx, letter.Broker, letter.Topic, letter.Payload, letter.Retained)
+		if err != nil {
+			r.Logger.WithError(err).WithFields(log.Fields{
+				"operation":    "Replay",
+				"deadLetterId": letter.ID,
+				"topic":        letter.Topic,
+			}).Warn("Failed to replay dead letter.")
+			result.Failed[letter.ID] = err.Error()
+			continue
+		}
+		result.Replayed = append(result.Replayed, letter.ID)
+		lettersCounter.WithLabelValues("replayed").Inc()
+	}
+
+	if len(result.Replayed) > 0 {
+		err = store.Remove(result.Replayed...)
+		if err != nil {
+			return result, err
+		}
+	}
+
+	return result, nil
+}
+
+// Close closes the sink
+func (r *Recorder) Close() error {
+	return r.Sink.Close()
+}
@@ -0,0 +1,216 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package deadletter_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/deadletter"
+)
+
+type attemptedError struct {
+	attempts int
+}
+
+func (e *attemptedError) Error() string {
+	return "timed out"
+}
+
+func (e *attemptedError) Attempts() int {
+	return e.attempts
+}
+
+var _ = Describe("Dead Letters", func() {
+	l, _ := test.NewNullLogger()
+
+	var dir string
+	var config *viper.Viper
+
+	newRecorder := func(publish deadletter.PublishFunc) *deadletter.Recorder {
+		r, err := deadletter.NewRecorder(config, publish, l)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(r).NotTo(BeNil())
+		return r
+	}
+
+	topics := func(letters []*deadletter.Letter) []string {
+		result := []string{}
+		for _, letter := range letters {
+			result = append(result, letter.Topic)
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "arkadiko-deadletter")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = viper.New()
+		config.Set("deadletter.sink", "file")
+		config.Set("deadletter.file.path", filepath.Join(dir, "deadletters.jsonl"))
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("Recorder", func() {
+		It("Should not be created if dead letters are disabled", func() {
+			config.Set("deadletter.sink", "none")
+			r, err := deadletter.NewRecorder(config, nil, l)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r).To(BeNil())
+
+			// dead letters are disabled by default
+			r, err = deadletter.NewRecorder(viper.New(), nil, l)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(r).To(BeNil())
+
+			// recording on a disabled recorder does nothing
+			r.Record(&deadletter.Letter{Topic: "topic"})
+		})
+
+		It("Should fail for unknown sinks", func() {
+			config.Set("deadletter.sink", "kafka")
+			_, err := deadletter.NewRecorder(config, nil, l)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should record letters with an id and when they failed", func() {
+			r := newRecorder(nil)
+			defer r.Close()
+
+			r.Record(&deadletter.Letter{
+				Broker:    "default",
+				Topic:     "topic",
+				Payload:   `{"a": 1}`,
+				Error:     "timed out",
+				Attempts:  3,
+				Requestor: "tests",
+			})
+
+			letters, err := r.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(letters).To(HaveLen(1))
+			Expect(letters[0].ID).NotTo(BeEmpty())
+			Expect(letters[0].FailedAt.IsZero()).To(BeFalse())
+			Expect(letters[0].Payload).To(Equal(`{"a": 1}`))
+			Expect(letters[0].Attempts).To(Equal(3))
+			Expect(letters[0].Requestor).To(Equal("tests"))
+		})
+
+		It("Should replay letters and keep the ones that fail again", func() {
+			var published []string
+			publish := func(ctx context.Context, broker, topic, payload string, retained bool) error {
+				if topic == "fail" {
+					return errors.New("broker unavailable")
+				}
+				published = append(published, topic)
+				return nil
+			}
+			r := newRecorder(nil)
+			defer r.Close()
+			for _, topic := range []string{"first", "fail", "second", "third"} {
+				r.Record(&deadletter.Letter{Topic: topic})
+			}
+			letters, err := r.List()
+			Expect(err).NotTo(HaveOccurred())
+
+			result, err := r.Replay(context.Background(), publish, letters[0].ID, letters[1].ID, letters[3].ID)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Replayed).To(ConsistOf(letters[0].ID, letters[3].ID))
+			Expect(result.Failed).To(HaveKeyWithValue(letters[1].ID, "broker unavailable"))
+			Expect(published).To(Equal([]string{"first", "third"}))
+
+			left, err := r.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(topics(left)).To(Equal([]string{"fail", "second"}))
+
+			result, err = r.Replay(context.Background(), publish)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Replayed).To(ConsistOf(letters[2].ID))
+		})
+
+		It("Should tell how many times failed messages were tried", func() {
+			Expect(deadletter.Attempts(fmt.Errorf("publishing: %w", &attemptedError{3}))).To(Equal(3))
+			Expect(deadletter.Attempts(errors.New("broker is unavailable"))).To(Equal(0))
+		})
+	})
+
+	Describe("File Sink", func() {
+		It("Should rotate files once they grow past the max size", func() {
+			config.Set("deadletter.file.maxSize", 200)
+			config.Set("deadletter.file.maxFiles", 3)
+			r := newRecorder(nil)
+			defer r.Close()
+
+			for i := 0; i < 10; i++ {
+				r.Record(&deadletter.Letter{Topic: fmt.Sprintf("topic/%d", i)})
+			}
+
+			files, err := filepath.Glob(filepath.Join(dir, "deadletters.jsonl*"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(files).To(HaveLen(3))
+
+			letters, err := r.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(letters)).To(BeNumerically("<", 10))
+			Expect(letters[len(letters)-1].Topic).To(Equal("topic/9"))
+		})
+
+		It("Should remove letters", func() {
+			r := newRecorder(nil)
+			r.Record(&deadletter.Letter{Topic: "first"})
+			r.Record(&deadletter.Letter{Topic: "second"})
+			letters, err := r.List()
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(r.Remove(letters[0].ID)).To(Succeed())
+			r.Record(&deadletter.Letter{Topic: "third"})
+			Expect(r.Close()).To(Succeed())
+
+			letters, err = newRecorder(nil).List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(topics(letters)).To(Equal([]string{"second", "third"}))
+		})
+	})
+
+	Describe("Mqtt Sink", func() {
+		It("Should publish letters to the dead letter topic", func() {
+			var broker, topic, payload string
+			config.Set("deadletter.sink", "mqtt")
+			config.Set("deadletter.mqtt.broker", "eu")
+			r := newRecorder(func(ctx context.Context, b, t, p string, retained bool) error {
+				broker, topic, payload = b, t, p
+				return nil
+			})
+
+			r.Record(&deadletter.Letter{Topic: "topic", Payload: "payload"})
+
+			Expect(broker).To(Equal("eu"))
+			Expect(topic).To(Equal("arkadiko/deadletters"))
+			letter := &deadletter.Letter{}
+			Expect(json.Unmarshal([]byte(payload), letter)).To(Succeed())
+			Expect(letter.Topic).To(Equal("topic"))
+			Expect(letter.Payload).To(Equal("payload"))
+
+			_, err := r.List()
+			Expect(err).To(Equal(deadletter.ErrNotInspectable))
+		})
+	})
+})
@@ -0,0 +1,243 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package deadletter
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// FileSink appends letters as JSON lines to a local file, rotating it once
+// it grows past MaxSize bytes and keeping at most MaxFiles files
+type FileSink struct {
+	Path     string
+	MaxSize  int64
+	MaxFiles int
+	file     *os.File
+	size     int64
+	lock     sync.Mutex
+}
+
+// NewFileSink returns a FileSink configured under the deadletter.file key
+func NewFileSink(config *viper.Viper) (*FileSink, error) {
+	config.SetDefault("deadletter.file.path", "./data/deadletters.jsonl")
+	config.SetDefault("deadletter.file.maxSize", 10*1024*1024)
+	config.SetDefault("deadletter.file.maxFiles", 5)
+
+	s := &FileSink{
+		Path:     config.GetString("deadletter.file.path"),
+		MaxSize:  config.GetInt64("deadletter.file.maxSize"),
+		MaxFiles: config.GetInt("deadletter.file.maxFiles"),
+	}
+	if s.MaxFiles < 1 {
+		s.MaxFiles = 1
+	}
+
+	err := os.MkdirAll(filepath.Dir(s.Path), 0755)
+	if err != nil {
+		return nil, fmt.Errorf("could not create directory for dead letters: %w", err)
+	}
+
+	return s, nil
+}
+
+// files returns the paths of the rotated files followed by the current one,
+// oldest first
+func (s *FileSink) files() []string {
+	files := []string{}
+	for i := s.MaxFiles - 1; i > 0; i-- {
+		files = append(files, fmt.Sprintf("%s.%d", s.Path, i))
+	}
+	return append(files, s.Path)
+}
+
+// open must be called holding the lock
+func (s *FileSink) open() error {
+	if s.file != nil {
+		return nil
+	}
+
+	f, err := os.OpenFile(s.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("could not open %s: %w", s.Path, err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.file = f
+	s.size = info.Size()
+	return nil
+}
+
+// closeFile must be called holding the lock
+func (s *FileSink) closeFile() error {
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// rotate must be called holding the lock
+func (s *FileSink) rotate() error {
+	err := s.closeFile()
+	if err != nil {
+		return err
+	}
+
+	files := s.files()
+	os.Remove(files[0])
+	for i := 1; i < len(files); i++ {
+		err := os.Rename(files[i], files[i-1])
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write appends letter to the current file
+func (s *FileSink) Write(letter *Letter) error {
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err = s.open()
+	if err != nil {
+		return err
+	}
+	if s.size > 0 && s.size+int64(len(b)) > s.MaxSize {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+		err = s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(b)
+	s.size += int64(n)
+	return err
+}
+
+// List returns every letter kept in the files, oldest first
+func (s *FileSink) List() ([]*Letter, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	letters := []*Letter{}
+	for _, path := range s.files() {
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(b))
+		scanner.Buffer(make([]byte, 64*1024), len(b)+1)
+		for scanner.Scan() {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			letter := &Letter{}
+			err := json.Unmarshal(scanner.Bytes(), letter)
+			if err != nil {
+				return nil, fmt.Errorf("could not parse dead letter from %s: %w", path, err)
+			}
+			letters = append(letters, letter)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return letters, nil
+}
+
+// Remove rewrites the files without the letters with the given ids
+func (s *FileSink) Remove(ids ...string) error {
+	remove := map[string]bool{}
+	for _, id := range ids {
+		remove[id] = true
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	err := s.closeFile()
+	if err != nil {
+		return err
+	}
+
+	for _, path := range s.files() {
+		b, err := os.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		kept := bytes.Buffer{}
+		changed := false
+		for _, line := range bytes.Split(b, []byte("\n")) {
+			if len(bytes.TrimSpace(line)) == 0 {
+				continue
+			}
+			letter := &Letter{}
+			if json.Unmarshal(line, letter) == nil && remove[letter.ID] {
+				changed = true
+				continue
+			}
+			kept.Write(line)
+			kept.WriteByte('\n')
+		}
+		if !changed {
+			continue
+		}
+
+		tmp := path + ".tmp"
+		err = os.WriteFile(tmp, kept.Bytes(), 0600)
+		if err != nil {
+			return err
+		}
+		err = os.Rename(tmp, path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes the current file
+func (s *FileSink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closeFile()
+}
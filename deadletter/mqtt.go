@@ -0,0 +1,49 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package deadletter
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/spf13/viper"
+)
+
+// MqttSink publishes letters as JSON to a dead letter topic, so they can be
+// consumed by anything subscribed to it
+type MqttSink struct {
+	Broker  string
+	Topic   string
+	publish PublishFunc
+}
+
+// NewMqttSink returns a MqttSink configured under the deadletter.mqtt key
+func NewMqttSink(config *viper.Viper, publish PublishFunc) *MqttSink {
+	config.SetDefault("deadletter.mqtt.broker", "default")
+	config.SetDefault("deadletter.mqtt.topic", "arkadiko/deadletters")
+
+	return &MqttSink{
+		Broker:  config.GetString("deadletter.mqtt.broker"),
+		Topic:   config.GetString("deadletter.mqtt.topic"),
+		publish: publish,
+	}
+}
+
+// Write publishes letter to the dead letter topic
+func (s *MqttSink) Write(letter *Letter) error {
+	b, err := json.Marshal(letter)
+	if err != nil {
+		return err
+	}
+	return s.publish(context.Background(), s.Broker, s.Topic, string(b), false)
+}
+
+// Close does nothing, the broker connection is owned by the caller
+func (s *MqttSink) Close() error {
+	return nil
+}
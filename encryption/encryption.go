@@ -0,0 +1,109 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+// Package encryption encrypts payloads so they can not be read by the
+// broker, and decrypts them on the consumer side.
+//
+// Payloads are encrypted with AES-GCM, using the topic as additional data
+// so they can not be replayed to other topics, and wrapped in an envelope
+// made of a one line header naming the key followed by the nonce and the
+// ciphertext:
+//
+//	arkadiko-encryption/1 <key id>\n<nonce><ciphertext>
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Prefix starts the header of every encrypted payload
+const Prefix = "arkadiko-encryption/1 "
+
+// SealedPrefix starts every payload sealed to be kept until it is published
+const SealedPrefix = "arkadiko-sealed/1 "
+
+// ErrInvalidMessage is returned when decrypting a malformed message
+var ErrInvalidMessage = errors.New("invalid encrypted message")
+
+// ErrNotEncrypted is returned when decrypting a message that was not
+// encrypted, so plain text published straight to the broker is never taken
+// for a payload of an encrypted topic
+var ErrNotEncrypted = errors.New("message is not encrypted")
+
+func newGCM(key *Key) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key.secret)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt encrypts payload for topic with the active key of keyring
+func Encrypt(keyring *Keyring, topic string, payload []byte) ([]byte, error) {
+	key, err := keyring.Active(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := fmt.Sprintf("%s%s\n", Prefix, key.ID)
+	message := make([]byte, len(header)+gcm.NonceSize(), len(header)+gcm.NonceSize()+len(payload)+gcm.Overhead())
+	copy(message, header)
+	nonce := message[len(header):]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(message, nonce, payload, []byte(topic)), nil
+}
+
+// IsEncrypted returns whether message is an encrypted payload
+func IsEncrypted(message []byte) bool {
+	return bytes.HasPrefix(message, []byte(Prefix))
+}
+
+// Decrypt returns the payload of a message encrypted for topic. Messages
+// that were not encrypted fail with ErrNotEncrypted
+func Decrypt(keyring *Keyring, topic string, message []byte) ([]byte, error) {
+	if !IsEncrypted(message) {
+		return nil, ErrNotEncrypted
+	}
+
+	end := bytes.IndexByte(message, '\n')
+	if end < 0 {
+		return nil, ErrInvalidMessage
+	}
+	key, err := keyring.Key(string(message[len(Prefix):end]))
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data := message[end+1:]
+	if len(data) < gcm.NonceSize()+gcm.Overhead() {
+		return nil, ErrInvalidMessage
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	payload, err := gcm.Open(nil, nonce, ciphertext, []byte(topic))
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt message: %w", err)
+	}
+	return payload, nil
+}
@@ -0,0 +1,318 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package encryption_test
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+	"unicode/utf8"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/encryption"
+)
+
+type message struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *message) Topic() string {
+	return m.topic
+}
+
+func (m *message) Payload() []byte {
+	return m.payload
+}
+
+func newKey(id string, notBefore, notAfter time.Time) *encryption.Key {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	Expect(err).NotTo(HaveOccurred())
+	return &encryption.Key{
+		ID:        id,
+		Key:       base64.StdEncoding.EncodeToString(secret),
+		NotBefore: notBefore,
+		NotAfter:  notAfter,
+	}
+}
+
+var _ = Describe("Encryption", func() {
+	l, _ := test.NewNullLogger()
+	now := time.Now()
+
+	var dir string
+
+	writeKeyring := func(keys ...*encryption.Key) string {
+		b, err := json.Marshal(map[string]interface{}{"keys": keys})
+		Expect(err).NotTo(HaveOccurred())
+		path := filepath.Join(dir, "keyring.json")
+		Expect(os.WriteFile(path, b, 0600)).To(Succeed())
+		return path
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "arkadiko-encryption")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("Keyring", func() {
+		It("Should encrypt with the key that became valid last", func() {
+			keyring, err := encryption.NewKeyring(
+				newKey("old", now.Add(-48*time.Hour), now.Add(time.Hour)),
+				newKey("current", now.Add(-time.Hour), time.Time{}),
+				newKey("next", now.Add(time.Hour), time.Time{}),
+			)
+			Expect(err).NotTo(HaveOccurred())
+
+			key, err := keyring.Active(now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key.ID).To(Equal("current"))
+
+			key, err = keyring.Active(now.Add(2 * time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key.ID).To(Equal("next"))
+		})
+
+		It("Should fail when no key is valid", func() {
+			keyring, err := encryption.NewKeyring(newKey("expired", time.Time{}, now.Add(-time.Hour)))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = keyring.Active(now)
+			Expect(err).To(Equal(encryption.ErrNoActiveKey))
+		})
+
+		It("Should fail for invalid keys", func() {
+			_, err := encryption.NewKeyring(&encryption.Key{ID: "short", Key: base64.StdEncoding.EncodeToString([]byte("short"))})
+			Expect(err).To(HaveOccurred())
+
+			_, err = encryption.NewKeyring(newKey("with space", time.Time{}, time.Time{}))
+			Expect(err).To(HaveOccurred())
+
+			_, err = encryption.NewKeyring(newKey("twice", time.Time{}, time.Time{}), newKey("twice", time.Time{}, time.Time{}))
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should reload the keyring file when it changes", func() {
+			path := writeKeyring(newKey("first", time.Time{}, time.Time{}))
+			keyring, err := encryption.LoadKeyring(path, 0, l)
+			Expect(err).NotTo(HaveOccurred())
+
+			next := newKey("second", now.Add(-time.Minute), time.Time{})
+			writeKeyring(newKey("first", time.Time{}, time.Time{}), next)
+			Expect(os.Chtimes(path, now.Add(time.Second), now.Add(time.Second))).To(Succeed())
+
+			key, err := keyring.Active(now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key.ID).To(Equal("second"))
+		})
+
+		It("Should keep the keys loaded before if the file becomes invalid", func() {
+			path := writeKeyring(newKey("first", time.Time{}, time.Time{}))
+			keyring, err := encryption.LoadKeyring(path, 0, l)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(os.WriteFile(path, []byte("{"), 0600)).To(Succeed())
+			Expect(os.Chtimes(path, now.Add(time.Second), now.Add(time.Second))).To(Succeed())
+
+			key, err := keyring.Active(now)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(key.ID).To(Equal("first"))
+		})
+	})
+
+	Describe("Envelope", func() {
+		It("Should decrypt messages encrypted with any key of the keyring", func() {
+			old := newKey("old", now.Add(-48*time.Hour), now.Add(-time.Hour))
+			oldKeyring, err := encryption.NewKeyring(old)
+			Expect(err).NotTo(HaveOccurred())
+
+			// the old keyring can't encrypt anymore, so the message is
+			// encrypted with a keyring from before it expired
+			previous, err := encryption.NewKeyring(&encryption.Key{ID: "old", Key: old.Key})
+			Expect(err).NotTo(HaveOccurred())
+			encrypted, err := encryption.Encrypt(previous, "dm/player", []byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(encrypted)).To(HavePrefix("arkadiko-encryption/1 old\n"))
+			Expect(string(encrypted)).NotTo(ContainSubstring("hello"))
+
+			payload, err := encryption.Decrypt(oldKeyring, "dm/player", encrypted)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(payload)).To(Equal("hello"))
+		})
+
+		It("Should fail to decrypt messages published to other topics", func() {
+			keyring, err := encryption.NewKeyring(newKey("key", time.Time{}, time.Time{}))
+			Expect(err).NotTo(HaveOccurred())
+			encrypted, err := encryption.Encrypt(keyring, "dm/player", []byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = encryption.Decrypt(keyring, "dm/other", encrypted)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should fail to decrypt messages with unknown keys", func() {
+			keyring, err := encryption.NewKeyring(newKey("key", time.Time{}, time.Time{}))
+			Expect(err).NotTo(HaveOccurred())
+			other, err := encryption.NewKeyring(newKey("other", time.Time{}, time.Time{}))
+			Expect(err).NotTo(HaveOccurred())
+			encrypted, err := encryption.Encrypt(keyring, "dm/player", []byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = encryption.Decrypt(other, "dm/player", encrypted)
+			Expect(err).To(Equal(encryption.ErrUnknownKey))
+		})
+
+		It("Should refuse messages that are not encrypted", func() {
+			keyring, err := encryption.NewKeyring()
+			Expect(err).NotTo(HaveOccurred())
+			_, err = encryption.Decrypt(keyring, "dm/player", []byte("hello"))
+			Expect(err).To(Equal(encryption.ErrNotEncrypted))
+		})
+	})
+
+	Describe("Encryptor", func() {
+		var config *viper.Viper
+
+		BeforeEach(func() {
+			config = viper.New()
+			config.Set("encryption.keyring", writeKeyring(newKey("key", time.Time{}, time.Time{})))
+			config.Set("encryption.topics", []map[string]interface{}{
+				{"pattern": "dm/#"},
+			})
+		})
+
+		It("Should encrypt payloads of matching topics", func() {
+			e, err := encryption.NewEncryptor(config, l)
+			Expect(err).NotTo(HaveOccurred())
+
+			encrypted, err := e.Encrypt("dm/player", "hello")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(len(encrypted)).To(BeNumerically("<=", len("hello")+e.Overhead("dm/player")))
+			payload, err := encryption.Decrypt(e.Keyring, "dm/player", []byte(encrypted))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(payload)).To(Equal("hello"))
+
+			Expect(e.Encrypt("chat/room", "hello")).To(Equal("hello"))
+			Expect(e.Overhead("chat/room")).To(Equal(0))
+		})
+
+		It("Should only decrypt payloads of matching topics", func() {
+			e, err := encryption.NewEncryptor(config, l)
+			Expect(err).NotTo(HaveOccurred())
+
+			encrypted, err := e.Encrypt("dm/player", "hello")
+			Expect(err).NotTo(HaveOccurred())
+			payload, err := e.Decrypt("dm/player", []byte(encrypted))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(payload)).To(Equal("hello"))
+
+			_, err = e.Decrypt("dm/player", []byte("hello"))
+			Expect(err).To(Equal(encryption.ErrNotEncrypted))
+			Expect(e.Decrypt("chat/room", []byte("hello"))).To(Equal([]byte("hello")))
+		})
+
+		It("Should seal payloads of matching topics to be kept as text", func() {
+			e, err := encryption.NewEncryptor(config, l)
+			Expect(err).NotTo(HaveOccurred())
+
+			sealed, err := e.Seal("dm/player", "hello")
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sealed).To(HavePrefix(encryption.SealedPrefix))
+			Expect(sealed).NotTo(ContainSubstring("hello"))
+			Expect(utf8.ValidString(sealed)).To(BeTrue())
+			Expect(e.Open("dm/player", sealed)).To(Equal("hello"))
+
+			_, err = e.Open("dm/other", sealed)
+			Expect(err).To(HaveOccurred())
+
+			// payloads kept before they were sealed are opened as they are
+			Expect(e.Open("dm/player", "hello")).To(Equal("hello"))
+			Expect(e.Seal("chat/room", "hello")).To(Equal("hello"))
+			Expect(e.Open("chat/room", sealed)).To(Equal(sealed))
+		})
+
+		It("Should not need a keyring if no topic is encrypted", func() {
+			config.Set("encryption.topics", nil)
+			config.Set("encryption.keyring", filepath.Join(dir, "missing.json"))
+			_, err := encryption.NewEncryptor(config, l)
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should fail rather than publish unencrypted payloads", func() {
+			config.Set("encryption.keyring", writeKeyring(newKey("expired", time.Time{}, now.Add(-time.Hour))))
+			e, err := encryption.NewEncryptor(config, l)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, err = e.Encrypt("dm/player", "hello")
+			Expect(err).To(MatchError(ContainSubstring("no encryption key is valid now")))
+		})
+	})
+
+	Describe("MessageHandler", func() {
+		It("Should give decrypted payloads to the handler", func() {
+			keyring, err := encryption.NewKeyring(newKey("key", time.Time{}, time.Time{}))
+			Expect(err).NotTo(HaveOccurred())
+			encrypted, err := encryption.Encrypt(keyring, "dm/player", []byte("hello"))
+			Expect(err).NotTo(HaveOccurred())
+
+			var received []string
+			var failed []error
+			handler := encryption.MessageHandler(keyring, func(client mqtt.Client, m mqtt.Message) {
+				received = append(received, string(m.Payload()))
+			}, func(m mqtt.Message, err error) {
+				failed = append(failed, err)
+			})
+
+			handler(nil, &message{topic: "dm/player", payload: encrypted})
+			handler(nil, &message{topic: "dm/other", payload: encrypted})
+			handler(nil, &message{topic: "dm/player", payload: []byte("plain")})
+
+			Expect(received).To(Equal([]string{"hello"}))
+			Expect(failed).To(HaveLen(2))
+			Expect(failed[1]).To(Equal(encryption.ErrNotEncrypted))
+		})
+
+		It("Should give payloads of topics that are not encrypted as they are", func() {
+			config := viper.New()
+			config.Set("encryption.keyring", writeKeyring(newKey("key", time.Time{}, time.Time{})))
+			config.Set("encryption.topics", []map[string]interface{}{
+				{"pattern": "dm/#"},
+			})
+			e, err := encryption.NewEncryptor(config, l)
+			Expect(err).NotTo(HaveOccurred())
+
+			var received []string
+			var failed []error
+			handler := e.MessageHandler(func(client mqtt.Client, m mqtt.Message) {
+				received = append(received, string(m.Payload()))
+			}, func(m mqtt.Message, err error) {
+				failed = append(failed, err)
+			})
+
+			handler(nil, &message{topic: "chat/room", payload: []byte("plain")})
+			handler(nil, &message{topic: "dm/player", payload: []byte("plain")})
+
+			Expect(received).To(Equal([]string{"plain"}))
+			Expect(failed).To(Equal([]error{encryption.ErrNotEncrypted}))
+		})
+	})
+})
@@ -0,0 +1,216 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package encryption
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/topic"
+)
+
+// Overhead is how much larger encrypted payloads are, with key ids of up to
+// 64 bytes
+const Overhead = len(Prefix) + 64 + 1 + 12 + 16
+
+type ruleConfig struct {
+	Pattern string `mapstructure:"pattern"`
+}
+
+var (
+	metricsOnce     sync.Once
+	messagesCounter *metrics.CounterVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		messagesCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "encrypted_messages",
+			Help:      "Payloads of topics with encryption by whether they could be encrypted",
+		}, []string{"status"})
+	})
+}
+
+// Encryptor encrypts the payloads of the topics matching its patterns
+type Encryptor struct {
+	Keyring  *Keyring
+	Logger   log.FieldLogger
+	patterns []string
+}
+
+// NewEncryptor returns an Encryptor with the patterns and keyring
+// configured under the encryption key. The keyring is only loaded if some
+// topic is encrypted
+func NewEncryptor(config *viper.Viper, logger log.FieldLogger) (*Encryptor, error) {
+	config.SetDefault("encryption.keyring", "./config/keyring.json")
+	config.SetDefault("encryption.reloadInterval", time.Minute)
+
+	initMetrics()
+
+	e := &Encryptor{
+		Logger: logger.WithField("source", "Encryptor"),
+	}
+
+	var rules []ruleConfig
+	err := config.UnmarshalKey("encryption.topics", &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption.topics configuration: %w", err)
+	}
+	for _, rc := range rules {
+		if rc.Pattern == "" {
+			return nil, fmt.Errorf("encryption rules need a pattern")
+		}
+		e.patterns = append(e.patterns, rc.Pattern)
+	}
+	if len(e.patterns) == 0 {
+		return e, nil
+	}
+
+	e.Keyring, err = LoadKeyring(
+		config.GetString("encryption.keyring"),
+		config.GetDuration("encryption.reloadInterval"),
+		logger,
+	)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := e.Keyring.Active(time.Now()); err != nil {
+		e.Logger.WithError(err).Warn("No encryption key is valid now, encrypted topics can not be published to.")
+	}
+	e.Logger.WithField("patterns", e.patterns).Info("Loaded encrypted topics.")
+
+	return e, nil
+}
+
+// Encrypts returns whether payloads published to t are encrypted
+func (e *Encryptor) Encrypts(t string) bool {
+	for _, pattern := range e.patterns {
+		if topic.Match(pattern, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Encrypt encrypts payload if t is encrypted, or returns it as it is
+// otherwise. Payloads are never published unencrypted to encrypted topics,
+// so an error is returned when they can't be encrypted
+func (e *Encryptor) Encrypt(t, payload string) (string, error) {
+	if !e.Encrypts(t) {
+		return payload, nil
+	}
+
+	encrypted, err := Encrypt(e.Keyring, t, []byte(payload))
+	if err != nil {
+		messagesCounter.WithLabelValues("failed").Inc()
+		return "", fmt.Errorf("could not encrypt payload: %w", err)
+	}
+	messagesCounter.WithLabelValues("encrypted").Inc()
+	return string(encrypted), nil
+}
+
+// Decrypt returns the payload of a message published to t. Messages of
+// encrypted topics must be encrypted, and fail with ErrNotEncrypted
+// otherwise, while messages of other topics are returned as they are
+func (e *Encryptor) Decrypt(t string, message []byte) ([]byte, error) {
+	if !e.Encrypts(t) {
+		return message, nil
+	}
+	return Decrypt(e.Keyring, t, message)
+}
+
+// Seal encrypts payload if t is encrypted, or returns it as it is otherwise,
+// so payloads of encrypted topics kept to be published later are not stored
+// in plain text. Sealed payloads are base64 encoded after SealedPrefix, so
+// they can be kept as text, and are only read back with Open
+func (e *Encryptor) Seal(t, payload string) (string, error) {
+	if !e.Encrypts(t) {
+		return payload, nil
+	}
+
+	encrypted, err := Encrypt(e.Keyring, t, []byte(payload))
+	if err != nil {
+		return "", fmt.Errorf("could not seal payload: %w", err)
+	}
+	return SealedPrefix + base64.StdEncoding.EncodeToString(encrypted), nil
+}
+
+// Open returns the payload sealed by Seal. Payloads of encrypted topics
+// kept before they were sealed, and payloads of other topics, are returned
+// as they are
+func (e *Encryptor) Open(t, payload string) (string, error) {
+	if !e.Encrypts(t) || !strings.HasPrefix(payload, SealedPrefix) {
+		return payload, nil
+	}
+
+	encrypted, err := base64.StdEncoding.DecodeString(payload[len(SealedPrefix):])
+	if err != nil {
+		return "", ErrInvalidMessage
+	}
+	opened, err := Decrypt(e.Keyring, t, encrypted)
+	if err != nil {
+		return "", err
+	}
+	return string(opened), nil
+}
+
+// Overhead returns how much larger payloads published to t get once
+// encrypted
+func (e *Encryptor) Overhead(t string) int {
+	if !e.Encrypts(t) {
+		return 0
+	}
+	return Overhead
+}
+
+type decryptedMessage struct {
+	mqtt.Message
+	payload []byte
+}
+
+func (m *decryptedMessage) Payload() []byte {
+	return m.payload
+}
+
+// MessageHandler wraps a subscription handler of encrypted topics so it
+// receives decrypted payloads. Messages that can't be decrypted, including
+// the ones that were not encrypted, are given to onError instead
+func MessageHandler(keyring *Keyring, next mqtt.MessageHandler, onError func(mqtt.Message, error)) mqtt.MessageHandler {
+	return handler(func(t string, message []byte) ([]byte, error) {
+		return Decrypt(keyring, t, message)
+	}, next, onError)
+}
+
+// MessageHandler wraps a subscription handler so it receives decrypted
+// payloads of encrypted topics and the payloads of other topics as they
+// are. Messages that can't be decrypted are given to onError instead
+func (e *Encryptor) MessageHandler(next mqtt.MessageHandler, onError func(mqtt.Message, error)) mqtt.MessageHandler {
+	return handler(e.Decrypt, next, onError)
+}
+
+func handler(decrypt func(t string, message []byte) ([]byte, error), next mqtt.MessageHandler, onError func(mqtt.Message, error)) mqtt.MessageHandler {
+	return func(client mqtt.Client, message mqtt.Message) {
+		payload, err := decrypt(message.Topic(), message.Payload())
+		if err != nil {
+			if onError != nil {
+				onError(message, err)
+			}
+			return
+		}
+		next(client, &decryptedMessage{Message: message, payload: payload})
+	}
+}
@@ -0,0 +1,196 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package encryption
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ErrNoActiveKey is returned when no key of the keyring is valid now
+	ErrNoActiveKey = errors.New("no encryption key is valid now")
+	// ErrUnknownKey is returned when decrypting with a key missing from the
+	// keyring
+	ErrUnknownKey = errors.New("unknown encryption key")
+)
+
+// Key is an AES key valid for encrypting between NotBefore and NotAfter.
+// Zero times are not limited
+type Key struct {
+	ID        string    `json:"id"`
+	Key       string    `json:"key"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+	secret    []byte
+}
+
+// ValidAt returns whether the key may be used for encrypting at t
+func (k *Key) ValidAt(t time.Time) bool {
+	return (k.NotBefore.IsZero() || !t.Before(k.NotBefore)) &&
+		(k.NotAfter.IsZero() || t.Before(k.NotAfter))
+}
+
+type keyringFile struct {
+	Keys []*Key `json:"keys"`
+}
+
+// Keyring holds the keys of a keyring file, reloading it when it changes so
+// keys can be rotated without restarting
+type Keyring struct {
+	Path           string
+	ReloadInterval time.Duration
+	Logger         log.FieldLogger
+	lock           sync.Mutex
+	keys           map[string]*Key
+	modTime        time.Time
+	checkedAt      time.Time
+}
+
+// LoadKeyring returns the keyring in the file at path
+func LoadKeyring(path string, reloadInterval time.Duration, logger log.FieldLogger) (*Keyring, error) {
+	k := &Keyring{
+		Path:           path,
+		ReloadInterval: reloadInterval,
+		Logger:         logger.WithField("source", "Keyring"),
+	}
+
+	err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewKeyring returns a keyring with the given keys, for consumers that get
+// them from somewhere other than a file
+func NewKeyring(keys ...*Key) (*Keyring, error) {
+	loaded, err := parseKeys(keys)
+	if err != nil {
+		return nil, err
+	}
+	return &Keyring{keys: loaded}, nil
+}
+
+func parseKeys(keys []*Key) (map[string]*Key, error) {
+	loaded := map[string]*Key{}
+	for _, key := range keys {
+		if key.ID == "" || len(key.ID) > 64 || strings.ContainsAny(key.ID, " \n") {
+			return nil, fmt.Errorf("invalid key id %q", key.ID)
+		}
+		if _, ok := loaded[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %s", key.ID)
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(key.Key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s is not valid base64: %w", key.ID, err)
+		}
+		if len(secret) != 16 && len(secret) != 24 && len(secret) != 32 {
+			return nil, fmt.Errorf("key %s must have 16, 24 or 32 bytes", key.ID)
+		}
+
+		key.secret = secret
+		loaded[key.ID] = key
+	}
+	return loaded, nil
+}
+
+// load must be called holding the lock, or before the keyring is shared
+func (k *Keyring) load() error {
+	info, err := os.Stat(k.Path)
+	if err != nil {
+		return fmt.Errorf("could not read keyring %s: %w", k.Path, err)
+	}
+	b, err := os.ReadFile(k.Path)
+	if err != nil {
+		return fmt.Errorf("could not read keyring %s: %w", k.Path, err)
+	}
+
+	var file keyringFile
+	err = json.Unmarshal(b, &file)
+	if err != nil {
+		return fmt.Errorf("could not parse keyring %s: %w", k.Path, err)
+	}
+	keys, err := parseKeys(file.Keys)
+	if err != nil {
+		return fmt.Errorf("invalid keyring %s: %w", k.Path, err)
+	}
+
+	k.keys = keys
+	k.modTime = info.ModTime()
+	k.checkedAt = time.Now()
+	k.Logger.WithFields(log.Fields{
+		"path": k.Path,
+		"keys": len(keys),
+	}).Info("Loaded keyring.")
+	return nil
+}
+
+// reload must be called holding the lock
+func (k *Keyring) reload() {
+	if k.Path == "" || time.Since(k.checkedAt) < k.ReloadInterval {
+		return
+	}
+	k.checkedAt = time.Now()
+
+	info, err := os.Stat(k.Path)
+	if err == nil && info.ModTime().Equal(k.modTime) {
+		return
+	}
+
+	// the keys loaded before are kept if the file became invalid
+	if err := k.load(); err != nil {
+		k.Logger.WithError(err).Error("Failed to reload keyring.")
+	}
+}
+
+// Active returns the key to encrypt with at t: among the keys valid at t,
+// the one that became valid last
+func (k *Keyring) Active(t time.Time) (*Key, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.reload()
+
+	var active *Key
+	for _, key := range k.keys {
+		if !key.ValidAt(t) {
+			continue
+		}
+		if active == nil || key.NotBefore.After(active.NotBefore) ||
+			(key.NotBefore.Equal(active.NotBefore) && key.ID > active.ID) {
+			active = key
+		}
+	}
+	if active == nil {
+		return nil, ErrNoActiveKey
+	}
+	return active, nil
+}
+
+// Key returns the key with the given id. Keys are returned even once they
+// are no longer valid, so messages encrypted with them can be decrypted
+func (k *Keyring) Key(id string) (*Key, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	k.reload()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
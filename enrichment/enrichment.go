@@ -0,0 +1,274 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package enrichment
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/topic"
+)
+
+// defaultRules are used when enrichment.rules is not configured. They keep
+// messages sent through the HTTP API from being moderated, as they always
+// were, and leave messages sent through gRPC as they are.
+var defaultRules = []ruleConfig{
+	{
+		Pattern:   "#",
+		Frontends: []string{"http"},
+		Transforms: []transformConfig{
+			{Type: "default", Field: "should_moderate", Value: false},
+		},
+	},
+}
+
+// Metadata holds what transforms know about a message besides its payload
+type Metadata struct {
+	// Frontend is the API the message was received through, http or grpc
+	Frontend  string
+	Requestor string
+	RequestID string
+}
+
+// Transform changes a payload before it is published
+type Transform interface {
+	Apply(payload map[string]interface{}, meta Metadata)
+}
+
+type transformConfig struct {
+	Type   string      `mapstructure:"type"`
+	Field  string      `mapstructure:"field"`
+	To     string      `mapstructure:"to"`
+	Value  interface{} `mapstructure:"value"`
+	Format string      `mapstructure:"format"`
+}
+
+type ruleConfig struct {
+	Pattern    string            `mapstructure:"pattern"`
+	Frontends  []string          `mapstructure:"frontends"`
+	Transforms []transformConfig `mapstructure:"transforms"`
+}
+
+type rule struct {
+	pattern    string
+	frontends  []string
+	transforms []Transform
+}
+
+// matches returns whether the rule applies to messages published to t
+// received through frontend
+func (r *rule) matches(t, frontend string) bool {
+	if !topic.Match(r.pattern, t) {
+		return false
+	}
+	if len(r.frontends) == 0 {
+		return true
+	}
+	for _, f := range r.frontends {
+		if f == frontend {
+			return true
+		}
+	}
+	return false
+}
+
+// Pipeline applies the transforms of every rule matching a topic, in the
+// order they were configured
+type Pipeline struct {
+	rules []*rule
+}
+
+// NewPipeline builds the pipeline configured under enrichment.rules
+func NewPipeline(config *viper.Viper) (*Pipeline, error) {
+	rules := defaultRules
+	if config.IsSet("enrichment.rules") {
+		rules = nil
+		err := config.UnmarshalKey("enrichment.rules", &rules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid enrichment.rules configuration: %w", err)
+		}
+	}
+
+	p := &Pipeline{}
+	for _, rc := range rules {
+		if rc.Pattern == "" {
+			return nil, fmt.Errorf("enrichment rules need a pattern")
+		}
+
+		r := &rule{pattern: rc.Pattern, frontends: rc.Frontends}
+		for _, tc := range rc.Transforms {
+			t, err := newTransform(tc)
+			if err != nil {
+				return nil, fmt.Errorf("invalid transform for pattern %s: %w", rc.Pattern, err)
+			}
+			r.transforms = append(r.transforms, t)
+		}
+		p.rules = append(p.rules, r)
+	}
+
+	return p, nil
+}
+
+// Matches returns whether any rule applies to the message, so payloads
+// nothing would change can be left as they are
+func (p *Pipeline) Matches(t string, meta Metadata) bool {
+	for _, r := range p.rules {
+		if r.matches(t, meta.Frontend) {
+			return true
+		}
+	}
+	return false
+}
+
+// Apply runs every matching transform over payload, changing it in place
+func (p *Pipeline) Apply(t string, payload map[string]interface{}, meta Metadata) {
+	for _, r := range p.rules {
+		if !r.matches(t, meta.Frontend) {
+			continue
+		}
+		for _, transform := range r.transforms {
+			transform.Apply(payload, meta)
+		}
+	}
+}
+
+func newTransform(tc transformConfig) (Transform, error) {
+	if tc.Field == "" {
+		return nil, fmt.Errorf("%s transform needs a field", tc.Type)
+	}
+
+	if value, ok := tc.Value.(string); ok {
+		tc.Value = os.ExpandEnv(value)
+	}
+
+	switch tc.Type {
+	case "default":
+		return &setDefault{field: tc.Field, value: tc.Value}, nil
+	case "override":
+		return &override{field: tc.Field, value: tc.Value}, nil
+	case "remove":
+		return &remove{field: tc.Field}, nil
+	case "rename":
+		if tc.To == "" {
+			return nil, fmt.Errorf("rename transform needs a target field")
+		}
+		return &rename{field: tc.Field, to: tc.To}, nil
+	case "timestamp":
+		switch tc.Format {
+		case "":
+			tc.Format = "unixms"
+		case "unix", "unixms", "rfc3339":
+		default:
+			return nil, fmt.Errorf("unknown timestamp format %s", tc.Format)
+		}
+		return &timestamp{field: tc.Field, format: tc.Format}, nil
+	case "id":
+		return &id{field: tc.Field}, nil
+	case "requestor":
+		return &requestor{field: tc.Field}, nil
+	case "requestId":
+		return &requestID{field: tc.Field}, nil
+	}
+
+	return nil, fmt.Errorf("unknown transform type %s", tc.Type)
+}
+
+// setDefault sets a field only if the payload does not have it
+type setDefault struct {
+	field string
+	value interface{}
+}
+
+func (t *setDefault) Apply(payload map[string]interface{}, meta Metadata) {
+	if _, exists := payload[t.field]; !exists {
+		payload[t.field] = t.value
+	}
+}
+
+// override sets a field even if the payload already has it
+type override struct {
+	field string
+	value interface{}
+}
+
+func (t *override) Apply(payload map[string]interface{}, meta Metadata) {
+	payload[t.field] = t.value
+}
+
+type remove struct {
+	field string
+}
+
+func (t *remove) Apply(payload map[string]interface{}, meta Metadata) {
+	delete(payload, t.field)
+}
+
+type rename struct {
+	field string
+	to    string
+}
+
+func (t *rename) Apply(payload map[string]interface{}, meta Metadata) {
+	if value, exists := payload[t.field]; exists {
+		delete(payload, t.field)
+		payload[t.to] = value
+	}
+}
+
+// timestamp stamps the time the message went through arkadiko
+type timestamp struct {
+	field  string
+	format string
+}
+
+func (t *timestamp) Apply(payload map[string]interface{}, meta Metadata) {
+	now := time.Now()
+	switch t.format {
+	case "unix":
+		payload[t.field] = now.Unix()
+	case "rfc3339":
+		payload[t.field] = now.UTC().Format(time.RFC3339Nano)
+	default:
+		payload[t.field] = now.UnixNano() / int64(time.Millisecond)
+	}
+}
+
+// id stamps a generated unique id
+type id struct {
+	field string
+}
+
+func (t *id) Apply(payload map[string]interface{}, meta Metadata) {
+	payload[t.field] = uuid.NewV4().String()
+}
+
+// requestor stamps who asked arkadiko to send the message, if known
+type requestor struct {
+	field string
+}
+
+func (t *requestor) Apply(payload map[string]interface{}, meta Metadata) {
+	if meta.Requestor != "" {
+		payload[t.field] = meta.Requestor
+	}
+}
+
+// requestID stamps the id of the request the message was sent in, if known
+type requestID struct {
+	field string
+}
+
+func (t *requestID) Apply(payload map[string]interface{}, meta Metadata) {
+	if meta.RequestID != "" {
+		payload[t.field] = meta.RequestID
+	}
+}
@@ -0,0 +1,196 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package enrichment_test
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/enrichment"
+)
+
+var _ = Describe("Enrichment Pipeline", func() {
+	getPipeline := func(rules interface{}) *enrichment.Pipeline {
+		config := viper.New()
+		if rules != nil {
+			config.Set("enrichment.rules", rules)
+		}
+		pipeline, err := enrichment.NewPipeline(config)
+		Expect(err).NotTo(HaveOccurred())
+		return pipeline
+	}
+
+	Describe("Default rules", func() {
+		http := enrichment.Metadata{Frontend: "http"}
+
+		It("Should default should_moderate to false", func() {
+			payload := map[string]interface{}{"message": "hello"}
+			getPipeline(nil).Apply("any/topic", payload, http)
+			Expect(payload).To(HaveKeyWithValue("should_moderate", false))
+		})
+
+		It("Should not override should_moderate", func() {
+			payload := map[string]interface{}{"should_moderate": true}
+			getPipeline(nil).Apply("any/topic", payload, http)
+			Expect(payload).To(HaveKeyWithValue("should_moderate", true))
+		})
+
+		It("Should leave messages received through gRPC as they are", func() {
+			pipeline := getPipeline(nil)
+			grpc := enrichment.Metadata{Frontend: "grpc"}
+			Expect(pipeline.Matches("any/topic", grpc)).To(BeFalse())
+
+			payload := map[string]interface{}{"message": "hello"}
+			pipeline.Apply("any/topic", payload, grpc)
+			Expect(payload).NotTo(HaveKey("should_moderate"))
+		})
+
+		It("Should not be set on the config", func() {
+			config := viper.New()
+			_, err := enrichment.NewPipeline(config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(config.IsSet("enrichment.rules")).To(BeFalse())
+		})
+	})
+
+	Describe("Transforms", func() {
+		It("Should only apply rules matching the topic", func() {
+			pipeline := getPipeline([]map[string]interface{}{
+				{
+					"pattern": "chat/+",
+					"transforms": []map[string]interface{}{
+						{"type": "override", "field": "kind", "value": "chat"},
+					},
+				},
+			})
+
+			payload := map[string]interface{}{}
+			pipeline.Apply("rewards/game", payload, enrichment.Metadata{})
+			Expect(payload).To(BeEmpty())
+
+			pipeline.Apply("chat/game", payload, enrichment.Metadata{})
+			Expect(payload).To(HaveKeyWithValue("kind", "chat"))
+			Expect(pipeline.Matches("rewards/game", enrichment.Metadata{})).To(BeFalse())
+			Expect(pipeline.Matches("chat/game", enrichment.Metadata{})).To(BeTrue())
+		})
+
+		It("Should only apply rules to the frontends they are configured for", func() {
+			pipeline := getPipeline([]map[string]interface{}{
+				{
+					"pattern":   "#",
+					"frontends": []string{"grpc"},
+					"transforms": []map[string]interface{}{
+						{"type": "override", "field": "via", "value": "grpc"},
+					},
+				},
+			})
+
+			payload := map[string]interface{}{}
+			pipeline.Apply("topic", payload, enrichment.Metadata{Frontend: "http"})
+			Expect(payload).To(BeEmpty())
+
+			pipeline.Apply("topic", payload, enrichment.Metadata{Frontend: "grpc"})
+			Expect(payload).To(HaveKeyWithValue("via", "grpc"))
+		})
+
+		It("Should stamp timestamps in the configured format", func() {
+			pipeline := getPipeline([]map[string]interface{}{
+				{
+					"pattern": "#",
+					"transforms": []map[string]interface{}{
+						{"type": "timestamp", "field": "sent_at", "format": "rfc3339"},
+						{"type": "timestamp", "field": "sent_at_ms"},
+					},
+				},
+			})
+
+			payload := map[string]interface{}{}
+			pipeline.Apply("topic", payload, enrichment.Metadata{})
+
+			sentAt, err := time.Parse(time.RFC3339Nano, payload["sent_at"].(string))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(sentAt).To(BeTemporally("~", time.Now(), time.Second))
+			Expect(payload["sent_at_ms"]).To(BeNumerically("~", time.Now().UnixNano()/int64(time.Millisecond), 1000))
+		})
+
+		It("Should generate different ids for each message", func() {
+			pipeline := getPipeline([]map[string]interface{}{
+				{
+					"pattern": "#",
+					"transforms": []map[string]interface{}{
+						{"type": "id", "field": "id"},
+					},
+				},
+			})
+
+			first := map[string]interface{}{}
+			second := map[string]interface{}{}
+			pipeline.Apply("topic", first, enrichment.Metadata{})
+			pipeline.Apply("topic", second, enrichment.Metadata{})
+			Expect(first["id"]).NotTo(BeEmpty())
+			Expect(first["id"]).NotTo(Equal(second["id"]))
+		})
+
+		It("Should rename and remove fields and stamp the requestor", func() {
+			pipeline := getPipeline([]map[string]interface{}{
+				{
+					"pattern": "#",
+					"transforms": []map[string]interface{}{
+						{"type": "rename", "field": "msg", "to": "message"},
+						{"type": "remove", "field": "secret"},
+						{"type": "requestor", "field": "sent_by"},
+					},
+				},
+			})
+
+			payload := map[string]interface{}{"msg": "hello", "secret": "s3cr3t"}
+			pipeline.Apply("topic", payload, enrichment.Metadata{Requestor: "game-server"})
+			Expect(payload).To(Equal(map[string]interface{}{
+				"message": "hello",
+				"sent_by": "game-server",
+			}))
+		})
+
+		It("Should stamp the request id if known", func() {
+			pipeline := getPipeline([]map[string]interface{}{
+				{
+					"pattern": "#",
+					"transforms": []map[string]interface{}{
+						{"type": "requestId", "field": "request_id"},
+					},
+				},
+			})
+
+			payload := map[string]interface{}{"message": "hello"}
+			pipeline.Apply("topic", payload, enrichment.Metadata{RequestID: "abc"})
+			Expect(payload).To(HaveKeyWithValue("request_id", "abc"))
+
+			payload = map[string]interface{}{"message": "hello"}
+			pipeline.Apply("topic", payload, enrichment.Metadata{})
+			Expect(payload).NotTo(HaveKey("request_id"))
+		})
+	})
+
+	Describe("NewPipeline", func() {
+		It("Should fail for unknown transforms", func() {
+			config := viper.New()
+			config.Set("enrichment.rules", []map[string]interface{}{
+				{
+					"pattern": "#",
+					"transforms": []map[string]interface{}{
+						{"type": "uppercase", "field": "message"},
+					},
+				},
+			})
+			_, err := enrichment.NewPipeline(config)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
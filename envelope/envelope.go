@@ -0,0 +1,167 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+// Package envelope wraps payloads with metadata about who published them,
+// when and in which trace, and decodes them on the consumer side.
+//
+// Envelopes are JSON objects following a versioned schema, available as
+// SchemaV1:
+//
+//	{
+//	  "version": 1,
+//	  "id": "4f1c...",
+//	  "ts": "2024-01-01T12:00:00.123Z",
+//	  "source": "chat-service",
+//	  "game_id": "my-game",
+//	  "trace_id": "4bf92f3577b34da6a3ce929d0e0e4736",
+//	  "request_id": "9b2e...",
+//	  "content_type": "application/json",
+//	  "data": {"message": "hello"}
+//	}
+//
+// JSON data is embedded as it is, and data of any other content type is
+// base64 encoded.
+package envelope
+
+import (
+	"context"
+	_ "embed" // embeds the envelope schemas
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Version is the version of the envelopes written by this package
+const Version = 1
+
+// SchemaV1 is the JSON schema of version 1 envelopes
+//
+//go:embed v1.schema.json
+var SchemaV1 []byte
+
+var (
+	// ErrNotEnvelope is returned when decoding something that is not an
+	// envelope
+	ErrNotEnvelope = errors.New("payload is not an envelope")
+	// ErrUnsupportedVersion is returned when decoding envelopes of a
+	// version this package does not know
+	ErrUnsupportedVersion = errors.New("unsupported envelope version")
+)
+
+// Metadata holds what is known about a message besides its payload
+type Metadata struct {
+	Source    string
+	GameID    string
+	TraceID   string
+	RequestID string
+}
+
+// Envelope is a payload along with its metadata
+type Envelope struct {
+	Version     int             `json:"version"`
+	ID          string          `json:"id"`
+	Timestamp   time.Time       `json:"ts"`
+	Source      string          `json:"source,omitempty"`
+	GameID      string          `json:"game_id,omitempty"`
+	TraceID     string          `json:"trace_id,omitempty"`
+	RequestID   string          `json:"request_id,omitempty"`
+	ContentType string          `json:"content_type"`
+	Data        json.RawMessage `json:"data"`
+}
+
+// IsJSON returns whether data of contentType is embedded in envelopes as
+// it is
+func IsJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return mediaType == "application/json" || (strings.HasPrefix(mediaType, "application/") && strings.HasSuffix(mediaType, "+json"))
+}
+
+// TraceID returns the id of the trace in ctx, or an empty string if there
+// is none
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// New returns an envelope with a new id holding payload. JSON payloads must
+// be valid JSON
+func New(payload []byte, contentType string, meta Metadata) (*Envelope, error) {
+	e := &Envelope{
+		Version:     Version,
+		ID:          uuid.NewV4().String(),
+		Timestamp:   time.Now().UTC(),
+		Source:      meta.Source,
+		GameID:      meta.GameID,
+		TraceID:     meta.TraceID,
+		RequestID:   meta.RequestID,
+		ContentType: contentType,
+	}
+
+	if IsJSON(contentType) {
+		if !json.Valid(payload) {
+			return nil, fmt.Errorf("payload is not valid JSON")
+		}
+		e.Data = payload
+		return e, nil
+	}
+
+	data, err := json.Marshal(base64.StdEncoding.EncodeToString(payload))
+	if err != nil {
+		return nil, err
+	}
+	e.Data = data
+	return e, nil
+}
+
+// Decode returns the envelope in message
+func Decode(message []byte) (*Envelope, error) {
+	var e Envelope
+	if err := json.Unmarshal(message, &e); err != nil {
+		return nil, ErrNotEnvelope
+	}
+	switch {
+	case e.Version == 0 || e.ID == "" || e.ContentType == "" || e.Data == nil:
+		return nil, ErrNotEnvelope
+	case e.Version != Version:
+		return nil, fmt.Errorf("%w %d", ErrUnsupportedVersion, e.Version)
+	}
+	return &e, nil
+}
+
+// Payload returns the payload held by the envelope, as it was published
+func (e *Envelope) Payload() ([]byte, error) {
+	if IsJSON(e.ContentType) {
+		return e.Data, nil
+	}
+
+	var data string
+	if err := json.Unmarshal(e.Data, &data); err != nil {
+		return nil, fmt.Errorf("data of %s envelopes must be a base64 string", e.ContentType)
+	}
+	return base64.StdEncoding.DecodeString(data)
+}
+
+// Unmarshal decodes the JSON payload held by the envelope into v
+func (e *Envelope) Unmarshal(v interface{}) error {
+	if !IsJSON(e.ContentType) {
+		return fmt.Errorf("envelope holds %s data", e.ContentType)
+	}
+	return json.Unmarshal(e.Data, v)
+}
@@ -0,0 +1,148 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package envelope_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/topfreegames/arkadiko/envelope"
+)
+
+var _ = Describe("Envelope", func() {
+	meta := envelope.Metadata{
+		Source:    "chat-service",
+		GameID:    "my-game",
+		TraceID:   "4bf92f3577b34da6a3ce929d0e0e4736",
+		RequestID: "9b2e6f0c-request",
+	}
+
+	validate := func(message []byte) error {
+		compiler := jsonschema.NewCompiler()
+		Expect(compiler.AddResource("v1.schema.json", bytes.NewReader(envelope.SchemaV1))).To(Succeed())
+		schema, err := compiler.Compile("v1.schema.json")
+		Expect(err).NotTo(HaveOccurred())
+
+		var value interface{}
+		Expect(json.Unmarshal(message, &value)).To(Succeed())
+		return schema.Validate(value)
+	}
+
+	Describe("Encoding", func() {
+		It("Should embed JSON payloads as they are", func() {
+			e, err := envelope.New([]byte(`{"message":"hello"}`), "application/json", meta)
+			Expect(err).NotTo(HaveOccurred())
+			message, err := json.Marshal(e)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(message)).To(ContainSubstring(`"data":{"message":"hello"}`))
+			Expect(validate(message)).To(Succeed())
+
+			decoded, err := envelope.Decode(message)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded.Version).To(Equal(envelope.Version))
+			Expect(decoded.ID).To(Equal(e.ID))
+			Expect(decoded.Timestamp.Equal(e.Timestamp)).To(BeTrue())
+			Expect(decoded.Source).To(Equal("chat-service"))
+			Expect(decoded.GameID).To(Equal("my-game"))
+			Expect(decoded.TraceID).To(Equal(meta.TraceID))
+			Expect(decoded.RequestID).To(Equal(meta.RequestID))
+
+			var data map[string]string
+			Expect(decoded.Unmarshal(&data)).To(Succeed())
+			Expect(data).To(Equal(map[string]string{"message": "hello"}))
+		})
+
+		It("Should base64 encode other payloads", func() {
+			e, err := envelope.New([]byte{0, 1, 2}, "application/octet-stream", envelope.Metadata{})
+			Expect(err).NotTo(HaveOccurred())
+			message, err := json.Marshal(e)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(message)).To(ContainSubstring(`"data":"AAEC"`))
+			Expect(string(message)).NotTo(ContainSubstring("source"))
+			Expect(validate(message)).To(Succeed())
+
+			decoded, err := envelope.Decode(message)
+			Expect(err).NotTo(HaveOccurred())
+			payload, err := decoded.Payload()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(payload).To(Equal([]byte{0, 1, 2}))
+			Expect(decoded.Unmarshal(&map[string]string{})).To(HaveOccurred())
+		})
+
+		It("Should reject invalid JSON payloads", func() {
+			_, err := envelope.New([]byte(`{"message"`), "application/json", meta)
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("Should treat JSON based content types as JSON", func() {
+			Expect(envelope.IsJSON("application/json; charset=utf-8")).To(BeTrue())
+			Expect(envelope.IsJSON("application/vnd.game+json")).To(BeTrue())
+			Expect(envelope.IsJSON("text/plain")).To(BeFalse())
+		})
+	})
+
+	Describe("Decoding", func() {
+		It("Should reject payloads that are not envelopes", func() {
+			_, err := envelope.Decode([]byte(`{"message":"hello"}`))
+			Expect(err).To(Equal(envelope.ErrNotEnvelope))
+
+			_, err = envelope.Decode([]byte(`hello`))
+			Expect(err).To(Equal(envelope.ErrNotEnvelope))
+		})
+
+		It("Should reject envelopes of unknown versions", func() {
+			message := []byte(`{"version":2,"id":"id","ts":"2024-01-01T00:00:00Z","content_type":"application/json","data":{}}`)
+			_, err := envelope.Decode(message)
+			Expect(errors.Is(err, envelope.ErrUnsupportedVersion)).To(BeTrue())
+			Expect(validate(message)).NotTo(Succeed())
+		})
+	})
+
+	Describe("Wrapper", func() {
+		It("Should only wrap payloads of matching topics", func() {
+			config := viper.New()
+			config.Set("envelope.topics", []map[string]interface{}{
+				{"pattern": "chat/#"},
+			})
+			w, err := envelope.NewWrapper(config)
+			Expect(err).NotTo(HaveOccurred())
+
+			wrapped, err := w.Wrap("chat/room", []byte(`"hello"`), "application/json", meta)
+			Expect(err).NotTo(HaveOccurred())
+			e, err := envelope.Decode(wrapped)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(e.Data)).To(Equal(`"hello"`))
+
+			payload, err := w.Wrap("inventory/player", []byte(`"hello"`), "application/json", meta)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(payload)).To(Equal(`"hello"`))
+		})
+	})
+
+	Describe("TraceID", func() {
+		It("Should return the id of the trace in the context", func() {
+			Expect(envelope.TraceID(context.Background())).To(BeEmpty())
+
+			traceID, err := trace.TraceIDFromHex(meta.TraceID)
+			Expect(err).NotTo(HaveOccurred())
+			ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID: traceID,
+				SpanID:  trace.SpanID{1},
+			}))
+			Expect(envelope.TraceID(ctx)).To(Equal(meta.TraceID))
+		})
+	})
+})
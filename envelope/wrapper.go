@@ -0,0 +1,70 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package envelope
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/topic"
+)
+
+type ruleConfig struct {
+	Pattern string `mapstructure:"pattern"`
+}
+
+// Wrapper wraps the payloads of the topics matching its patterns in
+// envelopes
+type Wrapper struct {
+	patterns []string
+}
+
+// NewWrapper returns a Wrapper with the patterns configured under
+// envelope.topics
+func NewWrapper(config *viper.Viper) (*Wrapper, error) {
+	var rules []ruleConfig
+	err := config.UnmarshalKey("envelope.topics", &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope.topics configuration: %w", err)
+	}
+
+	w := &Wrapper{}
+	for _, rc := range rules {
+		if rc.Pattern == "" {
+			return nil, fmt.Errorf("envelope rules need a pattern")
+		}
+		w.patterns = append(w.patterns, rc.Pattern)
+	}
+	return w, nil
+}
+
+// Wraps returns whether payloads published to t are wrapped in envelopes
+func (w *Wrapper) Wraps(t string) bool {
+	for _, pattern := range w.patterns {
+		if topic.Match(pattern, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns payload wrapped in an envelope if t is wrapped, or as it is
+// otherwise
+func (w *Wrapper) Wrap(t string, payload []byte, contentType string, meta Metadata) ([]byte, error) {
+	if !w.Wraps(t) {
+		return payload, nil
+	}
+
+	e, err := New(payload, contentType, meta)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(e)
+}
@@ -9,13 +9,16 @@ import (
 	"net"
 	"net/http"
 	"strings"
-	"sync"
 	"time"
 
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	ehttp "github.com/topfreegames/extensions/http"
+	"go.opentelemetry.io/otel/propagation"
+
+	"github.com/topfreegames/arkadiko/retry"
+	"github.com/topfreegames/arkadiko/tracing"
 )
 
 // HTTPError is the error in a http call
@@ -40,6 +43,7 @@ type HttpClient struct {
 	ConfigPath    string
 	Config        *viper.Viper
 	Logger        log.FieldLogger
+	Retry         *retry.Policy
 	httpClient    *http.Client
 }
 
@@ -51,10 +55,13 @@ type MqttPost struct {
 	ClientId string `json:"clientid"`
 }
 
-var (
-	client *HttpClient
-	once   sync.Once
-)
+// Options configures the client created by NewHttpClient
+type Options struct {
+	// ConfigPath is the configuration file read when Config is not given
+	ConfigPath string
+	Config     *viper.Viper
+	Logger     log.FieldLogger
+}
 
 func getHTTPTransport(
 	maxIdleConns, maxIdleConnsPerHost int,
@@ -82,16 +89,31 @@ func getHTTPTransport(
 	}
 }
 
-// GetHqttClient creates the hqttclient and returns it
-func GetHttpClient(configPath string, l log.FieldLogger) *HttpClient {
-	once.Do(func() {
-		client = &HttpClient{
-			ConfigPath: configPath,
-			Config:     viper.New(),
+// NewHttpClient creates a client for the HTTP API of the broker configured
+// under the httpserver key
+func NewHttpClient(opts Options) (*HttpClient, error) {
+	mc := &HttpClient{
+		ConfigPath: opts.ConfigPath,
+		Config:     opts.Config,
+		Logger:     opts.Logger,
+	}
+
+	if mc.Config == nil {
+		mc.Config = viper.New()
+		err := mc.loadConfiguration()
+		if err != nil {
+			return nil, err
 		}
-		client.configure(l)
-	})
-	return client
+	}
+
+	mc.setConfigurationDefaults()
+	mc.configureClient()
+	return mc, nil
+}
+
+// Close releases the idle connections kept by the client
+func (mc *HttpClient) Close() {
+	mc.httpClient.CloseIdleConnections()
 }
 
 // SendMessage sends a message to mqqt using a HTTP POST request
@@ -109,52 +131,75 @@ func (mc *HttpClient) SendMessage(ctx context.Context, topic string, payload str
 		ClientId: fmt.Sprintf("arkadiko-%s", uuid.NewV4().String()),
 	}
 
-	b := new(bytes.Buffer)
-	json.NewEncoder(b).Encode(form)
+	b, err := json.Marshal(form)
+	if err != nil {
+		lg.WithError(err).Error("failed to build http request")
+		return err
+	}
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	ctx, span := tracing.StartPublish(ctx, "http", topic, byte(form.Qos), retainBool)
+	attempts, err := mc.Retry.Do(ctx, func(attempt int) error {
+		return mc.post(ctx, b, lg.WithField("attempt", attempt))
+	})
+	span.SetAttributes(tracing.AttemptsKey.Int(attempts))
+	tracing.End(span, err)
+	lg = lg.WithField("attempts", attempts)
+	if err != nil {
+		lg.WithError(err).Error("failed to send message")
+		return err
+	}
+	return nil
+}
 
+// post makes a single publish request, marking the errors that retrying
+// would not fix as permanent
+func (mc *HttpClient) post(ctx context.Context, body []byte, lg log.FieldLogger) error {
 	req, err := http.NewRequest(
 		"POST",
 		mc.HttpServerUrl+"/api/v4/mqtt/publish",
-		b,
+		bytes.NewReader(body),
 	)
 	if err != nil {
 		lg.WithError(err).Error("failed to build http request")
-		return err
-	}
-	if ctx == nil {
-		ctx = context.Background()
+		return retry.Permanent(err)
 	}
 	req = req.WithContext(ctx)
 
+	// the broker continues the trace of the publish span
+	propagation.TraceContext{}.Inject(ctx, propagation.HeaderCarrier(req.Header))
 	req.SetBasicAuth(mc.user, mc.password)
 	req.Header.Add("Content-Type", "application/json")
 	res, err := mc.httpClient.Do(req)
 	if err != nil {
-		lg.WithError(err).Error("failed to make request")
+		lg.WithError(err).Warn("failed to make request")
 		return err
 	}
 	defer res.Body.Close()
 
-	body, err := io.ReadAll(res.Body)
+	resBody, err := io.ReadAll(res.Body)
 	if err != nil {
-		lg.WithError(err).Error("failed to read body")
+		lg.WithError(err).Warn("failed to read body")
 		return err
 	}
 
 	if res.StatusCode > 399 {
 		err := NewHTTPError(res.StatusCode)
-		lg.WithError(err).WithField("body", body).Error("failed request")
+		lg.WithError(err).WithField("body", resBody).Warn("failed request")
+		if !isRetryableStatus(res.StatusCode) {
+			return retry.Permanent(err)
+		}
 		return err
 	}
 	return nil
 }
 
-func (mc *HttpClient) configure(l log.FieldLogger) {
-	mc.Logger = l
-
-	mc.setConfigurationDefaults()
-	mc.loadConfiguration()
-	mc.configureClient()
+func isRetryableStatus(status int) bool {
+	return status >= 500 ||
+		status == http.StatusTooManyRequests ||
+		status == http.StatusRequestTimeout
 }
 
 func (mc *HttpClient) setConfigurationDefaults() {
@@ -180,19 +225,21 @@ func (mc *HttpClient) configureClient() {
 	mc.HttpServerUrl = mc.Config.GetString("httpserver.url")
 	mc.user = mc.Config.GetString("httpserver.user")
 	mc.password = mc.Config.GetString("httpserver.pass")
+	mc.Retry = retry.NewPolicy(mc.Config, "httpserver.retry", "http")
 }
 
-func (mc *HttpClient) loadConfiguration() {
+func (mc *HttpClient) loadConfiguration() error {
 	mc.Config.SetConfigFile(mc.ConfigPath)
 	mc.Config.SetEnvPrefix("arkadiko")
 	mc.Config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 	mc.Config.AutomaticEnv()
 
-	if err := mc.Config.ReadInConfig(); err == nil {
-		mc.Logger.WithFields(log.Fields{
-			"configFile": mc.Config.ConfigFileUsed(),
-		}).Info("Loaded config file.")
-	} else {
-		panic(fmt.Sprintf("Could not load configuration file from: %s", mc.ConfigPath))
+	if err := mc.Config.ReadInConfig(); err != nil {
+		return fmt.Errorf("Could not load configuration file from: %s", mc.ConfigPath)
 	}
+	mc.Logger.WithFields(log.Fields{
+		"configFile": mc.Config.ConfigFileUsed(),
+	}).Info("Loaded config file.")
+
+	return nil
 }
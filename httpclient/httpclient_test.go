@@ -8,6 +8,10 @@ package httpclient_test
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -16,6 +20,7 @@ import (
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
 	"github.com/topfreegames/arkadiko/httpclient"
 	"github.com/topfreegames/arkadiko/mqttclient"
 )
@@ -28,9 +33,28 @@ var _ = Describe("HTTP Client", func() {
 		logger := l.WithFields(log.Fields{})
 		ctx := context.Background()
 
+		newHttpClient := func() *httpclient.HttpClient {
+			hc, err := httpclient.NewHttpClient(httpclient.Options{
+				ConfigPath: "../config/test.yml",
+				Logger:     logger,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return hc
+		}
+
+		newMqttClient := func() *mqttclient.MqttClient {
+			mc, err := mqttclient.NewMqttClient(mqttclient.Options{
+				ConfigPath: "../config/test.yml",
+				Logger:     logger,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return mc
+		}
+
 		Describe("Specs", func() {
 			It("It should send message and receive nil", func() {
-				mc := httpclient.GetHttpClient("../config/test.yml", logger)
+				mc := newHttpClient()
+				defer mc.Close()
 
 				Expect(mc.ConfigPath).To(Equal("../config/test.yml"))
 
@@ -39,7 +63,8 @@ var _ = Describe("HTTP Client", func() {
 			})
 
 			It("It should send retained message", func() {
-				hc := httpclient.GetHttpClient("../config/test.yml", logger)
+				hc := newHttpClient()
+				defer hc.Close()
 
 				Expect(hc.ConfigPath).To(Equal("../config/test.yml"))
 
@@ -49,7 +74,8 @@ var _ = Describe("HTTP Client", func() {
 				err := hc.SendMessage(nil, topic, expectedMsg, true)
 				Expect(err).NotTo(HaveOccurred())
 
-				mc := mqttclient.GetMqttClient("../config/test.yml", nil, nil, nil, logger)
+				mc := newMqttClient()
+				defer mc.Close()
 				var msg mqtt.Message
 				var onMessageHandler = func(client mqtt.Client, message mqtt.Message) {
 					msg = message
@@ -63,12 +89,82 @@ var _ = Describe("HTTP Client", func() {
 				Expect(msg.Retained()).To(BeTrue())
 				Expect(string(msg.Payload())).To(Equal(expectedMsg))
 			})
+
+			It("It should fail if the configuration can't be loaded", func() {
+				_, err := httpclient.NewHttpClient(httpclient.Options{
+					ConfigPath: "../config/missing.yml",
+					Logger:     logger,
+				})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("Retries", func() {
+			var requests int32
+			var statuses []int
+			var ts *httptest.Server
+
+			newRetryingClient := func() *httpclient.HttpClient {
+				config := viper.New()
+				config.Set("httpserver.url", ts.URL)
+				config.Set("httpserver.retry.initialBackoff", time.Millisecond)
+				hc, err := httpclient.NewHttpClient(httpclient.Options{
+					Config: config,
+					Logger: logger,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				return hc
+			}
+
+			BeforeEach(func() {
+				requests = 0
+				ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					i := atomic.AddInt32(&requests, 1)
+					w.WriteHeader(statuses[int(i)-1])
+				}))
+			})
+
+			AfterEach(func() {
+				ts.Close()
+			})
+
+			It("Should retry server errors", func() {
+				statuses = []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK}
+				hc := newRetryingClient()
+				defer hc.Close()
+
+				err := hc.SendMessage(ctx, "test", `{"message": "hello"}`, false)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+			})
+
+			It("Should not retry client errors", func() {
+				statuses = []int{http.StatusBadRequest, http.StatusOK}
+				hc := newRetryingClient()
+				defer hc.Close()
+
+				err := hc.SendMessage(ctx, "test", `{"message": "hello"}`, false)
+				var httpErr *httpclient.HTTPError
+				Expect(errors.As(err, &httpErr)).To(BeTrue())
+				Expect(httpErr.StatusCode).To(Equal(http.StatusBadRequest))
+				Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)))
+			})
+
+			It("Should give up after the maximum attempts", func() {
+				statuses = []int{http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway, http.StatusOK}
+				hc := newRetryingClient()
+				defer hc.Close()
+
+				err := hc.SendMessage(ctx, "test", `{"message": "hello"}`, false)
+				Expect(err).To(HaveOccurred())
+				Expect(atomic.LoadInt32(&requests)).To(Equal(int32(3)))
+			})
 		})
 
 		Describe("Perf", func() {
 			Measure("it should send message", func(b Benchmarker) {
-				var onConnectHandler = func(client mqtt.Client) {}
-				mc := mqttclient.GetMqttClient("../config/test.yml", onConnectHandler, nil, nil, logger)
+				mc := newMqttClient()
+				defer mc.Close()
 
 				runtime := b.Time("runtime", func() {
 					err := mc.SendMessage(ctx, "test", `{"message": "hello"}`)
@@ -0,0 +1,148 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package idempotency
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/metrics"
+)
+
+// HeaderName is the HTTP header callers send their idempotency keys in
+const HeaderName = "Idempotency-Key"
+
+var (
+	// ErrKeyReused is returned when a key is sent again for a different request
+	ErrKeyReused = errors.New("idempotency key was already used for a different request")
+	// ErrInFlight is returned when a request with the same key is still being processed
+	ErrInFlight = errors.New("a request with the same idempotency key is still being processed")
+)
+
+// Result is what was answered to the first request sent with a key
+type Result struct {
+	Fingerprint string `json:"fingerprint"`
+	Status      int    `json:"status"`
+	ContentType string `json:"contentType"`
+	Body        string `json:"body"`
+}
+
+var (
+	metricsOnce         sync.Once
+	deduplicatedCounter *metrics.CounterVec
+)
+
+func getDeduplicatedCounter() *metrics.CounterVec {
+	metricsOnce.Do(func() {
+		deduplicatedCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "deduplicated_requests",
+			Help:      "Requests answered from a previous result with the same idempotency key",
+		}, []string{"frontend"})
+	})
+	return deduplicatedCounter
+}
+
+// Deduplicator makes sure requests sharing an idempotency key are only
+// processed once during the configured window
+type Deduplicator struct {
+	Store    Store
+	TTL      time.Duration
+	frontend string
+	inFlight map[string]bool
+	lock     sync.Mutex
+}
+
+// NewDeduplicator returns a Deduplicator configured under the idempotency
+// key. Frontend identifies who is deduplicating requests in metrics.
+func NewDeduplicator(config *viper.Viper, frontend string) (*Deduplicator, error) {
+	config.SetDefault("idempotency.ttl", 10*time.Minute)
+	config.SetDefault("idempotency.store", "memory")
+	config.SetDefault("idempotency.maxKeys", 100000)
+
+	var store Store
+	switch config.GetString("idempotency.store") {
+	case "memory":
+		store = NewMemoryStore(config.GetInt("idempotency.maxKeys"))
+	default:
+		return nil, fmt.Errorf("unknown idempotency store %s", config.GetString("idempotency.store"))
+	}
+
+	return &Deduplicator{
+		Store:    store,
+		TTL:      config.GetDuration("idempotency.ttl"),
+		frontend: frontend,
+		inFlight: map[string]bool{},
+	}, nil
+}
+
+// Fingerprint identifies a request so a key reused for a different one can
+// be told apart from a retry
+func Fingerprint(parts ...string) string {
+	h := sha256.New()
+	for _, part := range parts {
+		fmt.Fprintf(h, "%d:%s", len(part), part)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Do runs process unless key was already seen, in which case the stored
+// result is returned and deduplicated is true. Only results returned without
+// error are stored, so failed requests can be retried. Requests arriving
+// while another one with the same key is being processed fail with
+// ErrInFlight.
+func (d *Deduplicator) Do(
+	key, fingerprint string,
+	process func() (*Result, error),
+) (result *Result, deduplicated bool, err error) {
+	if stored, ok := d.Store.Get(key); ok {
+		return d.replay(stored, fingerprint)
+	}
+
+	d.lock.Lock()
+	if d.inFlight[key] {
+		d.lock.Unlock()
+		return nil, false, ErrInFlight
+	}
+	d.inFlight[key] = true
+	d.lock.Unlock()
+
+	defer func() {
+		d.lock.Lock()
+		delete(d.inFlight, key)
+		d.lock.Unlock()
+	}()
+
+	// the first request may have finished between the lookup and the lock
+	if stored, ok := d.Store.Get(key); ok {
+		return d.replay(stored, fingerprint)
+	}
+
+	result, err = process()
+	if err != nil {
+		return result, false, err
+	}
+
+	result.Fingerprint = fingerprint
+	d.Store.Set(key, result, d.TTL)
+	return result, false, nil
+}
+
+func (d *Deduplicator) replay(stored *Result, fingerprint string) (*Result, bool, error) {
+	if stored.Fingerprint != fingerprint {
+		return nil, false, ErrKeyReused
+	}
+	getDeduplicatedCounter().WithLabelValues(d.frontend).Inc()
+	return stored, true, nil
+}
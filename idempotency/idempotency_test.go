@@ -0,0 +1,124 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package idempotency_test
+
+import (
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/idempotency"
+)
+
+var _ = Describe("Idempotency", func() {
+	Describe("Memory Store", func() {
+		It("Should evict the least recently used keys", func() {
+			store := idempotency.NewMemoryStore(2)
+			store.Set("a", &idempotency.Result{Body: "a"}, time.Minute)
+			store.Set("b", &idempotency.Result{Body: "b"}, time.Minute)
+			_, ok := store.Get("a")
+			Expect(ok).To(BeTrue())
+
+			store.Set("c", &idempotency.Result{Body: "c"}, time.Minute)
+			Expect(store.Len()).To(Equal(2))
+			_, ok = store.Get("b")
+			Expect(ok).To(BeFalse())
+			_, ok = store.Get("a")
+			Expect(ok).To(BeTrue())
+		})
+
+		It("Should forget expired keys", func() {
+			store := idempotency.NewMemoryStore(2)
+			store.Set("a", &idempotency.Result{Body: "a"}, time.Millisecond)
+			time.Sleep(5 * time.Millisecond)
+			_, ok := store.Get("a")
+			Expect(ok).To(BeFalse())
+			Expect(store.Len()).To(Equal(0))
+		})
+	})
+
+	Describe("Deduplicator", func() {
+		var deduplicator *idempotency.Deduplicator
+
+		BeforeEach(func() {
+			var err error
+			deduplicator, err = idempotency.NewDeduplicator(viper.New(), "test")
+			Expect(err).NotTo(HaveOccurred())
+		})
+
+		It("Should process each key only once", func() {
+			calls := 0
+			process := func() (*idempotency.Result, error) {
+				calls++
+				return &idempotency.Result{Status: 200, Body: "sent"}, nil
+			}
+
+			result, deduplicated, err := deduplicator.Do("key", "fingerprint", process)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deduplicated).To(BeFalse())
+			Expect(result.Body).To(Equal("sent"))
+
+			result, deduplicated, err = deduplicator.Do("key", "fingerprint", process)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deduplicated).To(BeTrue())
+			Expect(result.Body).To(Equal("sent"))
+			Expect(calls).To(Equal(1))
+		})
+
+		It("Should not remember failed requests", func() {
+			calls := 0
+			failure := errors.New("failed")
+			_, _, err := deduplicator.Do("key", "fingerprint", func() (*idempotency.Result, error) {
+				calls++
+				return nil, failure
+			})
+			Expect(err).To(Equal(failure))
+
+			_, deduplicated, err := deduplicator.Do("key", "fingerprint", func() (*idempotency.Result, error) {
+				calls++
+				return &idempotency.Result{Status: 200}, nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(deduplicated).To(BeFalse())
+			Expect(calls).To(Equal(2))
+		})
+
+		It("Should fail when a key is reused for a different request", func() {
+			process := func() (*idempotency.Result, error) {
+				return &idempotency.Result{Status: 200}, nil
+			}
+			_, _, err := deduplicator.Do("key", "fingerprint", process)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = deduplicator.Do("key", "other", process)
+			Expect(err).To(Equal(idempotency.ErrKeyReused))
+		})
+
+		It("Should fail while a request with the same key is in flight", func() {
+			started := make(chan bool)
+			release := make(chan bool)
+			go func() {
+				defer GinkgoRecover()
+				deduplicator.Do("key", "fingerprint", func() (*idempotency.Result, error) {
+					started <- true
+					<-release
+					return &idempotency.Result{Status: 200}, nil
+				})
+			}()
+			<-started
+
+			_, _, err := deduplicator.Do("key", "fingerprint", func() (*idempotency.Result, error) {
+				return &idempotency.Result{Status: 200}, nil
+			})
+			Expect(err).To(Equal(idempotency.ErrInFlight))
+			release <- true
+		})
+	})
+})
@@ -0,0 +1,98 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package idempotency
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// Store remembers the results of requests by their idempotency key
+type Store interface {
+	Get(key string) (*Result, bool)
+	Set(key string, result *Result, ttl time.Duration)
+}
+
+type entry struct {
+	key       string
+	result    *Result
+	expiresAt time.Time
+}
+
+// MemoryStore is a Store bounded in size that evicts the least recently
+// used keys once full
+type MemoryStore struct {
+	maxKeys int
+	entries map[string]*list.Element
+	order   *list.List
+	lock    sync.Mutex
+}
+
+// NewMemoryStore returns a MemoryStore holding at most maxKeys keys
+func NewMemoryStore(maxKeys int) *MemoryStore {
+	return &MemoryStore{
+		maxKeys: maxKeys,
+		entries: map[string]*list.Element{},
+		order:   list.New(),
+	}
+}
+
+// Get returns the result stored for key, if it has not expired yet
+func (s *MemoryStore) Get(key string) (*Result, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	e := el.Value.(*entry)
+	if time.Now().After(e.expiresAt) {
+		s.order.Remove(el)
+		delete(s.entries, key)
+		return nil, false
+	}
+
+	s.order.MoveToFront(el)
+	return e.result, true
+}
+
+// Set stores the result for key during ttl
+func (s *MemoryStore) Set(key string, result *Result, ttl time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		e := el.Value.(*entry)
+		e.result = result
+		e.expiresAt = time.Now().Add(ttl)
+		s.order.MoveToFront(el)
+		return
+	}
+
+	s.entries[key] = s.order.PushFront(&entry{
+		key:       key,
+		result:    result,
+		expiresAt: time.Now().Add(ttl),
+	})
+
+	for s.order.Len() > s.maxKeys {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.entries, oldest.Value.(*entry).key)
+	}
+}
+
+// Len returns how many keys are stored, including expired ones not yet evicted
+func (s *MemoryStore) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.order.Len()
+}
@@ -0,0 +1,208 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package limits
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/chunking"
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/requestid"
+	"github.com/topfreegames/arkadiko/topic"
+)
+
+var (
+	// ErrBodyTooLarge is returned when a request body is larger than allowed
+	ErrBodyTooLarge = errors.New("request body is too large")
+	// ErrPayloadTooLarge is returned when a payload is larger than allowed and
+	// can not be chunked
+	ErrPayloadTooLarge = errors.New("payload is too large")
+)
+
+// PublishFunc publishes a message to topic on the named broker
+type PublishFunc func(ctx context.Context, broker, topic, payload string, retained bool) error
+
+// Limit is how large requests and payloads of a topic may be. Zero sizes
+// are not limited
+type Limit struct {
+	Pattern        string
+	MaxBodySize    int
+	MaxPayloadSize int
+	Chunking       bool
+}
+
+type ruleConfig struct {
+	Pattern        string `mapstructure:"pattern"`
+	MaxBodySize    *int   `mapstructure:"maxBodySize"`
+	MaxPayloadSize *int   `mapstructure:"maxPayloadSize"`
+	Chunking       *bool  `mapstructure:"chunking"`
+}
+
+var (
+	metricsOnce      sync.Once
+	oversizedCounter *metrics.CounterVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		oversizedCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "oversized_messages",
+			Help:      "Messages over the size limits by what was done with them",
+		}, []string{"action"})
+	})
+}
+
+// Limits maps topic patterns to size limits, falling back to the global ones
+type Limits struct {
+	Default Limit
+	Logger  log.FieldLogger
+	rules   []*Limit
+}
+
+// NewLimits returns the limits configured under the limits key
+func NewLimits(config *viper.Viper, logger log.FieldLogger) (*Limits, error) {
+	config.SetDefault("limits.maxBodySize", 1024*1024)
+	config.SetDefault("limits.maxPayloadSize", 1024*1024)
+	config.SetDefault("limits.chunking", false)
+
+	initMetrics()
+
+	l := &Limits{
+		Default: Limit{
+			MaxBodySize:    config.GetInt("limits.maxBodySize"),
+			MaxPayloadSize: config.GetInt("limits.maxPayloadSize"),
+			Chunking:       config.GetBool("limits.chunking"),
+		},
+		Logger: logger.WithField("source", "Limits"),
+	}
+	if err := l.Default.validate(); err != nil {
+		return nil, err
+	}
+
+	var rules []ruleConfig
+	err := config.UnmarshalKey("limits.topics", &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid limits.topics configuration: %w", err)
+	}
+
+	for _, rc := range rules {
+		if rc.Pattern == "" {
+			return nil, fmt.Errorf("topic limits need a pattern")
+		}
+
+		limit := l.Default
+		limit.Pattern = rc.Pattern
+		if rc.MaxBodySize != nil {
+			limit.MaxBodySize = *rc.MaxBodySize
+		}
+		if rc.MaxPayloadSize != nil {
+			limit.MaxPayloadSize = *rc.MaxPayloadSize
+		}
+		if rc.Chunking != nil {
+			limit.Chunking = *rc.Chunking
+		}
+		if err := limit.validate(); err != nil {
+			return nil, err
+		}
+
+		l.rules = append(l.rules, &limit)
+		l.Logger.WithFields(log.Fields{
+			"pattern":        limit.Pattern,
+			"maxBodySize":    limit.MaxBodySize,
+			"maxPayloadSize": limit.MaxPayloadSize,
+			"chunking":       limit.Chunking,
+		}).Info("Loaded topic limits.")
+	}
+
+	return l, nil
+}
+
+func (l Limit) validate() error {
+	if l.Chunking && l.MaxPayloadSize <= chunking.MaxHeaderSize {
+		return fmt.Errorf("maxPayloadSize must be larger than %d bytes to chunk payloads", chunking.MaxHeaderSize)
+	}
+	return nil
+}
+
+// ChunkSize returns how many bytes of a payload go in each of its chunks
+func (l Limit) ChunkSize() int {
+	return l.MaxPayloadSize - chunking.MaxHeaderSize
+}
+
+// For returns the limits of the first rule matching t, or the global ones
+func (l *Limits) For(t string) Limit {
+	for _, rule := range l.rules {
+		if topic.Match(rule.Pattern, t) {
+			return *rule
+		}
+	}
+	return l.Default
+}
+
+// CheckBody returns ErrBodyTooLarge if a request body of size bytes is
+// larger than allowed for topic t
+func (l *Limits) CheckBody(t string, size int) error {
+	limit := l.For(t)
+	if limit.MaxBodySize > 0 && size > limit.MaxBodySize {
+		oversizedCounter.WithLabelValues("rejected").Inc()
+		return ErrBodyTooLarge
+	}
+	return nil
+}
+
+// CheckPayload returns ErrPayloadTooLarge if a payload of size bytes is
+// larger than allowed for topic t and can not be chunked. Retained payloads
+// are never chunked since each chunk would replace the previous one
+func (l *Limits) CheckPayload(t string, size int, retained bool) error {
+	limit := l.For(t)
+	if limit.MaxPayloadSize <= 0 || size <= limit.MaxPayloadSize {
+		return nil
+	}
+	if limit.Chunking && !retained {
+		return nil
+	}
+	oversizedCounter.WithLabelValues("rejected").Inc()
+	return ErrPayloadTooLarge
+}
+
+// Publish publishes payload with publish, splitting it into chunks if it is
+// larger than allowed for topic t and chunking is enabled for it
+func (l *Limits) Publish(ctx context.Context, publish PublishFunc, broker, t, payload string, retained bool) error {
+	limit := l.For(t)
+	if !limit.Chunking || retained || limit.MaxPayloadSize <= 0 || len(payload) <= limit.MaxPayloadSize {
+		return publish(ctx, broker, t, payload, retained)
+	}
+
+	id := uuid.NewV4().String()
+	chunks := chunking.Split(id, []byte(payload), limit.ChunkSize())
+	requestid.Logger(ctx, l.Logger).WithFields(log.Fields{
+		"operation": "Publish",
+		"topic":     t,
+		"chunkId":   id,
+		"size":      len(payload),
+		"chunks":    len(chunks),
+	}).Debug("Publishing payload in chunks.")
+
+	for i, chunk := range chunks {
+		err := publish(ctx, broker, t, string(chunk), false)
+		if err != nil {
+			return fmt.Errorf("could not publish chunk %d of %d: %w", i+1, len(chunks), err)
+		}
+	}
+	oversizedCounter.WithLabelValues("chunked").Inc()
+
+	return nil
+}
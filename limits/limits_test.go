@@ -0,0 +1,124 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package limits_test
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/chunking"
+	"github.com/topfreegames/arkadiko/limits"
+)
+
+var _ = Describe("Limits", func() {
+	l, _ := test.NewNullLogger()
+
+	var config *viper.Viper
+
+	newLimits := func() *limits.Limits {
+		lm, err := limits.NewLimits(config, l)
+		Expect(err).NotTo(HaveOccurred())
+		return lm
+	}
+
+	BeforeEach(func() {
+		config = viper.New()
+		config.Set("limits.maxBodySize", 1000)
+		config.Set("limits.maxPayloadSize", 500)
+		config.Set("limits.topics", []map[string]interface{}{
+			{"pattern": "small/#", "maxBodySize": 10, "maxPayloadSize": 10},
+			{"pattern": "large/+", "maxPayloadSize": 300, "chunking": true},
+			{"pattern": "unlimited", "maxBodySize": 0, "maxPayloadSize": 0},
+		})
+	})
+
+	It("Should use the limits of the first matching rule", func() {
+		lm := newLimits()
+
+		Expect(lm.For("small/topic")).To(Equal(limits.Limit{Pattern: "small/#", MaxBodySize: 10, MaxPayloadSize: 10}))
+		Expect(lm.For("large/topic")).To(Equal(limits.Limit{Pattern: "large/+", MaxBodySize: 1000, MaxPayloadSize: 300, Chunking: true}))
+		Expect(lm.For("other/topic")).To(Equal(limits.Limit{MaxBodySize: 1000, MaxPayloadSize: 500}))
+	})
+
+	It("Should refuse bodies larger than allowed", func() {
+		lm := newLimits()
+
+		Expect(lm.CheckBody("small/topic", 10)).To(Succeed())
+		Expect(lm.CheckBody("small/topic", 11)).To(Equal(limits.ErrBodyTooLarge))
+		Expect(lm.CheckBody("other/topic", 1000)).To(Succeed())
+		Expect(lm.CheckBody("unlimited", 100000)).To(Succeed())
+	})
+
+	It("Should refuse payloads larger than allowed unless they can be chunked", func() {
+		lm := newLimits()
+
+		Expect(lm.CheckPayload("small/topic", 11, false)).To(Equal(limits.ErrPayloadTooLarge))
+		Expect(lm.CheckPayload("large/topic", 1000, false)).To(Succeed())
+		Expect(lm.CheckPayload("large/topic", 1000, true)).To(Equal(limits.ErrPayloadTooLarge))
+		Expect(lm.CheckPayload("unlimited", 100000, false)).To(Succeed())
+	})
+
+	It("Should fail if chunks would not fit their header", func() {
+		config.Set("limits.topics", []map[string]interface{}{
+			{"pattern": "tiny/#", "maxPayloadSize": 100, "chunking": true},
+		})
+		_, err := limits.NewLimits(config, l)
+		Expect(err).To(HaveOccurred())
+	})
+
+	Describe("Publish", func() {
+		var published []string
+		var publishErr error
+
+		publish := func(ctx context.Context, broker, topic, payload string, retained bool) error {
+			if publishErr != nil {
+				return publishErr
+			}
+			published = append(published, payload)
+			return nil
+		}
+
+		BeforeEach(func() {
+			published = nil
+			publishErr = nil
+		})
+
+		It("Should publish small payloads as they are", func() {
+			Expect(newLimits().Publish(context.Background(), publish, "default", "large/topic", "hello", false)).To(Succeed())
+			Expect(published).To(Equal([]string{"hello"}))
+		})
+
+		It("Should split large payloads into chunks that can be reassembled", func() {
+			payload := strings.Repeat("a", 1000)
+			Expect(newLimits().Publish(context.Background(), publish, "default", "large/topic", payload, false)).To(Succeed())
+			Expect(len(published)).To(BeNumerically(">", 1))
+
+			r := chunking.NewReassembler(time.Minute, len(payload), newLimits().For("large/topic").ChunkSize())
+			var result []byte
+			for _, message := range published {
+				Expect(len(message)).To(BeNumerically("<=", 300))
+				var err error
+				result, _, err = r.Add([]byte(message))
+				Expect(err).NotTo(HaveOccurred())
+			}
+			Expect(string(result)).To(Equal(payload))
+		})
+
+		It("Should fail if a chunk can not be published", func() {
+			publishErr = errors.New("broker unavailable")
+			err := newLimits().Publish(context.Background(), publish, "default", "large/topic", strings.Repeat("a", 1000), false)
+			Expect(errors.Is(err, publishErr)).To(BeTrue())
+		})
+	})
+})
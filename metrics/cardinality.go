@@ -0,0 +1,178 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+)
+
+// Other is the value labels with too many values are reported with once
+// their value is not allowed nor among the most frequent ones
+const Other = "other"
+
+// candidatesPerValue is how many values are counted for each value a label
+// may keep, so values seen often enough can take the place of the least
+// frequent ones kept
+const candidatesPerValue = 4
+
+var (
+	labelLimits     atomic.Pointer[map[string]*labelLimit]
+	collapsedValues = NewCounterVec(Opts{
+		Namespace: "arkadiko",
+		Name:      "metrics_collapsed_label_values",
+		Help:      "Measurements whose label value was reported as other because the label had too many values",
+	}, []string{"label"})
+)
+
+// labelLimit keeps the values of a label to the allowed ones plus the
+// MaxValues most frequent others, counting how often values are seen with
+// the space-saving algorithm so memory stays bounded whatever the values
+type labelLimit struct {
+	name      string
+	allowed   map[string]struct{}
+	maxValues int
+
+	lock sync.Mutex
+	// counts estimates how often each candidate value was seen
+	counts map[string]uint64
+	// kept are the values reported as they are
+	kept map[string]struct{}
+}
+
+// newLabelLimits reads the limits of label values configured under
+// metrics.labels
+func newLabelLimits(config *viper.Viper) (map[string]*labelLimit, error) {
+	names := map[string]struct{}{}
+	for _, key := range config.AllKeys() {
+		if rest, ok := strings.CutPrefix(key, "metrics.labels."); ok {
+			names[strings.SplitN(rest, ".", 2)[0]] = struct{}{}
+		}
+	}
+
+	limits := map[string]*labelLimit{}
+	for name := range names {
+		key := "metrics.labels." + name
+		maxValues := config.GetInt(key + ".maxValues")
+		if maxValues < 0 {
+			return nil, fmt.Errorf("%s.maxValues must not be negative", key)
+		}
+
+		limit := &labelLimit{
+			name:      name,
+			allowed:   map[string]struct{}{},
+			maxValues: maxValues,
+			counts:    map[string]uint64{},
+			kept:      map[string]struct{}{},
+		}
+		for _, value := range config.GetStringSlice(key + ".allowlist") {
+			limit.allowed[value] = struct{}{}
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// limit returns value if it may be reported as it is, or Other
+func (l *labelLimit) limit(value string) string {
+	if _, ok := l.allowed[value]; ok || value == "" {
+		return value
+	}
+	if l.maxValues == 0 {
+		return l.collapse()
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	count := l.count(value)
+	if _, ok := l.kept[value]; ok {
+		return value
+	}
+	if len(l.kept) < l.maxValues {
+		l.kept[value] = struct{}{}
+		return value
+	}
+
+	// the value takes the place of the least frequent kept value once it
+	// is seen more often
+	least, leastCount := "", uint64(0)
+	for kept := range l.kept {
+		if c := l.counts[kept]; least == "" || c < leastCount {
+			least, leastCount = kept, c
+		}
+	}
+	if count > leastCount {
+		delete(l.kept, least)
+		l.kept[value] = struct{}{}
+		return value
+	}
+
+	return l.collapse()
+}
+
+// count counts value as seen once more, returning how often it was seen
+func (l *labelLimit) count(value string) uint64 {
+	if c, ok := l.counts[value]; ok {
+		l.counts[value] = c + 1
+		return c + 1
+	}
+
+	if len(l.counts) < l.maxValues*candidatesPerValue {
+		l.counts[value] = 1
+		return 1
+	}
+
+	// replace the least frequent candidate, which is never seen less than
+	// it, so the count of the new value is an upper bound
+	least, leastCount := "", uint64(0)
+	for candidate, c := range l.counts {
+		if least == "" || c < leastCount {
+			least, leastCount = candidate, c
+		}
+	}
+	delete(l.counts, least)
+	l.counts[value] = leastCount + 1
+	return leastCount + 1
+}
+
+func (l *labelLimit) collapse() string {
+	collapsedValues.WithLabelValues(l.name).Inc()
+	return Other
+}
+
+// limitValues returns the values to report for labels, replacing the ones
+// over the limits of their labels with Other
+func limitValues(labels, values []string) []string {
+	limits := labelLimits.Load()
+	if limits == nil || len(labels) != len(values) {
+		return values
+	}
+
+	var limited []string
+	for i, label := range labels {
+		limit, ok := (*limits)[label]
+		if !ok {
+			continue
+		}
+		if value := limit.limit(values[i]); value != values[i] {
+			if limited == nil {
+				limited = append([]string{}, values...)
+			}
+			limited[i] = value
+		}
+	}
+	if limited == nil {
+		return values
+	}
+	return limited
+}
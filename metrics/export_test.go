@@ -0,0 +1,11 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package metrics
+
+// SetStatsD lets tests report metrics to a fake StatsD client
+var SetStatsD = setStatsD
@@ -0,0 +1,224 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/extensions/dogstatsd"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	otelprom "go.opentelemetry.io/otel/exporters/prometheus"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"google.golang.org/grpc/credentials"
+
+	"github.com/topfreegames/arkadiko/otel"
+)
+
+// InstrumentationName is the name of the meter metrics are recorded with
+const InstrumentationName = "github.com/topfreegames/arkadiko"
+
+var (
+	providerLock sync.Mutex
+	provider     *sdkmetric.MeterProvider
+	registry     atomic.Pointer[prometheus.Registry]
+	statsD       atomic.Pointer[statsDReporter]
+)
+
+func init() {
+	registry.Store(prometheus.NewRegistry())
+}
+
+func setDefaults(config *viper.Viper) {
+	config.SetDefault("metrics.exporters", []string{"prometheus", "statsd"})
+	config.SetDefault("metrics.otlp.endpoint", "")
+	config.SetDefault("metrics.otlp.insecure", true)
+	config.SetDefault("metrics.otlp.interval", 30*time.Second)
+	config.SetDefault("metrics.otlp.timeout", 10*time.Second)
+	config.SetDefault("metrics.labels.game_id.maxValues", 100)
+	config.SetDefault("metrics.labels.requestor.maxValues", 100)
+	config.SetDefault("dogstatsd.host", "localhost:8125")
+	config.SetDefault("dogstatsd.prefix", "arkadiko.")
+	config.SetDefault("dogstatsd.tags_prefix", "arkadiko.")
+	config.SetDefault("dogstatsd.rate", "1")
+}
+
+// Configure reports every metric to the exporters listed in
+// metrics.exporters, replacing the exporters of a previous configuration,
+// and limits the values of the labels configured under metrics.labels.
+// Metrics are only recorded, and not reported, before Configure is called
+func Configure(ctx context.Context, config *viper.Viper, logger log.FieldLogger) (otel.Closer, error) {
+	setDefaults(config)
+	l := logger.WithFields(log.Fields{
+		"source":    "metrics",
+		"operation": "Configure",
+	})
+
+	limits, err := newLabelLimits(config)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := otel.NewResource(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	opts := []sdkmetric.Option{sdkmetric.WithResource(res)}
+
+	reg := prometheus.NewRegistry()
+	var reporter *statsDReporter
+	for _, exporter := range config.GetStringSlice("metrics.exporters") {
+		switch exporter {
+		case "prometheus":
+			reader, err := otelprom.New(
+				otelprom.WithRegisterer(reg),
+				otelprom.WithoutCounterSuffixes(),
+				otelprom.WithoutUnits(),
+				otelprom.WithoutScopeInfo(),
+				otelprom.WithoutTargetInfo(),
+			)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, sdkmetric.WithReader(reader))
+		case "otlp":
+			reader, err := newOTLPReader(ctx, config)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, sdkmetric.WithReader(reader))
+		case "statsd":
+			reporter, err = newStatsDReporter(config)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("unknown metrics exporter %s", exporter)
+		}
+	}
+
+	mp := sdkmetric.NewMeterProvider(opts...)
+	if err := bindAll(mp.Meter(InstrumentationName)); err != nil {
+		mp.Shutdown(ctx)
+		return nil, err
+	}
+	registry.Store(reg)
+	statsD.Store(reporter)
+	labelLimits.Store(&limits)
+
+	providerLock.Lock()
+	old := provider
+	provider = mp
+	providerLock.Unlock()
+	if old != nil {
+		if err := old.Shutdown(ctx); err != nil {
+			l.WithError(err).Warn("Failed to shut down previous metrics exporters.")
+		}
+	}
+
+	l.WithField("exporters", config.GetStringSlice("metrics.exporters")).Info("Configured metrics successfully.")
+	return mp.Shutdown, nil
+}
+
+// Gatherer returns the metrics of the prometheus exporter, to be served
+// along with the metrics of the Prometheus default registry
+func Gatherer() prometheus.Gatherer {
+	return registry.Load()
+}
+
+// setStatsD reports metrics to client from then on, or stops reporting
+// them to StatsD if client is nil
+func setStatsD(client dogstatsd.Client, rate float64, tagsPrefix string) {
+	if client == nil {
+		statsD.Store(nil)
+		return
+	}
+	statsD.Store(&statsDReporter{client: client, rate: rate, tagsPrefix: tagsPrefix})
+}
+
+func newOTLPReader(ctx context.Context, config *viper.Viper) (sdkmetric.Reader, error) {
+	opts := []otlpmetricgrpc.Option{otlpmetricgrpc.WithTimeout(config.GetDuration("metrics.otlp.timeout"))}
+	if endpoint := config.GetString("metrics.otlp.endpoint"); endpoint != "" {
+		opts = append(opts, otlpmetricgrpc.WithEndpoint(endpoint))
+	}
+	if headers := config.GetStringMapString("metrics.otlp.headers"); len(headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(headers))
+	}
+	if config.GetBool("metrics.otlp.insecure") {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	} else {
+		tlsConfig, err := otel.NewTLSConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, otlpmetricgrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+	}
+
+	exporter, err := otlpmetricgrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return sdkmetric.NewPeriodicReader(exporter,
+		sdkmetric.WithInterval(config.GetDuration("metrics.otlp.interval")),
+	), nil
+}
+
+// statsDReporter bridges metrics to StatsD as they are recorded
+type statsDReporter struct {
+	client     dogstatsd.Client
+	rate       float64
+	tagsPrefix string
+}
+
+func newStatsDReporter(config *viper.Viper) (*statsDReporter, error) {
+	rate, err := strconv.ParseFloat(config.GetString("dogstatsd.rate"), 64)
+	if err != nil {
+		return nil, err
+	}
+	c, err := dogstatsd.New(config.GetString("dogstatsd.host"), config.GetString("dogstatsd.prefix"))
+	if err != nil {
+		return nil, err
+	}
+	return &statsDReporter{
+		client:     c,
+		rate:       rate,
+		tagsPrefix: config.GetString("dogstatsd.tags_prefix"),
+	}, nil
+}
+
+func (s *statsDReporter) tags(tags []string) []string {
+	prefixed := make([]string, len(tags))
+	for i, t := range tags {
+		prefixed[i] = s.tagsPrefix + t
+	}
+	return prefixed
+}
+
+func (s *statsDReporter) count(name string, value float64, tags []string) {
+	s.client.Count(name, int64(math.Round(value)), s.tags(tags), s.rate)
+}
+
+func (s *statsDReporter) gauge(name string, value float64, tags []string) {
+	s.client.Gauge(name, value, s.tags(tags), s.rate)
+}
+
+func (s *statsDReporter) timing(name string, value time.Duration, tags []string) {
+	s.client.Timing(name, value, s.tags(tags), s.rate)
+}
+
+func (s *statsDReporter) histogram(name string, value float64, tags []string) {
+	s.client.Histogram(name, value, s.tags(tags), s.rate)
+}
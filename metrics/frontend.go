@@ -0,0 +1,81 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package metrics
+
+import (
+	"sync"
+)
+
+// Frontends are the APIs messages are received through
+const (
+	FrontendHTTP = "http"
+	FrontendGRPC = "grpc"
+)
+
+// Reasons requests are rejected for before being published
+const (
+	RejectedUnauthorized      = "unauthorized"
+	RejectedTooLarge          = "too_large"
+	RejectedQueueFull         = "queue_full"
+	RejectedSchedulesFull     = "schedules_full"
+	RejectedBrokerUnavailable = "broker_unavailable"
+)
+
+// Frontend are the metrics of messages received through either the HTTP or
+// the gRPC API, which label them the same way
+type Frontend struct {
+	// MQTTLatency is labeled by frontend, broker, error, retained, game_id
+	// and requestor
+	MQTTLatency *HistogramVec
+	// AsyncRequests is labeled by frontend, broker, dropped, retained and
+	// game_id
+	AsyncRequests *CounterVec
+	// PayloadSize is labeled by frontend and broker
+	PayloadSize *HistogramVec
+	// Rejections is labeled by frontend and reason
+	Rejections *CounterVec
+}
+
+var (
+	frontendOnce      sync.Once
+	frontendSingleton *Frontend
+)
+
+// NewFrontend returns the metrics of the APIs, defining them the first time
+// it is called
+func NewFrontend() *Frontend {
+	frontendOnce.Do(func() {
+		frontendSingleton = &Frontend{
+			MQTTLatency: NewHistogramVec(Opts{
+				Namespace: "arkadiko",
+				Name:      "mqtt_latency",
+				Help:      "MQTT latency",
+				Timing:    true,
+			}, []string{"frontend", "broker", "error", "retained", "game_id", "requestor"}),
+			AsyncRequests: NewCounterVec(Opts{
+				Namespace:  "arkadiko",
+				Name:       "async_requests",
+				Help:       "Messages enqueued, or dropped, to be published asynchronously",
+				StatsDName: "async_messages",
+			}, []string{"frontend", "broker", "dropped", "retained", "game_id"}),
+			PayloadSize: NewHistogramVec(Opts{
+				Namespace: "arkadiko",
+				Name:      "payload_size_bytes",
+				Help:      "Size of the payloads of accepted messages, before compression",
+				Buckets:   []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576, 4194304},
+			}, []string{"frontend", "broker"}),
+			Rejections: NewCounterVec(Opts{
+				Namespace: "arkadiko",
+				Name:      "rejected_requests",
+				Help:      "Requests refused before publishing by reason",
+			}, []string{"frontend", "reason"}),
+		}
+	})
+
+	return frontendSingleton
+}
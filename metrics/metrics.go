@@ -0,0 +1,347 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+// Package metrics defines each metric once and reports it to every
+// configured backend.
+//
+// Metrics are recorded through the OpenTelemetry metrics API, so they reach
+// Prometheus and OTLP collectors through the exporters of the SDK, and are
+// bridged to StatsD as they are recorded. Instruments mirror the vectors of
+// the Prometheus client, and can be defined before the exporters are
+// configured.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/noop"
+)
+
+// Opts describes a metric
+type Opts struct {
+	// Namespace prefixes the name of the metric in Prometheus and OTLP, but
+	// not in StatsD, where the configured prefix is used instead
+	Namespace string
+	Name      string
+	Help      string
+	// StatsDName is the name the metric is reported to StatsD with, for
+	// metrics that had another name there before
+	StatsDName string
+	// Buckets are the upper bounds of histogram buckets, Prometheus
+	// default buckets if not given
+	Buckets []float64
+	// Timing reports histogram observations, in seconds, as StatsD timings
+	Timing bool
+}
+
+func (o Opts) name() string {
+	if o.Namespace == "" {
+		return o.Name
+	}
+	return o.Namespace + "." + o.Name
+}
+
+func (o Opts) statsDName() string {
+	if o.StatsDName != "" {
+		return o.StatsDName
+	}
+	return o.Name
+}
+
+// instrument is bound to the meter of every configuration, so metrics
+// defined before the exporters are configured are exported too
+type instrument interface {
+	bind(meter metric.Meter) error
+}
+
+var (
+	instrumentsLock sync.Mutex
+	instruments     []instrument
+	currentMeter    metric.Meter = noop.NewMeterProvider().Meter("")
+)
+
+func register(i instrument) {
+	instrumentsLock.Lock()
+	defer instrumentsLock.Unlock()
+
+	instruments = append(instruments, i)
+	if err := i.bind(currentMeter); err != nil {
+		panic(err)
+	}
+}
+
+// bindAll binds every instrument to meter, failing if any can't be
+// created
+func bindAll(meter metric.Meter) error {
+	instrumentsLock.Lock()
+	defer instrumentsLock.Unlock()
+
+	for _, i := range instruments {
+		if err := i.bind(meter); err != nil {
+			return err
+		}
+	}
+	currentMeter = meter
+	return nil
+}
+
+// series is a set of label values of a metric
+type series struct {
+	attrs metric.MeasurementOption
+	set   attribute.Set
+	tags  []string
+}
+
+func newSeries(opts Opts, labels, values []string) series {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("metric %s has %d labels but got %d values: %v", opts.Name, len(labels), len(values), values))
+	}
+
+	kvs := make([]attribute.KeyValue, len(labels))
+	tags := make([]string, 0, len(labels))
+	for i, label := range labels {
+		kvs[i] = attribute.String(label, values[i])
+		// StatsD gets no tags for labels without a value, such as the
+		// requestor of messages sent through gRPC
+		if values[i] != "" {
+			tags = append(tags, label+":"+values[i])
+		}
+	}
+	set := attribute.NewSet(kvs...)
+	return series{attrs: metric.WithAttributeSet(set), set: set, tags: tags}
+}
+
+// CounterVec counts events by label values
+type CounterVec struct {
+	opts    Opts
+	labels  []string
+	counter atomic.Pointer[metric.Float64Counter]
+}
+
+// NewCounterVec defines a counter with the given labels
+func NewCounterVec(opts Opts, labels []string) *CounterVec {
+	v := &CounterVec{opts: opts, labels: labels}
+	register(v)
+	return v
+}
+
+func (v *CounterVec) bind(meter metric.Meter) error {
+	counter, err := meter.Float64Counter(v.opts.name(), metric.WithDescription(v.opts.Help))
+	if err != nil {
+		return err
+	}
+	v.counter.Store(&counter)
+	return nil
+}
+
+// WithLabelValues returns the counter of the given label values, in the
+// order the labels were defined in. Values over the limits of their labels
+// are replaced with Other
+func (v *CounterVec) WithLabelValues(values ...string) Counter {
+	return Counter{vec: v, series: newSeries(v.opts, v.labels, limitValues(v.labels, values))}
+}
+
+// Counter is a counter of a set of label values
+type Counter struct {
+	vec    *CounterVec
+	series series
+}
+
+// Inc counts one event
+func (c Counter) Inc() {
+	c.Add(1)
+}
+
+// Add counts value events, which must not be negative
+func (c Counter) Add(value float64) {
+	(*c.vec.counter.Load()).Add(context.Background(), value, c.series.attrs)
+	if s := statsD.Load(); s != nil {
+		s.count(c.vec.opts.statsDName(), value, c.series.tags)
+	}
+}
+
+// HistogramVec observes distributions of values by label values
+type HistogramVec struct {
+	opts      Opts
+	labels    []string
+	histogram atomic.Pointer[metric.Float64Histogram]
+}
+
+// NewHistogramVec defines a histogram with the given labels
+func NewHistogramVec(opts Opts, labels []string) *HistogramVec {
+	if opts.Buckets == nil {
+		opts.Buckets = prometheus.DefBuckets
+	}
+	v := &HistogramVec{opts: opts, labels: labels}
+	register(v)
+	return v
+}
+
+func (v *HistogramVec) bind(meter metric.Meter) error {
+	histogram, err := meter.Float64Histogram(v.opts.name(),
+		metric.WithDescription(v.opts.Help),
+		metric.WithExplicitBucketBoundaries(v.opts.Buckets...),
+	)
+	if err != nil {
+		return err
+	}
+	v.histogram.Store(&histogram)
+	return nil
+}
+
+// WithLabelValues returns the histogram of the given label values, in the
+// order the labels were defined in. Values over the limits of their labels
+// are replaced with Other
+func (v *HistogramVec) WithLabelValues(values ...string) Histogram {
+	return Histogram{vec: v, series: newSeries(v.opts, v.labels, limitValues(v.labels, values))}
+}
+
+// Histogram is a histogram of a set of label values
+type Histogram struct {
+	vec    *HistogramVec
+	series series
+}
+
+// Observe records value
+func (h Histogram) Observe(value float64) {
+	(*h.vec.histogram.Load()).Record(context.Background(), value, h.series.attrs)
+	if s := statsD.Load(); s != nil {
+		if h.vec.opts.Timing {
+			s.timing(h.vec.opts.statsDName(), time.Duration(value*float64(time.Second)), h.series.tags)
+		} else {
+			s.histogram(h.vec.opts.statsDName(), value, h.series.tags)
+		}
+	}
+}
+
+// GaugeVec keeps values that go up and down by label values
+type GaugeVec struct {
+	opts   Opts
+	labels []string
+	lock   sync.RWMutex
+	values map[string]*gaugeValue
+	reg    metric.Registration
+}
+
+type gaugeValue struct {
+	series series
+	bits   atomic.Uint64
+}
+
+func (g *gaugeValue) load() float64 {
+	return math.Float64frombits(g.bits.Load())
+}
+
+// NewGaugeVec defines a gauge with the given labels
+func NewGaugeVec(opts Opts, labels []string) *GaugeVec {
+	v := &GaugeVec{opts: opts, labels: labels, values: map[string]*gaugeValue{}}
+	register(v)
+	return v
+}
+
+// NewGauge defines a gauge without labels
+func NewGauge(opts Opts) Gauge {
+	return NewGaugeVec(opts, nil).WithLabelValues()
+}
+
+func (v *GaugeVec) bind(meter metric.Meter) error {
+	gauge, err := meter.Float64ObservableGauge(v.opts.name(), metric.WithDescription(v.opts.Help))
+	if err != nil {
+		return err
+	}
+	reg, err := meter.RegisterCallback(func(ctx context.Context, o metric.Observer) error {
+		v.lock.RLock()
+		defer v.lock.RUnlock()
+		for _, value := range v.values {
+			o.ObserveFloat64(gauge, value.load(), metric.WithAttributeSet(value.series.set))
+		}
+		return nil
+	}, gauge)
+	if err != nil {
+		return err
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.reg != nil {
+		v.reg.Unregister()
+	}
+	v.reg = reg
+	return nil
+}
+
+// WithLabelValues returns the gauge of the given label values, in the
+// order the labels were defined in. Values over the limits of their labels
+// are replaced with Other
+func (v *GaugeVec) WithLabelValues(values ...string) Gauge {
+	values = limitValues(v.labels, values)
+	key := strings.Join(values, "\xff")
+
+	v.lock.RLock()
+	value, ok := v.values[key]
+	v.lock.RUnlock()
+	if ok {
+		return Gauge{vec: v, value: value}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if value, ok = v.values[key]; !ok {
+		value = &gaugeValue{series: newSeries(v.opts, v.labels, values)}
+		v.values[key] = value
+	}
+	return Gauge{vec: v, value: value}
+}
+
+// Gauge is a gauge of a set of label values
+type Gauge struct {
+	vec   *GaugeVec
+	value *gaugeValue
+}
+
+// Set sets the gauge to value
+func (g Gauge) Set(value float64) {
+	g.value.bits.Store(math.Float64bits(value))
+	g.report(value)
+}
+
+// Add adds value, which may be negative, to the gauge
+func (g Gauge) Add(value float64) {
+	for {
+		old := g.value.bits.Load()
+		updated := math.Float64frombits(old) + value
+		if g.value.bits.CompareAndSwap(old, math.Float64bits(updated)) {
+			g.report(updated)
+			return
+		}
+	}
+}
+
+// Inc adds one to the gauge
+func (g Gauge) Inc() {
+	g.Add(1)
+}
+
+// Dec subtracts one from the gauge
+func (g Gauge) Dec() {
+	g.Add(-1)
+}
+
+func (g Gauge) report(value float64) {
+	if s := statsD.Load(); s != nil {
+		s.gauge(g.vec.opts.statsDName(), value, g.value.series.tags)
+	}
+}
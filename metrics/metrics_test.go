@@ -0,0 +1,331 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package metrics_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/metrics"
+)
+
+type fakeStatsD struct {
+	lock  sync.Mutex
+	calls []string
+}
+
+func (f *fakeStatsD) record(call string) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.calls = append(f.calls, call)
+	return nil
+}
+
+func (f *fakeStatsD) Calls() []string {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]string{}, f.calls...)
+}
+
+func (f *fakeStatsD) Incr(name string, tags []string, rate float64) error {
+	return f.record(fmt.Sprintf("incr %s %v", name, tags))
+}
+
+func (f *fakeStatsD) Count(name string, value int64, tags []string, rate float64) error {
+	return f.record(fmt.Sprintf("count %s %d %v", name, value, tags))
+}
+
+func (f *fakeStatsD) Gauge(name string, value float64, tags []string, rate float64) error {
+	return f.record(fmt.Sprintf("gauge %s %g %v", name, value, tags))
+}
+
+func (f *fakeStatsD) Timing(name string, value time.Duration, tags []string, rate float64) error {
+	return f.record(fmt.Sprintf("timing %s %s %v", name, value, tags))
+}
+
+func (f *fakeStatsD) Histogram(name string, value float64, tags []string, rate float64) error {
+	return f.record(fmt.Sprintf("histogram %s %g %v", name, value, tags))
+}
+
+var _ = Describe("Metrics", func() {
+	l, _ := test.NewNullLogger()
+	ctx := context.Background()
+
+	var config *viper.Viper
+
+	BeforeEach(func() {
+		config = viper.New()
+		config.Set("metrics.exporters", []string{"prometheus"})
+		config.Set("jaeger.serviceName", "arkadiko-test")
+	})
+
+	AfterEach(func() {
+		// forget the label limits of the spec
+		_, err := metrics.Configure(ctx, viper.New(), l)
+		Expect(err).NotTo(HaveOccurred())
+		metrics.SetStatsD(nil, 0, "")
+	})
+
+	configure := func() {
+		closer, err := metrics.Configure(ctx, config, l)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(closer).NotTo(BeNil())
+	}
+
+	gather := func(name string) *dto.MetricFamily {
+		families, err := metrics.Gatherer().Gather()
+		Expect(err).NotTo(HaveOccurred())
+		for _, family := range families {
+			if family.GetName() == name {
+				return family
+			}
+		}
+		return nil
+	}
+
+	labels := func(m *dto.Metric) map[string]string {
+		values := map[string]string{}
+		for _, pair := range m.GetLabel() {
+			values[pair.GetName()] = pair.GetValue()
+		}
+		return values
+	}
+
+	Describe("Configure", func() {
+		It("should fail on unknown exporters", func() {
+			config.Set("metrics.exporters", []string{"graphite"})
+			_, err := metrics.Configure(ctx, config, l)
+			Expect(err).To(MatchError("unknown metrics exporter graphite"))
+		})
+
+		It("should export instruments defined before it is called", func() {
+			counter := metrics.NewCounterVec(metrics.Opts{
+				Namespace: "arkadiko",
+				Name:      "test_early",
+				Help:      "Counter defined before configuration",
+			}, []string{"kind"})
+			counter.WithLabelValues("lost").Inc()
+
+			configure()
+			counter.WithLabelValues("kept").Add(2)
+
+			family := gather("arkadiko_test_early")
+			Expect(family).NotTo(BeNil())
+			Expect(family.GetHelp()).To(Equal("Counter defined before configuration"))
+			Expect(family.GetMetric()).To(HaveLen(1))
+			Expect(labels(family.GetMetric()[0])).To(Equal(map[string]string{"kind": "kept"}))
+			Expect(family.GetMetric()[0].GetCounter().GetValue()).To(Equal(2.0))
+		})
+
+		It("should replace the exporters of a previous configuration", func() {
+			counter := metrics.NewCounterVec(metrics.Opts{
+				Namespace: "arkadiko",
+				Name:      "test_reconfigured",
+			}, nil)
+			configure()
+			counter.WithLabelValues().Inc()
+			first := metrics.Gatherer()
+
+			configure()
+			counter.WithLabelValues().Inc()
+			Expect(metrics.Gatherer()).NotTo(BeIdenticalTo(first))
+			Expect(gather("arkadiko_test_reconfigured").GetMetric()[0].GetCounter().GetValue()).To(Equal(1.0))
+		})
+
+		It("should not export to prometheus if it is not configured", func() {
+			config.Set("metrics.exporters", []string{})
+			counter := metrics.NewCounterVec(metrics.Opts{Namespace: "arkadiko", Name: "test_unexported"}, nil)
+			configure()
+			counter.WithLabelValues().Inc()
+			Expect(gather("arkadiko_test_unexported")).To(BeNil())
+		})
+	})
+
+	Describe("HistogramVec", func() {
+		It("should export observations in the configured buckets", func() {
+			histogram := metrics.NewHistogramVec(metrics.Opts{
+				Namespace: "arkadiko",
+				Name:      "test_histogram",
+				Buckets:   []float64{1, 10},
+			}, []string{"route"})
+			configure()
+
+			histogram.WithLabelValues("/a").Observe(0.5)
+			histogram.WithLabelValues("/a").Observe(5)
+
+			h := gather("arkadiko_test_histogram").GetMetric()[0].GetHistogram()
+			Expect(h.GetSampleCount()).To(Equal(uint64(2)))
+			Expect(h.GetSampleSum()).To(Equal(5.5))
+			Expect(h.GetBucket()).To(HaveLen(2))
+			Expect(h.GetBucket()[0].GetUpperBound()).To(Equal(1.0))
+			Expect(h.GetBucket()[0].GetCumulativeCount()).To(Equal(uint64(1)))
+			Expect(h.GetBucket()[1].GetCumulativeCount()).To(Equal(uint64(2)))
+		})
+	})
+
+	Describe("GaugeVec", func() {
+		It("should export the last value of each set of labels", func() {
+			gauge := metrics.NewGaugeVec(metrics.Opts{Namespace: "arkadiko", Name: "test_gauge"}, []string{"broker"})
+			configure()
+
+			gauge.WithLabelValues("a").Set(3)
+			gauge.WithLabelValues("a").Inc()
+			gauge.WithLabelValues("b").Inc()
+			gauge.WithLabelValues("b").Dec()
+
+			values := map[string]float64{}
+			for _, m := range gather("arkadiko_test_gauge").GetMetric() {
+				values[labels(m)["broker"]] = m.GetGauge().GetValue()
+			}
+			Expect(values).To(Equal(map[string]float64{"a": 4, "b": 0}))
+		})
+	})
+
+	It("should panic when given the wrong number of label values", func() {
+		counter := metrics.NewCounterVec(metrics.Opts{Name: "test_labels"}, []string{"a", "b"})
+		Expect(func() { counter.WithLabelValues("a") }).To(Panic())
+	})
+
+	Describe("Label limits", func() {
+		value := func(name string, want map[string]string) float64 {
+			family := gather(name)
+			Expect(family).NotTo(BeNil())
+		metric:
+			for _, m := range family.GetMetric() {
+				for k, v := range want {
+					if labels(m)[k] != v {
+						continue metric
+					}
+				}
+				return m.GetCounter().GetValue()
+			}
+			return 0
+		}
+
+		It("should report values that are not allowed as other", func() {
+			config.Set("metrics.labels.game.allowlist", []string{"sniper"})
+			counter := metrics.NewCounterVec(metrics.Opts{Namespace: "arkadiko", Name: "test_allowlist"}, []string{"game", "kind"})
+			configure()
+
+			counter.WithLabelValues("sniper", "a").Inc()
+			counter.WithLabelValues("chess", "b").Inc()
+			counter.WithLabelValues("", "c").Inc()
+
+			Expect(value("arkadiko_test_allowlist", map[string]string{"game": "sniper", "kind": "a"})).To(Equal(1.0))
+			Expect(value("arkadiko_test_allowlist", map[string]string{"game": "other", "kind": "b"})).To(Equal(1.0))
+			Expect(value("arkadiko_test_allowlist", map[string]string{"game": "", "kind": "c"})).To(Equal(1.0))
+			Expect(value("arkadiko_metrics_collapsed_label_values", map[string]string{"label": "game"})).To(Equal(1.0))
+		})
+
+		It("should keep the most frequent values", func() {
+			config.Set("metrics.labels.game.maxValues", 2)
+			counter := metrics.NewCounterVec(metrics.Opts{Namespace: "arkadiko", Name: "test_top"}, []string{"game"})
+			configure()
+
+			for i := 0; i < 3; i++ {
+				counter.WithLabelValues("sniper").Inc()
+				counter.WithLabelValues("chess").Inc()
+			}
+			for i := 0; i < 4; i++ {
+				counter.WithLabelValues("poker").Inc()
+			}
+
+			Expect(value("arkadiko_test_top", map[string]string{"game": "other"})).To(Equal(3.0))
+			Expect(value("arkadiko_test_top", map[string]string{"game": "poker"})).To(Equal(1.0))
+			Expect(value("arkadiko_metrics_collapsed_label_values", map[string]string{"label": "game"})).To(Equal(3.0))
+
+			// poker took the place of one of the others, which is now
+			// seen less often
+			counter.WithLabelValues("sniper").Inc()
+			counter.WithLabelValues("chess").Inc()
+			Expect(value("arkadiko_test_top", map[string]string{"game": "other"})).To(Equal(4.0))
+		})
+
+		It("should apply to every exporter", func() {
+			config.Set("metrics.labels.game.allowlist", []string{"sniper"})
+			counter := metrics.NewCounterVec(metrics.Opts{Namespace: "arkadiko", Name: "test_limited_statsd"}, []string{"game"})
+			configure()
+			statsD := &fakeStatsD{}
+			metrics.SetStatsD(statsD, 1, "")
+
+			counter.WithLabelValues("chess").Inc()
+			Expect(statsD.Calls()).To(ContainElement("count test_limited_statsd 1 [game:other]"))
+		})
+
+		It("should fail for negative limits", func() {
+			config.Set("metrics.labels.game.maxValues", -1)
+			_, err := metrics.Configure(ctx, config, l)
+			Expect(err).To(MatchError("metrics.labels.game.maxValues must not be negative"))
+		})
+	})
+
+	Describe("StatsD", func() {
+		var statsD *fakeStatsD
+
+		BeforeEach(func() {
+			statsD = &fakeStatsD{}
+			metrics.SetStatsD(statsD, 1, "arkadiko.")
+		})
+
+		It("should report counters, gauges and histograms with prefixed tags", func() {
+			counter := metrics.NewCounterVec(metrics.Opts{Namespace: "arkadiko", Name: "test_statsd_counter"}, []string{"kind"})
+			gauge := metrics.NewGauge(metrics.Opts{Namespace: "arkadiko", Name: "test_statsd_gauge"})
+			histogram := metrics.NewHistogramVec(metrics.Opts{Namespace: "arkadiko", Name: "test_statsd_histogram"}, []string{"kind"})
+
+			counter.WithLabelValues("a").Inc()
+			gauge.Set(2)
+			histogram.WithLabelValues("b").Observe(0.25)
+
+			Expect(statsD.Calls()).To(Equal([]string{
+				"count test_statsd_counter 1 [arkadiko.kind:a]",
+				"gauge test_statsd_gauge 2 []",
+				"histogram test_statsd_histogram 0.25 [arkadiko.kind:b]",
+			}))
+		})
+
+		It("should omit tags of labels without a value", func() {
+			counter := metrics.NewCounterVec(metrics.Opts{Namespace: "arkadiko", Name: "test_statsd_empty"}, []string{"broker", "requestor"})
+
+			counter.WithLabelValues("default", "").Inc()
+
+			Expect(statsD.Calls()).To(Equal([]string{
+				"count test_statsd_empty 1 [arkadiko.broker:default]",
+			}))
+		})
+
+		It("should report timings under their StatsD name", func() {
+			histogram := metrics.NewHistogramVec(metrics.Opts{
+				Namespace:  "arkadiko",
+				Name:       "test_statsd_latency",
+				StatsDName: "test_statsd_latency_milliseconds",
+				Timing:     true,
+			}, []string{"route"})
+
+			histogram.WithLabelValues("/a").Observe(0.25)
+
+			Expect(statsD.Calls()).To(Equal([]string{
+				"timing test_statsd_latency_milliseconds 250ms [arkadiko.route:/a]",
+			}))
+		})
+
+		It("should stop reporting once configured without statsd", func() {
+			counter := metrics.NewCounterVec(metrics.Opts{Namespace: "arkadiko", Name: "test_statsd_stopped"}, nil)
+			configure()
+			counter.WithLabelValues().Inc()
+			Expect(statsD.Calls()).To(BeEmpty())
+		})
+	})
+})
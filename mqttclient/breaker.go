@@ -0,0 +1,101 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/sony/gobreaker"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/retry"
+)
+
+// ErrBrokerUnavailable is returned without trying to publish while the
+// circuit breaker of a broker is open
+var ErrBrokerUnavailable = errors.New("broker is unavailable")
+
+var (
+	breakerMetricsOnce sync.Once
+	breakerStateGauge  *metrics.GaugeVec
+)
+
+func initBreakerMetrics() {
+	breakerMetricsOnce.Do(func() {
+		breakerStateGauge = metrics.NewGaugeVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "circuit_breaker_state",
+			Help:      "State of the circuit breaker of each broker: 0 closed, 1 half-open, 2 open",
+		}, []string{"broker"})
+	})
+}
+
+// newBreaker returns the circuit breaker configured under mqttserver.breaker,
+// or nil if it is disabled
+func newBreaker(config *viper.Viper, broker string, l log.FieldLogger) *gobreaker.TwoStepCircuitBreaker {
+	config.SetDefault("mqttserver.breaker.enabled", true)
+	config.SetDefault("mqttserver.breaker.minRequests", 10)
+	config.SetDefault("mqttserver.breaker.failureRatio", 0.5)
+	config.SetDefault("mqttserver.breaker.interval", 10*time.Second)
+	config.SetDefault("mqttserver.breaker.openDuration", 5*time.Second)
+	config.SetDefault("mqttserver.breaker.halfOpenRequests", 1)
+
+	if !config.GetBool("mqttserver.breaker.enabled") {
+		return nil
+	}
+
+	initBreakerMetrics()
+	breakerStateGauge.WithLabelValues(broker).Set(float64(gobreaker.StateClosed))
+
+	minRequests := config.GetUint32("mqttserver.breaker.minRequests")
+	failureRatio := config.GetFloat64("mqttserver.breaker.failureRatio")
+
+	return gobreaker.NewTwoStepCircuitBreaker(gobreaker.Settings{
+		Name:        broker,
+		MaxRequests: config.GetUint32("mqttserver.breaker.halfOpenRequests"),
+		Interval:    config.GetDuration("mqttserver.breaker.interval"),
+		Timeout:     config.GetDuration("mqttserver.breaker.openDuration"),
+		// publishes left out of the counts are requested but neither
+		// succeed nor fail, so only the ones that did are considered
+		ReadyToTrip: func(counts gobreaker.Counts) bool {
+			counted := counts.TotalSuccesses + counts.TotalFailures
+			return counted >= minRequests &&
+				float64(counts.TotalFailures)/float64(counted) >= failureRatio
+		},
+		OnStateChange: func(name string, from, to gobreaker.State) {
+			l.WithFields(log.Fields{
+				"from": from.String(),
+				"to":   to.String(),
+			}).Warn("Circuit breaker changed state.")
+			breakerStateGauge.WithLabelValues(name).Set(float64(to))
+		},
+	})
+}
+
+// breakerOutcome returns whether a publish that ended with err succeeded as
+// far as the breaker is concerned, and whether it counts at all. Publishes
+// refused for being invalid say nothing about the broker, so they count as
+// successes, and neither do the ones the caller gave up on, which are left
+// out. While half-open they count as failures instead, as leaving out the
+// probe would keep the breaker half-open
+func breakerOutcome(ctx context.Context, state gobreaker.State, err error) (success, counted bool) {
+	switch {
+	case err == nil:
+		return true, true
+	case ctx.Err() != nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		return false, state == gobreaker.StateHalfOpen
+	case retry.IsPermanent(err):
+		return true, true
+	default:
+		return false, true
+	}
+}
@@ -0,0 +1,73 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package mqttclient
+
+import (
+	"context"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	jaeger "github.com/topfreegames/extensions/jaeger/mqtt"
+	"github.com/topfreegames/extensions/mqtt/interfaces"
+)
+
+// tracedClient traces publishes and subscriptions like the extensions mqtt
+// client does, while keeping the paho client around so it can be
+// disconnected
+type tracedClient struct {
+	ctx   context.Context
+	inner mqtt.Client
+	opts  *mqtt.ClientOptions
+}
+
+func newTracedClient(opts *mqtt.ClientOptions) *tracedClient {
+	return &tracedClient{context.Background(), mqtt.NewClient(opts), opts}
+}
+
+func (c *tracedClient) WithContext(ctx context.Context) interfaces.Client {
+	if ctx == nil {
+		panic("Context must be non-nil")
+	}
+	return &tracedClient{ctx, c.inner, c.opts}
+}
+
+func (c *tracedClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var token mqtt.Token
+
+	jaeger.Trace(c.ctx, "PUBLISH", topic, qos, c.opts.PingTimeout, func() mqtt.Token {
+		token = c.inner.Publish(topic, qos, retained, payload)
+		return token
+	})
+
+	return token
+}
+
+func (c *tracedClient) Subscribe(topic string, qos byte, callback mqtt.MessageHandler) mqtt.Token {
+	var token mqtt.Token
+
+	jaeger.Trace(c.ctx, "SUBSCRIBE", topic, qos, c.opts.PingTimeout, func() mqtt.Token {
+		token = c.inner.Subscribe(topic, qos, callback)
+		return token
+	})
+
+	return token
+}
+
+func (c *tracedClient) Connect() mqtt.Token {
+	return c.inner.Connect()
+}
+
+func (c *tracedClient) IsConnected() bool {
+	return c.inner.IsConnected()
+}
+
+func (c *tracedClient) Disconnect(quiesce uint) {
+	c.inner.Disconnect(quiesce)
+}
+
+func (c *tracedClient) Unsubscribe(topics ...string) mqtt.Token {
+	return c.inner.Unsubscribe(topics...)
+}
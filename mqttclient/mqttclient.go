@@ -10,77 +10,133 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"strings"
-	"sync"
 	"time"
 
 	log "github.com/sirupsen/logrus"
-	emqtt "github.com/topfreegames/extensions/mqtt"
 	"github.com/topfreegames/extensions/mqtt/interfaces"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/eclipse/paho.mqtt.golang/packets"
 	uuid "github.com/satori/go.uuid"
+	"github.com/sony/gobreaker"
 	"github.com/spf13/viper"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/topfreegames/arkadiko/requestid"
+	"github.com/topfreegames/arkadiko/retry"
+	"github.com/topfreegames/arkadiko/tracing"
 )
 
 // MqttClient contains the data needed to connect the client
 type MqttClient struct {
+	Name           string
 	MqttServerHost string
 	MqttServerPort int
 	Timeout        time.Duration
 	ConfigPath     string
 	Config         *viper.Viper
 	Logger         log.FieldLogger
-	MqttClient     interfaces.Client
-	maxRetries     int
+	// MqttClient is the first pooled connection, kept for subscribing
+	MqttClient  interfaces.Client
+	Connections []*Connection
+	Retry       *retry.Policy
+	Breaker     *gobreaker.TwoStepCircuitBreaker
+	ring        *ring
+}
+
+var errTimeout = errors.New("timed out waiting for the broker to acknowledge the message")
+
+// ErrInvalidTopic is returned without trying to publish to topics MQTT does
+// not allow publishing to
+var ErrInvalidTopic = errors.New("invalid topic")
+
+// terminalErrors are refusals of the broker that publishing again won't
+// change
+var terminalErrors = []error{
+	packets.ErrorRefusedBadProtocolVersion,
+	packets.ErrorRefusedIDRejected,
+	packets.ErrorRefusedBadUsernameOrPassword,
+	packets.ErrorRefusedNotAuthorised,
 }
 
-var client *MqttClient
-var once sync.Once
+// qos is the quality of service messages are published with
+const qos = 1
+
+// Options configures the clients created by NewMqttClient and NewRouter
+type Options struct {
+	// ConfigPath is the configuration file read when Config is not given
+	ConfigPath string
+	Config     *viper.Viper
+	// Name is the name of the broker, DefaultBroker if not given
+	Name             string
+	OnConnect        mqtt.OnConnectHandler
+	OnConnectionLost mqtt.ConnectionLostHandler
+	OnReconnecting   mqtt.ReconnectHandler
+	Logger           log.FieldLogger
+}
 
-// GetMqttClient creates the mqttclient and returns it
-func GetMqttClient(
-	configPath string,
-	onConnectHandler mqtt.OnConnectHandler,
-	onConnectionLost mqtt.ConnectionLostHandler,
-	onReconnecting mqtt.ReconnectHandler,
-	l log.FieldLogger,
-) *MqttClient {
-	defaultOnConnectHandler := func(client mqtt.Client) {
-		l.Info("Connected to MQTT server")
+func (o Options) withDefaults() (Options, error) {
+	if o.Name == "" {
+		o.Name = DefaultBroker
 	}
 
-	defaultOnConnectionLostHandler := func(client mqtt.Client, err error) {
-		l.WithError(err).Error("Connection to MQTT server lost")
+	if o.Config == nil {
+		config, err := loadConfiguration(o.ConfigPath, o.Logger)
+		if err != nil {
+			return o, err
+		}
+		o.Config = config
 	}
 
-	defaultOnReconnectingHandler := func(client mqtt.Client, options *mqtt.ClientOptions) {
-		l.Info("Reconnecting to MQTT server")
+	l := o.Logger
+	if o.OnConnect == nil {
+		o.OnConnect = func(client mqtt.Client) {
+			l.Info("Connected to MQTT server")
+		}
 	}
 
-	if onConnectHandler == nil {
-		onConnectHandler = defaultOnConnectHandler
+	if o.OnConnectionLost == nil {
+		o.OnConnectionLost = func(client mqtt.Client, err error) {
+			l.WithError(err).Error("Connection to MQTT server lost")
+		}
 	}
 
-	if onConnectionLost == nil {
-		onConnectionLost = defaultOnConnectionLostHandler
+	if o.OnReconnecting == nil {
+		o.OnReconnecting = func(client mqtt.Client, options *mqtt.ClientOptions) {
+			l.Info("Reconnecting to MQTT server")
+		}
 	}
 
-	if onReconnecting == nil {
-		onReconnecting = defaultOnReconnectingHandler
+	return o, nil
+}
+
+// NewMqttClient connects to the broker configured under the mqttserver key
+// and returns its client, which must be closed once no longer needed
+func NewMqttClient(opts Options) (*MqttClient, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
 	}
 
-	once.Do(func() {
-		client = &MqttClient{
-			ConfigPath: configPath,
-			Config:     viper.New(),
-		}
-		client.configure(l)
-		client.start(onConnectHandler, onConnectionLost, onReconnecting)
-	})
-	return client
+	mc := &MqttClient{
+		Name:       opts.Name,
+		ConfigPath: opts.ConfigPath,
+		Config:     opts.Config,
+		Logger: opts.Logger.WithFields(log.Fields{
+			"source": "MqttClient",
+			"broker": opts.Name,
+		}),
+	}
+	mc.setConfigurationDefaults()
+	mc.configureClient()
+	mc.start(opts.OnConnect, opts.OnConnectionLost, opts.OnReconnecting)
+	return mc, nil
 }
 
 // SendMessage sends the message with the given payload to topic
@@ -93,8 +149,66 @@ func (mc *MqttClient) SendRetainedMessage(ctx context.Context, topic string, mes
 	return mc.PublishMessage(ctx, topic, message, true)
 }
 
-func (mc *MqttClient) PublishMessage(ctx context.Context, topic string, message string, retained bool) error {
-	l := mc.Logger.WithFields(
+// PublishMessage publishes the message, failing fast with
+// ErrBrokerUnavailable while the circuit breaker is open
+func (mc *MqttClient) PublishMessage(ctx context.Context, topic string, message string, retained bool) (err error) {
+	ctx, span := tracing.StartPublish(ctx, mc.Name, topic, qos, retained)
+	defer func() {
+		tracing.End(span, err)
+	}()
+
+	inFlight := inFlightGauge.WithLabelValues(mc.Name)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	if mc.Breaker == nil {
+		return mc.publishMessage(ctx, topic, message, retained)
+	}
+
+	done, err := mc.Breaker.Allow()
+	if err == gobreaker.ErrOpenState || err == gobreaker.ErrTooManyRequests {
+		return ErrBrokerUnavailable
+	}
+	if err != nil {
+		return err
+	}
+
+	err = mc.publishMessage(ctx, topic, message, retained)
+	if success, counted := breakerOutcome(ctx, mc.Breaker.State(), err); counted {
+		done(success)
+	}
+	return err
+}
+
+// publishError keeps how many times a message was tried before giving up
+type publishError struct {
+	attempts int
+	err      error
+}
+
+func (e *publishError) Error() string {
+	return e.err.Error()
+}
+
+func (e *publishError) Unwrap() error {
+	return e.err
+}
+
+// Attempts returns how many times the message was tried
+func (e *publishError) Attempts() int {
+	return e.attempts
+}
+
+// BreakerState returns the state of the circuit breaker
+func (mc *MqttClient) BreakerState() string {
+	if mc.Breaker == nil {
+		return "disabled"
+	}
+	return mc.Breaker.State().String()
+}
+
+func (mc *MqttClient) publishMessage(ctx context.Context, topic string, message string, retained bool) error {
+	l := requestid.Logger(ctx, mc.Logger).WithFields(
 		log.Fields{
 			"method":   "PublishMessage",
 			"topic":    topic,
@@ -103,52 +217,151 @@ func (mc *MqttClient) PublishMessage(ctx context.Context, topic string, message
 		},
 	)
 
+	if err := validateTopic(topic); err != nil {
+		l.WithError(err).Error("Failed to publish message to mqtt")
+		return &publishError{err: retry.Permanent(err)}
+	}
+
+	conn := mc.ring.get(topic)
+	l = l.WithField("connection", conn.Index)
+
 	l.Debug("Publishing message to mqtt")
 
-	for i := 0; i < 3; i++ { // Retry up to 3 times
-		token := mc.MqttClient.WithContext(ctx).Publish(topic, 1, retained, message)
-		if token.WaitTimeout(mc.Timeout) {
-			l.Debug("message published to mqtt")
-			break
+	span := trace.SpanFromContext(ctx)
+	attempts, err := mc.Retry.Do(ctx, func(attempt int) error {
+		token := conn.Client.WithContext(ctx).Publish(topic, qos, retained, message)
+		if !token.WaitTimeout(mc.Timeout) {
+			l.WithField("attempt", attempt).Debug("message timed out")
+			conn.countPublish("timeout")
+			span.AddEvent("publish timed out", trace.WithAttributes(attribute.Int("attempt", attempt)))
+			return errTimeout
 		}
 
-		if token.Error() != nil {
-			l.WithError(token.Error()).Error("Error publishing message to mqtt")
-		} else {
-			l.Debug("message timed out")
-			return nil
+		if err := token.Error(); err != nil {
+			l.WithError(err).WithField("attempt", attempt).Warn("Error publishing message to mqtt")
+			conn.countPublish("failed")
+			span.AddEvent("publish failed", trace.WithAttributes(attribute.Int("attempt", attempt), attribute.String("error", err.Error())))
+			return classify(err)
 		}
 
-		time.Sleep(100 * time.Millisecond)
+		conn.countPublish("published")
+		return nil
+	})
+	l = l.WithField("attempts", attempts)
+	span.SetAttributes(tracing.AttemptsKey.Int(attempts), tracing.ConnectionKey.Int(conn.Index))
+
+	if err != nil {
+		l.WithError(err).Error("Failed to publish message to mqtt")
+		return &publishError{attempts: attempts, err: err}
 	}
 
+	l.Debug("message published to mqtt")
+	return nil
+}
+
+// validateTopic fails for topics that are empty, too long, or have
+// wildcards or null characters, which brokers disconnect publishers for
+func validateTopic(topic string) error {
+	if topic == "" || len(topic) > 65535 || strings.ContainsAny(topic, "+#\x00") {
+		return fmt.Errorf("%w %q", ErrInvalidTopic, topic)
+	}
 	return nil
 }
 
-// WaitForConnection to mqtt server
+// classify marks the errors publishing again won't fix as permanent, so
+// they are not retried
+func classify(err error) error {
+	for _, terminal := range terminalErrors {
+		if errors.Is(err, terminal) {
+			return retry.Permanent(err)
+		}
+	}
+	return err
+}
+
+// Health returns the state of every pooled connection
+func (mc *MqttClient) Health() []ConnectionHealth {
+	health := make([]ConnectionHealth, 0, len(mc.Connections))
+	for _, c := range mc.Connections {
+		health = append(health, ConnectionHealth{
+			Index:     c.Index,
+			ClientID:  c.ClientID,
+			Connected: c.Client.IsConnected(),
+		})
+	}
+	return health
+}
+
+func (mc *MqttClient) isConnected() bool {
+	for _, c := range mc.Connections {
+		if !c.Client.IsConnected() {
+			return false
+		}
+	}
+	return true
+}
+
+// Probe publishes a message to a unique topic under prefix and waits until
+// it is received back from the broker
+func (mc *MqttClient) Probe(ctx context.Context, prefix string) error {
+	id := uuid.NewV4().String()
+	topic := fmt.Sprintf("%s/%s", prefix, id)
+	received := make(chan struct{}, 1)
+
+	conn := mc.Connections[0]
+	token := conn.Client.Subscribe(topic, 1, func(client mqtt.Client, message mqtt.Message) {
+		if string(message.Payload()) == id {
+			select {
+			case received <- struct{}{}:
+			default:
+			}
+		}
+	})
+	if !token.WaitTimeout(mc.Timeout) {
+		return errTimeout
+	}
+	if err := token.Error(); err != nil {
+		return err
+	}
+	defer conn.traced.Unsubscribe(topic)
+
+	err := mc.PublishMessage(ctx, topic, id, false)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-received:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close disconnects every pooled connection
+func (mc *MqttClient) Close() {
+	for _, c := range mc.Connections {
+		c.traced.Disconnect(250)
+		c.closed()
+	}
+}
+
+// WaitForConnection waits for every pooled connection to the mqtt server
 func (mc *MqttClient) WaitForConnection(timeout int) error {
 	start := time.Now()
 	timedOut := func() bool {
 		return time.Now().Sub(start) > time.Duration(timeout)*time.Millisecond
 	}
-	for !mc.MqttClient.IsConnected() || timedOut() {
+	for !mc.isConnected() && !timedOut() {
 		time.Sleep(1 * time.Millisecond)
 	}
 
-	if timedOut() {
+	if !mc.isConnected() {
 		return fmt.Errorf("Connection to MQTT timed out")
 	}
 	return nil
 }
 
-func (mc *MqttClient) configure(l log.FieldLogger) {
-	mc.Logger = l.WithField("source", "MqttClient")
-
-	mc.setConfigurationDefaults()
-	mc.loadConfiguration()
-	mc.configureClient()
-}
-
 func (mc *MqttClient) setConfigurationDefaults() {
 	mc.Config.SetDefault("mqttserver.host", "localhost")
 	mc.Config.SetDefault("mqttserver.port", 1883)
@@ -156,36 +369,62 @@ func (mc *MqttClient) setConfigurationDefaults() {
 	mc.Config.SetDefault("mqttserver.pass", "admin")
 	mc.Config.SetDefault("mqttserver.ca_cert_file", "")
 	mc.Config.SetDefault("mqttserver.timeout", 500*time.Millisecond)
+	mc.Config.SetDefault("mqttserver.poolSize", 1)
 }
 
-func (mc *MqttClient) loadConfiguration() {
-	mc.Config.SetConfigFile(mc.ConfigPath)
-	mc.Config.SetEnvPrefix("arkadiko")
-	mc.Config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
-	mc.Config.AutomaticEnv()
+func loadConfiguration(configPath string, l log.FieldLogger) (*viper.Viper, error) {
+	config := viper.New()
+	config.SetConfigFile(configPath)
+	config.SetEnvPrefix("arkadiko")
+	config.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	config.AutomaticEnv()
 
-	if err := mc.Config.ReadInConfig(); err == nil {
-		mc.Logger.WithFields(log.Fields{
-			"configFile": mc.Config.ConfigFileUsed(),
-		}).Info("Loaded config file.")
-	} else {
-		panic(fmt.Sprintf("Could not load configuration file from: %s", mc.ConfigPath))
+	if err := config.ReadInConfig(); err != nil {
+		return nil, fmt.Errorf("Could not load configuration file from: %s", configPath)
 	}
+	l.WithFields(log.Fields{
+		"source":     "MqttClient",
+		"configFile": config.ConfigFileUsed(),
+	}).Info("Loaded config file.")
+
+	return config, nil
 }
 
 func (mc *MqttClient) configureClient() {
 	mc.MqttServerHost = mc.Config.GetString("mqttserver.host")
 	mc.MqttServerPort = mc.Config.GetInt("mqttserver.port")
 	mc.Timeout = mc.Config.GetDuration("mqttserver.timeout")
+	mc.Retry = retry.NewPolicy(mc.Config, "mqttserver.retry", "mqtt")
+	mc.Breaker = newBreaker(mc.Config, mc.Name, mc.Logger)
 }
 
 func (mc *MqttClient) start(onConnectHandler mqtt.OnConnectHandler, onConnectionLost mqtt.ConnectionLostHandler, onReconnecting mqtt.ReconnectHandler) {
+	initMetrics()
+
+	poolSize := mc.Config.GetInt("mqttserver.poolSize")
+	if poolSize < 1 {
+		poolSize = 1
+	}
+
 	mc.Logger.WithFields(log.Fields{
 		"host":         mc.MqttServerHost,
 		"port":         mc.MqttServerPort,
 		"ca_cert_file": mc.Config.GetString("mqttserver.ca_cert_file"),
+		"poolSize":     poolSize,
 	}).Info("Initializing mqtt client")
 
+	mc.Connections = make([]*Connection, poolSize)
+	for i := range mc.Connections {
+		mc.Connections[i] = mc.connect(i, onConnectHandler, onConnectionLost, onReconnecting)
+	}
+	mc.MqttClient = mc.Connections[0].Client
+	mc.ring = newRing(mc.Connections)
+
+	mc.Logger.Info(fmt.Sprintf("Successfully connected to mqtt server at %s:%d!",
+		mc.MqttServerHost, mc.MqttServerPort))
+}
+
+func (mc *MqttClient) connect(index int, onConnectHandler mqtt.OnConnectHandler, onConnectionLost mqtt.ConnectionLostHandler, onReconnecting mqtt.ReconnectHandler) *Connection {
 	useTLS := mc.Config.GetBool("mqttserver.usetls")
 
 	protocol := "tcp"
@@ -193,11 +432,19 @@ func (mc *MqttClient) start(onConnectHandler mqtt.OnConnectHandler, onConnection
 		protocol = "ssl"
 	}
 
-	clientID := fmt.Sprintf("arkadiko-%s", uuid.NewV4().String())
-	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("%s://%s:%d", protocol, mc.MqttServerHost, mc.MqttServerPort)).SetClientID(clientID)
+	conn := &Connection{
+		Broker:   mc.Name,
+		Index:    index,
+		ClientID: fmt.Sprintf("arkadiko-%s", uuid.NewV4().String()),
+	}
+	l := mc.Logger.WithFields(log.Fields{
+		"connection": index,
+		"clientId":   conn.ClientID,
+	})
+	opts := mqtt.NewClientOptions().AddBroker(fmt.Sprintf("%s://%s:%d", protocol, mc.MqttServerHost, mc.MqttServerPort)).SetClientID(conn.ClientID)
 
 	if useTLS {
-		mc.Logger.WithFields(log.Fields{
+		l.WithFields(log.Fields{
 			"insecure_skip_verify": mc.Config.GetBool("mqttserver.insecure_tls"),
 		}).Info("using tls")
 		certpool := x509.NewCertPool()
@@ -206,7 +453,7 @@ func (mc *MqttClient) start(onConnectHandler mqtt.OnConnectHandler, onConnection
 			if err == nil {
 				certpool.AppendCertsFromPEM(pemCerts)
 			} else {
-				mc.Logger.WithError(err).Error()
+				l.WithError(err).Error()
 			}
 		}
 		tlsConfig := &tls.Config{InsecureSkipVerify: mc.Config.GetBool("mqttserver.insecure_tls"), ClientAuth: tls.NoClientCert, RootCAs: certpool}
@@ -217,18 +464,25 @@ func (mc *MqttClient) start(onConnectHandler mqtt.OnConnectHandler, onConnection
 	opts.SetKeepAlive(3 * time.Second)
 	opts.SetPingTimeout(5 * time.Second)
 	opts.SetMaxReconnectInterval(30 * time.Second)
-	opts.SetOnConnectHandler(onConnectHandler)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		conn.connected()
+		onConnectHandler(client)
+	})
 	opts.SetAutoReconnect(true)
-	opts.SetConnectionLostHandler(onConnectionLost)
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		conn.lost(err)
+		onConnectionLost(client, err)
+	})
 	opts.SetReconnectingHandler(onReconnecting)
 
-	c := emqtt.NewClient(opts)
-	mc.MqttClient = c
+	conn.setState(stateDisconnected)
+	c := newTracedClient(opts)
+	conn.Client = c
+	conn.traced = c
 
 	if token := c.Connect(); token.Wait() && token.Error() != nil {
-		mc.Logger.WithError(token.Error()).Info("Error connecting to mqttserver")
+		l.WithError(token.Error()).Info("Error connecting to mqttserver")
 	}
 
-	mc.Logger.Info(fmt.Sprintf("Successfully connected to mqtt server at %s:%d!",
-		mc.MqttServerHost, mc.MqttServerPort))
+	return conn
 }
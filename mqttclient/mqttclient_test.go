@@ -8,13 +8,27 @@ package mqttclient_test
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	uuid "github.com/satori/go.uuid"
 	log "github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"github.com/topfreegames/arkadiko/deadletter"
+	"github.com/topfreegames/arkadiko/metrics"
 	"github.com/topfreegames/arkadiko/mqttclient"
+	"github.com/topfreegames/arkadiko/retry"
+	"github.com/topfreegames/arkadiko/tracing"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -28,13 +42,24 @@ var _ = Describe("MQTT Client", func() {
 		logger := l.WithFields(log.Fields{})
 		ctx := context.Background()
 
+		newClient := func(onConnect mqtt.OnConnectHandler) *mqttclient.MqttClient {
+			mc, err := mqttclient.NewMqttClient(mqttclient.Options{
+				ConfigPath: "../config/test.yml",
+				OnConnect:  onConnect,
+				Logger:     logger,
+			})
+			Expect(err).NotTo(HaveOccurred())
+			return mc
+		}
+
 		Describe("Specs", func() {
 			It("It should send message and receive nil", func() {
 				connected := false
 				var onConnectHandler = func(client mqtt.Client) {
 					connected = true
 				}
-				mc := mqttclient.GetMqttClient("../config/test.yml", onConnectHandler, nil, nil, logger)
+				mc := newClient(onConnectHandler)
+				defer mc.Close()
 
 				Expect(mc.ConfigPath).To(Equal("../config/test.yml"))
 
@@ -48,7 +73,8 @@ var _ = Describe("MQTT Client", func() {
 			})
 
 			It("It should send retained message", func() {
-				mc := mqttclient.GetMqttClient("../config/test.yml", nil, nil, nil, logger)
+				mc := newClient(nil)
+				defer mc.Close()
 
 				Expect(mc.ConfigPath).To(Equal("../config/test.yml"))
 
@@ -78,10 +104,449 @@ var _ = Describe("MQTT Client", func() {
 			})
 		})
 
+		Describe("Lifecycle", func() {
+			It("Should create independent clients", func() {
+				first := newClient(nil)
+				defer first.Close()
+				second := newClient(nil)
+				defer second.Close()
+
+				Expect(first.WaitForConnection(100)).To(Succeed())
+				Expect(second.WaitForConnection(100)).To(Succeed())
+				Expect(first.Health()[0].ClientID).NotTo(Equal(second.Health()[0].ClientID))
+			})
+
+			It("Should disconnect once closed", func() {
+				mc := newClient(nil)
+				Expect(mc.WaitForConnection(100)).To(Succeed())
+
+				mc.Close()
+				for _, connection := range mc.Health() {
+					Expect(connection.Connected).To(BeFalse())
+				}
+			})
+
+			It("Should fail if the configuration can't be loaded", func() {
+				_, err := mqttclient.NewMqttClient(mqttclient.Options{
+					ConfigPath: "../config/missing.yml",
+					Logger:     logger,
+				})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Describe("Metrics", func() {
+			BeforeEach(func() {
+				config := viper.New()
+				config.Set("metrics.exporters", []string{"prometheus"})
+				_, err := metrics.Configure(ctx, config, logger)
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			value := func(name string, labels map[string]string) float64 {
+				families, err := metrics.Gatherer().Gather()
+				Expect(err).NotTo(HaveOccurred())
+				for _, family := range families {
+					if family.GetName() != name {
+						continue
+					}
+				metric:
+					for _, m := range family.GetMetric() {
+						for _, pair := range m.GetLabel() {
+							if v, ok := labels[pair.GetName()]; ok && v != pair.GetValue() {
+								continue metric
+							}
+						}
+						return m.GetGauge().GetValue() + m.GetCounter().GetValue()
+					}
+				}
+				return -1
+			}
+
+			It("Should report the state of each connection", func() {
+				mc := newClient(nil)
+				Expect(mc.WaitForConnection(100)).To(Succeed())
+
+				connected := map[string]string{"broker": mc.Name, "connection": "0", "state": "connected"}
+				Eventually(func() float64 { return value("arkadiko_mqtt_connection_state", connected) }).Should(Equal(1.0))
+
+				mc.Close()
+				Expect(value("arkadiko_mqtt_connection_state", connected)).To(Equal(0.0))
+				disconnected := map[string]string{"broker": mc.Name, "connection": "0", "state": "disconnected"}
+				Expect(value("arkadiko_mqtt_connection_state", disconnected)).To(Equal(1.0))
+			})
+
+			It("Should count publish attempts by outcome", func() {
+				mc := newClient(nil)
+				defer mc.Close()
+				Expect(mc.WaitForConnection(100)).To(Succeed())
+
+				Expect(mc.SendMessage(ctx, "test", `{"message": "hello"}`)).To(Succeed())
+				Expect(value("arkadiko_publish_attempts", map[string]string{"client": "mqtt", "outcome": "succeeded"})).To(Equal(1.0))
+				Expect(value("arkadiko_mqtt_publishes_in_flight", map[string]string{"broker": mc.Name})).To(Equal(0.0))
+			})
+		})
+
+		Describe("Retries", func() {
+			It("Should return an error after retrying failed publishes", func() {
+				config := viper.New()
+				config.Set("mqttserver.host", "localhost")
+				config.Set("mqttserver.port", 1)
+				config.Set("mqttserver.retry.maxAttempts", 2)
+				config.Set("mqttserver.retry.initialBackoff", time.Millisecond)
+				mc, err := mqttclient.NewMqttClient(mqttclient.Options{
+					Config: config,
+					Logger: logger,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				defer mc.Close()
+
+				err = mc.SendMessage(ctx, "test", `{"message": "hello"}`)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("Should trace publishes with their attempts", func() {
+				recorder := tracetest.NewSpanRecorder()
+				otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+				defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+				config := viper.New()
+				config.Set("mqttserver.host", "localhost")
+				config.Set("mqttserver.port", 1)
+				config.Set("mqttserver.retry.maxAttempts", 2)
+				config.Set("mqttserver.retry.initialBackoff", time.Millisecond)
+				mc, err := mqttclient.NewMqttClient(mqttclient.Options{
+					Config: config,
+					Logger: logger,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				defer mc.Close()
+
+				parentCtx, parent := otel.Tracer("test").Start(ctx, "request")
+				err = mc.SendMessage(parentCtx, "test", `{"message": "hello"}`)
+				parent.End()
+				Expect(err).To(HaveOccurred())
+
+				var span sdktrace.ReadOnlySpan
+				for _, s := range recorder.Ended() {
+					if s.Name() == "test publish" {
+						span = s
+					}
+				}
+				Expect(span).NotTo(BeNil())
+				Expect(span.Parent().SpanID()).To(Equal(parent.SpanContext().SpanID()))
+				Expect(span.Status().Code).To(Equal(codes.Error))
+				failures := 0
+				for _, event := range span.Events() {
+					if event.Name == "publish failed" {
+						failures++
+					}
+				}
+				Expect(failures).To(Equal(2))
+				Expect(span.Attributes()).To(ContainElement(tracing.AttemptsKey.Int(2)))
+				Expect(span.Attributes()).To(ContainElement(tracing.BrokerKey.String(mqttclient.DefaultBroker)))
+			})
+		})
+
+		Describe("Circuit Breaker", func() {
+			unreachable := func() *viper.Viper {
+				config := viper.New()
+				config.Set("mqttserver.host", "localhost")
+				config.Set("mqttserver.port", 1)
+				config.Set("mqttserver.retry.maxAttempts", 1)
+				config.Set("mqttserver.breaker.minRequests", 2)
+				return config
+			}
+
+			It("Should fail fast once open", func() {
+				mc, err := mqttclient.NewMqttClient(mqttclient.Options{
+					Config: unreachable(),
+					Logger: logger,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				defer mc.Close()
+
+				Expect(mc.BreakerState()).To(Equal("closed"))
+				for i := 0; i < 2; i++ {
+					err = mc.SendMessage(ctx, "test", `{"message": "hello"}`)
+					Expect(err).To(HaveOccurred())
+					Expect(err).NotTo(Equal(mqttclient.ErrBrokerUnavailable))
+				}
+
+				err = mc.SendMessage(ctx, "test", `{"message": "hello"}`)
+				Expect(err).To(Equal(mqttclient.ErrBrokerUnavailable))
+				Expect(mc.BreakerState()).To(Equal("open"))
+			})
+
+			It("Should leave out publishes the caller gave up on", func() {
+				mc, err := mqttclient.NewMqttClient(mqttclient.Options{
+					Config: unreachable(),
+					Logger: logger,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				defer mc.Close()
+
+				Expect(mc.SendMessage(ctx, "test", "hello")).NotTo(Succeed())
+				canceled, cancel := context.WithCancel(ctx)
+				cancel()
+				Expect(mc.SendMessage(canceled, "test", "hello")).NotTo(Succeed())
+				Expect(mc.BreakerState()).To(Equal("closed"))
+
+				Expect(mc.SendMessage(ctx, "test", "hello")).NotTo(Succeed())
+				Expect(mc.BreakerState()).To(Equal("open"))
+			})
+
+			It("Should neither retry nor count publishes to invalid topics", func() {
+				config := unreachable()
+				config.Set("mqttserver.retry.maxAttempts", 3)
+				mc, err := mqttclient.NewMqttClient(mqttclient.Options{
+					Config: config,
+					Logger: logger,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				defer mc.Close()
+
+				for _, topic := range []string{"", "chat/+", "chat/#"} {
+					err = mc.SendMessage(ctx, topic, "hello")
+					Expect(errors.Is(err, mqttclient.ErrInvalidTopic)).To(BeTrue(), topic)
+					Expect(retry.IsPermanent(err)).To(BeTrue())
+					Expect(deadletter.Attempts(err)).To(Equal(0))
+				}
+				Expect(mc.BreakerState()).To(Equal("closed"))
+			})
+
+			It("Should publish to the fallback broker while open", func() {
+				config := unreachable()
+				config.Set("brokers", map[string]interface{}{
+					"down": map[string]interface{}{
+						"fallback": "up",
+						"breaker":  map[string]interface{}{"minRequests": 1},
+					},
+					"up": map[string]interface{}{"port": 1883},
+				})
+				config.Set("routing.default", "down")
+				router, err := mqttclient.NewRouter(mqttclient.Options{Config: config, Logger: logger})
+				Expect(err).NotTo(HaveOccurred())
+				defer router.Close()
+
+				up := router.Brokers["up"]
+				Expect(up.WaitForConnection(100)).To(Succeed())
+				topic := uuid.NewV4().String()
+				var lock sync.Mutex
+				var payload string
+				up.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = string(message.Payload())
+				}).Wait()
+
+				err = router.PublishMessage(ctx, "down", topic, `{"message": "first"}`, false)
+				Expect(err).To(HaveOccurred())
+
+				err = router.PublishMessage(ctx, "down", topic, `{"message": "second"}`, false)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() string {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).Should(Equal(`{"message": "second"}`))
+
+				health := router.Health()
+				Expect(health["down"].Breaker).To(Equal("open"))
+				Expect(health["up"].Breaker).To(Equal("closed"))
+			})
+		})
+
+		Describe("Pool", func() {
+			It("Should keep a connection per pool slot", func() {
+				mc := newClient(nil)
+				defer mc.Close()
+
+				err := mc.WaitForConnection(100)
+				Expect(err).NotTo(HaveOccurred())
+
+				health := mc.Health()
+				Expect(health).To(HaveLen(2))
+				Expect(health[0].ClientID).NotTo(Equal(health[1].ClientID))
+				for _, connection := range health {
+					Expect(connection.Connected).To(BeTrue())
+				}
+			})
+
+			It("Should keep the order of messages to the same topic", func() {
+				mc := newClient(nil)
+				defer mc.Close()
+
+				err := mc.WaitForConnection(100)
+				Expect(err).NotTo(HaveOccurred())
+
+				topic := uuid.NewV4().String()
+				var lock sync.Mutex
+				received := []string{}
+				mc.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					received = append(received, string(message.Payload()))
+				}).Wait()
+
+				expected := []string{}
+				for i := 0; i < 20; i++ {
+					payload := fmt.Sprintf(`{"sequence": %d}`, i)
+					expected = append(expected, payload)
+					Expect(mc.SendMessage(ctx, topic, payload)).To(Succeed())
+				}
+
+				Eventually(func() []string {
+					lock.Lock()
+					defer lock.Unlock()
+					return received
+				}).Should(Equal(expected))
+			})
+		})
+
+		Describe("Pool connections", func() {
+			It("Should not move topics to other connections while theirs is down", func() {
+				config := viper.New()
+				config.Set("mqttserver.host", "localhost")
+				config.Set("mqttserver.port", 1883)
+				config.Set("mqttserver.poolSize", 2)
+				config.Set("mqttserver.retry.maxAttempts", 1)
+				config.Set("mqttserver.breaker.enabled", false)
+				mc, err := mqttclient.NewMqttClient(mqttclient.Options{
+					Config: config,
+					Logger: logger,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				defer mc.Close()
+				Expect(mc.WaitForConnection(100)).To(Succeed())
+
+				mc.Connections[0].Client.(interface{ Disconnect(uint) }).Disconnect(0)
+
+				published, failed := 0, 0
+				for i := 0; i < 20; i++ {
+					if mc.SendMessage(ctx, uuid.NewV4().String(), "hello") == nil {
+						published++
+					} else {
+						failed++
+					}
+				}
+				Expect(published).To(BeNumerically(">", 0))
+				Expect(failed).To(BeNumerically(">", 0))
+			})
+
+			It("Should stop waiting for connections once timed out", func() {
+				config := viper.New()
+				config.Set("mqttserver.host", "localhost")
+				config.Set("mqttserver.port", 1)
+				mc, err := mqttclient.NewMqttClient(mqttclient.Options{
+					Config: config,
+					Logger: logger,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				defer mc.Close()
+
+				Expect(mc.WaitForConnection(50)).To(MatchError("Connection to MQTT timed out"))
+			})
+		})
+
+		Describe("Router", func() {
+			newConfig := func() *viper.Viper {
+				config := viper.New()
+				config.Set("mqttserver.host", "localhost")
+				config.Set("mqttserver.port", 1883)
+				return config
+			}
+
+			It("Should connect to the mqttserver broker by default", func() {
+				router, err := mqttclient.NewRouter(mqttclient.Options{Config: newConfig(), Logger: logger})
+				Expect(err).NotTo(HaveOccurred())
+				defer router.Close()
+
+				Expect(router.Brokers).To(HaveKey(mqttclient.DefaultBroker))
+				broker, err := router.Route("", "any/topic", "game")
+				Expect(err).NotTo(HaveOccurred())
+				Expect(broker).To(Equal(mqttclient.DefaultBroker))
+			})
+
+			It("Should route by topic pattern, game id and explicit broker", func() {
+				config := newConfig()
+				config.Set("brokers", map[string]interface{}{
+					"eu":       map[string]interface{}{},
+					"products": map[string]interface{}{"poolSize": 2},
+				})
+				config.Set("routing.default", "eu")
+				config.Set("routing.rules", []map[string]interface{}{
+					{"pattern": "sniper/#", "broker": "products"},
+					{"gameId": "racing", "broker": "products"},
+				})
+				router, err := mqttclient.NewRouter(mqttclient.Options{Config: config, Logger: logger})
+				Expect(err).NotTo(HaveOccurred())
+				defer router.Close()
+
+				Expect(router.Brokers["products"].Connections).To(HaveLen(2))
+
+				for _, route := range []struct {
+					broker, topic, gameID, expected string
+				}{
+					{"", "sniper/room", "sniper", "products"},
+					{"", "chat/racing", "racing", "products"},
+					{"", "chat/other", "other", "eu"},
+					{"eu", "sniper/room", "sniper", "eu"},
+				} {
+					broker, err := router.Route(route.broker, route.topic, route.gameID)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(broker).To(Equal(route.expected))
+				}
+
+				_, err = router.Route("unknown", "chat/other", "other")
+				Expect(err).To(Equal(mqttclient.ErrUnknownBroker))
+			})
+
+			It("Should publish through the routed broker", func() {
+				router, err := mqttclient.NewRouter(mqttclient.Options{Config: newConfig(), Logger: logger})
+				Expect(err).NotTo(HaveOccurred())
+				defer router.Close()
+
+				mc := router.Brokers[mqttclient.DefaultBroker]
+				Expect(mc.WaitForConnection(100)).To(Succeed())
+				Expect(router.Health()[mqttclient.DefaultBroker].Connections[0].Connected).To(BeTrue())
+
+				topic := uuid.NewV4().String()
+				var lock sync.Mutex
+				var payload string
+				mc.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = string(message.Payload())
+				}).Wait()
+
+				err = router.PublishMessage(ctx, mqttclient.DefaultBroker, topic, `{"message": "hello"}`, false)
+				Expect(err).NotTo(HaveOccurred())
+				Eventually(func() string {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).Should(Equal(`{"message": "hello"}`))
+
+				err = router.PublishMessage(ctx, "unknown", topic, `{"message": "hello"}`, false)
+				Expect(err).To(Equal(mqttclient.ErrUnknownBroker))
+			})
+
+			It("Should fail for rules to unknown brokers", func() {
+				config := newConfig()
+				config.Set("routing.rules", []map[string]interface{}{
+					{"pattern": "sniper/#", "broker": "products"},
+				})
+				_, err := mqttclient.NewRouter(mqttclient.Options{Config: config, Logger: logger})
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
 		Describe("Perf", func() {
 			Measure("it should send message", func(b Benchmarker) {
 				var onConnectHandler = func(client mqtt.Client) {}
-				mc := mqttclient.GetMqttClient("../config/test.yml", onConnectHandler, nil, nil, logger)
+				mc := newClient(onConnectHandler)
+				defer mc.Close()
 
 				runtime := b.Time("runtime", func() {
 					err := mc.SendMessage(ctx, "test", `{"message": "hello"}`)
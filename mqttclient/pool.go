@@ -0,0 +1,216 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package mqttclient
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/topfreegames/extensions/mqtt/interfaces"
+
+	"github.com/topfreegames/arkadiko/metrics"
+)
+
+// replicas is how many points each connection gets in the hash ring, so
+// topics spread evenly even with few connections
+const replicas = 100
+
+// States of pooled connections
+const (
+	stateConnected    = "connected"
+	stateReconnecting = "reconnecting"
+	stateDisconnected = "disconnected"
+)
+
+var connectionStates = []string{stateConnected, stateReconnecting, stateDisconnected}
+
+var (
+	metricsOnce           sync.Once
+	connectionUpGauge     *metrics.GaugeVec
+	connectionStateGauge  *metrics.GaugeVec
+	publishesCounter      *metrics.CounterVec
+	inFlightGauge         *metrics.GaugeVec
+	disconnectionsCounter *metrics.CounterVec
+	reconnectsCounter     *metrics.CounterVec
+	reconnectHistogram    *metrics.HistogramVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		connectionUpGauge = metrics.NewGaugeVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "mqtt_connection_up",
+			Help:      "Whether each pooled MQTT connection is connected",
+		}, []string{"broker", "connection"})
+		connectionStateGauge = metrics.NewGaugeVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "mqtt_connection_state",
+			Help:      "State of each pooled MQTT connection, 1 for the current state and 0 for the others",
+		}, []string{"broker", "connection", "state"})
+		publishesCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "mqtt_connection_publishes",
+			Help:      "Messages published through each pooled MQTT connection",
+		}, []string{"broker", "connection", "status"})
+		inFlightGauge = metrics.NewGaugeVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "mqtt_publishes_in_flight",
+			Help:      "Messages being published to each broker, including retries",
+		}, []string{"broker"})
+		disconnectionsCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "mqtt_disconnections",
+			Help:      "MQTT disconnections",
+		}, []string{"broker", "connection", "reason"})
+		reconnectsCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "mqtt_reconnects",
+			Help:      "Pooled MQTT connections reestablished after being lost",
+		}, []string{"broker", "connection"})
+		reconnectHistogram = metrics.NewHistogramVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "mqtt_reconnect_duration",
+			Help:      "Seconds pooled MQTT connections took to be reestablished after being lost",
+			Buckets:   []float64{0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+			Timing:    true,
+		}, []string{"broker"})
+	})
+}
+
+// Connection is one of the pooled connections to the MQTT server
+type Connection struct {
+	Broker   string
+	Index    int
+	ClientID string
+	Client   interfaces.Client
+
+	traced *tracedClient
+	// lostAt is when the connection was lost in unix nanoseconds, zero
+	// while it is up
+	lostAt atomic.Int64
+}
+
+// ConnectionHealth describes the state of a pooled connection
+type ConnectionHealth struct {
+	Index     int    `json:"index"`
+	ClientID  string `json:"clientId"`
+	Connected bool   `json:"connected"`
+}
+
+func (c *Connection) label() string {
+	return strconv.Itoa(c.Index)
+}
+
+func (c *Connection) setState(state string) {
+	for _, s := range connectionStates {
+		value := 0.0
+		if s == state {
+			value = 1
+		}
+		connectionStateGauge.WithLabelValues(c.Broker, c.label(), s).Set(value)
+	}
+
+	up := 0.0
+	if state == stateConnected {
+		up = 1
+	}
+	connectionUpGauge.WithLabelValues(c.Broker, c.label()).Set(up)
+}
+
+// connected reports the connection is up, counting a reconnect if it was
+// lost before
+func (c *Connection) connected() {
+	if lostAt := c.lostAt.Swap(0); lostAt != 0 {
+		reconnectsCounter.WithLabelValues(c.Broker, c.label()).Inc()
+		reconnectHistogram.WithLabelValues(c.Broker).Observe(time.Since(time.Unix(0, lostAt)).Seconds())
+	}
+	c.setState(stateConnected)
+}
+
+// lost reports the connection was lost and is being reestablished
+func (c *Connection) lost(err error) {
+	c.lostAt.CompareAndSwap(0, time.Now().UnixNano())
+	disconnectionsCounter.WithLabelValues(c.Broker, c.label(), disconnectReason(err)).Inc()
+	c.setState(stateReconnecting)
+}
+
+// closed reports the connection was closed for good
+func (c *Connection) closed() {
+	c.lostAt.Store(0)
+	c.setState(stateDisconnected)
+}
+
+// disconnectReason classifies connection errors, which embed addresses and
+// would make a label for each connection otherwise
+func disconnectReason(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return "closed"
+	case errors.Is(err, io.EOF):
+		return "eof"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case strings.Contains(err.Error(), "pingresp"):
+		return "keepalive"
+	default:
+		return "error"
+	}
+}
+
+func (c *Connection) countPublish(status string) {
+	publishesCounter.WithLabelValues(c.Broker, c.label(), status).Inc()
+}
+
+// ring assigns topics to connections by consistent hashing, so messages to
+// the same topic always leave through the same connection and keep their
+// order
+type ring struct {
+	hashes      []uint32
+	connections map[uint32]*Connection
+}
+
+func hash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func newRing(connections []*Connection) *ring {
+	r := &ring{connections: map[uint32]*Connection{}}
+	for _, c := range connections {
+		for i := 0; i < replicas; i++ {
+			h := hash(fmt.Sprintf("%d-%d", c.Index, i))
+			r.hashes = append(r.hashes, h)
+			r.connections[h] = c
+		}
+	}
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// get returns the connection owning topic. Messages always leave through
+// the owner of their topic, even while it is reconnecting, so they never
+// overtake earlier messages sent through it: publishes fail, and are
+// retried, until it is connected again
+func (r *ring) get(topic string) *Connection {
+	h := hash(topic)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.connections[r.hashes[i]]
+}
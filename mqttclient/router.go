@@ -0,0 +1,236 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package mqttclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/requestid"
+	"github.com/topfreegames/arkadiko/topic"
+)
+
+// DefaultBroker names the broker configured under mqttserver when no brokers
+// are configured
+const DefaultBroker = "default"
+
+// ErrUnknownBroker is returned when routing to a broker that is not configured
+var ErrUnknownBroker = errors.New("unknown broker")
+
+// brokerKeys are the settings a broker may override, any missing ones are
+// taken from mqttserver
+var brokerKeys = []string{
+	"host",
+	"port",
+	"user",
+	"pass",
+	"usetls",
+	"insecure_tls",
+	"ca_cert_file",
+	"timeout",
+	"poolSize",
+	"retry",
+	"breaker",
+}
+
+type routeConfig struct {
+	Pattern string `mapstructure:"pattern"`
+	GameID  string `mapstructure:"gameId"`
+	Broker  string `mapstructure:"broker"`
+}
+
+// Router publishes messages to one of several named brokers, chosen by
+// routing rules that match topics and game ids
+type Router struct {
+	Brokers map[string]*MqttClient
+	// Fallbacks maps brokers to the ones taking their messages while
+	// their circuit breakers are open
+	Fallbacks map[string]string
+	Default   string
+	Logger    log.FieldLogger
+	routes    []routeConfig
+}
+
+// BrokerHealth describes the state of a broker
+type BrokerHealth struct {
+	Breaker     string             `json:"breaker"`
+	Connections []ConnectionHealth `json:"connections"`
+}
+
+// NewRouter connects to every broker configured under the brokers key, or
+// to the one under mqttserver if there are none. The router must be closed
+// once no longer needed.
+func NewRouter(opts Options) (*Router, error) {
+	opts, err := opts.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	config := opts.Config
+	config.SetDefault("routing.default", DefaultBroker)
+
+	r := &Router{
+		Brokers:   map[string]*MqttClient{},
+		Fallbacks: map[string]string{},
+		Default:   config.GetString("routing.default"),
+		Logger:    opts.Logger.WithField("source", "MqttRouter"),
+	}
+
+	err = config.UnmarshalKey("routing.rules", &r.routes)
+	if err != nil {
+		return nil, fmt.Errorf("invalid routing.rules configuration: %w", err)
+	}
+
+	names := []string{}
+	for name := range config.GetStringMap("brokers") {
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		names = append(names, DefaultBroker)
+	}
+	sort.Strings(names)
+
+	if !contains(names, r.Default) {
+		return nil, fmt.Errorf("default broker %s is not configured", r.Default)
+	}
+	for _, route := range r.routes {
+		if route.Pattern == "" && route.GameID == "" {
+			return nil, fmt.Errorf("routing rules need a pattern or a gameId")
+		}
+		if !contains(names, route.Broker) {
+			return nil, fmt.Errorf("routing rule to unknown broker %s", route.Broker)
+		}
+	}
+
+	for _, name := range names {
+		fallback := config.GetString(fmt.Sprintf("brokers.%s.fallback", name))
+		if fallback == "" {
+			continue
+		}
+		if fallback == name || !contains(names, fallback) {
+			return nil, fmt.Errorf("invalid fallback %s for broker %s", fallback, name)
+		}
+		r.Fallbacks[name] = fallback
+	}
+
+	for _, name := range names {
+		brokerOpts := opts
+		brokerOpts.Name = name
+		brokerOpts.Config = brokerConfig(config, name)
+		mc, err := NewMqttClient(brokerOpts)
+		if err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.Brokers[name] = mc
+	}
+
+	return r, nil
+}
+
+// brokerConfig returns the settings of the named broker under the
+// mqttserver key, as the client expects them
+func brokerConfig(config *viper.Viper, name string) *viper.Viper {
+	v := viper.New()
+	for _, key := range brokerKeys {
+		if config.IsSet("mqttserver." + key) {
+			v.Set("mqttserver."+key, config.Get("mqttserver."+key))
+		}
+		brokerKey := fmt.Sprintf("brokers.%s.%s", name, key)
+		if config.IsSet(brokerKey) {
+			v.Set("mqttserver."+key, config.Get(brokerKey))
+		}
+	}
+	return v
+}
+
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Route returns the broker messages to topic should be published to. An
+// explicitly requested broker wins over the routing rules, of which the
+// first matching one is used.
+func (r *Router) Route(broker, t, gameID string) (string, error) {
+	if broker != "" {
+		if _, ok := r.Brokers[broker]; !ok {
+			return "", ErrUnknownBroker
+		}
+		return broker, nil
+	}
+
+	for _, route := range r.routes {
+		if route.Pattern != "" && !topic.Match(route.Pattern, t) {
+			continue
+		}
+		if route.GameID != "" && route.GameID != gameID {
+			continue
+		}
+		return route.Broker, nil
+	}
+
+	return r.Default, nil
+}
+
+// Client returns the client of the named broker
+func (r *Router) Client(broker string) (*MqttClient, error) {
+	mc, ok := r.Brokers[broker]
+	if !ok {
+		return nil, ErrUnknownBroker
+	}
+	return mc, nil
+}
+
+// PublishMessage publishes the message to topic on the named broker, or on
+// its fallback while the broker is unavailable
+func (r *Router) PublishMessage(ctx context.Context, broker, topic, message string, retained bool) error {
+	mc, err := r.Client(broker)
+	if err != nil {
+		return err
+	}
+
+	err = mc.PublishMessage(ctx, topic, message, retained)
+	fallback, ok := r.Fallbacks[broker]
+	if err != ErrBrokerUnavailable || !ok {
+		return err
+	}
+
+	requestid.Logger(ctx, r.Logger).WithFields(log.Fields{
+		"broker":   broker,
+		"fallback": fallback,
+		"topic":    topic,
+	}).Warn("Broker is unavailable, publishing to its fallback.")
+	return r.Brokers[fallback].PublishMessage(ctx, topic, message, retained)
+}
+
+// Health returns the state of every broker
+func (r *Router) Health() map[string]BrokerHealth {
+	health := map[string]BrokerHealth{}
+	for name, mc := range r.Brokers {
+		health[name] = BrokerHealth{
+			Breaker:     mc.BreakerState(),
+			Connections: mc.Health(),
+		}
+	}
+	return health
+}
+
+// Close disconnects from every broker
+func (r *Router) Close() {
+	for _, mc := range r.Brokers {
+		mc.Close()
+	}
+}
@@ -2,37 +2,83 @@ package otel
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
-	jaegerpropagation "go.opentelemetry.io/contrib/propagators/jaeger"
-	"log"
+	"os"
+	"time"
 
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	jaegerpropagation "go.opentelemetry.io/contrib/propagators/jaeger"
 	"go.opentelemetry.io/otel"
-	"go.opentelemetry.io/otel/exporters/otlp/otlptrace"
+	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
 	"go.opentelemetry.io/otel/propagation"
 	"go.opentelemetry.io/otel/sdk/resource"
 	"go.opentelemetry.io/otel/sdk/trace"
-	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"google.golang.org/grpc/credentials"
 )
 
+// Closer flushes and stops the tracer provider
 type Closer func(context.Context) error
 
-func NewTracer(ctx context.Context) (Closer, error) {
+// NoopCloser is the Closer of apps that are not traced
+func NoopCloser(context.Context) error {
+	return nil
+}
+
+func setDefaults(config *viper.Viper) {
+	config.SetDefault("jaeger.serviceName", "arkadiko")
+	config.SetDefault("jaeger.samplingProbability", 1.0)
+	config.SetDefault("otel.exporter.protocol", "grpc")
+	config.SetDefault("otel.exporter.endpoint", "")
+	config.SetDefault("otel.exporter.insecure", true)
+	config.SetDefault("otel.exporter.timeout", 10*time.Second)
+	config.SetDefault("otel.exporter.tls.caFile", "")
+	config.SetDefault("otel.exporter.tls.certFile", "")
+	config.SetDefault("otel.exporter.tls.keyFile", "")
+	config.SetDefault("otel.exporter.tls.insecureSkipVerify", false)
+}
 
-	client := otlptracegrpc.NewClient(otlptracegrpc.WithInsecure())
+// NewTracer installs a tracer provider exporting spans as configured under
+// the otel key, sampling the ratio of traces configured as
+// jaeger.samplingProbability. Spans are still created, so trace context
+// reaches published messages, when the exporter protocol is none or the
+// exporter can't be created
+func NewTracer(ctx context.Context, config *viper.Viper, logger log.FieldLogger) (Closer, error) {
+	setDefaults(config)
+	l := logger.WithFields(log.Fields{
+		"source":    "otel",
+		"operation": "NewTracer",
+	})
 
-	exporter, err := otlptrace.New(ctx, client)
+	// tracing without exporting still propagates trace context, so failing
+	// to create the exporter doesn't keep arkadiko from starting
+	exporter, err := NewExporter(ctx, config)
+	if err != nil {
+		l.WithError(err).Error("Failed to create the span exporter, spans will not be exported.")
+		exporter = nil
+	}
+	res, err := NewResource(ctx, config)
 	if err != nil {
-		log.Fatalf("Failed to create exporter: %v", err)
+		if res == nil {
+			return nil, err
+		}
+		l.WithError(err).Warn("Some resource attributes could not be detected.")
 	}
 
-	provider := trace.NewTracerProvider(
-		trace.WithBatcher(exporter),
-		trace.WithResource(resource.NewWithAttributes(
-			semconv.SchemaURL,
-			semconv.ServiceName("arkadiko"),
-		)),
-	)
+	opts := []trace.TracerProviderOption{
+		trace.WithSampler(NewSampler(config)),
+		trace.WithResource(res),
+	}
+	if exporter != nil {
+		opts = append(opts, trace.WithBatcher(exporter))
+	}
+	provider := trace.NewTracerProvider(opts...)
 
 	otel.SetTextMapPropagator(
 		propagation.NewCompositeTextMapPropagator(
@@ -41,11 +87,21 @@ func NewTracer(ctx context.Context) (Closer, error) {
 			propagation.Baggage{},
 		),
 	)
-
 	otel.SetTracerProvider(provider)
 
+	// export failures are logged instead of written to stderr
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		l.WithError(err).Warn("Open Telemetry failed.")
+	}))
+
+	l.WithFields(log.Fields{
+		"protocol":            config.GetString("otel.exporter.protocol"),
+		"endpoint":            config.GetString("otel.exporter.endpoint"),
+		"samplingProbability": config.GetFloat64("jaeger.samplingProbability"),
+	}).Info("Configured Open Telemetry.")
+
 	closeFunction := func(ctx context.Context) error {
-		err = provider.Shutdown(ctx)
+		err := provider.Shutdown(ctx)
 		if err != nil {
 			return fmt.Errorf("failed to shutdown tracer provider: %w", err)
 		}
@@ -53,5 +109,121 @@ func NewTracer(ctx context.Context) (Closer, error) {
 	}
 
 	return closeFunction, nil
+}
+
+// NewSampler returns a sampler following the sampling decision of the
+// parent span, and sampling the configured ratio of new traces
+func NewSampler(config *viper.Viper) trace.Sampler {
+	setDefaults(config)
+	return trace.ParentBased(trace.TraceIDRatioBased(config.GetFloat64("jaeger.samplingProbability")))
+}
+
+// NewResource returns the resource spans are reported with: the service
+// name, the attributes configured as otel.resource.attributes, with
+// environment variables expanded, and the ones in OTEL_RESOURCE_ATTRIBUTES
+func NewResource(ctx context.Context, config *viper.Viper) (*resource.Resource, error) {
+	setDefaults(config)
+
+	attrs := []attribute.KeyValue{
+		semconv.ServiceName(config.GetString("jaeger.serviceName")),
+	}
+	for key, value := range config.GetStringMapString("otel.resource.attributes") {
+		attrs = append(attrs, attribute.String(key, os.ExpandEnv(value)))
+	}
+
+	return resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(attrs...),
+		resource.WithFromEnv(),
+		resource.WithHost(),
+	)
+}
+
+// NewExporter returns the span exporter configured under otel.exporter, or
+// nil if spans are not exported
+func NewExporter(ctx context.Context, config *viper.Viper) (trace.SpanExporter, error) {
+	setDefaults(config)
+
+	endpoint := config.GetString("otel.exporter.endpoint")
+	headers := config.GetStringMapString("otel.exporter.headers")
+	timeout := config.GetDuration("otel.exporter.timeout")
+	insecure := config.GetBool("otel.exporter.insecure")
+
+	protocol := config.GetString("otel.exporter.protocol")
+	switch protocol {
+	case "grpc":
+		opts := []otlptracegrpc.Option{otlptracegrpc.WithTimeout(timeout)}
+		if endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+		}
+		if len(headers) > 0 {
+			opts = append(opts, otlptracegrpc.WithHeaders(headers))
+		}
+		if insecure {
+			opts = append(opts, otlptracegrpc.WithInsecure())
+		} else {
+			tlsConfig, err := NewTLSConfig(config)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracegrpc.WithTLSCredentials(credentials.NewTLS(tlsConfig)))
+		}
+		return otlptracegrpc.New(ctx, opts...)
+	case "http":
+		opts := []otlptracehttp.Option{otlptracehttp.WithTimeout(timeout)}
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(endpoint))
+		}
+		if len(headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(headers))
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		} else {
+			tlsConfig, err := NewTLSConfig(config)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, otlptracehttp.WithTLSClientConfig(tlsConfig))
+		}
+		return otlptracehttp.New(ctx, opts...)
+	case "stdout":
+		return stdouttrace.New()
+	case "none", "":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown otel.exporter.protocol %s", protocol)
+	}
+}
+
+// NewTLSConfig returns the TLS configuration of otel.exporter.tls, used
+// by OTLP exporters that are not insecure
+func NewTLSConfig(config *viper.Viper) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.GetBool("otel.exporter.tls.insecureSkipVerify"),
+	}
+
+	if caFile := config.GetString("otel.exporter.tls.caFile"); caFile != "" {
+		ca, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read otel.exporter.tls.caFile: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in otel.exporter.tls.caFile %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certFile := config.GetString("otel.exporter.tls.certFile")
+	keyFile := config.GetString("otel.exporter.tls.keyFile")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load otel.exporter.tls client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 
+	return tlsConfig, nil
 }
@@ -0,0 +1,123 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package otel_test
+
+import (
+	"context"
+	"os"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/topfreegames/arkadiko/otel"
+)
+
+var _ = Describe("Open Telemetry", func() {
+	l, _ := test.NewNullLogger()
+	ctx := context.Background()
+
+	var config *viper.Viper
+
+	BeforeEach(func() {
+		config = viper.New()
+	})
+
+	Describe("NewSampler", func() {
+		sample := func(parent trace.SpanContext) sdktrace.SamplingDecision {
+			return otel.NewSampler(config).ShouldSample(sdktrace.SamplingParameters{
+				ParentContext: trace.ContextWithSpanContext(ctx, parent),
+				TraceID:       trace.TraceID{1},
+				Name:          "publish",
+			}).Decision
+		}
+
+		It("Should sample the configured ratio of new traces", func() {
+			Expect(sample(trace.SpanContext{})).To(Equal(sdktrace.RecordAndSample))
+
+			config.Set("jaeger.samplingProbability", 0)
+			Expect(sample(trace.SpanContext{})).To(Equal(sdktrace.Drop))
+		})
+
+		It("Should follow the decision of the parent span", func() {
+			config.Set("jaeger.samplingProbability", 0)
+			parent := trace.NewSpanContext(trace.SpanContextConfig{
+				TraceID:    trace.TraceID{1},
+				SpanID:     trace.SpanID{1},
+				TraceFlags: trace.FlagsSampled,
+				Remote:     true,
+			})
+			Expect(sample(parent)).To(Equal(sdktrace.RecordAndSample))
+		})
+	})
+
+	Describe("NewResource", func() {
+		It("Should report the service name and configured attributes", func() {
+			os.Setenv("ARKADIKO_TEST_POD", "arkadiko-7f9c")
+			defer os.Unsetenv("ARKADIKO_TEST_POD")
+			config.Set("jaeger.serviceName", "arkadiko-test")
+			config.Set("otel.resource.attributes", map[string]string{
+				"deployment.environment": "staging",
+				"k8s.pod.name":           "${ARKADIKO_TEST_POD}",
+			})
+
+			res, err := otel.NewResource(ctx, config)
+			Expect(err).NotTo(HaveOccurred())
+			attrs := res.Attributes()
+			Expect(attrs).To(ContainElement(attribute.String("service.name", "arkadiko-test")))
+			Expect(attrs).To(ContainElement(attribute.String("deployment.environment", "staging")))
+			Expect(attrs).To(ContainElement(attribute.String("k8s.pod.name", "arkadiko-7f9c")))
+		})
+	})
+
+	Describe("NewExporter", func() {
+		It("Should create the configured exporter", func() {
+			for _, protocol := range []string{"grpc", "http", "stdout"} {
+				config.Set("otel.exporter.protocol", protocol)
+				config.Set("otel.exporter.endpoint", "localhost:4317")
+				config.Set("otel.exporter.headers", map[string]string{"authorization": "token"})
+				exporter, err := otel.NewExporter(ctx, config)
+				Expect(err).NotTo(HaveOccurred(), protocol)
+				Expect(exporter).NotTo(BeNil(), protocol)
+				Expect(exporter.Shutdown(ctx)).To(Succeed())
+			}
+		})
+
+		It("Should not create exporters when spans are not exported", func() {
+			config.Set("otel.exporter.protocol", "none")
+			exporter, err := otel.NewExporter(ctx, config)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(exporter).To(BeNil())
+		})
+
+		It("Should fail for invalid configurations", func() {
+			config.Set("otel.exporter.protocol", "zipkin")
+			_, err := otel.NewExporter(ctx, config)
+			Expect(err).To(MatchError("unknown otel.exporter.protocol zipkin"))
+
+			config.Set("otel.exporter.protocol", "grpc")
+			config.Set("otel.exporter.insecure", false)
+			config.Set("otel.exporter.tls.caFile", "/nonexistent/ca.pem")
+			_, err = otel.NewExporter(ctx, config)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Describe("NewTracer", func() {
+		It("Should keep tracing when the exporter can't be created", func() {
+			config.Set("otel.exporter.protocol", "zipkin")
+			closer, err := otel.NewTracer(ctx, config, l)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(closer(ctx)).To(Succeed())
+		})
+	})
+})
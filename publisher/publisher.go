@@ -0,0 +1,235 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/topfreegames/arkadiko/async"
+	"github.com/topfreegames/arkadiko/compression"
+	"github.com/topfreegames/arkadiko/deadletter"
+	"github.com/topfreegames/arkadiko/encryption"
+	"github.com/topfreegames/arkadiko/envelope"
+	"github.com/topfreegames/arkadiko/limits"
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/mqttclient"
+	"github.com/topfreegames/arkadiko/requestid"
+	"github.com/topfreegames/arkadiko/scheduler"
+	"github.com/topfreegames/arkadiko/signing"
+)
+
+// TooLargeError is returned for messages that would be published with a
+// payload larger than allowed for their topic
+type TooLargeError struct {
+	Size           int
+	MaxPayloadSize int
+	Err            error
+}
+
+func (e *TooLargeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *TooLargeError) Unwrap() error {
+	return e.Err
+}
+
+// EnvelopeError is returned for payloads that cannot be wrapped in the
+// envelope of their topic
+type EnvelopeError struct {
+	Err error
+}
+
+func (e *EnvelopeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *EnvelopeError) Unwrap() error {
+	return e.Err
+}
+
+// Message is a message received by one of the APIs to be published
+type Message struct {
+	// Frontend is the API the message was received by, labeling its metrics
+	Frontend string
+	// Broker is the broker asked for, or empty to route the message
+	Broker      string
+	Topic       string
+	Payload     []byte
+	ContentType string
+	Retained    bool
+	GameID      string
+	Requestor   string
+	// DeliverAt is when the message should be published, or the zero time
+	// to publish it right away
+	DeliverAt time.Time
+	// Async tells the message should be queued and published in background
+	Async bool
+}
+
+// Result tells what was done with a message
+type Result struct {
+	// Broker is the broker the message was routed to
+	Broker string
+	// Payload is the payload as wrapped in the topic envelope, before
+	// compression, encryption and signing
+	Payload []byte
+	// Schedule is the schedule of messages to be delivered later
+	Schedule *scheduler.Schedule
+	// Queued tells the message was queued to be published in background
+	Queued bool
+	// Latency is how long publishing the message took
+	Latency time.Duration
+}
+
+// Publisher publishes the messages received by every API the same way,
+// scheduling, queueing or publishing them right away and recording the ones
+// that could not be published
+type Publisher struct {
+	Brokers     *mqttclient.Router
+	Limits      *limits.Limits
+	Compression *compression.Compressor
+	Encryption  *encryption.Encryptor
+	Signing     *signing.Signer
+	Envelope    *envelope.Wrapper
+	Scheduler   *scheduler.Scheduler
+	Async       *async.Queue
+	DeadLetters *deadletter.Recorder
+	Metrics     *metrics.Frontend
+}
+
+// PublishMessage publishes a message kept by the scheduler, the async queue
+// or dead letters to the named broker, opening payloads sealed to be kept,
+// then compressing, encrypting, signing and splitting payloads that are too
+// large into chunks where enabled
+func (p *Publisher) PublishMessage(ctx context.Context, broker, topic, payload string, retained bool) error {
+	payload, err := p.Encryption.Open(topic, payload)
+	if err != nil {
+		return err
+	}
+	return p.publishEncoded(ctx, broker, topic, p.Compression.Encode(topic, payload), retained)
+}
+
+// publishEncoded publishes a payload that went through compression already
+func (p *Publisher) publishEncoded(ctx context.Context, broker, topic, payload string, retained bool) error {
+	payload, err := p.Encryption.Encrypt(topic, payload)
+	if err != nil {
+		return err
+	}
+	payload = p.Signing.Sign(topic, payload)
+	return p.Limits.Publish(ctx, p.Brokers.PublishMessage, broker, topic, payload, retained)
+}
+
+// Send wraps the message in the envelope of its topic, checks its size and
+// routes it, then schedules, queues or publishes it. The result is returned
+// along with errors publishing, so callers know where the message was routed
+func (p *Publisher) Send(ctx context.Context, m *Message) (*Result, error) {
+	payload, err := p.Envelope.Wrap(m.Topic, m.Payload, m.ContentType, envelope.Metadata{
+		Source:    m.Requestor,
+		GameID:    m.GameID,
+		TraceID:   envelope.TraceID(ctx),
+		RequestID: requestid.FromContext(ctx),
+	})
+	if err != nil {
+		return nil, &EnvelopeError{Err: err}
+	}
+
+	// payloads are only compressed to know the size they will be
+	// published with when they are too large as they are. Payloads published
+	// right away are published as they were compressed here, while scheduled
+	// and queued ones are kept as they are and compressed once published
+	overhead := p.Encryption.Overhead(m.Topic) + p.Signing.Overhead(m.Topic)
+	size := len(payload) + overhead
+	maxSize := p.Limits.For(m.Topic).MaxPayloadSize
+	deferred := !m.DeliverAt.IsZero() || m.Async
+	var encoded string
+	switch {
+	case maxSize <= 0 || size <= maxSize:
+	case deferred:
+		size = p.Compression.EncodedSize(m.Topic, string(payload)) + overhead
+	default:
+		encoded = p.Compression.Encode(m.Topic, string(payload))
+		size = len(encoded) + overhead
+	}
+	err = p.Limits.CheckPayload(m.Topic, size, m.Retained)
+	if err != nil {
+		p.Metrics.Rejections.WithLabelValues(m.Frontend, metrics.RejectedTooLarge).Inc()
+		return nil, &TooLargeError{Size: size, MaxPayloadSize: maxSize, Err: err}
+	}
+
+	broker, err := p.Brokers.Route(m.Broker, m.Topic, m.GameID)
+	if err != nil {
+		return nil, err
+	}
+	p.Metrics.PayloadSize.WithLabelValues(m.Frontend, broker).Observe(float64(len(payload)))
+	result := &Result{Broker: broker, Payload: payload}
+
+	// payloads of encrypted topics are never kept in plain text
+	var sealed string
+	if deferred {
+		sealed, err = p.Encryption.Seal(m.Topic, string(payload))
+		if err != nil {
+			return result, err
+		}
+	}
+
+	switch {
+	case !m.DeliverAt.IsZero():
+		result.Schedule, err = p.Scheduler.Schedule(broker, m.Topic, sealed, m.Retained, m.Requestor, m.DeliverAt)
+		if err == scheduler.ErrFull {
+			p.Metrics.Rejections.WithLabelValues(m.Frontend, metrics.RejectedSchedulesFull).Inc()
+		}
+		return result, err
+	case m.Async:
+		err = p.Async.Enqueue(ctx, broker, m.Topic, sealed, m.Retained, m.Requestor)
+		p.Metrics.AsyncRequests.WithLabelValues(m.Frontend, broker, fmt.Sprintf("%t", err != nil), fmt.Sprintf("%t", m.Retained), m.GameID).Inc()
+		if err == async.ErrFull {
+			p.Metrics.Rejections.WithLabelValues(m.Frontend, metrics.RejectedQueueFull).Inc()
+		}
+		result.Queued = err == nil
+		return result, err
+	}
+
+	start := time.Now()
+	if encoded == "" {
+		encoded = p.Compression.Encode(m.Topic, string(payload))
+	}
+	err = p.publishEncoded(ctx, broker, m.Topic, encoded, m.Retained)
+	result.Latency = time.Since(start)
+	p.Metrics.MQTTLatency.WithLabelValues(m.Frontend, broker, fmt.Sprintf("%t", err != nil), fmt.Sprintf("%t", m.Retained), m.GameID, m.Requestor).Observe(result.Latency.Seconds())
+
+	if err != nil {
+		p.record(broker, m, string(payload), err)
+	}
+	if errors.Is(err, mqttclient.ErrBrokerUnavailable) {
+		p.Metrics.Rejections.WithLabelValues(m.Frontend, metrics.RejectedBrokerUnavailable).Inc()
+	}
+	return result, err
+}
+
+// record keeps a message that could not be published as a dead letter,
+// sealing payloads of encrypted topics. Messages that can't be sealed are
+// not kept, as the error publishing them is returned anyway
+func (p *Publisher) record(broker string, m *Message, payload string, err error) {
+	sealed, sealErr := p.Encryption.Seal(m.Topic, payload)
+	if sealErr != nil {
+		return
+	}
+	p.DeadLetters.Record(&deadletter.Letter{
+		Broker:    broker,
+		Topic:     m.Topic,
+		Payload:   sealed,
+		Retained:  m.Retained,
+		Error:     err.Error(),
+		Attempts:  deadletter.Attempts(err),
+		Requestor: m.Requestor,
+	})
+}
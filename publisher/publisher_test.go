@@ -0,0 +1,201 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package publisher_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/async"
+	"github.com/topfreegames/arkadiko/compression"
+	"github.com/topfreegames/arkadiko/encryption"
+	"github.com/topfreegames/arkadiko/envelope"
+	"github.com/topfreegames/arkadiko/limits"
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/mqttclient"
+	"github.com/topfreegames/arkadiko/publisher"
+	"github.com/topfreegames/arkadiko/signing"
+)
+
+var _ = Describe("Publisher", func() {
+	l, _ := test.NewNullLogger()
+
+	var p *publisher.Publisher
+
+	BeforeEach(func() {
+		config := viper.New()
+		config.SetConfigFile("../config/test.yml")
+		Expect(config.ReadInConfig()).To(Succeed())
+
+		brokers, err := mqttclient.NewRouter(mqttclient.Options{Config: config, Logger: l})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(brokers.Brokers[brokers.Default].WaitForConnection(100)).To(Succeed())
+
+		p = &publisher.Publisher{Brokers: brokers, Metrics: metrics.NewFrontend()}
+		p.Limits, err = limits.NewLimits(config, l)
+		Expect(err).NotTo(HaveOccurred())
+		p.Compression, err = compression.NewCompressor(config, l)
+		Expect(err).NotTo(HaveOccurred())
+		p.Encryption, err = encryption.NewEncryptor(config, l)
+		Expect(err).NotTo(HaveOccurred())
+		p.Signing, err = signing.NewSigner(config, l)
+		Expect(err).NotTo(HaveOccurred())
+		p.Envelope, err = envelope.NewWrapper(config)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		p.Brokers.Close()
+	})
+
+	subscribe := func(topic string) func() string {
+		var lock sync.Mutex
+		var payload string
+		mc := p.Brokers.Brokers[p.Brokers.Default]
+		mc.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+			lock.Lock()
+			defer lock.Unlock()
+			payload = string(message.Payload())
+		}).Wait()
+		return func() string {
+			lock.Lock()
+			defer lock.Unlock()
+			return payload
+		}
+	}
+
+	It("Should encrypt the messages it publishes on encrypted topics", func() {
+		topic := "encrypted/" + uuid.NewV4().String()
+		received := subscribe(topic)
+
+		Expect(p.PublishMessage(context.Background(), "default", topic, `{"message":"hello"}`, false)).To(Succeed())
+
+		Eventually(received).ShouldNot(BeEmpty())
+		Expect(received()).NotTo(ContainSubstring("hello"))
+		decrypted, err := p.Encryption.Decrypt(topic, []byte(received()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(decrypted)).To(Equal(`{"message":"hello"}`))
+	})
+
+	It("Should wrap and publish the messages it is sent", func() {
+		topic := "enveloped/" + uuid.NewV4().String()
+		received := subscribe(topic)
+
+		result, err := p.Send(context.Background(), &publisher.Message{
+			Frontend:    metrics.FrontendHTTP,
+			Topic:       topic,
+			Payload:     []byte(`{"message":"hello"}`),
+			ContentType: "application/json",
+			Requestor:   "tests",
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Broker).To(Equal("default"))
+		Expect(result.Queued).To(BeFalse())
+
+		Eventually(received).ShouldNot(BeEmpty())
+		e, err := envelope.Decode([]byte(received()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(e.Source).To(Equal("tests"))
+		Expect(received()).To(Equal(string(result.Payload)))
+	})
+
+	It("Should refuse messages larger than allowed for their topic", func() {
+		_, err := p.Send(context.Background(), &publisher.Message{
+			Frontend:    metrics.FrontendGRPC,
+			Topic:       "limited/topic",
+			Payload:     []byte(`{"message":"a message larger than allowed for the topic"}`),
+			ContentType: "application/json",
+		})
+
+		var tooLarge *publisher.TooLargeError
+		Expect(errors.As(err, &tooLarge)).To(BeTrue())
+		Expect(tooLarge.MaxPayloadSize).To(Equal(48))
+		Expect(tooLarge.Size).To(BeNumerically(">", 48))
+		Expect(errors.Is(err, limits.ErrPayloadTooLarge)).To(BeTrue())
+	})
+
+	It("Should refuse messages for unknown brokers", func() {
+		_, err := p.Send(context.Background(), &publisher.Message{
+			Frontend: metrics.FrontendGRPC,
+			Broker:   "unknown",
+			Topic:    "some/topic",
+			Payload:  []byte(`{}`),
+		})
+		Expect(err).To(Equal(mqttclient.ErrUnknownBroker))
+	})
+
+	It("Should only keep payloads of encrypted topics sealed", func() {
+		topic := "encrypted/" + uuid.NewV4().String()
+		received := subscribe(topic)
+
+		var lock sync.Mutex
+		var queued string
+		p.Async = async.NewQueue(viper.New(), func(ctx context.Context, broker, topic, payload string, retained bool) error {
+			lock.Lock()
+			queued = payload
+			lock.Unlock()
+			return p.PublishMessage(ctx, broker, topic, payload, retained)
+		}, l)
+		p.Async.Start()
+		defer p.Async.Stop()
+
+		_, err := p.Send(context.Background(), &publisher.Message{
+			Frontend: metrics.FrontendHTTP,
+			Topic:    topic,
+			Payload:  []byte(`{"message":"hello"}`),
+			Async:    true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+
+		Eventually(received).ShouldNot(BeEmpty())
+		lock.Lock()
+		defer lock.Unlock()
+		Expect(queued).To(HavePrefix(encryption.SealedPrefix))
+		Expect(queued).NotTo(ContainSubstring("hello"))
+		decrypted, err := p.Encryption.Decrypt(topic, []byte(received()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(decrypted)).To(Equal(`{"message":"hello"}`))
+	})
+
+	It("Should queue async messages", func() {
+		config := viper.New()
+		var lock sync.Mutex
+		var published string
+		p.Async = async.NewQueue(config, func(ctx context.Context, broker, topic, payload string, retained bool) error {
+			lock.Lock()
+			defer lock.Unlock()
+			published = payload
+			return nil
+		}, l)
+		p.Async.Start()
+		defer p.Async.Stop()
+
+		result, err := p.Send(context.Background(), &publisher.Message{
+			Frontend: metrics.FrontendHTTP,
+			Topic:    "some/topic",
+			Payload:  []byte(`{"message":"hello"}`),
+			Async:    true,
+		})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.Queued).To(BeTrue())
+
+		Eventually(func() string {
+			lock.Lock()
+			defer lock.Unlock()
+			return published
+		}).Should(Equal(`{"message":"hello"}`))
+	})
+})
@@ -8,44 +8,122 @@
 package remote
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 
 	raven "github.com/getsentry/raven-go"
 	newrelic "github.com/newrelic/go-agent"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/async"
+	"github.com/topfreegames/arkadiko/compression"
+	"github.com/topfreegames/arkadiko/deadletter"
+	"github.com/topfreegames/arkadiko/encryption"
+	"github.com/topfreegames/arkadiko/enrichment"
+	"github.com/topfreegames/arkadiko/envelope"
+	"github.com/topfreegames/arkadiko/idempotency"
+	"github.com/topfreegames/arkadiko/limits"
+	"github.com/topfreegames/arkadiko/metrics"
 	"github.com/topfreegames/arkadiko/mqttclient"
+	"github.com/topfreegames/arkadiko/publisher"
+	"github.com/topfreegames/arkadiko/requestid"
+	"github.com/topfreegames/arkadiko/scheduler"
+	"github.com/topfreegames/arkadiko/signing"
+	"github.com/topfreegames/arkadiko/topic"
+	"github.com/topfreegames/arkadiko/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	context "golang.org/x/net/context"
 )
 
 // Server represents the server that replies to RPC messages
 type Server struct {
-	Debug      bool
-	Port       int
-	Host       string
-	ConfigPath string
-	Config     *viper.Viper
-	Logger     log.FieldLogger
-	MqttClient *mqttclient.MqttClient
-	NewRelic   newrelic.Application
-	grpcServer *grpc.Server
+	Debug       bool
+	Port        int
+	Host        string
+	ConfigPath  string
+	Config      *viper.Viper
+	Logger      log.FieldLogger
+	Brokers     *mqttclient.Router
+	MqttClient  *mqttclient.MqttClient
+	Enrichment  *enrichment.Pipeline
+	Limits      *limits.Limits
+	Compression *compression.Compressor
+	Encryption  *encryption.Encryptor
+	Signing     *signing.Signer
+	Envelope    *envelope.Wrapper
+	Tracing     *tracing.Propagator
+	Idempotency *idempotency.Deduplicator
+	Scheduler   *scheduler.Scheduler
+	Async       *async.Queue
+	DeadLetters *deadletter.Recorder
+	Publisher   *publisher.Publisher
+	NewRelic    newrelic.Application
+	Metrics     *metrics.Frontend
+	grpcServer  *grpc.Server
+	// owned are the components created by the server, which it starts and
+	// stops, as opposed to the ones it shares
+	owned Components
+}
+
+// Components are the publishing components a server can share with the
+// HTTP API, so messages are published through the same broker connections,
+// scheduled messages are persisted by a single scheduler, async messages
+// share the same bounded queue and dead letters the same sink
+type Components struct {
+	Brokers     *mqttclient.Router
+	Scheduler   *scheduler.Scheduler
+	Async       *async.Queue
+	DeadLetters *deadletter.Recorder
+}
+
+var (
+	metricsOnce   sync.Once
+	latencyMetric *metrics.HistogramVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		latencyMetric = metrics.NewHistogramVec(metrics.Opts{
+			Namespace:  "arkadiko",
+			Name:       "grpc_response_time",
+			Help:       "gRPC API response time",
+			StatsDName: "grpc_response_time_milliseconds",
+			Timing:     true,
+		}, []string{"method", "code"})
+	})
 }
 
 // NewServer returns a new RPC Server
 func NewServer(host string, port int, configPath string, debug bool, logger log.FieldLogger) (*Server, error) {
+	return NewServerWithComponents(host, port, configPath, debug, logger, Components{})
+}
+
+// NewServerWithComponents returns a new RPC Server using the shared
+// components, and creating the ones not shared as configured
+func NewServerWithComponents(host string, port int, configPath string, debug bool, logger log.FieldLogger, shared Components) (*Server, error) {
 	server := &Server{
-		Host:       host,
-		Port:       port,
-		ConfigPath: configPath,
-		Config:     viper.New(),
-		Debug:      debug,
-		MqttClient: nil,
-		Logger:     logger,
+		Host:        host,
+		Port:        port,
+		ConfigPath:  configPath,
+		Config:      viper.New(),
+		Debug:       debug,
+		MqttClient:  nil,
+		Logger:      logger,
+		Brokers:     shared.Brokers,
+		Scheduler:   shared.Scheduler,
+		Async:       shared.Async,
+		DeadLetters: shared.DeadLetters,
 	}
 	err := server.configure()
 	if err != nil {
@@ -61,21 +139,122 @@ func (s *Server) configure() error {
 		return err
 	}
 	s.configureSentry()
+	s.Metrics = metrics.NewFrontend()
 	err = s.configureNewRelic()
 	if err != nil {
 		return err
 	}
 
+	s.Enrichment, err = enrichment.NewPipeline(s.Config)
+	if err != nil {
+		return err
+	}
+
+	s.Idempotency, err = idempotency.NewDeduplicator(s.Config, "grpc")
+	if err != nil {
+		return err
+	}
+
+	s.Limits, err = limits.NewLimits(s.Config, s.Logger)
+	if err != nil {
+		return err
+	}
+
+	s.Compression, err = compression.NewCompressor(s.Config, s.Logger)
+	if err != nil {
+		return err
+	}
+
+	s.Encryption, err = encryption.NewEncryptor(s.Config, s.Logger)
+	if err != nil {
+		return err
+	}
+
+	s.Signing, err = signing.NewSigner(s.Config, s.Logger)
+	if err != nil {
+		return err
+	}
+
+	s.Envelope, err = envelope.NewWrapper(s.Config)
+	if err != nil {
+		return err
+	}
+
+	s.Tracing = tracing.NewPropagator(s.Config)
+
 	err = s.configureRPC()
 	if err != nil {
 		return err
 	}
 
-	defaultLogger := s.Logger.WithFields(log.Fields{})
+	return s.configureComponents()
+}
+
+// configureComponents creates the publishing components that are enabled
+// and were not shared with the server
+func (s *Server) configureComponents() error {
+	l := s.Logger.WithFields(log.Fields{
+		"source":    "rpc",
+		"operation": "configureComponents",
+	})
+
+	if s.Brokers == nil {
+		l.Debug("Connecting to mqtt...")
+		brokers, err := mqttclient.NewRouter(mqttclient.Options{
+			Config: s.Config,
+			Logger: l,
+		})
+		if err != nil {
+			l.WithError(err).Error("Failed to connect to mqtt.")
+			return err
+		}
+		s.Brokers = brokers
+		s.owned.Brokers = brokers
+		l.Info("Connected to mqtt successfully.")
+	}
+	s.MqttClient = s.Brokers.Brokers[s.Brokers.Default]
+
+	s.Publisher = &publisher.Publisher{
+		Brokers:     s.Brokers,
+		Limits:      s.Limits,
+		Compression: s.Compression,
+		Encryption:  s.Encryption,
+		Signing:     s.Signing,
+		Envelope:    s.Envelope,
+		Metrics:     s.Metrics,
+	}
+
+	if s.DeadLetters == nil {
+		recorder, err := deadletter.NewRecorder(s.Config, s.Brokers.PublishMessage, s.Logger)
+		if err != nil {
+			l.WithError(err).Error("Failed to configure dead letters.")
+			return err
+		}
+		s.DeadLetters = recorder
+		s.owned.DeadLetters = recorder
+	}
+
+	if s.Scheduler == nil && s.Config.GetBool("scheduler.enabled") {
+		scheduler, err := scheduler.NewScheduler(s.Config, s.Publisher.PublishMessage, s.Logger)
+		if err != nil {
+			l.WithError(err).Error("Failed to configure scheduler.")
+			return err
+		}
+		scheduler.DeadLetters = s.DeadLetters
+		s.Scheduler = scheduler
+		s.owned.Scheduler = scheduler
+	}
+
+	if s.Async == nil && s.Config.GetBool("async.enabled") {
+		queue := async.NewQueue(s.Config, s.Publisher.PublishMessage, s.Logger)
+		queue.DeadLetters = s.DeadLetters
+		s.Async = queue
+		s.owned.Async = queue
+	}
 
-	defaultLogger.Debug("Connecting to mqtt...")
-	s.MqttClient = mqttclient.GetMqttClient(s.ConfigPath, nil, nil, nil, defaultLogger)
-	defaultLogger.Info("Connected to mqtt successfully.")
+	s.Publisher.Scheduler = s.Scheduler
+	s.Publisher.Async = s.Async
+	s.Publisher.DeadLetters = s.DeadLetters
 
 	return nil
 }
@@ -150,9 +329,12 @@ func (s *Server) OnErrorHandler(err error, stack []byte) {
 func (s *Server) configureRPC() error {
 	l := s.Logger.WithField("operation", "configureRPC")
 
-	opts := []grpc.ServerOption{}
+	initMetrics()
+	opts := []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler()),
+		grpc.ChainUnaryInterceptor(requestid.UnaryServerInterceptor, latencyInterceptor),
+	}
 
-	//TODO: instrument with Jaeger
 	s.grpcServer = grpc.NewServer(opts...)
 	RegisterMQTTServer(s.grpcServer, s)
 	l.Debug("MQTT Server configured properly")
@@ -180,6 +362,13 @@ func (s *Server) Start() error {
 		"port": s.Port,
 	}).Info("RPC Server started.")
 
+	if s.owned.Scheduler != nil {
+		s.owned.Scheduler.Start()
+	}
+	if s.owned.Async != nil {
+		s.owned.Async.Start()
+	}
+
 	wg.Add(1)
 	go func(s *Server, lis net.Listener) {
 		wg.Done()
@@ -192,28 +381,273 @@ func (s *Server) Start() error {
 	return nil
 }
 
+// Close stops serving, waiting for the requests being handled, stops the
+// components it owns and disconnects from the brokers. Shared components are
+// left for their owner to stop after the server is closed
+func (s *Server) Close() {
+	s.grpcServer.GracefulStop()
+
+	// queued messages are published before disconnecting
+	if s.owned.Async != nil {
+		s.owned.Async.Stop()
+	}
+	if s.owned.Scheduler != nil {
+		s.owned.Scheduler.Stop()
+	}
+	if s.owned.DeadLetters != nil {
+		s.owned.DeadLetters.Close()
+	}
+	if s.owned.Brokers != nil {
+		s.owned.Brokers.Close()
+	}
+}
+
 // SendMessage to MQTT Server
 func (s *Server) SendMessage(ctx context.Context, message *Message) (*SendMessageResult, error) {
-	l := s.Logger.WithFields(log.Fields{
+	if message.IdempotencyKey == "" {
+		return s.sendMessage(ctx, message)
+	}
+
+	// every field telling how to publish the message is fingerprinted, so a
+	// key reused with other scheduling options is refused like it is over
+	// HTTP, where they are part of the URI
+	var deliverAt, delay string
+	if message.DeliverAt != nil {
+		deliverAt = message.DeliverAt.AsTime().Format(time.RFC3339Nano)
+	}
+	if message.Delay != nil {
+		delay = message.Delay.AsDuration().String()
+	}
+	fingerprint := idempotency.Fingerprint(
+		message.Topic,
+		message.Payload,
+		fmt.Sprintf("%t", message.Retained),
+		message.Broker,
+		deliverAt,
+		delay,
+		fmt.Sprintf("%t", message.Async),
+	)
+	result, deduplicated, err := s.Idempotency.Do(message.IdempotencyKey, fingerprint, func() (*idempotency.Result, error) {
+		sent, err := s.sendMessage(ctx, message)
+		if err != nil {
+			return nil, err
+		}
+		result := &idempotency.Result{Status: http.StatusOK, Body: sent.ScheduleId}
+		if sent.Queued {
+			result.Status = http.StatusAccepted
+		}
+		return result, nil
+	})
+
+	switch {
+	case err == idempotency.ErrKeyReused:
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	case err == idempotency.ErrInFlight:
+		return nil, status.Error(codes.Aborted, err.Error())
+	case err != nil:
+		return nil, err
+	}
+
+	if deduplicated {
+		requestid.Logger(ctx, s.Logger).WithFields(log.Fields{
+			"source":         "rpc",
+			"operation":      "SendMessage",
+			"topic":          message.Topic,
+			"idempotencyKey": message.IdempotencyKey,
+		}).Debug("Deduplicated message.")
+	}
+
+	return &SendMessageResult{
+		Topic:      message.Topic,
+		Retained:   message.Retained,
+		ScheduleId: result.Body,
+		Queued:     result.Status == http.StatusAccepted,
+	}, nil
+}
+
+func (s *Server) sendMessage(ctx context.Context, message *Message) (*SendMessageResult, error) {
+	l := requestid.Logger(ctx, s.Logger).WithFields(log.Fields{
 		"source":    "rpc",
 		"operation": "Start",
 		"Topic":     message.Topic,
 	})
-	var err error
-	if message.Retained {
-		l.Debug("Sending retained message.")
-		err = s.MqttClient.SendRetainedMessage(ctx, message.Topic, message.Payload)
-	} else {
-		l.Debug("Sending message.")
-		err = s.MqttClient.SendMessage(ctx, message.Topic, message.Payload)
+	deliverAt, err := getDeliverAt(message)
+	if err != nil {
+		return nil, err
+	}
+	if !deliverAt.IsZero() && s.Scheduler == nil {
+		return nil, status.Error(codes.FailedPrecondition, "scheduler is not enabled")
+	}
+	if message.Async && s.Async == nil {
+		return nil, status.Error(codes.FailedPrecondition, "async publishing is not enabled")
+	}
+
+	err = s.Limits.CheckBody(message.Topic, len(message.Payload))
+	if err != nil {
+		s.Metrics.Rejections.WithLabelValues(metrics.FrontendGRPC, metrics.RejectedTooLarge).Inc()
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	ctx, span := tracing.StartCreate(ctx, message.Topic, message.Retained)
+	defer span.End()
+
+	// only JSON objects matching enrichment rules or getting the trace
+	// context are encoded again, any other payload is sent as it was received
+	payload := message.Payload
+	msgPayload := decodeObject(payload)
+	meta := enrichment.Metadata{
+		Frontend:  metrics.FrontendGRPC,
+		RequestID: requestid.FromContext(ctx),
+	}
+	if msgPayload != nil && (s.Enrichment.Matches(message.Topic, meta) || s.Tracing.Field != "") {
+		payload, err = s.enrich(ctx, message.Topic, msgPayload, meta)
+		if err != nil {
+			l.WithError(err).Error("Failed to enrich message.")
+			return nil, err
+		}
+	}
+
+	gameID := topic.GameID(message.Topic, msgPayload)
+
+	// the gRPC API has no content types, so payloads that are not JSON are
+	// wrapped as binary data
+	contentType := "application/octet-stream"
+	if json.Valid([]byte(payload)) {
+		contentType = "application/json"
+	}
+	result, err := s.Publisher.Send(ctx, &publisher.Message{
+		Frontend:    metrics.FrontendGRPC,
+		Broker:      message.Broker,
+		Topic:       message.Topic,
+		Payload:     []byte(payload),
+		ContentType: contentType,
+		Retained:    message.Retained,
+		GameID:      gameID,
+		DeliverAt:   deliverAt,
+		Async:       message.Async,
+	})
+
+	var envelopeErr *publisher.EnvelopeError
+	var tooLargeErr *publisher.TooLargeError
+	switch {
+	case errors.As(err, &envelopeErr):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.As(err, &tooLargeErr):
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	case err == mqttclient.ErrUnknownBroker:
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("unknown broker %s", message.Broker))
+	}
+	l = l.WithField("broker", result.Broker)
+
+	if !deliverAt.IsZero() {
+		switch {
+		case err == scheduler.ErrFull:
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		case err == scheduler.ErrTooFar:
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case err != nil:
+			l.WithError(err).Error("Failed to schedule message.")
+			return nil, err
+		}
+
+		l.WithField("scheduleId", result.Schedule.ID).Debug("Scheduled message.")
+		return &SendMessageResult{
+			Topic:      message.Topic,
+			Retained:   message.Retained,
+			ScheduleId: result.Schedule.ID,
+		}, nil
+	}
+
+	if message.Async {
+		switch {
+		case err == async.ErrFull:
+			l.Warn("Async queue is full, dropping message.")
+			return nil, status.Error(codes.ResourceExhausted, err.Error())
+		case err == async.ErrStopped:
+			return nil, status.Error(codes.Unavailable, err.Error())
+		case err != nil:
+			return nil, err
+		}
+
+		l.Debug("Enqueued message.")
+		return &SendMessageResult{
+			Topic:    message.Topic,
+			Retained: message.Retained,
+			Queued:   true,
+		}, nil
+	}
+
+	if errors.Is(err, mqttclient.ErrBrokerUnavailable) {
+		l.WithError(err).Warn("Broker is unavailable.")
+		return nil, status.Error(codes.Unavailable, err.Error())
 	}
 	if err != nil {
 		l.WithError(err).Error("Failed to send message to MQTT.")
 		return nil, err
 	}
 
+	l.Debug("Sent message.")
 	return &SendMessageResult{
 		Topic:    message.Topic,
 		Retained: message.Retained,
 	}, nil
 }
+
+// latencyInterceptor measures how long each call takes to be answered
+func latencyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	latencyMetric.WithLabelValues(info.FullMethod, status.Code(err).String()).Observe(time.Since(start).Seconds())
+	return resp, err
+}
+
+// getDeliverAt returns when the message should be published, or the zero
+// time if it should be published right away
+func getDeliverAt(message *Message) (time.Time, error) {
+	switch {
+	case message.DeliverAt != nil && message.Delay != nil:
+		return time.Time{}, status.Error(codes.InvalidArgument, "only one of deliver_at and delay may be given")
+	case message.DeliverAt != nil:
+		if err := message.DeliverAt.CheckValid(); err != nil {
+			return time.Time{}, status.Error(codes.InvalidArgument, err.Error())
+		}
+		return message.DeliverAt.AsTime(), nil
+	case message.Delay != nil:
+		if err := message.Delay.CheckValid(); err != nil || message.Delay.AsDuration() < 0 {
+			return time.Time{}, status.Error(codes.InvalidArgument, "delay must be a positive duration")
+		}
+		return time.Now().Add(message.Delay.AsDuration()), nil
+	}
+
+	return time.Time{}, nil
+}
+
+// decodeObject returns the JSON object in payload, or nil if it is not one.
+// Numbers are kept as they were sent, so integers too large for a float64
+// are published without losing precision
+func decodeObject(payload string) map[string]interface{} {
+	decoder := json.NewDecoder(strings.NewReader(payload))
+	decoder.UseNumber()
+
+	var msgPayload map[string]interface{}
+	if err := decoder.Decode(&msgPayload); err != nil {
+		return nil
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil
+	}
+	return msgPayload
+}
+
+// enrich runs the enrichment pipeline over a JSON object payload and
+// injects the trace context of ctx into it
+func (s *Server) enrich(ctx context.Context, topic string, msgPayload map[string]interface{}, meta enrichment.Metadata) (string, error) {
+	s.Enrichment.Apply(topic, msgPayload, meta)
+	s.Tracing.Inject(ctx, msgPayload)
+
+	b, err := json.Marshal(msgPayload)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
@@ -9,14 +9,37 @@ package remote_test
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
+	dto "github.com/prometheus/client_model/go"
 	uuid "github.com/satori/go.uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/async"
+	"github.com/topfreegames/arkadiko/metrics"
 	"github.com/topfreegames/arkadiko/remote"
+	"github.com/topfreegames/arkadiko/requestid"
+	"github.com/topfreegames/arkadiko/scheduler"
 	. "github.com/topfreegames/arkadiko/testing"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 var _ = Describe("RPC Server", func() {
@@ -27,6 +50,53 @@ var _ = Describe("RPC Server", func() {
 				Expect(err).NotTo(HaveOccurred())
 				Expect(s).NotTo(BeNil())
 			})
+
+			It("Should use the components it shares", func() {
+				config := viper.New()
+				queue := async.NewQueue(config, nil, logrus.New())
+				s, err := remote.NewServerWithComponents("0.0.0.0", 8891, "../config/test.yml", false, logrus.New(), remote.Components{
+					Async: queue,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.Async).To(BeIdenticalTo(queue))
+				Expect(s.Scheduler).NotTo(BeNil())
+				Expect(s.DeadLetters).NotTo(BeNil())
+
+				// shared components are left for their owner to stop
+				s.Close()
+				Expect(queue.Enqueue(context.Background(), "default", "topic", "payload", false, "")).To(Succeed())
+			})
+
+			It("Should publish through the brokers it shares", func() {
+				owner, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+				defer owner.Close()
+
+				s, err := remote.NewServerWithComponents("0.0.0.0", 8891, "../config/test.yml", false, logrus.New(), remote.Components{
+					Brokers: owner.Brokers,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.Brokers).To(BeIdenticalTo(owner.Brokers))
+				Expect(s.Publisher.Brokers).To(BeIdenticalTo(owner.Brokers))
+				Expect(s.MqttClient.WaitForConnection(100)).To(Succeed())
+
+				// shared brokers are left for their owner to disconnect
+				s.Close()
+				for _, connection := range s.MqttClient.Health() {
+					Expect(connection.Connected).To(BeTrue())
+				}
+			})
+
+			It("Should disconnect from the brokers once closed", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.MqttClient.WaitForConnection(100)).To(Succeed())
+
+				s.Close()
+				for _, connection := range s.MqttClient.Health() {
+					Expect(connection.Connected).To(BeFalse())
+				}
+			})
 		})
 
 		Describe("sending messages", func() {
@@ -63,6 +133,396 @@ var _ = Describe("RPC Server", func() {
 				Expect(msg.Retained()).To(BeTrue())
 				Expect(string(msg.Payload())).To(Equal(expectedMsg))
 			})
+
+			It("Should send messages with the same idempotency key only once", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				topic := uuid.NewV4().String()
+				received := 0
+				s.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					received++
+				})
+				time.Sleep(50 * time.Millisecond)
+
+				cli, err := GetRPCTestClient()
+				Expect(err).NotTo(HaveOccurred())
+
+				message := &remote.Message{
+					Topic:          topic,
+					Payload:        `{"qwe": 123}`,
+					IdempotencyKey: uuid.NewV4().String(),
+				}
+				for i := 0; i < 2; i++ {
+					result, err := cli.SendMessage(context.Background(), message)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(result.Topic).To(Equal(topic))
+				}
+
+				time.Sleep(50 * time.Millisecond)
+				Expect(received).To(Equal(1))
+			})
+
+			It("Should refuse idempotency keys reused with other scheduling options", func() {
+				_, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				cli, err := GetRPCTestClient()
+				Expect(err).NotTo(HaveOccurred())
+
+				message := &remote.Message{
+					Topic:          uuid.NewV4().String(),
+					Payload:        `{"qwe": 123}`,
+					IdempotencyKey: uuid.NewV4().String(),
+				}
+				_, err = cli.SendMessage(context.Background(), message)
+				Expect(err).NotTo(HaveOccurred())
+
+				message.Delay = durationpb.New(time.Hour)
+				_, err = cli.SendMessage(context.Background(), message)
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+
+				message.Delay = nil
+				message.Async = true
+				_, err = cli.SendMessage(context.Background(), message)
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			})
+
+			It("Should stamp messages with the request id of the call", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				topic := fmt.Sprintf("enriched/%s", uuid.NewV4().String())
+				var lock sync.Mutex
+				var payload map[string]interface{}
+				s.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					json.Unmarshal(message.Payload(), &payload)
+				}).Wait()
+
+				cli, err := GetRPCTestClient()
+				Expect(err).NotTo(HaveOccurred())
+
+				ctx := metadata.AppendToOutgoingContext(context.Background(), requestid.MetadataKey, "grpc-request-1")
+				var header metadata.MD
+				_, err = cli.SendMessage(ctx, &remote.Message{
+					Topic:   topic,
+					Payload: `{"message": "hello"}`,
+				}, grpc.Header(&header))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(header.Get(requestid.MetadataKey)).To(Equal([]string{"grpc-request-1"}))
+
+				Eventually(func() interface{} {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload["request_id"]
+				}).Should(Equal("grpc-request-1"))
+			})
+
+			It("Should keep the numbers of enriched payloads as they were sent", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				topic := fmt.Sprintf("enriched/%s", uuid.NewV4().String())
+				var lock sync.Mutex
+				var payload string
+				s.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = string(message.Payload())
+				}).Wait()
+
+				cli, err := GetRPCTestClient()
+				Expect(err).NotTo(HaveOccurred())
+				_, err = cli.SendMessage(context.Background(), &remote.Message{
+					Topic:   topic,
+					Payload: `{"user_id": 9007199254740993, "score": 1.5}`,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				Eventually(func() string {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).Should(And(
+					ContainSubstring(`"user_id":9007199254740993`),
+					ContainSubstring(`"score":1.5`),
+					ContainSubstring(`"server_id":"arkadiko-test"`),
+				))
+			})
+
+			It("Should inject the trace context of the publish into payloads", func() {
+				recorder := tracetest.NewSpanRecorder()
+				otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+				defer otel.SetTracerProvider(noop.NewTracerProvider())
+
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+				s.Tracing.Field = "traceparent"
+
+				topic := uuid.NewV4().String()
+				var lock sync.Mutex
+				var payload map[string]interface{}
+				s.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					json.Unmarshal(message.Payload(), &payload)
+				}).Wait()
+
+				ctx, request := otel.Tracer("test").Start(context.Background(), "request")
+				_, err = s.SendMessage(ctx, &remote.Message{
+					Topic:   topic,
+					Payload: `{"message": "hello"}`,
+				})
+				request.End()
+				Expect(err).NotTo(HaveOccurred())
+
+				spans := map[string]sdktrace.ReadOnlySpan{}
+				for _, span := range recorder.Ended() {
+					spans[span.Name()] = span
+				}
+				Expect(spans).To(HaveKey(topic + " create"))
+				Expect(spans).To(HaveKey(topic + " publish"))
+				create := spans[topic+" create"]
+				Expect(create.Parent().SpanID()).To(Equal(request.SpanContext().SpanID()))
+				Expect(spans[topic+" publish"].Parent().SpanID()).To(Equal(create.SpanContext().SpanID()))
+
+				Eventually(func() interface{} {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload["traceparent"]
+				}).Should(Equal(fmt.Sprintf("00-%s-%s-01", create.SpanContext().TraceID(), create.SpanContext().SpanID())))
+			})
+
+			It("Should generate request ids for calls without one", func() {
+				cli, err := GetRPCTestClient()
+				Expect(err).NotTo(HaveOccurred())
+
+				var header metadata.MD
+				_, err = cli.SendMessage(context.Background(), &remote.Message{
+					Topic:   uuid.NewV4().String(),
+					Payload: `{"message": "hello"}`,
+				}, grpc.Header(&header))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(header.Get(requestid.MetadataKey)).To(HaveLen(1))
+				Expect(requestid.Valid(header.Get(requestid.MetadataKey)[0])).To(BeTrue())
+			})
+
+			It("Should send non JSON object payloads as they were received", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				topic := uuid.NewV4().String()
+				cli, err := GetRPCTestClient()
+				Expect(err).NotTo(HaveOccurred())
+
+				expectedMsg := `[{ "qwe": 123 }]`
+				_, err = cli.SendMessage(context.Background(), &remote.Message{
+					Topic:    topic,
+					Payload:  expectedMsg,
+					Retained: true,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				var msg mqtt.Message
+				s.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					msg = message
+				})
+
+				//Have to wait so the goroutine can call our handler
+				time.Sleep(50 * time.Millisecond)
+
+				Expect(msg).NotTo(BeNil())
+				Expect(string(msg.Payload())).To(Equal(expectedMsg))
+			})
+		})
+
+		Describe("async messages", func() {
+			It("Should queue messages and publish them in the background", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				Expect(s.Async).NotTo(BeNil())
+				s.Async.Start()
+				defer s.Close()
+
+				topic := uuid.NewV4().String()
+				var lock sync.Mutex
+				var payload string
+				s.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = string(message.Payload())
+				}).Wait()
+
+				result, err := s.SendMessage(context.Background(), &remote.Message{
+					Topic:   topic,
+					Payload: `{ "qwe": 123 }`,
+					Async:   true,
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.Queued).To(BeTrue())
+
+				Eventually(func() string {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).Should(Equal(`{ "qwe": 123 }`))
+			})
+
+			It("Should fail when async publishing is not enabled", func() {
+				os.Setenv("ARKADIKO_ASYNC_ENABLED", "false")
+				defer os.Unsetenv("ARKADIKO_ASYNC_ENABLED")
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.Async).To(BeNil())
+
+				_, err = s.SendMessage(context.Background(), &remote.Message{
+					Topic:   uuid.NewV4().String(),
+					Payload: `{ "qwe": 123 }`,
+					Async:   true,
+				})
+				Expect(status.Code(err)).To(Equal(codes.FailedPrecondition))
+			})
+		})
+
+		Describe("size limits", func() {
+			It("Should fail for payloads larger than allowed", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = s.SendMessage(context.Background(), &remote.Message{
+					Topic:   "limited/topic",
+					Payload: fmt.Sprintf(`{ "qwe": "%s" }`, strings.Repeat("a", 100)),
+				})
+				Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+			})
+		})
+
+		Describe("metrics", func() {
+			BeforeEach(func() {
+				config := viper.New()
+				config.Set("metrics.exporters", []string{"prometheus"})
+				_, err := metrics.Configure(context.Background(), config, logrus.New())
+				Expect(err).NotTo(HaveOccurred())
+			})
+
+			find := func(name string, labels map[string]string) *dto.Metric {
+				families, err := metrics.Gatherer().Gather()
+				Expect(err).NotTo(HaveOccurred())
+				for _, family := range families {
+					if family.GetName() != name {
+						continue
+					}
+				metric:
+					for _, m := range family.GetMetric() {
+						values := map[string]string{}
+						for _, pair := range m.GetLabel() {
+							values[pair.GetName()] = pair.GetValue()
+						}
+						for k, v := range labels {
+							if values[k] != v {
+								continue metric
+							}
+						}
+						return m
+					}
+				}
+				return nil
+			}
+
+			It("Should report messages labeled as received through gRPC", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(s.MqttClient.WaitForConnection(100)).To(Succeed())
+
+				_, err = s.SendMessage(context.Background(), &remote.Message{
+					Topic:   uuid.NewV4().String(),
+					Payload: `{ "qwe": 123 }`,
+				})
+				Expect(err).NotTo(HaveOccurred())
+
+				size := find("arkadiko_payload_size_bytes", map[string]string{"frontend": "grpc", "broker": "default"})
+				Expect(size).NotTo(BeNil())
+				Expect(size.GetHistogram().GetSampleSum()).To(Equal(float64(len(`{ "qwe": 123 }`))))
+
+				latency := find("arkadiko_mqtt_latency", map[string]string{"frontend": "grpc", "broker": "default", "error": "false"})
+				Expect(latency).NotTo(BeNil())
+				Expect(latency.GetHistogram().GetSampleCount()).To(Equal(uint64(1)))
+			})
+
+			It("Should count rejected messages by reason", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = s.SendMessage(context.Background(), &remote.Message{
+					Topic:   "limited/topic",
+					Payload: fmt.Sprintf(`{ "qwe": "%s" }`, strings.Repeat("a", 100)),
+				})
+				Expect(status.Code(err)).To(Equal(codes.ResourceExhausted))
+
+				rejected := find("arkadiko_rejected_requests", map[string]string{"frontend": "grpc", "reason": "too_large"})
+				Expect(rejected).NotTo(BeNil())
+				Expect(rejected.GetCounter().GetValue()).To(Equal(1.0))
+			})
+		})
+
+		Describe("scheduling messages", func() {
+			It("Should publish delayed messages once they are due", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				dir, err := os.MkdirTemp("", "arkadiko-schedules")
+				Expect(err).NotTo(HaveOccurred())
+				defer os.RemoveAll(dir)
+
+				s.Config.Set("scheduler.path", filepath.Join(dir, "schedules.json"))
+				s.Config.Set("scheduler.pollInterval", 10*time.Millisecond)
+				s.Scheduler, err = scheduler.NewScheduler(s.Config, s.Brokers.PublishMessage, s.Logger)
+				Expect(err).NotTo(HaveOccurred())
+				s.Publisher.Scheduler = s.Scheduler
+				s.Scheduler.Start()
+				defer s.Scheduler.Stop()
+
+				topic := uuid.NewV4().String()
+				var lock sync.Mutex
+				var payload string
+				s.MqttClient.MqttClient.Subscribe(topic, 2, func(client mqtt.Client, message mqtt.Message) {
+					lock.Lock()
+					defer lock.Unlock()
+					payload = string(message.Payload())
+				}).Wait()
+
+				result, err := s.SendMessage(context.Background(), &remote.Message{
+					Topic:   topic,
+					Payload: `{ "qwe": 123 }`,
+					Delay:   durationpb.New(100 * time.Millisecond),
+				})
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result.ScheduleId).NotTo(BeEmpty())
+				Expect(s.Scheduler.List()).To(HaveLen(1))
+
+				Eventually(func() string {
+					lock.Lock()
+					defer lock.Unlock()
+					return payload
+				}).Should(Equal(`{ "qwe": 123 }`))
+				Expect(s.Scheduler.List()).To(BeEmpty())
+			})
+
+			It("Should fail if both deliver_at and delay are given", func() {
+				s, err := GetDefaultTestServer()
+				Expect(err).NotTo(HaveOccurred())
+
+				_, err = s.SendMessage(context.Background(), &remote.Message{
+					Topic:     uuid.NewV4().String(),
+					Payload:   `{ "qwe": 123 }`,
+					DeliverAt: timestamppb.Now(),
+					Delay:     durationpb.New(time.Minute),
+				})
+				Expect(status.Code(err)).To(Equal(codes.InvalidArgument))
+			})
 		})
 	})
 })
@@ -0,0 +1,106 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+// Package requestid correlates what arkadiko logs and publishes with the
+// request that caused it.
+//
+// Each request is given the id its caller sent in the X-Request-ID header,
+// or x-request-id metadata for gRPC, or a new one if it sent none. The id
+// travels in the request context, so everything logged while handling the
+// request can be tagged with it, and is sent back to the caller.
+package requestid
+
+import (
+	"context"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+const (
+	// Header is the HTTP header request ids are read from and written to
+	Header = "X-Request-ID"
+	// MetadataKey is the gRPC metadata key request ids are read from and
+	// written to
+	MetadataKey = "x-request-id"
+	// LogField is the field request ids are logged as
+	LogField = "requestId"
+	// MaxLength is the longest request id accepted from callers
+	MaxLength = 128
+)
+
+type contextKey struct{}
+
+// New returns a new request id
+func New() string {
+	return uuid.NewV4().String()
+}
+
+// Valid returns whether id can be used as it was received. Ids must be
+// printable ASCII without spaces, so they can't forge log lines or headers
+func Valid(id string) bool {
+	if id == "" || len(id) > MaxLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// Ensure returns id if it is valid, or a new request id otherwise
+func Ensure(id string) string {
+	if Valid(id) {
+		return id
+	}
+	return New()
+}
+
+// NewContext returns ctx carrying the request id
+func NewContext(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, contextKey{}, id)
+}
+
+// FromContext returns the request id carried by ctx, or an empty string if
+// there is none
+func FromContext(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(contextKey{}).(string)
+	return id
+}
+
+// Logger returns l tagged with the request id carried by ctx, if any
+func Logger(ctx context.Context, l log.FieldLogger) log.FieldLogger {
+	id := FromContext(ctx)
+	if id == "" {
+		return l
+	}
+	return l.WithField(LogField, id)
+}
+
+// UnaryServerInterceptor gives each call the request id in its metadata, or
+// a new one, and sends it back in the response header metadata
+func UnaryServerInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(MetadataKey); len(values) > 0 {
+			id = values[0]
+		}
+	}
+	id = Ensure(id)
+
+	// the header is best effort, the call is handled even if the transport
+	// does not take it
+	_ = grpc.SetHeader(ctx, metadata.Pairs(MetadataKey, id))
+	return handler(NewContext(ctx, id), req)
+}
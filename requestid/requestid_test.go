@@ -0,0 +1,94 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package requestid_test
+
+import (
+	"context"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/topfreegames/arkadiko/requestid"
+)
+
+var _ = Describe("Request ID", func() {
+	Describe("Validating ids", func() {
+		It("Should accept ids from callers", func() {
+			Expect(requestid.Valid("4f1c0d2e-trace:42")).To(BeTrue())
+			Expect(requestid.Valid(strings.Repeat("a", requestid.MaxLength))).To(BeTrue())
+		})
+
+		It("Should refuse ids that could forge logs or headers", func() {
+			Expect(requestid.Valid("")).To(BeFalse())
+			Expect(requestid.Valid("id\nlevel=error")).To(BeFalse())
+			Expect(requestid.Valid("some id")).To(BeFalse())
+			Expect(requestid.Valid("ïd")).To(BeFalse())
+			Expect(requestid.Valid(strings.Repeat("a", requestid.MaxLength+1))).To(BeFalse())
+		})
+
+		It("Should replace invalid ids with new ones", func() {
+			Expect(requestid.Ensure("abc")).To(Equal("abc"))
+
+			id := requestid.Ensure("some id")
+			Expect(id).NotTo(Equal("some id"))
+			Expect(requestid.Valid(id)).To(BeTrue())
+			Expect(requestid.Ensure("")).NotTo(Equal(requestid.Ensure("")))
+		})
+	})
+
+	Describe("Context", func() {
+		It("Should carry the id", func() {
+			ctx := requestid.NewContext(context.Background(), "abc")
+			Expect(requestid.FromContext(ctx)).To(Equal("abc"))
+			Expect(requestid.FromContext(context.Background())).To(BeEmpty())
+		})
+
+		It("Should tag log lines with the id", func() {
+			logger, hook := test.NewNullLogger()
+
+			ctx := requestid.NewContext(context.Background(), "abc")
+			requestid.Logger(ctx, logger).Info("tagged")
+			requestid.Logger(context.Background(), logger).Info("untagged")
+
+			entries := hook.AllEntries()
+			Expect(entries).To(HaveLen(2))
+			Expect(entries[0].Data).To(HaveKeyWithValue(requestid.LogField, "abc"))
+			Expect(entries[1].Data).NotTo(HaveKey(requestid.LogField))
+		})
+	})
+
+	Describe("gRPC interceptor", func() {
+		var received string
+		handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+			received = requestid.FromContext(ctx)
+			return nil, nil
+		}
+		info := &grpc.UnaryServerInfo{FullMethod: "/MQTT/SendMessage"}
+
+		BeforeEach(func() {
+			received = ""
+		})
+
+		It("Should use the id in the call metadata", func() {
+			ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(requestid.MetadataKey, "abc"))
+			_, err := requestid.UnaryServerInterceptor(ctx, nil, info, handler)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(received).To(Equal("abc"))
+		})
+
+		It("Should generate an id for calls without one", func() {
+			_, err := requestid.UnaryServerInterceptor(context.Background(), nil, info, handler)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requestid.Valid(received)).To(BeTrue())
+		})
+	})
+})
@@ -0,0 +1,165 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package retry
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/metrics"
+)
+
+var (
+	metricsOnce     sync.Once
+	attemptsCounter *metrics.CounterVec
+	retriesCounter  *metrics.CounterVec
+	failuresCounter *metrics.CounterVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		attemptsCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "publish_attempts",
+			Help:      "Publish attempts by whether they succeeded",
+		}, []string{"client", "outcome"})
+		retriesCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "publish_retries",
+			Help:      "Publishes retried after a failed attempt",
+		}, []string{"client"})
+		failuresCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "publish_failures",
+			Help:      "Publishes that failed after all the attempts they were allowed",
+		}, []string{"client", "reason"})
+	})
+}
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err as not worth retrying
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsPermanent returns true if err should not be retried. Errors from the
+// context are always permanent.
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded)
+}
+
+// Policy decides how many times and how often failed attempts are retried
+type Policy struct {
+	Name           string
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter is the fraction of each backoff that is randomized
+	Jitter float64
+}
+
+// NewPolicy returns the policy configured under key, reporting metrics
+// labeled with name
+func NewPolicy(config *viper.Viper, key, name string) *Policy {
+	config.SetDefault(key+".maxAttempts", 3)
+	config.SetDefault(key+".initialBackoff", 100*time.Millisecond)
+	config.SetDefault(key+".maxBackoff", 2*time.Second)
+	config.SetDefault(key+".multiplier", 2)
+	config.SetDefault(key+".jitter", 0.2)
+
+	initMetrics()
+
+	return &Policy{
+		Name:           name,
+		MaxAttempts:    config.GetInt(key + ".maxAttempts"),
+		InitialBackoff: config.GetDuration(key + ".initialBackoff"),
+		MaxBackoff:     config.GetDuration(key + ".maxBackoff"),
+		Multiplier:     config.GetFloat64(key + ".multiplier"),
+		Jitter:         config.GetFloat64(key + ".jitter"),
+	}
+}
+
+// Backoff returns how long to wait after the given failed attempt, counting
+// from 1
+func (p *Policy) Backoff(attempt int) time.Duration {
+	backoff := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if backoff > float64(p.MaxBackoff) {
+		backoff = float64(p.MaxBackoff)
+	}
+	backoff -= backoff * p.Jitter * rand.Float64()
+	return time.Duration(backoff)
+}
+
+// Do calls attempt until it succeeds, returns a permanent error, runs out of
+// attempts or would outlive the deadline of ctx. It returns how many
+// attempts were made along with the last error.
+func (p *Policy) Do(ctx context.Context, attempt func(attempt int) error) (int, error) {
+	var err error
+	for i := 1; ; i++ {
+		err = attempt(i)
+		if err == nil {
+			attemptsCounter.WithLabelValues(p.Name, "succeeded").Inc()
+			return i, nil
+		}
+		attemptsCounter.WithLabelValues(p.Name, "failed").Inc()
+
+		if IsPermanent(err) {
+			p.fail("permanent")
+			return i, err
+		}
+
+		if i >= p.MaxAttempts {
+			p.fail("exhausted")
+			return i, err
+		}
+
+		backoff := p.Backoff(i)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			p.fail("deadline")
+			return i, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			p.fail("deadline")
+			return i, err
+		case <-timer.C:
+		}
+		retriesCounter.WithLabelValues(p.Name).Inc()
+	}
+}
+
+func (p *Policy) fail(reason string) {
+	failuresCounter.WithLabelValues(p.Name, reason).Inc()
+}
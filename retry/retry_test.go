@@ -0,0 +1,110 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package retry_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/retry"
+)
+
+var _ = Describe("Retry", func() {
+	errFailed := errors.New("failed")
+
+	var policy *retry.Policy
+
+	BeforeEach(func() {
+		config := viper.New()
+		config.Set("test.retry.initialBackoff", time.Millisecond)
+		config.Set("test.retry.maxBackoff", 4*time.Millisecond)
+		config.Set("test.retry.maxAttempts", 4)
+		policy = retry.NewPolicy(config, "test.retry", "test")
+	})
+
+	Describe("Backoff", func() {
+		It("Should grow exponentially up to the maximum", func() {
+			policy.Jitter = 0
+			Expect(policy.Backoff(1)).To(Equal(time.Millisecond))
+			Expect(policy.Backoff(2)).To(Equal(2 * time.Millisecond))
+			Expect(policy.Backoff(3)).To(Equal(4 * time.Millisecond))
+			Expect(policy.Backoff(10)).To(Equal(4 * time.Millisecond))
+		})
+
+		It("Should only shorten backoffs with jitter", func() {
+			policy.Jitter = 0.5
+			for i := 0; i < 100; i++ {
+				Expect(policy.Backoff(2)).To(BeNumerically(">=", time.Millisecond))
+				Expect(policy.Backoff(2)).To(BeNumerically("<=", 2*time.Millisecond))
+			}
+		})
+	})
+
+	Describe("Do", func() {
+		It("Should stop retrying once an attempt succeeds", func() {
+			attempts, err := policy.Do(context.Background(), func(attempt int) error {
+				if attempt < 3 {
+					return errFailed
+				}
+				return nil
+			})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(attempts).To(Equal(3))
+		})
+
+		It("Should give up after the maximum attempts", func() {
+			attempts, err := policy.Do(context.Background(), func(attempt int) error {
+				return errFailed
+			})
+			Expect(err).To(Equal(errFailed))
+			Expect(attempts).To(Equal(4))
+		})
+
+		It("Should not retry permanent errors", func() {
+			attempts, err := policy.Do(context.Background(), func(attempt int) error {
+				return retry.Permanent(fmt.Errorf("wrapped: %w", errFailed))
+			})
+			Expect(errors.Is(err, errFailed)).To(BeTrue())
+			Expect(retry.IsPermanent(err)).To(BeTrue())
+			Expect(attempts).To(Equal(1))
+		})
+
+		It("Should not retry past the context deadline", func() {
+			policy.InitialBackoff = time.Second
+			policy.MaxBackoff = time.Second
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			start := time.Now()
+			attempts, err := policy.Do(ctx, func(attempt int) error {
+				return errFailed
+			})
+			Expect(err).To(Equal(errFailed))
+			Expect(attempts).To(Equal(1))
+			Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+		})
+
+		It("Should stop waiting once the context is cancelled", func() {
+			policy.InitialBackoff = time.Second
+			policy.MaxBackoff = time.Second
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(10*time.Millisecond, cancel)
+
+			attempts, err := policy.Do(ctx, func(attempt int) error {
+				return errFailed
+			})
+			Expect(err).To(Equal(errFailed))
+			Expect(attempts).To(Equal(1))
+		})
+	})
+})
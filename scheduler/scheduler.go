@@ -0,0 +1,355 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package scheduler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/deadletter"
+	"github.com/topfreegames/arkadiko/metrics"
+)
+
+var (
+	// ErrNotFound is returned when cancelling a schedule that does not exist
+	ErrNotFound = errors.New("schedule not found")
+	// ErrFull is returned when scheduler.maxPending schedules are already pending
+	ErrFull = errors.New("too many pending schedules")
+	// ErrTooFar is returned when a message is scheduled after scheduler.maxDelay
+	ErrTooFar = errors.New("message scheduled too far in the future")
+)
+
+// PublishFunc publishes a message to the named broker when its schedule is due
+type PublishFunc func(ctx context.Context, broker, topic, payload string, retained bool) error
+
+// Schedule is a message waiting to be published
+type Schedule struct {
+	ID        string    `json:"id"`
+	Broker    string    `json:"broker"`
+	Topic     string    `json:"topic"`
+	Payload   string    `json:"payload"`
+	Retained  bool      `json:"retained"`
+	DeliverAt time.Time `json:"deliverAt"`
+	CreatedAt time.Time `json:"createdAt"`
+	Attempts  int       `json:"attempts"`
+	Requestor string    `json:"requestor,omitempty"`
+}
+
+var (
+	metricsOnce       sync.Once
+	pendingGauge      metrics.Gauge
+	deliveriesCounter *metrics.CounterVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		pendingGauge = metrics.NewGauge(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "scheduled_messages_pending",
+			Help:      "Scheduled messages waiting to be published",
+		})
+		deliveriesCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "scheduled_messages",
+			Help:      "Scheduled messages by what happened to them",
+		}, []string{"status"})
+	})
+}
+
+// Scheduler keeps messages until they are due, persisting them to a local
+// file so they survive restarts
+type Scheduler struct {
+	Path         string
+	PollInterval time.Duration
+	MaxPending   int
+	MaxDelay     time.Duration
+	MaxAttempts  int
+	DeadLetters  *deadletter.Recorder
+	Logger       log.FieldLogger
+	publish      PublishFunc
+	schedules    map[string]*Schedule
+	lock         sync.Mutex
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// NewScheduler returns a Scheduler configured under the scheduler key, with
+// every schedule persisted in scheduler.path loaded
+func NewScheduler(config *viper.Viper, publish PublishFunc, logger log.FieldLogger) (*Scheduler, error) {
+	config.SetDefault("scheduler.path", "./data/schedules.json")
+	config.SetDefault("scheduler.pollInterval", time.Second)
+	config.SetDefault("scheduler.maxPending", 10000)
+	config.SetDefault("scheduler.maxDelay", 30*24*time.Hour)
+	config.SetDefault("scheduler.maxAttempts", 3)
+
+	initMetrics()
+
+	s := &Scheduler{
+		Path:         config.GetString("scheduler.path"),
+		PollInterval: config.GetDuration("scheduler.pollInterval"),
+		MaxPending:   config.GetInt("scheduler.maxPending"),
+		MaxDelay:     config.GetDuration("scheduler.maxDelay"),
+		MaxAttempts:  config.GetInt("scheduler.maxAttempts"),
+		Logger:       logger.WithField("source", "Scheduler"),
+		publish:      publish,
+		schedules:    map[string]*Schedule{},
+	}
+
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *Scheduler) load() error {
+	b, err := os.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("could not read schedules from %s: %w", s.Path, err)
+	}
+
+	var schedules []*Schedule
+	err = json.Unmarshal(b, &schedules)
+	if err != nil {
+		return fmt.Errorf("could not parse schedules from %s: %w", s.Path, err)
+	}
+
+	for _, schedule := range schedules {
+		s.schedules[schedule.ID] = schedule
+	}
+	pendingGauge.Set(float64(len(s.schedules)))
+	s.Logger.WithField("pending", len(s.schedules)).Info("Loaded persisted schedules.")
+
+	return nil
+}
+
+// persist must be called holding the lock
+func (s *Scheduler) persist() error {
+	pendingGauge.Set(float64(len(s.schedules)))
+
+	b, err := json.Marshal(s.sorted())
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.Path), 0755)
+	if err != nil {
+		return err
+	}
+
+	// write and rename so a crash never leaves a truncated file behind
+	tmp := s.Path + ".tmp"
+	err = os.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.Path)
+}
+
+// sorted must be called holding the lock
+func (s *Scheduler) sorted() []*Schedule {
+	schedules := make([]*Schedule, 0, len(s.schedules))
+	for _, schedule := range s.schedules {
+		schedules = append(schedules, schedule)
+	}
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].DeliverAt.Before(schedules[j].DeliverAt)
+	})
+	return schedules
+}
+
+// Schedule stores a message to be published to broker at deliverAt
+func (s *Scheduler) Schedule(broker, topic, payload string, retained bool, requestor string, deliverAt time.Time) (*Schedule, error) {
+	now := time.Now()
+	if deliverAt.Sub(now) > s.MaxDelay {
+		return nil, ErrTooFar
+	}
+
+	schedule := &Schedule{
+		ID:        uuid.NewV4().String(),
+		Broker:    broker,
+		Topic:     topic,
+		Payload:   payload,
+		Retained:  retained,
+		DeliverAt: deliverAt.UTC(),
+		CreatedAt: now.UTC(),
+		Requestor: requestor,
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if len(s.schedules) >= s.MaxPending {
+		return nil, ErrFull
+	}
+
+	s.schedules[schedule.ID] = schedule
+	err := s.persist()
+	if err != nil {
+		delete(s.schedules, schedule.ID)
+		return nil, fmt.Errorf("could not persist schedule: %w", err)
+	}
+	deliveriesCounter.WithLabelValues("scheduled").Inc()
+
+	return schedule, nil
+}
+
+// Cancel removes a pending schedule
+func (s *Scheduler) Cancel(id string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	schedule, ok := s.schedules[id]
+	if !ok {
+		return ErrNotFound
+	}
+
+	delete(s.schedules, id)
+	err := s.persist()
+	if err != nil {
+		s.schedules[id] = schedule
+		return fmt.Errorf("could not persist schedule: %w", err)
+	}
+	deliveriesCounter.WithLabelValues("cancelled").Inc()
+
+	return nil
+}
+
+// List returns the pending schedules, sooner first
+func (s *Scheduler) List() []*Schedule {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.sorted()
+}
+
+// Pending returns how many schedules are waiting to be published
+func (s *Scheduler) Pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.schedules)
+}
+
+// Start starts publishing messages as they become due
+func (s *Scheduler) Start() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	go func(stop, done chan struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(s.PollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				s.deliverDue()
+			}
+		}
+	}(s.stop, s.done)
+}
+
+// Stop stops publishing messages, waiting for deliveries in progress.
+// Pending schedules are kept for the next start.
+func (s *Scheduler) Stop() {
+	s.lock.Lock()
+	stop, done := s.stop, s.done
+	s.stop, s.done = nil, nil
+	s.lock.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (s *Scheduler) deliverDue() {
+	s.lock.Lock()
+	now := time.Now()
+	due := []*Schedule{}
+	for _, schedule := range s.sorted() {
+		if schedule.DeliverAt.After(now) {
+			break
+		}
+		due = append(due, schedule)
+	}
+	s.lock.Unlock()
+
+	for _, schedule := range due {
+		s.deliver(schedule)
+	}
+}
+
+func (s *Scheduler) deliver(schedule *Schedule) {
+	l := s.Logger.WithFields(log.Fields{
+		"operation":  "deliver",
+		"scheduleId": schedule.ID,
+		"broker":     schedule.Broker,
+		"topic":      schedule.Topic,
+	})
+
+	err := s.publish(context.Background(), schedule.Broker, schedule.Topic, schedule.Payload, schedule.Retained)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// it may have been cancelled while being published
+	if _, ok := s.schedules[schedule.ID]; !ok {
+		return
+	}
+
+	schedule.Attempts++
+	switch {
+	case err == nil:
+		l.Debug("Published scheduled message.")
+		deliveriesCounter.WithLabelValues("published").Inc()
+		delete(s.schedules, schedule.ID)
+	case schedule.Attempts >= s.MaxAttempts:
+		l.WithError(err).WithField("payload", schedule.Payload).Error("Giving up on scheduled message.")
+		deliveriesCounter.WithLabelValues("failed").Inc()
+		s.DeadLetters.Record(&deadletter.Letter{
+			Broker:    schedule.Broker,
+			Topic:     schedule.Topic,
+			Payload:   schedule.Payload,
+			Retained:  schedule.Retained,
+			Error:     err.Error(),
+			Attempts:  schedule.Attempts,
+			Requestor: schedule.Requestor,
+		})
+		delete(s.schedules, schedule.ID)
+	default:
+		l.WithError(err).Warn("Failed to publish scheduled message, will retry.")
+	}
+
+	err = s.persist()
+	if err != nil {
+		l.WithError(err).Error("Could not persist schedules.")
+	}
+}
@@ -0,0 +1,193 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package scheduler_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/deadletter"
+	"github.com/topfreegames/arkadiko/scheduler"
+)
+
+type published struct {
+	broker   string
+	topic    string
+	payload  string
+	retained bool
+}
+
+var _ = Describe("Scheduler", func() {
+	l, _ := test.NewNullLogger()
+
+	var dir string
+	var config *viper.Viper
+	var lock sync.Mutex
+	var messages []published
+	var publishErr error
+
+	publish := func(ctx context.Context, broker, topic, payload string, retained bool) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if publishErr != nil {
+			return publishErr
+		}
+		messages = append(messages, published{broker, topic, payload, retained})
+		return nil
+	}
+
+	getMessages := func() []published {
+		lock.Lock()
+		defer lock.Unlock()
+		return messages
+	}
+
+	newScheduler := func() *scheduler.Scheduler {
+		s, err := scheduler.NewScheduler(config, publish, l)
+		Expect(err).NotTo(HaveOccurred())
+		return s
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = os.MkdirTemp("", "arkadiko-scheduler")
+		Expect(err).NotTo(HaveOccurred())
+
+		config = viper.New()
+		config.Set("scheduler.path", filepath.Join(dir, "schedules.json"))
+		config.Set("scheduler.pollInterval", 5*time.Millisecond)
+		messages = nil
+		publishErr = nil
+	})
+
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Describe("Schedule", func() {
+		It("Should list pending schedules sooner first", func() {
+			s := newScheduler()
+			later, err := s.Schedule("default", "topic", "later", false, "", time.Now().Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+			sooner, err := s.Schedule("default", "topic", "sooner", true, "", time.Now().Add(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+
+			schedules := s.List()
+			Expect(schedules).To(HaveLen(2))
+			Expect(schedules[0].ID).To(Equal(sooner.ID))
+			Expect(schedules[1].ID).To(Equal(later.ID))
+		})
+
+		It("Should persist schedules across instances", func() {
+			schedule, err := newScheduler().Schedule("default", "topic", "payload", true, "", time.Now().Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+
+			info, err := os.Stat(filepath.Join(dir, "schedules.json"))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0600)))
+
+			schedules := newScheduler().List()
+			Expect(schedules).To(HaveLen(1))
+			Expect(schedules[0].ID).To(Equal(schedule.ID))
+			Expect(schedules[0].Payload).To(Equal("payload"))
+			Expect(schedules[0].Retained).To(BeTrue())
+		})
+
+		It("Should refuse schedules beyond the limits", func() {
+			config.Set("scheduler.maxPending", 1)
+			config.Set("scheduler.maxDelay", time.Hour)
+			s := newScheduler()
+
+			_, err := s.Schedule("default", "topic", "payload", false, "", time.Now().Add(2*time.Hour))
+			Expect(err).To(Equal(scheduler.ErrTooFar))
+
+			_, err = s.Schedule("default", "topic", "payload", false, "", time.Now().Add(time.Minute))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = s.Schedule("default", "topic", "payload", false, "", time.Now().Add(time.Minute))
+			Expect(err).To(Equal(scheduler.ErrFull))
+		})
+	})
+
+	Describe("Cancel", func() {
+		It("Should remove the schedule", func() {
+			s := newScheduler()
+			schedule, err := s.Schedule("default", "topic", "payload", false, "", time.Now().Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(s.Cancel(schedule.ID)).To(Succeed())
+			Expect(s.List()).To(BeEmpty())
+			Expect(newScheduler().List()).To(BeEmpty())
+		})
+
+		It("Should fail for unknown schedules", func() {
+			Expect(newScheduler().Cancel("unknown")).To(Equal(scheduler.ErrNotFound))
+		})
+	})
+
+	Describe("Delivery", func() {
+		It("Should publish messages once they are due", func() {
+			s := newScheduler()
+			_, err := s.Schedule("eu", "soon", "payload", true, "", time.Now().Add(20*time.Millisecond))
+			Expect(err).NotTo(HaveOccurred())
+			_, err = s.Schedule("default", "later", "payload", false, "", time.Now().Add(time.Hour))
+			Expect(err).NotTo(HaveOccurred())
+
+			s.Start()
+			defer s.Stop()
+
+			Eventually(getMessages).Should(Equal([]published{{"eu", "soon", "payload", true}}))
+			Expect(s.List()).To(HaveLen(1))
+		})
+
+		It("Should give up after the configured attempts", func() {
+			config.Set("scheduler.maxAttempts", 2)
+			publishErr = errors.New("broker unavailable")
+			s := newScheduler()
+			_, err := s.Schedule("default", "topic", "payload", false, "", time.Now())
+			Expect(err).NotTo(HaveOccurred())
+
+			s.Start()
+			defer s.Stop()
+
+			Eventually(s.List).Should(BeEmpty())
+			Expect(getMessages()).To(BeEmpty())
+		})
+
+		It("Should record messages it gave up on as dead letters", func() {
+			config.Set("scheduler.maxAttempts", 2)
+			config.Set("deadletter.sink", "file")
+			config.Set("deadletter.file.path", filepath.Join(dir, "deadletters.jsonl"))
+			publishErr = errors.New("broker unavailable")
+			recorder, err := deadletter.NewRecorder(config, nil, l)
+			Expect(err).NotTo(HaveOccurred())
+			defer recorder.Close()
+			s := newScheduler()
+			s.DeadLetters = recorder
+			_, err = s.Schedule("default", "topic", "payload", false, "tests", time.Now())
+			Expect(err).NotTo(HaveOccurred())
+
+			s.Start()
+			defer s.Stop()
+
+			Eventually(recorder.List).Should(HaveLen(1))
+			letters, err := recorder.List()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(letters[0].Topic).To(Equal("topic"))
+			Expect(letters[0].Attempts).To(Equal(2))
+			Expect(letters[0].Requestor).To(Equal("tests"))
+		})
+	})
+})
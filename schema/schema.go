@@ -0,0 +1,151 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package schema
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/topic"
+)
+
+// Violation is a single way in which a payload failed to match its schema
+type Violation struct {
+	Pointer string `json:"pointer"`
+	Message string `json:"message"`
+}
+
+// Result is the outcome of validating a payload against the registry
+type Result struct {
+	Pattern    string
+	DryRun     bool
+	Violations []Violation
+}
+
+// Valid returns true if the payload had no violations
+func (r *Result) Valid() bool {
+	return len(r.Violations) == 0
+}
+
+type ruleConfig struct {
+	Pattern string `mapstructure:"pattern"`
+	Schema  string `mapstructure:"schema"`
+	DryRun  *bool  `mapstructure:"dryRun"`
+}
+
+type rule struct {
+	pattern string
+	dryRun  bool
+	schema  *jsonschema.Schema
+}
+
+// Registry maps topic patterns to the JSON Schemas their payloads must follow
+type Registry struct {
+	Path   string
+	DryRun bool
+	Logger log.FieldLogger
+	rules  []*rule
+}
+
+// NewRegistry loads the schemas configured under the schemas key
+func NewRegistry(config *viper.Viper, logger log.FieldLogger) (*Registry, error) {
+	r := &Registry{
+		Path:   config.GetString("schemas.path"),
+		DryRun: config.GetBool("schemas.dryRun"),
+		Logger: logger.WithField("source", "SchemaRegistry"),
+	}
+
+	var rules []ruleConfig
+	err := config.UnmarshalKey("schemas.topics", &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid schemas.topics configuration: %w", err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	for _, rc := range rules {
+		if rc.Pattern == "" || rc.Schema == "" {
+			return nil, fmt.Errorf("schema rules need both a pattern and a schema")
+		}
+
+		s, err := compiler.Compile(filepath.Join(r.Path, rc.Schema))
+		if err != nil {
+			return nil, fmt.Errorf("could not load schema %s: %w", rc.Schema, err)
+		}
+
+		dryRun := r.DryRun
+		if rc.DryRun != nil {
+			dryRun = *rc.DryRun
+		}
+
+		r.rules = append(r.rules, &rule{
+			pattern: rc.Pattern,
+			dryRun:  dryRun,
+			schema:  s,
+		})
+		r.Logger.WithFields(log.Fields{
+			"pattern": rc.Pattern,
+			"schema":  rc.Schema,
+			"dryRun":  dryRun,
+		}).Info("Loaded payload schema.")
+	}
+
+	return r, nil
+}
+
+// Validate checks payload against the schema of the first rule matching
+// topic. A nil result means no schema applies to the topic.
+func (r *Registry) Validate(t string, payload interface{}) (*Result, error) {
+	for _, rl := range r.rules {
+		if !topic.Match(rl.pattern, t) {
+			continue
+		}
+
+		result := &Result{
+			Pattern: rl.pattern,
+			DryRun:  rl.dryRun,
+		}
+
+		err := rl.schema.Validate(payload)
+		if err == nil {
+			return result, nil
+		}
+
+		var validationErr *jsonschema.ValidationError
+		if !errors.As(err, &validationErr) {
+			return nil, err
+		}
+
+		result.Violations = violations(validationErr)
+
+		return result, nil
+	}
+
+	return nil, nil
+}
+
+// violations flattens the validation error tree, keeping only its leaves since
+// every other node just summarizes the errors below it
+func violations(err *jsonschema.ValidationError) []Violation {
+	if len(err.Causes) == 0 {
+		return []Violation{{
+			Pointer: err.InstanceLocation,
+			Message: err.Message,
+		}}
+	}
+
+	var result []Violation
+	for _, cause := range err.Causes {
+		result = append(result, violations(cause)...)
+	}
+	return result
+}
@@ -0,0 +1,84 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package schema_test
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/schema"
+)
+
+var _ = Describe("Schema Registry", func() {
+	l, _ := test.NewNullLogger()
+
+	getRegistry := func() *schema.Registry {
+		config := viper.New()
+		config.SetConfigFile("../config/test.yml")
+		Expect(config.ReadInConfig()).To(Succeed())
+		registry, err := schema.NewRegistry(config, l)
+		Expect(err).NotTo(HaveOccurred())
+		return registry
+	}
+
+	parse := func(payload string) map[string]interface{} {
+		var msg map[string]interface{}
+		Expect(json.Unmarshal([]byte(payload), &msg)).To(Succeed())
+		return msg
+	}
+
+	Describe("Validate", func() {
+		It("Should return nil for topics without schema", func() {
+			result, err := getRegistry().Validate("other/topic", parse(`{"message": 1}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(BeNil())
+		})
+
+		It("Should accept valid payloads", func() {
+			result, err := getRegistry().Validate("schema/game/chat", parse(`{"message": "hello", "sender": {"id": "a"}}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Pattern).To(Equal("schema/+/chat"))
+			Expect(result.Valid()).To(BeTrue())
+		})
+
+		It("Should report violations with JSON pointers", func() {
+			result, err := getRegistry().Validate("schema/game/chat", parse(`{"message": 1, "sender": {}}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Valid()).To(BeFalse())
+			Expect(result.DryRun).To(BeFalse())
+
+			pointers := []string{}
+			for _, v := range result.Violations {
+				pointers = append(pointers, v.Pointer)
+			}
+			Expect(pointers).To(ConsistOf("/message", "/sender"))
+		})
+
+		It("Should flag dry run rules", func() {
+			result, err := getRegistry().Validate("schema/game/dryrun", parse(`{}`))
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.Valid()).To(BeFalse())
+			Expect(result.DryRun).To(BeTrue())
+		})
+	})
+
+	Describe("NewRegistry", func() {
+		It("Should fail for missing schema files", func() {
+			config := viper.New()
+			config.Set("schemas.path", "../config/schemas")
+			config.Set("schemas.topics", []map[string]interface{}{
+				{"pattern": "a/b", "schema": "missing.json"},
+			})
+			_, err := schema.NewRegistry(config, l)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+})
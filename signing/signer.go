@@ -0,0 +1,253 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/topfreegames/arkadiko/metrics"
+	"github.com/topfreegames/arkadiko/topic"
+)
+
+// Overhead is how much larger signed payloads are, with key ids of up to
+// 64 bytes
+const Overhead = len(Prefix) + 64 + 1 + 20 + 1 + 86 + 1
+
+type ruleConfig struct {
+	Pattern string `mapstructure:"pattern"`
+}
+
+type publicKeyConfig struct {
+	ID  string `mapstructure:"id"`
+	Key string `mapstructure:"key"`
+}
+
+var (
+	metricsOnce     sync.Once
+	messagesCounter *metrics.CounterVec
+)
+
+func initMetrics() {
+	metricsOnce.Do(func() {
+		messagesCounter = metrics.NewCounterVec(metrics.Opts{
+			Namespace: "arkadiko",
+			Name:      "signed_messages",
+			Help:      "Payloads signed by whether their topic is a system topic",
+		}, []string{"kind"})
+	})
+}
+
+// Signer signs the payloads of the topics matching its patterns
+type Signer struct {
+	Key        *PrivateKey
+	Logger     log.FieldLogger
+	publicKeys []PublicKey
+	patterns   []string
+	system     []string
+}
+
+// LoadPrivateKey returns the PKCS #8 PEM encoded Ed25519 private key in the
+// file at path, such as the ones generated by
+// `openssl genpkey -algorithm ed25519`. Keys without an id are named after
+// the fingerprint of their public key
+func LoadPrivateKey(path, id string) (*PrivateKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read signing key %s: %w", path, err)
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("signing key %s is not PEM encoded", path)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse signing key %s: %w", path, err)
+	}
+	key, ok := parsed.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key %s is not an Ed25519 key", path)
+	}
+
+	if id == "" {
+		sum := sha256.Sum256(key.Public().(ed25519.PublicKey))
+		id = hex.EncodeToString(sum[:8])
+	}
+	if err := validID(id); err != nil {
+		return nil, err
+	}
+	return &PrivateKey{ID: id, Key: key}, nil
+}
+
+func loadPatterns(config *viper.Viper, key string) ([]string, error) {
+	var rules []ruleConfig
+	err := config.UnmarshalKey(key, &rules)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s configuration: %w", key, err)
+	}
+	patterns := make([]string, 0, len(rules))
+	for _, rc := range rules {
+		if rc.Pattern == "" {
+			return nil, fmt.Errorf("%s rules need a pattern", key)
+		}
+		patterns = append(patterns, rc.Pattern)
+	}
+	return patterns, nil
+}
+
+// NewSigner returns a Signer with the key and patterns configured under the
+// signing key. A key is required when there are signed or system topics,
+// so they are never published unsigned
+func NewSigner(config *viper.Viper, logger log.FieldLogger) (*Signer, error) {
+	config.SetDefault("signing.key", "")
+	config.SetDefault("signing.keyId", "")
+
+	initMetrics()
+
+	s := &Signer{
+		Logger:     logger.WithField("source", "Signer"),
+		publicKeys: []PublicKey{},
+	}
+
+	var err error
+	s.patterns, err = loadPatterns(config, "signing.topics")
+	if err != nil {
+		return nil, err
+	}
+	s.system, err = loadPatterns(config, "signing.systemTopics")
+	if err != nil {
+		return nil, err
+	}
+
+	if path := config.GetString("signing.key"); path != "" {
+		s.Key, err = LoadPrivateKey(path, config.GetString("signing.keyId"))
+		if err != nil {
+			return nil, err
+		}
+		s.publicKeys = append(s.publicKeys, s.Key.Public())
+	}
+
+	// keys payloads were signed with before rotating the private key, still
+	// served to consumers so they can verify retained messages
+	var previous []publicKeyConfig
+	err = config.UnmarshalKey("signing.publicKeys", &previous)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing.publicKeys configuration: %w", err)
+	}
+	for _, pk := range previous {
+		key, err := ParsePublicKey(pk.ID, pk.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid signing.publicKeys configuration: %w", err)
+		}
+		s.publicKeys = append(s.publicKeys, key)
+	}
+	if _, err := NewVerifier(s.publicKeys...); err != nil {
+		return nil, fmt.Errorf("invalid signing.publicKeys configuration: %w", err)
+	}
+
+	switch {
+	case s.Key == nil && len(s.system) > 0:
+		return nil, fmt.Errorf("signing.key is required to sign system topics")
+	case s.Key == nil && len(s.patterns) > 0:
+		return nil, fmt.Errorf("signing.key is required to sign signing.topics")
+	case s.Key != nil:
+		s.Logger.WithFields(log.Fields{
+			"keyId":        s.Key.ID,
+			"patterns":     s.patterns,
+			"systemTopics": s.system,
+		}).Info("Loaded signed topics.")
+	}
+
+	return s, nil
+}
+
+func (s *Signer) isSystem(t string) bool {
+	for _, pattern := range s.system {
+		if topic.Match(pattern, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Signs returns whether payloads published to t are signed
+func (s *Signer) Signs(t string) bool {
+	if s.isSystem(t) {
+		return true
+	}
+	for _, pattern := range s.patterns {
+		if topic.Match(pattern, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// Sign signs payload if t is signed, or returns it as it is otherwise
+func (s *Signer) Sign(t, payload string) string {
+	if !s.Signs(t) {
+		return payload
+	}
+
+	kind := "topic"
+	if s.isSystem(t) {
+		kind = "system"
+	}
+	messagesCounter.WithLabelValues(kind).Inc()
+	return string(Sign(s.Key, t, []byte(payload), time.Now()))
+}
+
+// Overhead returns how much larger payloads published to t get once signed
+func (s *Signer) Overhead(t string) int {
+	if !s.Signs(t) {
+		return 0
+	}
+	return Overhead
+}
+
+// PublicKeys returns the keys consumers verify signatures with, starting
+// with the one payloads are signed with now
+func (s *Signer) PublicKeys() []PublicKey {
+	return s.publicKeys
+}
+
+type verifiedMessage struct {
+	mqtt.Message
+	payload []byte
+}
+
+func (m *verifiedMessage) Payload() []byte {
+	return m.payload
+}
+
+// MessageHandler wraps a subscription handler so it only receives messages
+// with valid signatures, without the signature envelope. Messages that are
+// not signed or fail verification are given to onError instead
+func MessageHandler(verifier *Verifier, next mqtt.MessageHandler, onError func(mqtt.Message, error)) mqtt.MessageHandler {
+	return func(client mqtt.Client, message mqtt.Message) {
+		payload, _, err := verifier.Verify(message.Topic(), message.Payload())
+		if err != nil {
+			if onError != nil {
+				onError(message, err)
+			}
+			return
+		}
+		next(client, &verifiedMessage{Message: message, payload: payload})
+	}
+}
@@ -0,0 +1,218 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+// Package signing signs payloads with Ed25519 so consumers can tell the
+// messages published by arkadiko from the ones published straight to the
+// broker, and verifies them on the consumer side.
+//
+// The signature covers the topic, the time the payload was signed at and
+// the payload, and is sent in an envelope made of a one line header naming
+// the key followed by the payload:
+//
+//	arkadiko-signature/1 <key id> <unix milliseconds> <signature>\n<payload>
+//
+// Signatures are encoded with unpadded URL safe base64.
+package signing
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prefix starts the header of every signed payload
+const Prefix = "arkadiko-signature/1 "
+
+var (
+	// ErrNotSigned is returned when verifying a payload without a signature
+	ErrNotSigned = errors.New("payload is not signed")
+	// ErrInvalidMessage is returned when verifying a malformed message
+	ErrInvalidMessage = errors.New("invalid signed message")
+	// ErrUnknownKey is returned when verifying a message signed with a key
+	// the verifier does not have
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrInvalidSignature is returned when the signature does not match the
+	// topic and payload
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrExpired is returned when verifying a message signed too long ago
+	ErrExpired = errors.New("signature expired")
+)
+
+// PrivateKey is a key payloads are signed with
+type PrivateKey struct {
+	ID  string
+	Key ed25519.PrivateKey
+}
+
+// Algorithm names the signature algorithm of public keys
+const Algorithm = "Ed25519"
+
+// PublicKey is a key signatures are verified with
+type PublicKey struct {
+	ID  string
+	Key ed25519.PublicKey
+}
+
+type publicKeyJSON struct {
+	ID        string `json:"id"`
+	Algorithm string `json:"algorithm"`
+	Key       string `json:"key"`
+}
+
+// ParsePublicKey returns the public key with id and a base64 encoded key
+func ParsePublicKey(id, key string) (PublicKey, error) {
+	if err := validID(id); err != nil {
+		return PublicKey{}, err
+	}
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return PublicKey{}, fmt.Errorf("key %s is not valid base64: %w", id, err)
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return PublicKey{}, fmt.Errorf("key %s must have %d bytes", id, ed25519.PublicKeySize)
+	}
+	return PublicKey{ID: id, Key: b}, nil
+}
+
+// MarshalJSON encodes k with its algorithm and base64 encoded key
+func (k PublicKey) MarshalJSON() ([]byte, error) {
+	return json.Marshal(publicKeyJSON{
+		ID:        k.ID,
+		Algorithm: Algorithm,
+		Key:       base64.StdEncoding.EncodeToString(k.Key),
+	})
+}
+
+// UnmarshalJSON decodes keys encoded by MarshalJSON
+func (k *PublicKey) UnmarshalJSON(b []byte) error {
+	var decoded publicKeyJSON
+	if err := json.Unmarshal(b, &decoded); err != nil {
+		return err
+	}
+	if decoded.Algorithm != "" && decoded.Algorithm != Algorithm {
+		return fmt.Errorf("key %s uses unsupported algorithm %s", decoded.ID, decoded.Algorithm)
+	}
+	key, err := ParsePublicKey(decoded.ID, decoded.Key)
+	if err != nil {
+		return err
+	}
+	*k = key
+	return nil
+}
+
+// Public returns the public key signatures made with k are verified with
+func (k *PrivateKey) Public() PublicKey {
+	return PublicKey{ID: k.ID, Key: k.Key.Public().(ed25519.PublicKey)}
+}
+
+func validID(id string) error {
+	if id == "" || len(id) > 64 || strings.ContainsAny(id, " \n") {
+		return fmt.Errorf("invalid key id %q", id)
+	}
+	return nil
+}
+
+// signed returns the bytes a signature covers. MQTT topics can't contain
+// the null character, so it separates the fields
+func signed(topic string, at int64, payload []byte) []byte {
+	b := make([]byte, 0, len(topic)+len(payload)+22)
+	b = append(b, topic...)
+	b = append(b, 0)
+	b = strconv.AppendInt(b, at, 10)
+	b = append(b, 0)
+	return append(b, payload...)
+}
+
+// Sign signs payload for topic with key, as of at
+func Sign(key *PrivateKey, topic string, payload []byte, at time.Time) []byte {
+	ms := at.UnixMilli()
+	signature := ed25519.Sign(key.Key, signed(topic, ms, payload))
+
+	header := fmt.Sprintf("%s%s %d %s\n", Prefix, key.ID, ms, base64.RawURLEncoding.EncodeToString(signature))
+	message := make([]byte, 0, len(header)+len(payload))
+	message = append(message, header...)
+	return append(message, payload...)
+}
+
+// IsSigned returns whether message is a signed payload
+func IsSigned(message []byte) bool {
+	return bytes.HasPrefix(message, []byte(Prefix))
+}
+
+// Verifier verifies signed payloads with a set of public keys
+type Verifier struct {
+	// MaxAge is how long ago messages may have been signed, or zero to
+	// accept messages signed at any time
+	MaxAge time.Duration
+	keys   map[string]ed25519.PublicKey
+}
+
+// NewVerifier returns a Verifier with the given keys, such as the ones
+// served by arkadiko at /signing/keys
+func NewVerifier(keys ...PublicKey) (*Verifier, error) {
+	v := &Verifier{keys: map[string]ed25519.PublicKey{}}
+	for _, key := range keys {
+		if err := validID(key.ID); err != nil {
+			return nil, err
+		}
+		if len(key.Key) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s must have %d bytes", key.ID, ed25519.PublicKeySize)
+		}
+		if _, ok := v.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %s", key.ID)
+		}
+		v.keys[key.ID] = key.Key
+	}
+	return v, nil
+}
+
+// Verify checks the signature of a message published to topic and returns
+// the payload and when it was signed. Payloads without a signature are
+// rejected with ErrNotSigned
+func (v *Verifier) Verify(topic string, message []byte) ([]byte, time.Time, error) {
+	if !IsSigned(message) {
+		return nil, time.Time{}, ErrNotSigned
+	}
+
+	end := bytes.IndexByte(message, '\n')
+	if end < 0 {
+		return nil, time.Time{}, ErrInvalidMessage
+	}
+	fields := strings.Split(string(message[len(Prefix):end]), " ")
+	if len(fields) != 3 {
+		return nil, time.Time{}, ErrInvalidMessage
+	}
+	ms, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, time.Time{}, ErrInvalidMessage
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(fields[2])
+	if err != nil {
+		return nil, time.Time{}, ErrInvalidMessage
+	}
+
+	key, ok := v.keys[fields[0]]
+	if !ok {
+		return nil, time.Time{}, ErrUnknownKey
+	}
+	payload := message[end+1:]
+	if !ed25519.Verify(key, signed(topic, ms, payload), signature) {
+		return nil, time.Time{}, ErrInvalidSignature
+	}
+
+	at := time.UnixMilli(ms)
+	if v.MaxAge > 0 && time.Since(at) > v.MaxAge {
+		return nil, at, ErrExpired
+	}
+	return payload, at, nil
+}
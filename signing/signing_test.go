@@ -0,0 +1,243 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package signing_test
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/viper"
+	"github.com/topfreegames/arkadiko/signing"
+)
+
+type message struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *message) Topic() string {
+	return m.topic
+}
+
+func (m *message) Payload() []byte {
+	return m.payload
+}
+
+func newKey(id string) *signing.PrivateKey {
+	_, key, err := ed25519.GenerateKey(nil)
+	Expect(err).NotTo(HaveOccurred())
+	return &signing.PrivateKey{ID: id, Key: key}
+}
+
+var _ = Describe("Signing", func() {
+	l, _ := test.NewNullLogger()
+
+	Describe("Verifier", func() {
+		It("Should verify signed payloads", func() {
+			key := newKey("key")
+			verifier, err := signing.NewVerifier(key.Public())
+			Expect(err).NotTo(HaveOccurred())
+
+			at := time.Now().Truncate(time.Millisecond)
+			signed := signing.Sign(key, "system/announcements", []byte("maintenance at noon"), at)
+			Expect(string(signed)).To(HavePrefix("arkadiko-signature/1 key "))
+			Expect(len(signed)).To(BeNumerically("<=", len("maintenance at noon")+signing.Overhead-64+len("key")))
+
+			payload, signedAt, err := verifier.Verify("system/announcements", signed)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(payload)).To(Equal("maintenance at noon"))
+			Expect(signedAt.Equal(at)).To(BeTrue())
+		})
+
+		It("Should reject payloads that are not signed", func() {
+			verifier, err := signing.NewVerifier(newKey("key").Public())
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = verifier.Verify("system/announcements", []byte("free gems for everyone"))
+			Expect(err).To(Equal(signing.ErrNotSigned))
+		})
+
+		It("Should reject payloads that were tampered with", func() {
+			key := newKey("key")
+			verifier, err := signing.NewVerifier(key.Public())
+			Expect(err).NotTo(HaveOccurred())
+			signed := signing.Sign(key, "system/announcements", []byte("maintenance at noon"), time.Now())
+
+			tampered := append([]byte{}, signed...)
+			tampered[len(tampered)-1] = 'X'
+			_, _, err = verifier.Verify("system/announcements", tampered)
+			Expect(err).To(Equal(signing.ErrInvalidSignature))
+
+			_, _, err = verifier.Verify("system/other", signed)
+			Expect(err).To(Equal(signing.ErrInvalidSignature))
+
+			_, _, err = verifier.Verify("system/announcements", signed[:30])
+			Expect(err).To(Equal(signing.ErrInvalidMessage))
+		})
+
+		It("Should reject payloads signed with unknown keys", func() {
+			verifier, err := signing.NewVerifier(newKey("key").Public())
+			Expect(err).NotTo(HaveOccurred())
+			signed := signing.Sign(newKey("other"), "system/announcements", []byte("hello"), time.Now())
+
+			_, _, err = verifier.Verify("system/announcements", signed)
+			Expect(err).To(Equal(signing.ErrUnknownKey))
+		})
+
+		It("Should reject payloads signed too long ago", func() {
+			key := newKey("key")
+			verifier, err := signing.NewVerifier(key.Public())
+			Expect(err).NotTo(HaveOccurred())
+			verifier.MaxAge = time.Minute
+			signed := signing.Sign(key, "system/announcements", []byte("hello"), time.Now().Add(-time.Hour))
+
+			_, _, err = verifier.Verify("system/announcements", signed)
+			Expect(err).To(Equal(signing.ErrExpired))
+		})
+
+		It("Should read the keys served to consumers", func() {
+			key := newKey("key")
+			b, err := json.Marshal([]signing.PublicKey{key.Public()})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(b)).To(ContainSubstring(`"algorithm":"Ed25519"`))
+
+			var keys []signing.PublicKey
+			Expect(json.Unmarshal(b, &keys)).To(Succeed())
+			verifier, err := signing.NewVerifier(keys...)
+			Expect(err).NotTo(HaveOccurred())
+
+			_, _, err = verifier.Verify("topic", signing.Sign(key, "topic", []byte("hello"), time.Now()))
+			Expect(err).NotTo(HaveOccurred())
+		})
+	})
+
+	Describe("Signer", func() {
+		var dir string
+		var config *viper.Viper
+		var key ed25519.PrivateKey
+
+		BeforeEach(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "arkadiko-signing")
+			Expect(err).NotTo(HaveOccurred())
+
+			_, key, err = ed25519.GenerateKey(nil)
+			Expect(err).NotTo(HaveOccurred())
+			der, err := x509.MarshalPKCS8PrivateKey(key)
+			Expect(err).NotTo(HaveOccurred())
+			path := filepath.Join(dir, "key.pem")
+			Expect(os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)).To(Succeed())
+
+			config = viper.New()
+			config.Set("signing.key", path)
+			config.Set("signing.topics", []map[string]interface{}{
+				{"pattern": "signed/#"},
+			})
+			config.Set("signing.systemTopics", []map[string]interface{}{
+				{"pattern": "system/#"},
+			})
+		})
+
+		AfterEach(func() {
+			os.RemoveAll(dir)
+		})
+
+		It("Should sign payloads of signed and system topics", func() {
+			s, err := signing.NewSigner(config, l)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Key.ID).To(HaveLen(16))
+
+			verifier, err := signing.NewVerifier(s.PublicKeys()...)
+			Expect(err).NotTo(HaveOccurred())
+			for _, t := range []string{"signed/room", "system/announcements"} {
+				signed := s.Sign(t, "hello")
+				Expect(len(signed)).To(BeNumerically("<=", len("hello")+s.Overhead(t)))
+				payload, _, err := verifier.Verify(t, []byte(signed))
+				Expect(err).NotTo(HaveOccurred())
+				Expect(string(payload)).To(Equal("hello"))
+			}
+
+			Expect(s.Sign("chat/room", "hello")).To(Equal("hello"))
+			Expect(s.Overhead("chat/room")).To(Equal(0))
+		})
+
+		It("Should serve previous public keys after the current one", func() {
+			previous := newKey("previous").Public()
+			b, err := json.Marshal(previous)
+			Expect(err).NotTo(HaveOccurred())
+			var encoded map[string]string
+			Expect(json.Unmarshal(b, &encoded)).To(Succeed())
+			config.Set("signing.keyId", "current")
+			config.Set("signing.publicKeys", []map[string]interface{}{
+				{"id": "previous", "key": encoded["key"]},
+			})
+
+			s, err := signing.NewSigner(config, l)
+			Expect(err).NotTo(HaveOccurred())
+			keys := s.PublicKeys()
+			Expect(keys).To(HaveLen(2))
+			Expect(keys[0].ID).To(Equal("current"))
+			Expect(keys[0].Key).To(Equal(key.Public()))
+			Expect(keys[1]).To(Equal(previous))
+		})
+
+		It("Should require a key to sign system topics", func() {
+			config.Set("signing.key", "")
+			_, err := signing.NewSigner(config, l)
+			Expect(err).To(MatchError("signing.key is required to sign system topics"))
+		})
+
+		It("Should require a key to sign signed topics", func() {
+			config.Set("signing.key", "")
+			config.Set("signing.systemTopics", nil)
+			_, err := signing.NewSigner(config, l)
+			Expect(err).To(MatchError("signing.key is required to sign signing.topics"))
+		})
+
+		It("Should not require a key without signed topics", func() {
+			s, err := signing.NewSigner(viper.New(), l)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(s.Sign("signed/room", "hello")).To(Equal("hello"))
+			Expect(s.PublicKeys()).To(BeEmpty())
+		})
+	})
+
+	Describe("MessageHandler", func() {
+		It("Should only give messages with valid signatures to the handler", func() {
+			key := newKey("key")
+			verifier, err := signing.NewVerifier(key.Public())
+			Expect(err).NotTo(HaveOccurred())
+			signed := signing.Sign(key, "system/announcements", []byte("hello"), time.Now())
+
+			var received []string
+			var failed []error
+			handler := signing.MessageHandler(verifier, func(client mqtt.Client, m mqtt.Message) {
+				received = append(received, string(m.Payload()))
+			}, func(m mqtt.Message, err error) {
+				failed = append(failed, err)
+			})
+
+			handler(nil, &message{topic: "system/announcements", payload: signed})
+			handler(nil, &message{topic: "system/announcements", payload: []byte("spoofed")})
+			handler(nil, &message{topic: "system/other", payload: signed})
+
+			Expect(received).To(Equal([]string{"hello"}))
+			Expect(failed).To(Equal([]error{signing.ErrNotSigned, signing.ErrInvalidSignature}))
+		})
+	})
+})
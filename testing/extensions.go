@@ -140,6 +140,10 @@ func measure(description string, setup func(map[string]interface{}), f func(*htt
 }
 
 func request(method, path, body string, app *api.App) (int, string) {
+	return requestWithHeaders(method, path, body, nil, app)
+}
+
+func requestWithHeaders(method, path, body string, headers map[string]string, app *api.App) (int, string) {
 	var req *http.Request
 	if body != "" {
 		reader := strings.NewReader(body) //Convert string to reader
@@ -147,6 +151,9 @@ func request(method, path, body string, app *api.App) (int, string) {
 	} else {
 		req, _ = http.NewRequest(method, path, nil)
 	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
 	rec := httptest.NewRecorder()
 	app.App.ServeHTTP(rec, req)
 	return rec.Code, rec.Body.String()
@@ -162,6 +169,16 @@ func PostBody(app *api.App, url string, payload string) (int, string) {
 	return sendBody(app, "POST", url, payload)
 }
 
+// PostBodyWithHeaders returns a test request against specified URL with the given headers
+func PostBodyWithHeaders(app *api.App, url string, payload string, headers map[string]string) (int, string) {
+	return requestWithHeaders("POST", url, payload, headers, app)
+}
+
+// Delete returns a test request against specified URL
+func Delete(app *api.App, url string) (int, string) {
+	return request("DELETE", url, "", app)
+}
+
 func sendBody(app *api.App, method, url, payload string) (int, string) {
 	return request(method, url, payload, app)
 }
@@ -175,3 +192,13 @@ func sendJSON(app *api.App, method, url string, payloadJSON interface{}) (int, s
 	payload, _ := json.Marshal(payloadJSON)
 	return request(method, url, string(payload), app)
 }
+
+// AdminRequest returns a test request against the admin API, authenticated
+// with the configured admin credentials
+func AdminRequest(app *api.App, method, url, payload string) (int, string) {
+	req := httptest.NewRequest(method, url, strings.NewReader(payload))
+	req.SetBasicAuth(app.Config.GetString("admin.username"), app.Config.GetString("admin.password"))
+	rec := httptest.NewRecorder()
+	app.Admin.ServeHTTP(rec, req)
+	return rec.Code, rec.Body.String()
+}
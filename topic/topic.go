@@ -0,0 +1,58 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package topic
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Match reports whether topic matches pattern. Patterns follow MQTT
+// subscription semantics: "+" matches exactly one level and a trailing "#"
+// matches any number of remaining levels, including none.
+func Match(pattern, topic string) bool {
+	if pattern == "#" {
+		return true
+	}
+
+	patternLevels := strings.Split(pattern, "/")
+	topicLevels := strings.Split(topic, "/")
+
+	for i, level := range patternLevels {
+		if level == "#" {
+			return i == len(patternLevels)-1
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+
+	return len(patternLevels) == len(topicLevels)
+}
+
+// GameID returns the game a message belongs to: the game_id (or gameID)
+// field of its payload if present, otherwise the second level of its topic,
+// or the whole topic if it has a single level
+func GameID(topic string, payload map[string]interface{}) string {
+	for _, k := range []string{"game_id", "gameID"} {
+		if v, ok := payload[k]; ok && v != nil {
+			return fmt.Sprint(v)
+		}
+	}
+	gameID := ""
+	if strings.Contains(topic, "/") {
+		gameID = strings.Split(topic, "/")[1]
+	} else {
+		gameID = topic
+	}
+
+	return gameID
+}
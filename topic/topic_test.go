@@ -0,0 +1,49 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package topic_test
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/topfreegames/arkadiko/topic"
+)
+
+var _ = Describe("Topic", func() {
+	Describe("Match", func() {
+		It("Should match exact topics", func() {
+			Expect(topic.Match("chat/room", "chat/room")).To(BeTrue())
+			Expect(topic.Match("chat/room", "chat/other")).To(BeFalse())
+			Expect(topic.Match("chat/room", "chat/room/1")).To(BeFalse())
+		})
+
+		It("Should match single level wildcards", func() {
+			Expect(topic.Match("chat/+/messages", "chat/game1/messages")).To(BeTrue())
+			Expect(topic.Match("chat/+/messages", "chat/game1/other")).To(BeFalse())
+			Expect(topic.Match("chat/+", "chat/game1/messages")).To(BeFalse())
+		})
+
+		It("Should match multi level wildcards", func() {
+			Expect(topic.Match("#", "anything/at/all")).To(BeTrue())
+			Expect(topic.Match("chat/#", "chat")).To(BeTrue())
+			Expect(topic.Match("chat/#", "chat/game1/messages")).To(BeTrue())
+			Expect(topic.Match("chat/#", "rewards/game1")).To(BeFalse())
+		})
+	})
+
+	Describe("GameID", func() {
+		It("Should prefer the game id in the payload", func() {
+			Expect(topic.GameID("chat/game1", map[string]interface{}{"game_id": "game2"})).To(Equal("game2"))
+			Expect(topic.GameID("chat/game1", map[string]interface{}{"gameID": 3})).To(Equal("3"))
+		})
+
+		It("Should fall back to the topic", func() {
+			Expect(topic.GameID("chat/game1/messages", nil)).To(Equal("game1"))
+			Expect(topic.GameID("game1", map[string]interface{}{})).To(Equal("game1"))
+		})
+	})
+})
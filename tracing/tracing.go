@@ -0,0 +1,159 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+// Package tracing carries OpenTelemetry trace context from the requests
+// arkadiko handles to the consumers of the messages it publishes.
+//
+// MQTT 3.1.1 has no user properties, so the W3C traceparent of the request
+// is injected into a configurable field of JSON object payloads, and
+// extracted from it on the consumer side.
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName names the tracer of the spans started by arkadiko
+const InstrumentationName = "github.com/topfreegames/arkadiko"
+
+// Attribute keys of publish and receive spans
+const (
+	SystemKey      = attribute.Key("messaging.system")
+	DestinationKey = attribute.Key("messaging.destination.name")
+	OperationKey   = attribute.Key("messaging.operation")
+	BrokerKey      = attribute.Key("arkadiko.broker")
+	QoSKey         = attribute.Key("mqtt.qos")
+	RetainedKey    = attribute.Key("mqtt.retained")
+	AttemptsKey    = attribute.Key("arkadiko.retry.attempts")
+	ConnectionKey  = attribute.Key("arkadiko.connection")
+)
+
+// traceContext is the W3C propagator, used regardless of the propagators
+// configured globally so consumers always get a traceparent
+var traceContext = propagation.TraceContext{}
+
+// Tracer returns the tracer of the spans started by arkadiko
+func Tracer() trace.Tracer {
+	return otel.Tracer(InstrumentationName)
+}
+
+// StartCreate starts the span of creating a message to be published to
+// topic. It is the span whose trace context is injected into the message,
+// so consumers continue the trace from the publish, and the publishes of
+// the message to its broker are its children
+func StartCreate(ctx context.Context, topic string, retained bool) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, topic+" create",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			SystemKey.String("mqtt"),
+			DestinationKey.String(topic),
+			OperationKey.String("create"),
+			RetainedKey.Bool(retained),
+		),
+	)
+}
+
+// StartPublish starts the span of publishing a message to topic on broker
+func StartPublish(ctx context.Context, broker, topic string, qos byte, retained bool) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, topic+" publish",
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			SystemKey.String("mqtt"),
+			DestinationKey.String(topic),
+			OperationKey.String("publish"),
+			BrokerKey.String(broker),
+			QoSKey.Int(int(qos)),
+			RetainedKey.Bool(retained),
+		),
+	)
+}
+
+// End ends span, recording err if the operation failed
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Propagator injects trace context into payloads
+type Propagator struct {
+	// Field is the payload field the traceparent is injected into, or empty
+	// if it is not injected
+	Field string
+}
+
+// NewPropagator returns a Propagator injecting into the field configured
+// under tracing.payloadField
+func NewPropagator(config *viper.Viper) *Propagator {
+	config.SetDefault("tracing.payloadField", "")
+
+	return &Propagator{
+		Field: config.GetString("tracing.payloadField"),
+	}
+}
+
+// Inject sets the traceparent of the span in ctx on payload. Payloads are
+// left as they are when there is no span or the field is already set
+func (p *Propagator) Inject(ctx context.Context, payload map[string]interface{}) {
+	if p.Field == "" || payload == nil {
+		return
+	}
+	if _, ok := payload[p.Field]; ok {
+		return
+	}
+
+	carrier := propagation.MapCarrier{}
+	traceContext.Inject(ctx, carrier)
+	if traceparent := carrier.Get("traceparent"); traceparent != "" {
+		payload[p.Field] = traceparent
+	}
+}
+
+// Extract returns ctx with the remote span whose traceparent is in field of
+// the JSON object payload, or ctx as it is if there is none
+func Extract(ctx context.Context, field string, payload []byte) context.Context {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return ctx
+	}
+	traceparent, ok := fields[field].(string)
+	if !ok {
+		return ctx
+	}
+	return traceContext.Extract(ctx, propagation.MapCarrier{"traceparent": traceparent})
+}
+
+// MessageHandler wraps a subscription handler so each message is handled
+// in a receive span continuing the trace injected into field
+func MessageHandler(field string, next func(context.Context, mqtt.Client, mqtt.Message)) mqtt.MessageHandler {
+	return func(client mqtt.Client, message mqtt.Message) {
+		ctx := Extract(context.Background(), field, message.Payload())
+		ctx, span := Tracer().Start(ctx, message.Topic()+" receive",
+			trace.WithSpanKind(trace.SpanKindConsumer),
+			trace.WithAttributes(
+				SystemKey.String("mqtt"),
+				DestinationKey.String(message.Topic()),
+				OperationKey.String("receive"),
+				QoSKey.Int(int(message.Qos())),
+				RetainedKey.Bool(message.Retained()),
+			),
+		)
+		defer span.End()
+		next(ctx, client, message)
+	}
+}
@@ -0,0 +1,174 @@
+// arkadiko
+// https://github.com/topfreegames/arkadiko
+//
+// Licensed under the MIT license:
+// http://www.opensource.org/licenses/mit-license
+// Copyright © 2016 Top Free Games <backend@tfgco.com>
+
+package tracing_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/viper"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/topfreegames/arkadiko/tracing"
+)
+
+type message struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (m *message) Topic() string {
+	return m.topic
+}
+
+func (m *message) Payload() []byte {
+	return m.payload
+}
+
+func (m *message) Qos() byte {
+	return 1
+}
+
+func (m *message) Retained() bool {
+	return false
+}
+
+func attributes(span sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	values := map[attribute.Key]attribute.Value{}
+	for _, kv := range span.Attributes() {
+		values[kv.Key] = kv.Value
+	}
+	return values
+}
+
+var _ = Describe("Tracing", func() {
+	var recorder *tracetest.SpanRecorder
+
+	BeforeEach(func() {
+		recorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	})
+
+	Describe("Propagator", func() {
+		newPropagator := func() *tracing.Propagator {
+			config := viper.New()
+			config.Set("tracing.payloadField", "traceparent")
+			return tracing.NewPropagator(config)
+		}
+
+		It("Should carry the trace from the payload to the consumer", func() {
+			ctx, span := tracing.Tracer().Start(context.Background(), "request")
+			payload := map[string]interface{}{"message": "hello"}
+			newPropagator().Inject(ctx, payload)
+			span.End()
+			Expect(payload["traceparent"]).To(HavePrefix("00-" + span.SpanContext().TraceID().String()))
+
+			b, err := json.Marshal(payload)
+			Expect(err).NotTo(HaveOccurred())
+			extracted := trace.SpanContextFromContext(tracing.Extract(context.Background(), "traceparent", b))
+			Expect(extracted.TraceID()).To(Equal(span.SpanContext().TraceID()))
+			Expect(extracted.SpanID()).To(Equal(span.SpanContext().SpanID()))
+			Expect(extracted.IsRemote()).To(BeTrue())
+		})
+
+		It("Should leave payloads without a span as they are", func() {
+			payload := map[string]interface{}{"message": "hello"}
+			newPropagator().Inject(context.Background(), payload)
+			Expect(payload).NotTo(HaveKey("traceparent"))
+		})
+
+		It("Should not replace traceparents set by the requestor", func() {
+			ctx, span := tracing.Tracer().Start(context.Background(), "request")
+			defer span.End()
+			payload := map[string]interface{}{"traceparent": "mine"}
+			newPropagator().Inject(ctx, payload)
+			Expect(payload["traceparent"]).To(Equal("mine"))
+		})
+
+		It("Should not inject anything unless a field is configured", func() {
+			ctx, span := tracing.Tracer().Start(context.Background(), "request")
+			defer span.End()
+			payload := map[string]interface{}{}
+			tracing.NewPropagator(viper.New()).Inject(ctx, payload)
+			Expect(payload).To(BeEmpty())
+		})
+
+		It("Should ignore payloads without a traceparent", func() {
+			ctx := tracing.Extract(context.Background(), "traceparent", []byte("hello"))
+			Expect(trace.SpanContextFromContext(ctx).IsValid()).To(BeFalse())
+		})
+	})
+
+	Describe("Spans", func() {
+		It("Should describe publishes", func() {
+			_, span := tracing.StartPublish(context.Background(), "default", "chat/room", 1, true)
+			tracing.End(span, errors.New("broker is gone"))
+
+			spans := recorder.Ended()
+			Expect(spans).To(HaveLen(1))
+			Expect(spans[0].Name()).To(Equal("chat/room publish"))
+			Expect(spans[0].SpanKind()).To(Equal(trace.SpanKindProducer))
+			Expect(spans[0].Status().Code).To(Equal(codes.Error))
+			values := attributes(spans[0])
+			Expect(values[tracing.BrokerKey].AsString()).To(Equal("default"))
+			Expect(values[tracing.DestinationKey].AsString()).To(Equal("chat/room"))
+			Expect(values[tracing.QoSKey].AsInt64()).To(Equal(int64(1)))
+			Expect(values[tracing.RetainedKey].AsBool()).To(BeTrue())
+		})
+
+		It("Should describe message creations", func() {
+			ctx, span := tracing.StartCreate(context.Background(), "chat/room", false)
+			_, publish := tracing.StartPublish(ctx, "default", "chat/room", 1, false)
+			publish.End()
+			span.End()
+
+			spans := recorder.Ended()
+			Expect(spans).To(HaveLen(2))
+			Expect(spans[1].Name()).To(Equal("chat/room create"))
+			Expect(spans[1].SpanKind()).To(Equal(trace.SpanKindProducer))
+			values := attributes(spans[1])
+			Expect(values[tracing.OperationKey].AsString()).To(Equal("create"))
+			Expect(values[tracing.DestinationKey].AsString()).To(Equal("chat/room"))
+			Expect(spans[0].Parent().SpanID()).To(Equal(spans[1].SpanContext().SpanID()))
+		})
+
+		It("Should continue the trace of received messages", func() {
+			ctx, parent := tracing.Tracer().Start(context.Background(), "request")
+			payload := map[string]interface{}{}
+			config := viper.New()
+			config.Set("tracing.payloadField", "trace")
+			tracing.NewPropagator(config).Inject(ctx, payload)
+			parent.End()
+			b, err := json.Marshal(payload)
+			Expect(err).NotTo(HaveOccurred())
+
+			var handled trace.SpanContext
+			handler := tracing.MessageHandler("trace", func(ctx context.Context, client mqtt.Client, m mqtt.Message) {
+				handled = trace.SpanContextFromContext(ctx)
+			})
+			handler(nil, &message{topic: "chat/room", payload: b})
+
+			Expect(handled.TraceID()).To(Equal(parent.SpanContext().TraceID()))
+			spans := recorder.Ended()
+			Expect(spans).To(HaveLen(2))
+			Expect(spans[1].Name()).To(Equal("chat/room receive"))
+			Expect(spans[1].SpanKind()).To(Equal(trace.SpanKindConsumer))
+			Expect(spans[1].Parent().SpanID()).To(Equal(parent.SpanContext().SpanID()))
+		})
+	})
+})